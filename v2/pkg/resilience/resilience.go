@@ -0,0 +1,184 @@
+// Package resilience holds the retry, backoff and circuit breaking policies shared by the ConnectionPool
+// (reconnecting), the Publisher (republishing) and the Consumer (re-consuming and redelivery).
+package resilience
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Policy decides how long to back off before retrying after the given consecutive failure (counting from 1) and
+// whether to retry at all.
+type Policy interface {
+	Backoff(attempt uint32) (delay time.Duration, retry bool)
+}
+
+// Observer is implemented by stateful policies, like the CircuitBreaker, that want to know about successes.
+type Observer interface {
+	Success()
+}
+
+// Succeeded notifies the policy of a success when it is an Observer.
+func Succeeded(policy Policy) {
+	if observer, ok := policy.(Observer); ok {
+		observer.Success()
+	}
+}
+
+// Constant waits the same Delay between attempts, MaxAttempts zero retries forever.
+type Constant struct {
+	Delay       time.Duration
+	MaxAttempts uint32
+}
+
+// Backoff implements Policy.
+func (c *Constant) Backoff(attempt uint32) (time.Duration, bool) {
+
+	if c.MaxAttempts > 0 && attempt > c.MaxAttempts {
+		return 0, false
+	}
+
+	return c.Delay, true
+}
+
+// Exponential multiplies the delay between attempts, MaxAttempts zero retries forever.
+type Exponential struct {
+	InitialDelay time.Duration
+	Multiplier   float64 // defaults to 2
+	MaxDelay     time.Duration
+	Jitter       float64 // 0-1, fraction of the delay randomized, ex.) 0.2 is +/- 20%
+	MaxAttempts  uint32
+}
+
+// Backoff implements Policy.
+func (e *Exponential) Backoff(attempt uint32) (time.Duration, bool) {
+
+	if e.MaxAttempts > 0 && attempt > e.MaxAttempts {
+		return 0, false
+	}
+
+	if e.InitialDelay <= 0 || attempt == 0 {
+		return 0, true
+	}
+
+	multiplier := e.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+
+	delay := float64(e.InitialDelay) * math.Pow(multiplier, float64(attempt-1))
+	if e.MaxDelay > 0 && delay > float64(e.MaxDelay) {
+		delay = float64(e.MaxDelay)
+	}
+
+	if e.Jitter > 0 {
+		jitter := math.Min(e.Jitter, 1)
+		delay += delay * jitter * (rand.Float64()*2 - 1)
+	}
+
+	return time.Duration(delay), true
+}
+
+// CircuitBreaker wraps a Policy and opens after Threshold consecutive failures, reported by anyone sharing it.
+// While open every Backoff waits out the rest of the Cooldown, so callers stop hammering a broker that is down.
+// A Success closes it.
+type CircuitBreaker struct {
+	Policy    Policy
+	Threshold uint32
+	Cooldown  time.Duration
+	failures  uint32
+	openUntil time.Time
+	lock      sync.Mutex
+}
+
+// NewCircuitBreaker creates a CircuitBreaker around the policy.
+func NewCircuitBreaker(policy Policy, threshold uint32, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		Policy:    policy,
+		Threshold: threshold,
+		Cooldown:  cooldown,
+	}
+}
+
+// Backoff implements Policy.
+func (cb *CircuitBreaker) Backoff(attempt uint32) (time.Duration, bool) {
+
+	delay, retry := cb.Policy.Backoff(attempt)
+	if !retry {
+		return 0, false
+	}
+
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	now := time.Now()
+	cb.failures++
+	if cb.Threshold > 0 && cb.failures >= cb.Threshold && !now.Before(cb.openUntil) {
+		cb.openUntil = now.Add(cb.Cooldown)
+	}
+
+	if remaining := cb.openUntil.Sub(now); remaining > delay {
+		delay = remaining
+	}
+
+	return delay, true
+}
+
+// Success implements Observer.
+func (cb *CircuitBreaker) Success() {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	cb.failures = 0
+	cb.openUntil = time.Time{}
+}
+
+// Open reports whether the breaker is currently open.
+func (cb *CircuitBreaker) Open() bool {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	return time.Now().Before(cb.openUntil)
+}
+
+// Retry calls fn until it succeeds, the policy gives up or the context is done, returning the last error.
+func Retry(ctx context.Context, policy Policy, fn func() error) error {
+
+	for attempt := uint32(1); ; attempt++ {
+		err := fn()
+		if err == nil {
+			Succeeded(policy)
+			return nil
+		}
+
+		delay, retry := policy.Backoff(attempt)
+		if !retry {
+			return err
+		}
+
+		if err := Wait(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// Wait sleeps for the delay or until the context is done.
+func Wait(ctx context.Context, delay time.Duration) error {
+
+	if delay <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,42 @@
+package tcr
+
+import (
+	"errors"
+	"fmt"
+)
+
+// CommitNotifier is implemented by (a wrapper of) the caller's database transaction. The callback registered
+// with AfterCommit must only run once the transaction committed, and never when it rolled back.
+type CommitNotifier interface {
+	AfterCommit(callback func())
+}
+
+// CommitNotifierFunc adapts a function registering commit callbacks to a CommitNotifier.
+type CommitNotifierFunc func(callback func())
+
+// AfterCommit calls the function.
+func (f CommitNotifierFunc) AfterCommit(callback func()) {
+	f(callback)
+}
+
+// PublishAfterCommit queues the letter for AutoPublish only once the transaction commits, so a rolled back
+// transaction never publishes. Letters that can't be queued by then (the publisher shut down) are reported
+// on PublishReceipts.
+func (pub *Publisher) PublishAfterCommit(tx CommitNotifier, letter *Letter) error {
+
+	if tx == nil {
+		return errors.New("can't publish after commit without a transaction")
+	}
+
+	if letter.Envelope == nil {
+		return fmt.Errorf("LetterID: %s has no envelope to address it with", letter.LetterID.String())
+	}
+
+	tx.AfterCommit(func() {
+		if err := pub.QueueLetterWithError(letter); err != nil {
+			pub.publishReceipt(letter, fmt.Errorf("LetterID: %s was committed but couldn't be queued: %w", letter.LetterID.String(), err))
+		}
+	})
+
+	return nil
+}
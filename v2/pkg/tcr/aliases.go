@@ -0,0 +1,87 @@
+package tcr
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// exchangeAlias is the compiled form of an ExchangeAlias.
+type exchangeAlias struct {
+	exchange           string
+	routingKeyTemplate *template.Template
+	err                error
+}
+
+// compileExchangeAliases parses every RoutingKeyTemplate once so publishing only executes them.
+// A bad template is kept with its error and surfaces on the first publish that references it.
+func compileExchangeAliases(aliases map[string]*ExchangeAlias) map[string]*exchangeAlias {
+
+	compiled := make(map[string]*exchangeAlias, len(aliases))
+	for name, alias := range aliases {
+		compiled[name] = compileExchangeAlias(name, alias)
+	}
+
+	return compiled
+}
+
+func compileExchangeAlias(name string, alias *ExchangeAlias) *exchangeAlias {
+
+	if alias == nil {
+		return &exchangeAlias{err: fmt.Errorf("exchange alias %q has no definition", name)}
+	}
+
+	compiled := &exchangeAlias{exchange: alias.Exchange}
+	if alias.RoutingKeyTemplate != "" {
+		compiled.routingKeyTemplate, compiled.err = template.New(name).Option("missingkey=error").Parse(alias.RoutingKeyTemplate)
+	}
+
+	return compiled
+}
+
+// AddExchangeAlias adds (or replaces) a logical exchange name that Letters can reference with Envelope.Alias.
+func (pub *Publisher) AddExchangeAlias(name string, alias *ExchangeAlias) error {
+
+	compiled := compileExchangeAlias(name, alias)
+	if compiled.err != nil {
+		return compiled.err
+	}
+
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	pub.aliases[name] = compiled
+	return nil
+}
+
+// resolveAddress determines the actual exchange and routing key for an Envelope.
+// Envelopes without an Alias are published exactly as addressed.
+func (pub *Publisher) resolveAddress(envelope *Envelope) (string, string, error) {
+
+	if envelope.Alias == "" {
+		return envelope.Exchange, envelope.RoutingKey, nil
+	}
+
+	pub.pubRWLock.RLock()
+	alias, ok := pub.aliases[envelope.Alias]
+	pub.pubRWLock.RUnlock()
+
+	if !ok {
+		return "", "", fmt.Errorf("exchange alias %q was not found in config", envelope.Alias)
+	}
+
+	if alias.err != nil {
+		return "", "", alias.err
+	}
+
+	if alias.routingKeyTemplate == nil {
+		return alias.exchange, envelope.RoutingKey, nil
+	}
+
+	builder := &strings.Builder{}
+	if err := alias.routingKeyTemplate.Execute(builder, envelope); err != nil {
+		return "", "", fmt.Errorf("exchange alias %q failed to build a routing key: %w", envelope.Alias, err)
+	}
+
+	return alias.exchange, builder.String(), nil
+}
@@ -0,0 +1,101 @@
+package tcr
+
+import (
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/streadway/amqp"
+)
+
+// ArchivedLetter is a copy of what a Publisher actually sent on the wire.
+type ArchivedLetter struct {
+	LetterID    uuid.UUID  `json:"LetterID"`
+	Exchange    string     `json:"Exchange"`
+	RoutingKey  string     `json:"RoutingKey"`
+	ContentType string     `json:"ContentType,omitempty"`
+	MessageID   string     `json:"MessageID,omitempty"`
+	Headers     amqp.Table `json:"Headers,omitempty"`
+	Timestamp   time.Time  `json:"Timestamp"`
+	BodySize    int        `json:"BodySize"`
+	Body        []byte     `json:"Body,omitempty"` // only when ArchiveBodies is enabled
+}
+
+// ArchiveSink receives the sampled letters, it is called on the publishing goroutine so keep it fast.
+type ArchiveSink interface {
+	Archive(*ArchivedLetter)
+}
+
+// JSONLinesArchiveSink writes each ArchivedLetter as a line of JSON.
+type JSONLinesArchiveSink struct {
+	writer io.Writer
+	lock   *sync.Mutex
+}
+
+// NewJSONLinesArchiveSink creates an ArchiveSink writing JSONL to the writer (ex. an *os.File).
+func NewJSONLinesArchiveSink(writer io.Writer) *JSONLinesArchiveSink {
+	return &JSONLinesArchiveSink{
+		writer: writer,
+		lock:   &sync.Mutex{},
+	}
+}
+
+// Archive writes the letter, failures are dropped as archival is best effort.
+func (sink *JSONLinesArchiveSink) Archive(letter *ArchivedLetter) {
+
+	data, err := json.Marshal(letter)
+	if err != nil {
+		return
+	}
+
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+
+	_, _ = sink.writer.Write(append(data, '\n'))
+}
+
+// SetArchiveSink enables archival sampling of published letters.
+// sampleRate is the percentage (0-100) of letters copied to the sink, includeBodies also copies the body.
+func (pub *Publisher) SetArchiveSink(sink ArchiveSink, sampleRate float64, includeBodies bool) {
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	pub.archiveSink = sink
+	pub.archiveSampleRate = sampleRate
+	pub.archiveBodies = includeBodies
+}
+
+// archive copies a sample of the letters that were successfully written to the channel.
+func (pub *Publisher) archive(prepared *preparedLetter) {
+
+	pub.pubRWLock.RLock()
+	sink, sampleRate, includeBodies := pub.archiveSink, pub.archiveSampleRate, pub.archiveBodies
+	pub.pubRWLock.RUnlock()
+
+	if sink == nil || sampleRate <= 0 {
+		return
+	}
+
+	if sampleRate < 100 && rand.Float64()*100 >= sampleRate {
+		return
+	}
+
+	archived := &ArchivedLetter{
+		LetterID:    prepared.letterID,
+		Exchange:    prepared.exchange,
+		RoutingKey:  prepared.routingKey,
+		ContentType: prepared.publishing.ContentType,
+		MessageID:   prepared.publishing.MessageId,
+		Headers:     prepared.publishing.Headers,
+		Timestamp:   prepared.publishing.Timestamp,
+		BodySize:    len(prepared.publishing.Body),
+	}
+
+	if includeBodies {
+		archived.Body = prepared.publishing.Body
+	}
+
+	sink.Archive(archived)
+}
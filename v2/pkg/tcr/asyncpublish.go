@@ -0,0 +1,62 @@
+package tcr
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+)
+
+// PublishResult is the pending outcome of a PublishAsync letter.
+type PublishResult struct {
+	LetterID uuid.UUID
+	done     chan struct{}
+	err      error
+}
+
+// PublishAsync publishes the letter with confirmation in the background, like PublishWithConfirmationError with the
+// PublishTimeOutInterval, and returns its result right away. Wait on the result for the outcome of this letter
+// instead of correlating PublishReceipts by LetterID, none is sent. A letter without a LetterID is given one.
+func (pub *Publisher) PublishAsync(letter *Letter) *PublishResult {
+
+	if letter.LetterID == uuid.Nil {
+		letter.LetterID = pub.newLetterID()
+	}
+
+	result := &PublishResult{
+		LetterID: letter.LetterID,
+		done:     make(chan struct{}),
+	}
+
+	go func() {
+		result.err = pub.PublishWithConfirmationError(letter, 0)
+		close(result.done)
+	}()
+
+	return result
+}
+
+// Wait blocks until the letter was confirmed (nil) or failed, or the context is done - which only stops waiting,
+// the publish goes on until its timeout.
+func (pr *PublishResult) Wait(ctx context.Context) error {
+	select {
+	case <-pr.done:
+		return pr.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Done is closed once the outcome is known.
+func (pr *PublishResult) Done() <-chan struct{} {
+	return pr.done
+}
+
+// Err is the outcome once Done, nil before.
+func (pr *PublishResult) Err() error {
+	select {
+	case <-pr.done:
+		return pr.err
+	default:
+		return nil
+	}
+}
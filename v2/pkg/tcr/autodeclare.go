@@ -0,0 +1,133 @@
+package tcr
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// autoDeclarer remembers the exchange/routing keys it declared the topology of, per pool as pools may point at
+// other vhosts.
+type autoDeclarer struct {
+	topology *TopologyConfig
+	declared map[*ConnectionPool]map[string]bool
+	lock     *sync.Mutex
+}
+
+// SetAutoDeclare declares the part of the topology a letter is published through on the first publish to each
+// exchange and routing key: the exchange, the queue bindings of the exchange matching the routing key and their
+// queues - or the queue named by the routing key on the default exchange. Cold starts then publish without
+// separate bootstrap code or NOT_FOUND channel errors. A failed declaration fails the letter and is tried again
+// on the next one, nil stops declaring.
+func (pub *Publisher) SetAutoDeclare(topology *TopologyConfig) {
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	if topology == nil {
+		pub.autoDeclarer = nil
+		return
+	}
+
+	pub.autoDeclarer = &autoDeclarer{
+		topology: topology,
+		declared: make(map[*ConnectionPool]map[string]bool),
+		lock:     &sync.Mutex{},
+	}
+}
+
+// autoDeclare declares the topology of the exchange and routing key on the pool the first time it is published to.
+func (pub *Publisher) autoDeclare(pool *ConnectionPool, letter *Letter, exchange string, routingKey string) error {
+
+	pub.pubRWLock.RLock()
+	declarer := pub.autoDeclarer
+	pub.pubRWLock.RUnlock()
+
+	if declarer == nil {
+		return nil
+	}
+
+	key := exchange + "\x00" + routingKey
+
+	declarer.lock.Lock()
+	declared := declarer.declared[pool][key]
+	declarer.lock.Unlock()
+
+	if declared {
+		return nil
+	}
+
+	if selected := declarer.selectTopology(exchange, routingKey); selected != nil {
+		if err := NewTopologer(pool).BuildTopology(selected, false); err != nil {
+			return fmt.Errorf("LetterID: %s can't be published, auto-declaring exchange %q with routing key %q failed: %w", letter.LetterID.String(), exchange, routingKey, err)
+		}
+	}
+
+	declarer.lock.Lock()
+	if declarer.declared[pool] == nil {
+		declarer.declared[pool] = make(map[string]bool)
+	}
+	declarer.declared[pool][key] = true
+	declarer.lock.Unlock()
+
+	return nil
+}
+
+// selectTopology is the part of the topology publishing to the exchange with the routing key goes through, nil
+// when the topology defines none of it.
+func (ad *autoDeclarer) selectTopology(exchange string, routingKey string) *TopologyConfig {
+
+	selected := &TopologyConfig{}
+	queues := make(map[string]*Queue, len(ad.topology.Queues))
+	for _, queue := range ad.topology.Queues {
+		queues[queue.Name] = queue
+	}
+
+	if exchange == "" {
+		if queue, ok := queues[routingKey]; ok {
+			selected.Queues = append(selected.Queues, queue)
+			return selected
+		}
+		return nil
+	}
+
+	exchangeType := amqp.ExchangeDirect
+	for _, declared := range ad.topology.Exchanges {
+		if declared.Name == exchange {
+			selected.Exchanges = append(selected.Exchanges, declared)
+			exchangeType = declared.Type
+			break
+		}
+	}
+
+	for _, binding := range ad.topology.QueueBindings {
+		if binding.ExchangeName != exchange || !bindingRoutes(exchangeType, binding.RoutingKey, routingKey) {
+			continue
+		}
+
+		selected.QueueBindings = append(selected.QueueBindings, binding)
+		if queue, ok := queues[binding.QueueName]; ok {
+			selected.Queues = append(selected.Queues, queue)
+			delete(queues, binding.QueueName) // bound more than once
+		}
+	}
+
+	if len(selected.Exchanges) == 0 && len(selected.QueueBindings) == 0 {
+		return nil
+	}
+
+	return selected
+}
+
+// bindingRoutes is true when an exchange of the type routes the routing key over a binding with the binding key.
+func bindingRoutes(exchangeType string, bindingKey string, routingKey string) bool {
+
+	switch exchangeType {
+	case amqp.ExchangeFanout, amqp.ExchangeHeaders:
+		return true
+	case amqp.ExchangeTopic:
+		return topicMatches(bindingKey, routingKey)
+	default:
+		return bindingKey == routingKey
+	}
+}
@@ -0,0 +1,55 @@
+package tcr
+
+import "errors"
+
+// SetAutoRetry republishes letters auto-publishing failed to publish, up to their RetryCount times, backing off per
+// the Publisher's retry policy (SetRetryPolicy, else the PublisherConfig's RetryPolicy). Only the final failure
+// sends a receipt. Don't combine it with a RabbitService, the service retries failed receipts itself.
+func (pub *Publisher) SetAutoRetry(enabled bool) {
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	pub.autoRetry = enabled
+}
+
+// retryLetter schedules the next attempt of the failed letter, false when it isn't retried and its receipt is due.
+// A retried letter stays pending (see Flush) until it is queued again.
+func (pub *Publisher) retryLetter(letter *Letter, err error) bool {
+
+	pub.pubRWLock.RLock()
+	enabled := pub.autoRetry
+	policy := pub.retryPolicy
+	pub.pubRWLock.RUnlock()
+
+	if !enabled || letter.RetryCount == 0 || letter.retries >= letter.RetryCount {
+		return false
+	}
+
+	// retrying can't get a letter past a closed or full queue, a parked letter isn't lost
+	if errors.Is(err, ErrShutdown) || errors.Is(err, ErrQueueFull) || errors.Is(err, ErrFallback) {
+		return false
+	}
+
+	if policy == nil {
+		var retryPolicy *RetryPolicy
+		if pub.Config != nil && pub.Config.PublisherConfig != nil {
+			retryPolicy = pub.Config.PublisherConfig.RetryPolicy
+		}
+		policy = retryPolicy.Policy(letter.RetryCount)
+	}
+
+	delay, retry := policy.Backoff(letter.retries + 1)
+	if !retry {
+		return false
+	}
+
+	letter.retries++
+	pub.currentClock().AfterFunc(delay, func() {
+		if err := pub.queueLetter(letter); err != nil {
+			pub.publishReceipt(letter, err)
+		}
+		pub.pending.done()
+	})
+
+	return true
+}
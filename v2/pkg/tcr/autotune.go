@@ -0,0 +1,326 @@
+package tcr
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// workerPool bounds how many actions a Consumer runs concurrently, resizable while consuming.
+type workerPool struct {
+	limit  int
+	active int
+	cond   *sync.Cond
+}
+
+func (wp *workerPool) acquire() {
+	wp.cond.L.Lock()
+	defer wp.cond.L.Unlock()
+
+	for wp.active >= wp.limit {
+		wp.cond.Wait()
+	}
+	wp.active++
+}
+
+func (wp *workerPool) release() {
+	wp.cond.L.Lock()
+	defer wp.cond.L.Unlock()
+
+	wp.active--
+	wp.cond.Broadcast()
+}
+
+func (wp *workerPool) resize(limit int) {
+	wp.cond.L.Lock()
+	defer wp.cond.L.Unlock()
+
+	wp.limit = limit
+	wp.cond.Broadcast()
+}
+
+// SetWorkers runs up to workers actions concurrently (StartConsumingWithAction), one or less handles messages one
+// at a time (default). Deliveries wait in the prefetch while every worker is busy. Not stopping immediately
+// waits for the running actions.
+func (con *Consumer) SetWorkers(workers int) {
+	con.conLock.Lock()
+	defer con.conLock.Unlock()
+
+	if workers <= 1 {
+		workers = 1
+	}
+
+	if con.workers == nil {
+		con.workers = &workerPool{limit: workers, cond: sync.NewCond(&sync.Mutex{})}
+		return
+	}
+
+	con.workers.resize(workers)
+}
+
+// Workers is how many actions the Consumer runs concurrently.
+func (con *Consumer) Workers() int {
+	con.conLock.Lock()
+	workers := con.workers
+	con.conLock.Unlock()
+
+	if workers == nil {
+		return 1
+	}
+
+	workers.cond.L.Lock()
+	defer workers.cond.L.Unlock()
+
+	return workers.limit
+}
+
+// dispatch runs the action inline, or on a worker when the Consumer has them.
+func (con *Consumer) dispatch(msg *ReceivedMessage, action func(*ReceivedMessage)) {
+
+	con.conLock.Lock()
+	workers := con.workers
+	con.conLock.Unlock()
+
+	if workers == nil {
+		con.act(msg, action)
+		return
+	}
+
+	workers.acquire()
+	con.messageGroup.Add(1)
+	go func() {
+		defer con.messageGroup.Done()
+		defer workers.release()
+
+		con.act(msg, action)
+	}()
+}
+
+// act runs the action under the processing deadline, reporting its latency to the AutoTuner.
+func (con *Consumer) act(msg *ReceivedMessage, action func(*ReceivedMessage)) {
+
+	con.conLock.Lock()
+	tuner := con.tuner
+	con.conLock.Unlock()
+
+	started := time.Now()
+	if con.processingDeadline > 0 {
+		con.actWithLease(msg, action)
+	} else {
+		action(msg)
+	}
+
+	if tuner != nil {
+		tuner.observe(time.Since(started))
+	}
+}
+
+// AutoTuneConfig bounds the worker count and prefetch an AutoTuner picks.
+type AutoTuneConfig struct {
+	MinWorkers    int    `json:"MinWorkers" yaml:"MinWorkers"`                       // defaults to 1
+	MaxWorkers    int    `json:"MaxWorkers" yaml:"MaxWorkers"`                       // defaults to MinWorkers, workers aren't tuned
+	MinPrefetch   int    `json:"MinPrefetch,omitempty" yaml:"MinPrefetch,omitempty"` // defaults to 1
+	MaxPrefetch   int    `json:"MaxPrefetch,omitempty" yaml:"MaxPrefetch,omitempty"` // zero leaves the prefetch alone
+	TargetLatency uint32 `json:"TargetLatency" yaml:"TargetLatency"`                 // ms, average handler latency to converge on
+	Interval      uint32 `json:"Interval,omitempty" yaml:"Interval,omitempty"`       // ms between adjustments, defaults to 5000
+}
+
+// AutoTuner adjusts a Consumer's workers and prefetch every interval. While handlers are faster than the target
+// and the queue depth grows, it adds a worker (and the prefetch to keep it busy). Handlers slower than the target
+// mean a saturated downstream, so it backs off by a quarter. An empty queue slowly gives workers back.
+type AutoTuner struct {
+	consumer  *Consumer
+	config    AutoTuneConfig
+	target    time.Duration
+	workers   int
+	prefetch  int
+	lastDepth int
+	latency   time.Duration // sum over the current interval
+	samples   int
+	stop      chan struct{}
+	stopOnce  *sync.Once
+	lock      *sync.Mutex
+}
+
+// EnableAutoTune starts tuning the Consumer. The tuned prefetch is applied channel-wide (the consumer has its
+// channel to itself) so it takes effect without re-consuming, a lower QosCountOverride still caps it.
+func (con *Consumer) EnableAutoTune(config *AutoTuneConfig) (*AutoTuner, error) {
+
+	if config == nil || config.TargetLatency == 0 {
+		return nil, errors.New("auto-tuning requires a target latency")
+	}
+
+	tuned := *config
+	if tuned.MinWorkers < 1 {
+		tuned.MinWorkers = 1
+	}
+	if tuned.MaxWorkers < tuned.MinWorkers {
+		tuned.MaxWorkers = tuned.MinWorkers
+	}
+	if tuned.MinPrefetch < 1 {
+		tuned.MinPrefetch = 1
+	}
+	if tuned.MaxPrefetch != 0 && tuned.MaxPrefetch < tuned.MinPrefetch {
+		return nil, fmt.Errorf("consumer %q auto-tune MaxPrefetch %d is below MinPrefetch %d", con.ConsumerName, tuned.MaxPrefetch, tuned.MinPrefetch)
+	}
+
+	interval := time.Duration(tuned.Interval) * time.Millisecond
+	if interval == 0 {
+		interval = 5 * time.Second
+	}
+
+	tuner := &AutoTuner{
+		consumer: con,
+		config:   tuned,
+		target:   time.Duration(tuned.TargetLatency) * time.Millisecond,
+		workers:  tuned.MinWorkers,
+		prefetch: tuned.MinPrefetch,
+		stop:     make(chan struct{}),
+		stopOnce: &sync.Once{},
+		lock:     &sync.Mutex{},
+	}
+
+	con.SetWorkers(tuner.workers)
+
+	con.conLock.Lock()
+	con.tuner = tuner
+	con.conLock.Unlock()
+
+	if tuned.MaxPrefetch > 0 {
+		con.applyPrefetch(tuner.prefetch)
+	}
+
+	go tuner.tuneLoop(interval)
+	return tuner, nil
+}
+
+// Stop ends the tuning, the Consumer keeps its current workers and prefetch.
+func (at *AutoTuner) Stop() {
+	at.stopOnce.Do(func() {
+		close(at.stop)
+
+		at.consumer.conLock.Lock()
+		if at.consumer.tuner == at {
+			at.consumer.tuner = nil
+		}
+		at.consumer.conLock.Unlock()
+	})
+}
+
+// Current returns the tuned workers and prefetch.
+func (at *AutoTuner) Current() (workers int, prefetch int) {
+	at.lock.Lock()
+	defer at.lock.Unlock()
+
+	return at.workers, at.prefetch
+}
+
+func (at *AutoTuner) observe(latency time.Duration) {
+	at.lock.Lock()
+	defer at.lock.Unlock()
+
+	at.latency += latency
+	at.samples++
+}
+
+func (at *AutoTuner) tuneLoop(interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-at.stop:
+			return
+		case <-ticker.C:
+			at.tune()
+		}
+	}
+}
+
+func (at *AutoTuner) tune() {
+
+	depth, err := at.queueDepth()
+	if err != nil {
+		at.consumer.errors <- fmt.Errorf("consumer %q auto-tune failed reading the queue depth: %w", at.consumer.ConsumerName, err)
+		return
+	}
+
+	at.lock.Lock()
+	var average time.Duration
+	if at.samples > 0 {
+		average = at.latency / time.Duration(at.samples)
+	}
+	at.latency, at.samples = 0, 0
+
+	growing := depth > at.lastDepth
+	at.lastDepth = depth
+
+	workers := at.workers
+	switch {
+	case average > at.target+at.target/5:
+		workers -= (workers + 3) / 4
+	case depth > 0 && (growing || depth > workers*at.prefetch):
+		workers++
+	case depth == 0 && !growing:
+		workers--
+	}
+	workers = clampInt(workers, at.config.MinWorkers, at.config.MaxWorkers)
+
+	prefetch := at.prefetch
+	if at.config.MaxPrefetch > 0 {
+		prefetch = clampInt(workers*2, at.config.MinPrefetch, at.config.MaxPrefetch)
+	}
+
+	workersChanged := workers != at.workers
+	prefetchChanged := prefetch != at.prefetch
+	at.workers, at.prefetch = workers, prefetch
+	at.lock.Unlock()
+
+	if workersChanged {
+		at.consumer.SetWorkers(workers)
+	}
+	if prefetchChanged {
+		at.consumer.applyPrefetch(prefetch)
+	}
+}
+
+func (at *AutoTuner) queueDepth() (int, error) {
+
+	channel := at.consumer.ConnectionPool.GetTransientChannel(false)
+	defer channel.Close()
+
+	queue, err := channel.QueueDeclarePassive(at.consumer.QueueName, false, false, false, false, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	return queue.Messages, nil
+}
+
+// applyPrefetch sets the channel-wide prefetch of the channel being consumed on.
+func (con *Consumer) applyPrefetch(prefetch int) {
+
+	con.conLock.Lock()
+	chanHost := con.consumeChannel
+	con.conLock.Unlock()
+
+	if chanHost == nil {
+		return
+	}
+
+	if err := chanHost.Channel.Qos(prefetch, 0, true); err != nil {
+		con.errors <- fmt.Errorf("consumer %q auto-tune failed setting the prefetch to %d: %w", con.ConsumerName, prefetch, err)
+	}
+}
+
+func clampInt(value int, min int, max int) int {
+	if value < min {
+		return min
+	}
+	if value > max {
+		return max
+	}
+	return value
+}
@@ -0,0 +1,166 @@
+package tcr
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LetterIterator streams letters for Backfill, ex. from a file or a database cursor.
+type LetterIterator interface {
+	// Next returns the next letter or io.EOF when the source is exhausted.
+	Next() (*Letter, error)
+
+	// Checkpoint persists that every letter returned so far is published, so a new iterator
+	// over the same source can resume after it.
+	Checkpoint() error
+}
+
+// BackfillResult summarizes a Backfill run.
+type BackfillResult struct {
+	Published uint64
+	Duration  time.Duration
+}
+
+// Backfill publishes every letter of the source with confirmations, at most rate letters per second
+// (unlimited when rate isn't positive). The source is checkpointed after every confirmed letter, so a failed
+// or cancelled Backfill resumes where it stopped when given an iterator over the same source.
+func (pub *Publisher) Backfill(ctx context.Context, source LetterIterator, rate float64) (*BackfillResult, error) {
+
+	limiter := newRateLimiter(rate, 1)
+	result := &BackfillResult{}
+	started := time.Now()
+	defer func() { result.Duration = time.Since(started) }()
+
+	for {
+		if err := limiter.wait(ctx); err != nil {
+			return result, err
+		}
+
+		letter, err := source.Next()
+		if errors.Is(err, io.EOF) {
+			return result, nil
+		}
+		if err != nil {
+			return result, err
+		}
+
+		if err := pub.backfillLetter(ctx, letter); err != nil {
+			return result, err
+		}
+
+		result.Published++
+		if err := source.Checkpoint(); err != nil {
+			return result, err
+		}
+	}
+}
+
+// backfillLetter publishes with confirmation, bounded by the publish timeout when one is configured.
+func (pub *Publisher) backfillLetter(ctx context.Context, letter *Letter) error {
+
+	if pub.publishTimeOutDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, pub.publishTimeOutDuration)
+		defer cancel()
+	}
+
+	return pub.PublishWithConfirmationContextError(ctx, letter)
+}
+
+// JSONLinesLetterIterator reads one JSON Letter per line from a file. Its checkpoint is the count
+// of published lines, kept next to the file in <path>.checkpoint.
+type JSONLinesLetterIterator struct {
+	file           *os.File
+	scanner        *bufio.Scanner
+	checkpointPath string
+	line           uint64
+}
+
+// NewJSONLinesLetterIterator opens the file and skips the lines a previous Backfill already published.
+func NewJSONLinesLetterIterator(path string) (*JSONLinesLetterIterator, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	iter := &JSONLinesLetterIterator{
+		file:           file,
+		scanner:        bufio.NewScanner(file),
+		checkpointPath: path + ".checkpoint",
+	}
+	iter.scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	skip, err := iter.readCheckpoint()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	for iter.line < skip && iter.scanner.Scan() {
+		iter.line++
+	}
+
+	return iter, iter.scanner.Err()
+}
+
+// Next reads the next letter, blank lines are skipped.
+func (iter *JSONLinesLetterIterator) Next() (*Letter, error) {
+
+	for iter.scanner.Scan() {
+		iter.line++
+
+		data := iter.scanner.Bytes()
+		if len(strings.TrimSpace(string(data))) == 0 {
+			continue
+		}
+
+		letter := &Letter{}
+		if err := json.Unmarshal(data, letter); err != nil {
+			return nil, err
+		}
+
+		return letter, nil
+	}
+
+	if err := iter.scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, io.EOF
+}
+
+// Checkpoint records the lines read so far, replacing the previous checkpoint only once it was written in full.
+func (iter *JSONLinesLetterIterator) Checkpoint() error {
+
+	if err := ioutil.WriteFile(iter.checkpointPath+".tmp", []byte(strconv.FormatUint(iter.line, 10)), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(iter.checkpointPath+".tmp", iter.checkpointPath)
+}
+
+// Close closes the underlying file.
+func (iter *JSONLinesLetterIterator) Close() error {
+	return iter.file.Close()
+}
+
+func (iter *JSONLinesLetterIterator) readCheckpoint() (uint64, error) {
+
+	data, err := ioutil.ReadFile(iter.checkpointPath)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
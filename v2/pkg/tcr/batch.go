@@ -0,0 +1,106 @@
+package tcr
+
+import (
+	"context"
+	"fmt"
+)
+
+// PublishBatch publishes the letters over a single channel per ConnectionPool instead of acquiring a channel
+// per letter, then sends one aggregated PublishReceipt to PublishReceipts (and returns it). Its Batch holds
+// the per letter receipts, Success is only true when every letter was published. A channel error fails only
+// the letter that hit it, the remaining letters continue on a fresh channel.
+//
+// For proper resilience (at least once delivery guarantee over shaky network) use PublishWithConfirmation
+func (pub *Publisher) PublishBatch(letters []*Letter) *PublishReceipt {
+
+	results := make([]*PublishReceipt, len(letters))
+	byPool := make(map[*ConnectionPool][]int)
+	pools := make([]*ConnectionPool, 0, 1)
+
+	for i, letter := range letters {
+		pool := pub.activePool()
+		if letter.Envelope != nil { // a missing envelope fails in prepareLetter
+			var err error
+			pool, err = pub.resolvePool(letter.Envelope)
+			if err != nil {
+				results[i] = pub.batchResult(letter, err)
+				continue
+			}
+		}
+
+		if _, ok := byPool[pool]; !ok {
+			pools = append(pools, pool)
+		}
+		byPool[pool] = append(byPool[pool], i)
+	}
+
+	for _, pool := range pools {
+		chanHost := pool.GetChannelFromPool()
+
+		for _, i := range byPool[pool] {
+			channelErr := false
+			err := pub.intercept(context.Background(), letters[i], func(letter *Letter) error {
+				prepared, err := pub.prepareLetterOn(letter, pool)
+				if err != nil {
+					return err
+				}
+
+				err = prepared.publish(chanHost.Channel)
+				channelErr = err != nil
+				return err
+			})
+			results[i] = pub.batchResult(letters[i], err)
+
+			if channelErr {
+				pool.ReturnChannel(chanHost, true)
+				chanHost = pool.GetChannelFromPool()
+			}
+		}
+
+		pool.ReturnChannel(chanHost, false)
+	}
+
+	receipt := &PublishReceipt{
+		PublisherName: pub.Name,
+		LetterID:      pub.newLetterID(),
+		Success:       true,
+		Batch:         results,
+	}
+
+	failed := 0
+	for _, result := range results {
+		if !result.Success {
+			failed++
+			if receipt.Error == nil {
+				receipt.Error = result.Error
+			}
+		}
+	}
+
+	if failed > 0 {
+		receipt.Success = false
+		receipt.Error = fmt.Errorf("%d of %d letters of the batch failed to publish, first error: %w", failed, len(letters), receipt.Error)
+	}
+
+	pub.sendReceipt(receipt)
+
+	return receipt
+}
+
+// batchResult builds the receipt of a single letter of a batch.
+func (pub *Publisher) batchResult(letter *Letter, err error) *PublishReceipt {
+
+	result := &PublishReceipt{
+		PublisherName: pub.Name,
+		LetterID:      letter.LetterID,
+		Success:       err == nil,
+		Error:         err,
+	}
+
+	if err != nil {
+		result.FailedLetter = letter
+		pub.journalFailure(letter, err)
+	}
+
+	return result
+}
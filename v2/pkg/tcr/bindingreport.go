@@ -0,0 +1,129 @@
+package tcr
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// BindingDrift is a binding that differs between a TopologyConfig and the broker.
+type BindingDrift struct {
+	Source          string
+	Destination     string
+	DestinationType string // "queue" or "exchange"
+	RoutingKey      string
+}
+
+func (bd *BindingDrift) String() string {
+	return fmt.Sprintf("%s -> %s %s (routing key %q)", bd.Source, bd.DestinationType, bd.Destination, bd.RoutingKey)
+}
+
+// BindingReport compares the bindings of a TopologyConfig with the broker's.
+type BindingReport struct {
+	Verified   int             // configured bindings found on the broker
+	Missing    []*BindingDrift // configured but not on the broker
+	Unexpected []*BindingDrift // on the broker between configured exchanges and destinations, but not configured
+}
+
+// Drifted is true when the broker's bindings don't match the config.
+func (br *BindingReport) Drifted() bool {
+	return len(br.Missing) > 0 || len(br.Unexpected) > 0
+}
+
+// String renders the report one binding per line, ex. for a preflight log.
+func (br *BindingReport) String() string {
+
+	builder := &strings.Builder{}
+	fmt.Fprintf(builder, "%d bindings verified, %d missing, %d unexpected\n", br.Verified, len(br.Missing), len(br.Unexpected))
+	for _, drift := range br.Missing {
+		fmt.Fprintf(builder, "missing: %s\n", drift)
+	}
+	for _, drift := range br.Unexpected {
+		fmt.Fprintf(builder, "unexpected: %s\n", drift)
+	}
+
+	return builder.String()
+}
+
+// ListBindings lists every binding of the vhost.
+func (mc *ManagementClient) ListBindings() ([]*ManagementBinding, error) {
+
+	bindings := make([]*ManagementBinding, 0)
+	err := mc.do(http.MethodGet, fmt.Sprintf("/bindings/%s", mc.escapedVHost()), nil, &bindings)
+	return bindings, err
+}
+
+// VerifyBindings checks every queue and exchange binding of the config exists on the broker (through the
+// management API) and reports the drift. Bindings are matched by source, destination and routing key, the
+// default exchange's implicit bindings are ignored.
+func (top *Topologer) VerifyBindings(config *TopologyConfig) (*BindingReport, error) {
+
+	if top.Management == nil {
+		return nil, errors.New("can't verify bindings without a management client")
+	}
+
+	if config == nil {
+		return nil, errors.New("can't verify bindings without a topology config")
+	}
+
+	existing, err := top.Management.ListBindings()
+	if err != nil {
+		return nil, err
+	}
+
+	return compareBindings(config, existing), nil
+}
+
+func compareBindings(config *TopologyConfig, existing []*ManagementBinding) *BindingReport {
+
+	configured := make(map[BindingDrift]bool)
+	sources := make(map[string]bool)
+	destinations := make(map[string]bool)
+
+	for _, binding := range config.QueueBindings {
+		key := BindingDrift{Source: binding.ExchangeName, Destination: binding.QueueName, DestinationType: "queue", RoutingKey: binding.RoutingKey}
+		configured[key] = true
+		sources[key.Source] = true
+		destinations[key.DestinationType+"/"+key.Destination] = true
+	}
+	for _, binding := range config.ExchangeBindings {
+		key := BindingDrift{Source: binding.ParentExchangeName, Destination: binding.ExchangeName, DestinationType: "exchange", RoutingKey: binding.RoutingKey}
+		configured[key] = true
+		sources[key.Source] = true
+		destinations[key.DestinationType+"/"+key.Destination] = true
+	}
+
+	report := &BindingReport{}
+	found := make(map[BindingDrift]bool)
+	for _, binding := range existing {
+		if binding.Source == "" {
+			continue
+		}
+
+		key := BindingDrift{Source: binding.Source, Destination: binding.Destination, DestinationType: binding.DestinationType, RoutingKey: binding.RoutingKey}
+		if configured[key] {
+			found[key] = true
+			continue
+		}
+
+		if sources[key.Source] && destinations[key.DestinationType+"/"+key.Destination] {
+			drift := key
+			report.Unexpected = append(report.Unexpected, &drift)
+		}
+	}
+
+	for key := range configured {
+		if found[key] {
+			report.Verified++
+			continue
+		}
+		drift := key
+		report.Missing = append(report.Missing, &drift)
+	}
+
+	sort.Slice(report.Missing, func(i, j int) bool { return report.Missing[i].String() < report.Missing[j].String() })
+	sort.Slice(report.Unexpected, func(i, j int) bool { return report.Unexpected[i].String() < report.Unexpected[j].String() })
+	return report
+}
@@ -0,0 +1,183 @@
+package tcr
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	// DefaultMaxMessageSize is RabbitMQ's default max_message_size (128 MiB).
+	DefaultMaxMessageSize = 128 << 20
+
+	// DefaultBodySizeAlertThreshold is the share of the MaxMessageSize the p99 body size alerts at.
+	DefaultBodySizeAlertThreshold = 0.8
+)
+
+// bodySizeBounds are the upper bounds of the BodySizes buckets in bytes, the last bucket is unbounded.
+var bodySizeBounds = []int{
+	1 << 10,
+	4 << 10,
+	16 << 10,
+	64 << 10,
+	256 << 10,
+	1 << 20,
+	4 << 20,
+	16 << 20,
+	32 << 20,
+	64 << 20,
+	96 << 20,
+	128 << 20,
+}
+
+// SizeBucket counts the body sizes up to UpperBound (and above the previous bucket), zero is unbounded.
+type SizeBucket struct {
+	UpperBound int
+	Count      uint64
+}
+
+// SizeHistogram is the distribution of published body sizes in bytes.
+type SizeHistogram struct {
+	Count   uint64
+	Sum     uint64
+	Max     int
+	Buckets []SizeBucket
+}
+
+// Mean is the average body size, zero without observations.
+func (sh *SizeHistogram) Mean() float64 {
+	if sh.Count == 0 {
+		return 0
+	}
+	return float64(sh.Sum) / float64(sh.Count)
+}
+
+// Quantile estimates the q (0-1) quantile, interpolated within its bucket and never above Max.
+func (sh *SizeHistogram) Quantile(q float64) int {
+
+	if sh.Count == 0 {
+		return 0
+	}
+
+	rank := q * float64(sh.Count)
+	var seen uint64
+	lower := 0
+	for _, bucket := range sh.Buckets {
+		if bucket.Count > 0 && float64(seen+bucket.Count) >= rank {
+			upper := bucket.UpperBound
+			if upper == 0 || upper > sh.Max {
+				upper = sh.Max
+			}
+			estimate := lower + int(float64(upper-lower)*(rank-float64(seen))/float64(bucket.Count))
+			if estimate > sh.Max {
+				return sh.Max
+			}
+			return estimate
+		}
+		seen += bucket.Count
+		lower = bucket.UpperBound
+	}
+
+	return sh.Max
+}
+
+func (sh *SizeHistogram) observe(size int) {
+
+	sh.Count++
+	sh.Sum += uint64(size)
+	if size > sh.Max {
+		sh.Max = size
+	}
+
+	for i := range sh.Buckets {
+		bound := sh.Buckets[i].UpperBound
+		if bound == 0 || size <= bound {
+			sh.Buckets[i].Count++
+			return
+		}
+	}
+}
+
+func newSizeBuckets(bounds []int) []SizeBucket {
+
+	buckets := make([]SizeBucket, len(bounds)+1)
+	for i, bound := range bounds {
+		buckets[i].UpperBound = bound
+	}
+
+	return buckets
+}
+
+// bodySizeQuantile estimates the quantile of the published body sizes.
+func (ps *publisherStats) bodySizeQuantile(q float64) int {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	return ps.bodySizes.Quantile(q)
+}
+
+// BodySizeAlertConfig warns with PublisherEventBodySizeNearLimit once the p99 published body size reaches Threshold
+// of the broker's MaxMessageSize, before publishes start failing. Bodies merely larger than the frame_max are split
+// into frames and don't fail.
+type BodySizeAlertConfig struct {
+	MaxMessageSize int     `json:"MaxMessageSize,omitempty" yaml:"MaxMessageSize,omitempty"` // bytes, the broker's max_message_size, defaults to DefaultMaxMessageSize
+	Threshold      float64 `json:"Threshold,omitempty" yaml:"Threshold,omitempty"`           // share (0-1) of MaxMessageSize, defaults to DefaultBodySizeAlertThreshold
+}
+
+// bodySizeAlert is the state of a BodySizeAlertConfig.
+type bodySizeAlert struct {
+	limit    int
+	alerting bool
+	lock     *sync.Mutex
+}
+
+// SetBodySizeAlert watches the published body sizes per the config, nil stops watching.
+func (pub *Publisher) SetBodySizeAlert(config *BodySizeAlertConfig) {
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	if config == nil {
+		pub.bodySizeAlert = nil
+		return
+	}
+
+	maxMessageSize := config.MaxMessageSize
+	if maxMessageSize <= 0 {
+		maxMessageSize = DefaultMaxMessageSize
+	}
+
+	threshold := config.Threshold
+	if threshold <= 0 || threshold > 1 {
+		threshold = DefaultBodySizeAlertThreshold
+	}
+
+	pub.bodySizeAlert = &bodySizeAlert{
+		limit: int(float64(maxMessageSize) * threshold),
+		lock:  &sync.Mutex{},
+	}
+}
+
+// checkBodySizes emits an event when the p99 body size crosses the alert's limit, either way.
+func (pub *Publisher) checkBodySizes() {
+
+	pub.pubRWLock.RLock()
+	alert := pub.bodySizeAlert
+	pub.pubRWLock.RUnlock()
+
+	if alert == nil {
+		return
+	}
+
+	p99 := pub.stats.bodySizeQuantile(0.99)
+
+	alert.lock.Lock()
+	defer alert.lock.Unlock()
+
+	switch {
+	case !alert.alerting && p99 >= alert.limit:
+		alert.alerting = true
+		pub.emitEvent(PublisherEventBodySizeNearLimit, fmt.Sprintf("p99 body size %d bytes reached the alert limit of %d bytes", p99, alert.limit))
+	case alert.alerting && p99 < alert.limit:
+		alert.alerting = false
+		pub.emitEvent(PublisherEventBodySizeRecovered, fmt.Sprintf("p99 body size %d bytes is below the alert limit of %d bytes", p99, alert.limit))
+	}
+}
@@ -0,0 +1,57 @@
+package tcr
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// HeaderFirstAttempt overrides the publish timestamp as the start of a message's processing budget,
+	// set it (unix milliseconds) when republishing a message for a retry.
+	HeaderFirstAttempt = "x-tcr-first-attempt"
+)
+
+// firstAttempt is when the processing budget of the delivery started, zero when unknown.
+// Requeued and dead lettered messages keep their Timestamp so it spans every retry.
+func firstAttempt(delivery amqp.Delivery) time.Time {
+
+	switch value := delivery.Headers[HeaderFirstAttempt].(type) {
+	case int64:
+		return time.Unix(0, value*int64(time.Millisecond))
+	case int32:
+		return time.Unix(0, int64(value)*int64(time.Millisecond))
+	case time.Time:
+		return value
+	}
+
+	return delivery.Timestamp
+}
+
+// rejectExhaustedMessage returns true when the message outlived the ProcessingBudget and was rejected
+// without requeue (dead lettered) regardless of any remaining retries.
+func (con *Consumer) rejectExhaustedMessage(msg *ReceivedMessage) bool {
+
+	if con.processingBudget <= 0 || !msg.IsAckable {
+		return false
+	}
+
+	started := firstAttempt(msg.Delivery)
+	if started.IsZero() {
+		return false
+	}
+
+	age := time.Since(started)
+	if age <= con.processingBudget {
+		return false
+	}
+
+	if err := msg.Reject(false); err != nil {
+		con.errors <- err
+		return false
+	}
+
+	con.errors <- fmt.Errorf("consumer %q rejected MessageID %s, its processing budget of %s was exhausted (age: %s)", con.ConsumerName, msg.MessageID, con.processingBudget, age)
+	return true
+}
@@ -0,0 +1,122 @@
+package tcr
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/streadway/amqp"
+)
+
+const (
+	// HeaderRoutingCanary marks the canary letters published by VerifyExchangeRouting, consumers should drop them.
+	HeaderRoutingCanary = "x-tcr-routing-canary"
+
+	// DefaultCanaryRoutingKey is used by VerifyExchangeRouting when no routing key is given.
+	DefaultCanaryRoutingKey = "tcr.canary"
+)
+
+// RoutingVerification is the outcome of publishing a mandatory canary to an exchange.
+// Routed is false when the broker returned the canary: neither a binding nor an alternate exchange took it.
+type RoutingVerification struct {
+	Exchange          string
+	AlternateExchange string // from the exchange's alternate-exchange argument, if it was declared with one
+	RoutingKey        string
+	Routed            bool
+	ReplyCode         uint16
+	ReplyText         string
+	Err               error // the canary itself could not be published (ex. the exchange doesn't exist)
+}
+
+// VerifyExchangeRouting publishes a mandatory canary to each exchange and reports which ones routed it, either
+// through a binding or the alternate exchange's catch-all, so broken bindings surface before real letters are lost.
+// Canaries are transient, carry HeaderRoutingCanary and may reach real queues.
+func (top *Topologer) VerifyExchangeRouting(exchanges []*Exchange, routingKey string, timeout time.Duration) ([]*RoutingVerification, error) {
+
+	if routingKey == "" {
+		routingKey = DefaultCanaryRoutingKey
+	}
+
+	verifications := make([]*RoutingVerification, 0, len(exchanges))
+	for _, exchange := range exchanges {
+		verification := &RoutingVerification{
+			Exchange:   exchange.Name,
+			RoutingKey: routingKey,
+		}
+		if alternate, ok := exchange.Args["alternate-exchange"].(string); ok {
+			verification.AlternateExchange = alternate
+		}
+
+		top.publishCanary(verification, timeout)
+		verifications = append(verifications, verification)
+	}
+
+	for _, verification := range verifications {
+		if verification.Err != nil || !verification.Routed {
+			return verifications, errors.New("one or more exchanges failed to route the canary")
+		}
+	}
+
+	return verifications, nil
+}
+
+// publishCanary runs on its own transient channel as an unknown exchange closes the channel.
+func (top *Topologer) publishCanary(verification *RoutingVerification, timeout time.Duration) {
+
+	channel := top.ConnectionPool.GetTransientChannel(true)
+	defer func() { _ = channel.Close() }()
+
+	confirmations := channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+	returns := channel.NotifyReturn(make(chan amqp.Return, 1))
+
+	err := channel.Publish(
+		verification.Exchange,
+		verification.RoutingKey,
+		true,  // mandatory
+		false, // immediate
+		amqp.Publishing{
+			MessageId: uuid.New().String(),
+			Timestamp: time.Now().UTC(),
+			Headers:   amqp.Table{HeaderRoutingCanary: true},
+			AppId:     top.ConnectionPool.Config.ApplicationName,
+		},
+	)
+	if err != nil {
+		verification.Err = err
+		return
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case confirmation, ok := <-confirmations:
+		if !ok {
+			verification.Err = fmt.Errorf("channel closed before the canary to exchange %q was confirmed", verification.Exchange)
+			return
+		}
+		if !confirmation.Ack {
+			verification.Err = fmt.Errorf("canary to exchange %q was nacked", verification.Exchange)
+			return
+		}
+	case <-timer.C:
+		verification.Err = fmt.Errorf("canary to exchange %q was not confirmed within %s", verification.Exchange, timeout)
+		return
+	}
+
+	// The broker sends basic.return before the basic.ack of the same publish.
+	select {
+	case ret := <-returns:
+		verification.ReplyCode = ret.ReplyCode
+		verification.ReplyText = ret.ReplyText
+	default:
+		verification.Routed = true
+	}
+}
+
+// IsRoutingCanary reports if the message is a canary published by VerifyExchangeRouting.
+func IsRoutingCanary(msg *ReceivedMessage) bool {
+	canary, ok := msg.Delivery.Headers[HeaderRoutingCanary].(bool)
+	return ok && canary
+}
@@ -16,6 +16,7 @@ type ChannelHost struct {
 	CachedChannel bool
 	Confirmations chan amqp.Confirmation
 	Errors        chan *amqp.Error
+	Returns       chan amqp.Return // only cached channels, drained by the ConnectionPool
 	connHost      *ConnectionHost
 	chanLock      *sync.Mutex
 }
@@ -76,6 +77,11 @@ func (ch *ChannelHost) MakeChannel() (err error) {
 	ch.Errors = make(chan *amqp.Error, 100)
 	ch.Channel.NotifyClose(ch.Errors)
 
+	if ch.CachedChannel {
+		ch.Returns = make(chan amqp.Return, 100)
+		ch.Channel.NotifyReturn(ch.Returns)
+	}
+
 	return nil
 }
 
@@ -0,0 +1,71 @@
+package tcr
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ErrChannelMaxExhausted is reported (once per episode) when connections ran out of channel ids (channel_max).
+var ErrChannelMaxExhausted = errors.New("connection channel_max exhausted - backing off channel creation")
+
+const (
+	channelMaxMinBackoff = 50 * time.Millisecond
+	channelMaxMaxBackoff = 5 * time.Second
+)
+
+// channelMaxState tracks channel_max exhaustion of a ConnectionPool.
+type channelMaxState struct {
+	exhausted bool
+	backoff   time.Duration
+	lock      *sync.Mutex
+}
+
+// ChannelMaxExhausted reports whether channel creation is currently backing off because of channel_max.
+func (cp *ConnectionPool) ChannelMaxExhausted() bool {
+	cp.channelMax.lock.Lock()
+	defer cp.channelMax.lock.Unlock()
+
+	return cp.channelMax.exhausted
+}
+
+// backOffOnChannelMax returns true when err is a channel_max exhaustion, after backing off. Exhaustion is
+// not a connection failure so the connection must not be flagged for recovery.
+func (cp *ConnectionPool) backOffOnChannelMax(err error) bool {
+
+	if !errors.Is(err, amqp.ErrChannelMax) {
+		return false
+	}
+
+	cp.channelMax.lock.Lock()
+	firstReport := !cp.channelMax.exhausted
+	cp.channelMax.exhausted = true
+	if cp.channelMax.backoff < channelMaxMinBackoff {
+		cp.channelMax.backoff = channelMaxMinBackoff
+	} else if cp.channelMax.backoff < channelMaxMaxBackoff {
+		cp.channelMax.backoff *= 2
+		if cp.channelMax.backoff > channelMaxMaxBackoff {
+			cp.channelMax.backoff = channelMaxMaxBackoff
+		}
+	}
+	backoff := cp.channelMax.backoff
+	cp.channelMax.lock.Unlock()
+
+	if firstReport && cp.errorHandler != nil {
+		cp.errorHandler(ErrChannelMaxExhausted)
+	}
+
+	time.Sleep(backoff)
+	return true
+}
+
+// channelCreated clears the exhaustion once a channel could be created again.
+func (cp *ConnectionPool) channelCreated() {
+	cp.channelMax.lock.Lock()
+	defer cp.channelMax.lock.Unlock()
+
+	cp.channelMax.exhausted = false
+	cp.channelMax.backoff = 0
+}
@@ -0,0 +1,135 @@
+package tcr
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// HeaderClaimCheck holds the BlobStore key of a body that was offloaded.
+	HeaderClaimCheck = "x-tcr-claim-check"
+
+	// HeaderClaimCheckSize holds the size of the offloaded body.
+	HeaderClaimCheckSize = "x-tcr-claim-check-size"
+)
+
+// BlobStore keeps large bodies outside of RabbitMQ (S3, GCS, a filesystem...).
+// Blobs are never deleted by tcr, use the store's lifecycle/expiry rules.
+type BlobStore interface {
+	PutBlob(key string, data []byte) error
+	GetBlob(key string) ([]byte, error)
+}
+
+// FileBlobStore keeps blobs as files in a directory, ex. a shared volume.
+type FileBlobStore struct {
+	directory string
+}
+
+// NewFileBlobStore creates the directory when needed.
+func NewFileBlobStore(directory string) (*FileBlobStore, error) {
+
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+
+	return &FileBlobStore{directory: directory}, nil
+}
+
+// PutBlob writes the blob.
+func (store *FileBlobStore) PutBlob(key string, data []byte) error {
+	return ioutil.WriteFile(store.path(key), data, 0644)
+}
+
+// GetBlob reads the blob.
+func (store *FileBlobStore) GetBlob(key string) ([]byte, error) {
+	return ioutil.ReadFile(store.path(key))
+}
+
+func (store *FileBlobStore) path(key string) string {
+	return filepath.Join(store.directory, filepath.Base(strings.ReplaceAll(key, "..", "")))
+}
+
+// SetBlobStore offloads bodies larger than threshold bytes to the store, the letter is published
+// with an empty body and a HeaderClaimCheck reference restored by a Consumer with the same store.
+func (pub *Publisher) SetBlobStore(store BlobStore, threshold int) {
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	pub.blobStore = store
+	pub.blobThreshold = threshold
+}
+
+// offloadBody uploads the body when it is over the threshold, returning the body and headers to publish.
+func (pub *Publisher) offloadBody(letter *Letter, body []byte) ([]byte, amqp.Table, error) {
+
+	pub.pubRWLock.RLock()
+	store := pub.blobStore
+	threshold := pub.blobThreshold
+	pub.pubRWLock.RUnlock()
+
+	if store == nil || len(body) <= threshold {
+		return body, letter.Envelope.Headers, nil
+	}
+
+	key := pub.newLetterID().String() // unique per offload, letters may share (or lack) a LetterID
+	if err := store.PutBlob(key, body); err != nil {
+		return nil, nil, fmt.Errorf("offloading the body of LetterID: %s failed: %w", letter.LetterID.String(), err)
+	}
+
+	headers := make(amqp.Table, len(letter.Envelope.Headers)+2)
+	for header, value := range letter.Envelope.Headers {
+		headers[header] = value
+	}
+	headers[HeaderClaimCheck] = key
+	headers[HeaderClaimCheckSize] = int64(len(body))
+
+	return []byte{}, headers, nil
+}
+
+// SetBlobStore lets the Consumer restore bodies offloaded by a Publisher before the handler sees them.
+func (con *Consumer) SetBlobStore(store BlobStore) {
+	con.conLock.Lock()
+	defer con.conLock.Unlock()
+
+	con.blobStore = store
+}
+
+// ClaimCheckKey returns the BlobStore key of an offloaded body.
+func (msg *ReceivedMessage) ClaimCheckKey() (string, bool) {
+	key, ok := msg.Delivery.Headers[HeaderClaimCheck].(string)
+	return key, ok
+}
+
+// restoreBody fetches an offloaded body, false when it failed and the message was nacked for redelivery.
+func (con *Consumer) restoreBody(msg *ReceivedMessage) bool {
+
+	key, ok := msg.ClaimCheckKey()
+	if !ok {
+		return true
+	}
+
+	con.conLock.Lock()
+	store := con.blobStore
+	con.conLock.Unlock()
+
+	if store == nil {
+		return true // hand it over as is, the handler may fetch it itself
+	}
+
+	body, err := store.GetBlob(key)
+	if err != nil {
+		con.errors <- fmt.Errorf("consumer %q failed to restore the body of MessageID %s: %w", con.ConsumerName, msg.MessageID, err)
+		if msg.IsAckable {
+			_ = msg.Nack(true)
+		}
+		return false
+	}
+
+	msg.Body = body
+	return true
+}
@@ -0,0 +1,112 @@
+package tcr
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Clock tells publishers, consumers and pools the time, so timestamps, timeouts, retry backoffs and
+// processing deadlines can be tested deterministically with a fake.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	AfterFunc(d time.Duration, f func()) (stop func() bool)
+}
+
+// SystemClock is the real time (default).
+type SystemClock struct{}
+
+// Now is time.Now.
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// After is time.After.
+func (SystemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// AfterFunc is time.AfterFunc, returning the timer's Stop.
+func (SystemClock) AfterFunc(d time.Duration, f func()) func() bool {
+	return time.AfterFunc(d, f).Stop
+}
+
+// IDGenerator assigns the LetterIDs of letters created by the Publisher and RabbitService.
+type IDGenerator interface {
+	NewLetterID() uuid.UUID
+}
+
+// UUIDGenerator generates random (v4) UUIDs (default).
+type UUIDGenerator struct{}
+
+// NewLetterID is uuid.New.
+func (UUIDGenerator) NewLetterID() uuid.UUID {
+	return uuid.New()
+}
+
+// SetClock replaces the Publisher's clock, nil restores the SystemClock.
+func (pub *Publisher) SetClock(clock Clock) {
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	if clock == nil {
+		clock = SystemClock{}
+	}
+	pub.clock = clock
+}
+
+// SetIDGenerator replaces the Publisher's LetterID generator, nil restores the UUIDGenerator.
+func (pub *Publisher) SetIDGenerator(ids IDGenerator) {
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	if ids == nil {
+		ids = UUIDGenerator{}
+	}
+	pub.ids = ids
+}
+
+func (pub *Publisher) currentClock() Clock {
+	pub.pubRWLock.RLock()
+	defer pub.pubRWLock.RUnlock()
+
+	return pub.clock
+}
+
+func (pub *Publisher) newLetterID() uuid.UUID {
+	pub.pubRWLock.RLock()
+	ids := pub.ids
+	pub.pubRWLock.RUnlock()
+
+	return ids.NewLetterID()
+}
+
+// SetClock replaces the Consumer's clock used for processing deadlines, nil restores the SystemClock.
+func (con *Consumer) SetClock(clock Clock) {
+	con.conLock.Lock()
+	defer con.conLock.Unlock()
+
+	if clock == nil {
+		clock = SystemClock{}
+	}
+	con.clock = clock
+}
+
+func (con *Consumer) currentClock() Clock {
+	con.conLock.Lock()
+	defer con.conLock.Unlock()
+
+	return con.clock
+}
+
+// SetClock replaces the ConnectionPool's clock used for its health, nil restores the SystemClock.
+func (cp *ConnectionPool) SetClock(clock Clock) {
+	cp.health.lock.Lock()
+	defer cp.health.lock.Unlock()
+
+	if clock == nil {
+		clock = SystemClock{}
+	}
+	cp.health.clock = clock
+}
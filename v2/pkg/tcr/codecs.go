@@ -0,0 +1,193 @@
+package tcr
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"mime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// ContentTypeGob is the content type of the GobMarshaller.
+	ContentTypeGob = "application/x-gob"
+
+	// ContentTypeFlatBuffers is the content type of the FlatBuffersMarshaller.
+	ContentTypeFlatBuffers = "application/x-flatbuffers"
+)
+
+// GobMarshaller marshals values with encoding/gob, for Go to Go services.
+type GobMarshaller struct{}
+
+// Marshal gob encodes the value.
+func (GobMarshaller) Marshal(value interface{}) ([]byte, error) {
+
+	buffer := &bytes.Buffer{}
+	if err := gob.NewEncoder(buffer).Encode(value); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// Unmarshal gob decodes into the value.
+func (GobMarshaller) Unmarshal(data []byte, value interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(value)
+}
+
+// ContentType is application/x-gob.
+func (GobMarshaller) ContentType() string {
+	return ContentTypeGob
+}
+
+// FlatBufferMarshaler is implemented by (wrappers of) generated FlatBuffers tables,
+// ex. by returning builder.FinishedBytes().
+type FlatBufferMarshaler interface {
+	MarshalFlatBuffer() ([]byte, error)
+}
+
+// FlatBufferUnmarshaler is implemented by (wrappers of) generated FlatBuffers tables,
+// ex. with GetRootAs<Table>(data, 0) which reads the body in place without copying.
+type FlatBufferUnmarshaler interface {
+	UnmarshalFlatBuffer(data []byte) error
+}
+
+// FlatBuffersMarshaller passes FlatBuffers through without copying, values are finished buffers ([]byte)
+// or implement FlatBufferMarshaler/FlatBufferUnmarshaler, so no FlatBuffers dependency is required here.
+type FlatBuffersMarshaller struct{}
+
+// Marshal returns the finished buffer of the value.
+func (FlatBuffersMarshaller) Marshal(value interface{}) ([]byte, error) {
+
+	switch fb := value.(type) {
+	case []byte:
+		return fb, nil
+	case FlatBufferMarshaler:
+		return fb.MarshalFlatBuffer()
+	}
+
+	return nil, fmt.Errorf("can't marshal %T as a flatbuffer, it must be []byte or a FlatBufferMarshaler", value)
+}
+
+// Unmarshal hands the body to the value, the value references data so the body must not be modified.
+func (FlatBuffersMarshaller) Unmarshal(data []byte, value interface{}) error {
+
+	switch fb := value.(type) {
+	case *[]byte:
+		*fb = data
+		return nil
+	case FlatBufferUnmarshaler:
+		return fb.UnmarshalFlatBuffer(data)
+	}
+
+	return fmt.Errorf("can't unmarshal a flatbuffer into %T, it must be *[]byte or a FlatBufferUnmarshaler", value)
+}
+
+// ContentType is application/x-flatbuffers.
+func (FlatBuffersMarshaller) ContentType() string {
+	return ContentTypeFlatBuffers
+}
+
+// marshallers is the serialization registry, keyed by name.
+var marshallers = struct {
+	byName map[string]Marshaller
+	lock   *sync.RWMutex
+}{
+	byName: map[string]Marshaller{
+		"json":        JSONMarshaller{},
+		"gob":         GobMarshaller{},
+		"flatbuffers": FlatBuffersMarshaller{},
+	},
+	lock: &sync.RWMutex{},
+}
+
+// RegisterMarshaller adds (or replaces) a Marshaller selectable by name in the Publisher and Consumer configs.
+func RegisterMarshaller(name string, marshaller Marshaller) {
+	marshallers.lock.Lock()
+	defer marshallers.lock.Unlock()
+
+	marshallers.byName[name] = marshaller
+}
+
+// GetMarshaller returns the Marshaller registered under the name.
+func GetMarshaller(name string) (Marshaller, bool) {
+	marshallers.lock.RLock()
+	defer marshallers.lock.RUnlock()
+
+	marshaller, ok := marshallers.byName[name]
+	return marshaller, ok
+}
+
+// MarshallerNames returns the sorted names of the registered Marshallers.
+func MarshallerNames() []string {
+	marshallers.lock.RLock()
+	defer marshallers.lock.RUnlock()
+
+	names := make([]string, 0, len(marshallers.byName))
+	for name := range marshallers.byName {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// marshallerForContentType finds the registered Marshaller producing the content type.
+func marshallerForContentType(contentType string) (Marshaller, bool) {
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, false
+	}
+
+	marshallers.lock.RLock()
+	defer marshallers.lock.RUnlock()
+
+	for _, name := range []string{"json", "gob", "flatbuffers"} { // builtins first for a stable pick
+		if marshaller, ok := marshallers.byName[name]; ok && sameMediaType(marshaller.ContentType(), mediaType) {
+			return marshaller, true
+		}
+	}
+
+	for _, marshaller := range marshallers.byName {
+		if sameMediaType(marshaller.ContentType(), mediaType) {
+			return marshaller, true
+		}
+	}
+
+	return nil, false
+}
+
+// Unmarshal decodes the body into the value with the Consumer's Marshaller, or the registered Marshaller
+// matching the message's content type.
+func (msg *ReceivedMessage) Unmarshal(value interface{}) error {
+
+	marshaller := msg.marshaller
+	if marshaller == nil {
+		var ok bool
+		if marshaller, ok = marshallerForContentType(msg.Delivery.ContentType); !ok {
+			return errors.New("can't unmarshal, no marshaller for content type " + msg.Delivery.ContentType)
+		}
+	}
+
+	return marshaller.Unmarshal(msg.Body, value)
+}
+
+// configuredMarshaller looks up the Marshaller named in a config, nil when unnamed. An unknown name is an error
+// rather than silently falling back to JSON (or the content type).
+func configuredMarshaller(name string) (Marshaller, error) {
+
+	if name == "" {
+		return nil, nil
+	}
+
+	marshaller, ok := GetMarshaller(name)
+	if !ok {
+		return nil, fmt.Errorf("no marshaller is registered as %q, registered are: %s", name, strings.Join(MarshallerNames(), ", "))
+	}
+
+	return marshaller, nil
+}
@@ -5,19 +5,30 @@ import (
 	"compress/gzip"
 	"io"
 	"io/ioutil"
+	"sync"
 
 	"github.com/klauspost/compress/zstd"
 )
 
+// zstdWriters and gzipWriters reuse compressors, a zstd encoder in particular is costly to create per letter.
+var zstdWriters = sync.Pool{}
+var gzipWriters = sync.Pool{}
+
 // CompressWithZstd uses an external dependency for Zstd to compress data and places data in the supplied buffer.
 func CompressWithZstd(data []byte, buffer *bytes.Buffer) error {
 
-	zstdWriter, err := zstd.NewWriter(buffer)
-	if err != nil {
-		return err
+	zstdWriter, ok := zstdWriters.Get().(*zstd.Encoder)
+	if ok {
+		zstdWriter.Reset(buffer)
+	} else {
+		var err error
+		zstdWriter, err = zstd.NewWriter(buffer)
+		if err != nil {
+			return err
+		}
 	}
 
-	_, err = io.Copy(zstdWriter, bytes.NewReader(data))
+	_, err := io.Copy(zstdWriter, bytes.NewReader(data))
 	if err != nil {
 
 		closeErr := zstdWriter.Close()
@@ -28,7 +39,14 @@ func CompressWithZstd(data []byte, buffer *bytes.Buffer) error {
 		return err
 	}
 
-	return zstdWriter.Close()
+	if err = zstdWriter.Close(); err != nil {
+		return err
+	}
+
+	zstdWriter.Reset(nil) // don't keep the buffer reachable from the pool
+	zstdWriters.Put(zstdWriter)
+
+	return nil
 }
 
 // DecompressWithZstd uses an external dependency for Zstd to decompress data and replaces the supplied buffer with a new buffer with data in it.
@@ -53,7 +71,12 @@ func DecompressWithZstd(buffer *bytes.Buffer) error {
 // CompressWithGzip uses the standard Gzip Writer to compress data and places data in the supplied buffer.
 func CompressWithGzip(data []byte, buffer *bytes.Buffer) error {
 
-	gzipWriter := gzip.NewWriter(buffer)
+	gzipWriter, ok := gzipWriters.Get().(*gzip.Writer)
+	if ok {
+		gzipWriter.Reset(buffer)
+	} else {
+		gzipWriter = gzip.NewWriter(buffer)
+	}
 
 	_, err := gzipWriter.Write(data)
 	if err != nil {
@@ -64,6 +87,9 @@ func CompressWithGzip(data []byte, buffer *bytes.Buffer) error {
 		return err
 	}
 
+	gzipWriter.Reset(nil)
+	gzipWriters.Put(gzipWriter)
+
 	return nil
 }
 
@@ -7,6 +7,11 @@ type RabbitSeasoning struct {
 	PoolConfig        *PoolConfig                `json:"PoolConfig" yaml:"PoolConfig"`
 	ConsumerConfigs   map[string]*ConsumerConfig `json:"ConsumerConfigs" yaml:"ConsumerConfigs"`
 	PublisherConfig   *PublisherConfig           `json:"PublisherConfig" yaml:"PublisherConfig"`
+	ManagementConfig  *ManagementConfig          `json:"ManagementConfig,omitempty" yaml:"ManagementConfig,omitempty"`
+
+	Pools            map[string]*PoolConfig      `json:"Pools,omitempty" yaml:"Pools,omitempty"`                       // named pools besides PoolConfig, see Envelope.Pool and ConsumerConfig.Pool
+	TopologyConfig   *TopologyConfig             `json:"TopologyConfig,omitempty" yaml:"TopologyConfig,omitempty"`     // built on the PoolConfig's pool by RabbitService.Start
+	PublisherConfigs map[string]*PublisherConfig `json:"PublisherConfigs,omitempty" yaml:"PublisherConfigs,omitempty"` // named publishers besides PublisherConfig, see RabbitService.GetPublisher
 }
 
 // PoolConfig represents settings for creating/configuring pools.
@@ -16,9 +21,21 @@ type PoolConfig struct {
 	Heartbeat            uint32     `json:"Heartbeat" yaml:"Heartbeat"`
 	ConnectionTimeout    uint32     `json:"ConnectionTimeout" yaml:"ConnectionTimeout"`
 	SleepOnErrorInterval uint32     `json:"SleepOnErrorInterval" yaml:"SleepOnErrorInterval"` // sleep length on errors
-	MaxConnectionCount   uint64     `json:"MaxConnectionCount" yaml:"MaxConnectionCount"`   // number of connections to create in the pool
+	MaxConnectionCount   uint64     `json:"MaxConnectionCount" yaml:"MaxConnectionCount"`     // number of connections to create in the pool
 	MaxCacheChannelCount uint64     `json:"MaxCacheChannelCount" yaml:"MaxCacheChannelCount"` // number of channels to be cached in the pool
-	TLSConfig            *TLSConfig `json:"TLSConfig" yaml:"TLSConfig"`            // TLS settings for connection with AMQPS.
+	TLSConfig            *TLSConfig `json:"TLSConfig" yaml:"TLSConfig"`                       // TLS settings for connection with AMQPS.
+
+	WebSocketConfig *WebSocketConfig `json:"WebSocketConfig,omitempty" yaml:"WebSocketConfig,omitempty"` // tunnel connections through a WebSocket gateway
+
+	ChannelDistribution    string `json:"ChannelDistribution,omitempty" yaml:"ChannelDistribution,omitempty"`       // spread (default), pack or dedicated-confirms
+	ChannelsPerConnection  uint64 `json:"ChannelsPerConnection,omitempty" yaml:"ChannelsPerConnection,omitempty"`   // pack, defaults to an even share of MaxCacheChannelCount
+	ConfirmConnectionCount uint64 `json:"ConfirmConnectionCount,omitempty" yaml:"ConfirmConnectionCount,omitempty"` // dedicated-confirms, defaults to 1
+
+	KeepAliveInterval uint32 `json:"KeepAliveInterval,omitempty" yaml:"KeepAliveInterval,omitempty"` // ms, if zero connections are not probed
+	KeepAliveTimeout  uint32 `json:"KeepAliveTimeout,omitempty" yaml:"KeepAliveTimeout,omitempty"`   // ms, defaults to ConnectionTimeout
+
+	FrameMax   uint32 `json:"FrameMax,omitempty" yaml:"FrameMax,omitempty"`     // bytes per frame (at least 4096), zero accepts the server's frame_max
+	ChannelMax uint16 `json:"ChannelMax,omitempty" yaml:"ChannelMax,omitempty"` // channels per connection, zero accepts the server's channel_max
 }
 
 // TLSConfig represents settings for configuring TLS.
@@ -26,7 +43,9 @@ type TLSConfig struct {
 	EnableTLS         bool   `json:"EnableTLS" yaml:"EnableTLS"` // Use TLSConfig to create connections with AMQPS uri.
 	PEMCertLocation   string `json:"PEMCertLocation" yaml:"PEMCertLocation"`
 	LocalCertLocation string `json:"LocalCertLocation" yaml:"LocalCertLocation"`
+	LocalKeyLocation  string `json:"LocalKeyLocation,omitempty" yaml:"LocalKeyLocation,omitempty"` // defaults to LocalCertLocation
 	CertServerName    string `json:"CertServerName" yaml:"CertServerName"`
+	ReloadInterval    uint32 `json:"ReloadInterval,omitempty" yaml:"ReloadInterval,omitempty"` // ms, if zero the cert/key/CA files are not watched
 }
 
 // ConsumerConfig represents settings for configuring a consumer with ease.
@@ -38,18 +57,91 @@ type ConsumerConfig struct {
 	Exclusive            bool                   `json:"Exclusive" yaml:"Exclusive"`
 	NoWait               bool                   `json:"NoWait" yaml:"NoWait"`
 	Args                 map[string]interface{} `json:"Args" yaml:"Args"`
-	QosCountOverride     int                    `json:"QosCountOverride" yaml:"QosCountOverride"`     // if zero ignored
+	QosCountOverride     int                    `json:"QosCountOverride" yaml:"QosCountOverride"`         // if zero ignored
 	SleepOnErrorInterval uint32                 `json:"SleepOnErrorInterval" yaml:"SleepOnErrorInterval"` // sleep on error
-	SleepOnIdleInterval  uint32                 `json:"SleepOnIdleInterval" yaml:"SleepOnIdleInterval"`  // sleep on idle
+	SleepOnIdleInterval  uint32                 `json:"SleepOnIdleInterval" yaml:"SleepOnIdleInterval"`   // sleep on idle
+	ProcessingDeadline   uint32                 `json:"ProcessingDeadline" yaml:"ProcessingDeadline"`     // ms, if zero ignored - actions exceeding it are nacked for redelivery
+	ProgressInterval     uint32                 `json:"ProgressInterval" yaml:"ProgressInterval"`         // ms, how often the progress handler is invoked, defaults to a quarter of ProcessingDeadline
+	ProcessingBudget     uint32                 `json:"ProcessingBudget" yaml:"ProcessingBudget"`         // ms, if zero ignored - messages older than this (across all retries) are rejected to the DLQ
+	PoisonMessageConfig  *PoisonMessageConfig   `json:"PoisonMessageConfig,omitempty" yaml:"PoisonMessageConfig,omitempty"`
+	TapConfig            *TapConfig             `json:"TapConfig,omitempty" yaml:"TapConfig,omitempty"`
+	Marshaller           string                 `json:"Marshaller,omitempty" yaml:"Marshaller,omitempty"` // registered marshaller name used by ReceivedMessage.Unmarshal
+	ProvenanceConfig     *ProvenanceConfig      `json:"ProvenanceConfig,omitempty" yaml:"ProvenanceConfig,omitempty"`
+	AutoDecompress       bool                   `json:"AutoDecompress,omitempty" yaml:"AutoDecompress,omitempty"`       // decode gzip/zstd content-encodings before the handler sees the body
+	MaxProcessingRate    float64                `json:"MaxProcessingRate,omitempty" yaml:"MaxProcessingRate,omitempty"` // msgs/sec handed to the handler, if zero ignored - independent of prefetch
+	ProcessingBurst      int                    `json:"ProcessingBurst,omitempty" yaml:"ProcessingBurst,omitempty"`     // messages allowed at once under MaxProcessingRate, defaults to 1
+	OwnedQueue           *OwnedQueue            `json:"OwnedQueue,omitempty" yaml:"OwnedQueue,omitempty"`               // declared and bound on every (re)start of consuming
+	QueueDeleted         *QueueDeletedConfig    `json:"QueueDeleted,omitempty" yaml:"QueueDeleted,omitempty"`           // resubscribe, recreate or stop when the queue is deleted while consuming
+	Handler              string                 `json:"Handler,omitempty" yaml:"Handler,omitempty"`                     // HandlerRegistry name RabbitService.Start consumes with, empty isn't started
+	Pool                 string                 `json:"Pool,omitempty" yaml:"Pool,omitempty"`                           // named pool of the seasoning's Pools the RabbitService consumes from
+	Polling              *PollingConfig         `json:"Polling,omitempty" yaml:"Polling,omitempty"`                     // basic.get loop when the broker refuses basic.consume
+	MaxClockSkew         uint32                 `json:"MaxClockSkew,omitempty" yaml:"MaxClockSkew,omitempty"`           // ms the EndToEndLatency tolerates stamps in the future, defaults to 1000
 }
 
 // PublisherConfig represents settings for configuring global settings for all Publishers with ease.
 type PublisherConfig struct {
+	Name                   string `json:"Name,omitempty" yaml:"Name,omitempty"` // identifies the publisher in the registry, generated if empty
+	Pool                   string `json:"Pool,omitempty" yaml:"Pool,omitempty"` // named pool of the seasoning's Pools a RabbitService's PublisherConfigs publish on
 	AutoAck                bool   `json:"AutoAck" yaml:"AutoAck"`
 	SleepOnIdleInterval    uint32 `json:"SleepOnIdleInterval" yaml:"SleepOnIdleInterval"`
 	SleepOnErrorInterval   uint32 `json:"SleepOnErrorInterval" yaml:"SleepOnErrorInterval"`
 	PublishTimeOutInterval uint32 `json:"PublishTimeOutInterval" yaml:"PublishTimeOutInterval"`
 	MaxRetryCount          uint32 `json:"MaxRetryCount" yaml:"MaxRetryCount"`
+
+	QueueCapacity int    `json:"QueueCapacity,omitempty" yaml:"QueueCapacity,omitempty"` // letters QueueLetter holds per QueueLane for the auto-publisher, defaults to 1000
+	QueueOverflow string `json:"QueueOverflow,omitempty" yaml:"QueueOverflow,omitempty"` // block (default), error or drop-oldest when the queue is full
+
+	AutoPublishWorkers int `json:"AutoPublishWorkers,omitempty" yaml:"AutoPublishWorkers,omitempty"` // concurrent auto-publishes, defaults to half the pool's MaxCacheChannelCount plus one
+	ConfirmWindow      int `json:"ConfirmWindow,omitempty" yaml:"ConfirmWindow,omitempty"`           // unconfirmed publishes per channel, zero or one publishes one letter per channel at a time
+	StreamWindow       int `json:"StreamWindow,omitempty" yaml:"StreamWindow,omitempty"`             // unconfirmed publishes of PublishToStream, defaults to 1000
+
+	RetryPolicy *RetryPolicy `json:"RetryPolicy,omitempty" yaml:"RetryPolicy,omitempty"` // backoff between retries, nil retries immediately
+	AutoRetry   bool         `json:"AutoRetry,omitempty" yaml:"AutoRetry,omitempty"`     // republishes failed auto-published letters up to their RetryCount, see SetAutoRetry
+
+	ExchangeAliases map[string]*ExchangeAlias `json:"ExchangeAliases,omitempty" yaml:"ExchangeAliases,omitempty"` // logical name -> exchange
+
+	ArchiveSampleRate float64 `json:"ArchiveSampleRate,omitempty" yaml:"ArchiveSampleRate,omitempty"` // percentage (0-100) of letters sent to the ArchiveSink
+	ArchiveBodies     bool    `json:"ArchiveBodies,omitempty" yaml:"ArchiveBodies,omitempty"`         // archive bodies as well as metadata
+
+	Marshaller        string `json:"Marshaller,omitempty" yaml:"Marshaller,omitempty"`               // registered marshaller name (json, gob, flatbuffers, ...)
+	ContentTypePolicy string `json:"ContentTypePolicy,omitempty" yaml:"ContentTypePolicy,omitempty"` // ignore (default), warn or fail on content types not matching the Marshaller
+
+	StatsRoutingKeyLimit int `json:"StatsRoutingKeyLimit,omitempty" yaml:"StatsRoutingKeyLimit,omitempty"` // exchange/routing key pairs tracked by Stats, defaults to 1000
+
+	ProvenanceConfig *ProvenanceConfig `json:"ProvenanceConfig,omitempty" yaml:"ProvenanceConfig,omitempty"` // headers stamped on every letter
+
+	TenantQuota *TenantQuotaConfig `json:"TenantQuota,omitempty" yaml:"TenantQuota,omitempty"` // per tenant limits of the auto-publisher
+
+	RateLimit *PublishRateLimit `json:"RateLimit,omitempty" yaml:"RateLimit,omitempty"` // throttles every publish, direct and auto-publish alike
+
+	VerifyExchanges bool `json:"VerifyExchanges,omitempty" yaml:"VerifyExchanges,omitempty"` // passive declare exchanges on their first publish
+
+	StrictTopology *TopologyConfig `json:"StrictTopology,omitempty" yaml:"StrictTopology,omitempty"` // refuses letters to exchanges it doesn't declare
+	AutoDeclare    *TopologyConfig `json:"AutoDeclare,omitempty" yaml:"AutoDeclare,omitempty"`       // declares the exchange, bindings and queues of the first publish to each exchange/routing key
+
+	BodySizeAlert *BodySizeAlertConfig `json:"BodySizeAlert,omitempty" yaml:"BodySizeAlert,omitempty"` // warns when the p99 body size nears the broker's max_message_size
+
+	StampMessageID   string `json:"StampMessageID,omitempty" yaml:"StampMessageID,omitempty"`     // uuid or ulid, stamped on letters without a MessageID
+	StampTimestamp   bool   `json:"StampTimestamp,omitempty" yaml:"StampTimestamp,omitempty"`     // stamps a UTC Timestamp on letters without one
+	StampPublishedAt bool   `json:"StampPublishedAt,omitempty" yaml:"StampPublishedAt,omitempty"` // stamps the ms publish time for the Consumers' EndToEndLatency
+
+	FallbackExchange *FallbackExchangeConfig `json:"FallbackExchange,omitempty" yaml:"FallbackExchange,omitempty"` // parks nacked and returned letters on an alternate exchange
+
+	NotifyUnknownOutcomes bool `json:"NotifyUnknownOutcomes,omitempty" yaml:"NotifyUnknownOutcomes,omitempty"` // receipts for letters whose channel died before confirming them
+
+	Compression *CompressionConfig `json:"Compression,omitempty" yaml:"Compression,omitempty"` // compresses bodies on publish and stamps content-encoding
+
+	Deduplication *DeduplicationConfig `json:"Deduplication,omitempty" yaml:"Deduplication,omitempty"` // skips letters already published by MessageID/LetterID
+
+	DelayConfig *DelayConfig `json:"DelayConfig,omitempty" yaml:"DelayConfig,omitempty"` // PublishWithDelay topology
+}
+
+// ExchangeAlias maps a logical name referenced by Letters onto an environment specific Exchange.
+// RoutingKeyTemplate is a text/template executed against the Envelope, ex.) "orders.{{.RoutingKey}}".
+// When RoutingKeyTemplate is empty the Envelope's RoutingKey is used as is.
+type ExchangeAlias struct {
+	Exchange           string `json:"Exchange" yaml:"Exchange"`
+	RoutingKeyTemplate string `json:"RoutingKeyTemplate,omitempty" yaml:"RoutingKeyTemplate,omitempty"`
 }
 
 // TopologyConfig allows you to build simple toplogies from a JSON file.
@@ -58,12 +150,18 @@ type TopologyConfig struct {
 	Queues           []*Queue           `json:"Queues" yaml:"Queues"`
 	QueueBindings    []*QueueBinding    `json:"QueueBindings" yaml:"QueueBindings"`
 	ExchangeBindings []*ExchangeBinding `json:"ExchangeBindings" yaml:"ExchangeBindings"`
+	Users            []*User            `json:"Users,omitempty" yaml:"Users,omitempty"` // provisioned through the Topologer's management client
 }
 
 // CompressionConfig allows you to configuration symmetric key encryption based on options
 type CompressionConfig struct {
 	Enabled bool   `json:"Enabled" yaml:"Enabled"`
 	Type    string `json:"Type,omitempty" yaml:"Type,omitempty"`
+
+	// Publisher content-encoding only, letters asking for Envelope.Compression are always compressed.
+	MinSize          int      `json:"MinSize,omitempty" yaml:"MinSize,omitempty"`                   // bytes, smaller bodies are published as is
+	MaxEntropy       float64  `json:"MaxEntropy,omitempty" yaml:"MaxEntropy,omitempty"`             // bits per byte of a body sample, above it the body looks compressed already, defaults to 7.5
+	SkipContentTypes []string `json:"SkipContentTypes,omitempty" yaml:"SkipContentTypes,omitempty"` // media types (ex. image/*) never compressed, defaults to common compressed formats
 }
 
 // EncryptionConfig allows you to configuration symmetric key encryption based on options
@@ -74,4 +172,7 @@ type EncryptionConfig struct {
 	TimeConsideration uint32 `json:"TimeConsideration,omitempty" yaml:"TimeConsideration,omitempty"`
 	MemoryMultiplier  uint32 `json:"" yaml:""`
 	Threads           uint8  `json:"Threads,omitempty" yaml:"Threads,omitempty"`
+	KeyVersion        string `json:"KeyVersion,omitempty" yaml:"KeyVersion,omitempty"` // stamped on transparently encrypted bodies
+
+	PreviousHashkeys map[string][]byte `json:"-" yaml:"-"` // key version -> Hashkey, decrypts bodies encrypted before a key rotation
 }
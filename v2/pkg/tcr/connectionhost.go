@@ -3,6 +3,7 @@ package tcr
 import (
 	"crypto/tls"
 	"errors"
+	"net"
 	"sync"
 	"time"
 
@@ -19,6 +20,11 @@ type ConnectionHost struct {
 	heartbeatInterval  time.Duration
 	connectionTimeout  time.Duration
 	tlsConfig          *TLSConfig
+	tlsReloader        *TLSReloader
+	limits             connectionLimits
+	dial               func(network, addr string) (net.Conn, error)
+	netConn            net.Conn // the latest dialed socket, closed to sever a connection that failed its keepalive probe
+	netConnLock        *sync.Mutex
 	Errors             chan *amqp.Error
 	Blockers           chan amqp.Blocking
 	connLock           *sync.Mutex
@@ -33,6 +39,42 @@ func NewConnectionHost(
 	connectionTimeout time.Duration,
 	tlsConfig *TLSConfig) (*ConnectionHost, error) {
 
+	return newConnectionHost(uri, connectionName, connectionID, heartbeatInterval, connectionTimeout, tlsConfig, nil, nil, connectionLimits{})
+}
+
+// connectionLimits are the frame_max and channel_max a ConnectionHost asks for, zero accepts the server's.
+// The server's limits still cap them, the handshake settles on the lower value.
+type connectionLimits struct {
+	frameMax   int
+	channelMax int
+}
+
+// newConnectionHost creates the ConnectionHost sharing the pool's TLS material.
+func newConnectionHost(
+	uri string,
+	connectionName string,
+	connectionID uint64,
+	heartbeatInterval time.Duration,
+	connectionTimeout time.Duration,
+	tlsConfig *TLSConfig,
+	reloader *TLSReloader,
+	dial func(network, addr string) (net.Conn, error),
+	limits connectionLimits) (*ConnectionHost, error) {
+
+	uri, endpointDial, err := resolveEndpoint(uri, connectionTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// the endpoint named by the URI wins over the pool's dialer
+	if endpointDial != nil {
+		dial = endpointDial
+	}
+
+	if dial == nil {
+		dial = resolvingDial(connectionTimeout)
+	}
+
 	connHost := &ConnectionHost{
 		uri:               uri,
 		connectionName:    connectionName,
@@ -40,10 +82,14 @@ func NewConnectionHost(
 		heartbeatInterval: heartbeatInterval,
 		connectionTimeout: connectionTimeout,
 		tlsConfig:         tlsConfig,
+		tlsReloader:       reloader,
+		limits:            limits,
 		Errors:            make(chan *amqp.Error, 10),
 		Blockers:          make(chan amqp.Blocking, 10),
 		connLock:          &sync.Mutex{},
+		netConnLock:       &sync.Mutex{},
 	}
+	connHost.dial = connHost.trackingDial(dial)
 
 	ok := connHost.Connect()
 	if !ok {
@@ -79,11 +125,19 @@ func (ch *ConnectionHost) ConnectWithErrorHandler(errorHandler func(error)) bool
 	var actualTLSConfig *tls.Config
 	var err error
 
-	if ch.tlsConfig != nil && ch.tlsConfig.EnableTLS {
+	if ch.tlsReloader != nil {
+		actualTLSConfig = ch.tlsReloader.TLSConfig()
+	} else if ch.tlsConfig != nil && ch.tlsConfig.EnableTLS {
 
-		actualTLSConfig, err = CreateTLSConfig(
+		keyLocation := ch.tlsConfig.LocalKeyLocation
+		if keyLocation == "" {
+			keyLocation = ch.tlsConfig.LocalCertLocation
+		}
+
+		actualTLSConfig, err = CreateTLSConfigWithKey(
 			ch.tlsConfig.PEMCertLocation,
-			ch.tlsConfig.LocalCertLocation)
+			ch.tlsConfig.LocalCertLocation,
+			keyLocation)
 		if err != nil {
 			if errorHandler != nil {
 				errorHandler(err)
@@ -94,8 +148,10 @@ func (ch *ConnectionHost) ConnectWithErrorHandler(errorHandler func(error)) bool
 
 	if actualTLSConfig == nil {
 		amqpConn, err = amqp.DialConfig(ch.uri, amqp.Config{
-			Heartbeat: ch.heartbeatInterval,
-			Dial:      amqp.DefaultDial(ch.connectionTimeout),
+			Heartbeat:  ch.heartbeatInterval,
+			ChannelMax: ch.limits.channelMax,
+			FrameSize:  ch.limits.frameMax,
+			Dial:       ch.dial,
 			Properties: amqp.Table{
 				"connection_name": ch.connectionName,
 			},
@@ -103,7 +159,9 @@ func (ch *ConnectionHost) ConnectWithErrorHandler(errorHandler func(error)) bool
 	} else {
 		amqpConn, err = amqp.DialConfig("amqps://"+ch.tlsConfig.CertServerName, amqp.Config{
 			Heartbeat:       ch.heartbeatInterval,
-			Dial:            amqp.DefaultDial(ch.connectionTimeout),
+			ChannelMax:      ch.limits.channelMax,
+			FrameSize:       ch.limits.frameMax,
+			Dial:            ch.dial,
 			TLSClientConfig: actualTLSConfig,
 			Properties: amqp.Table{
 				"connection_name": ch.connectionName,
@@ -152,3 +210,16 @@ func (ch *ConnectionHost) PauseOnFlowControl() {
 		}
 	}
 }
+
+// NegotiatedLimits are the frame_max and channel_max the current connection settled on with the server.
+func (ch *ConnectionHost) NegotiatedLimits() (frameMax int, channelMax int) {
+
+	ch.connLock.Lock()
+	defer ch.connLock.Unlock()
+
+	if ch.Connection == nil {
+		return 0, 0
+	}
+
+	return ch.Connection.Config.FrameSize, ch.Connection.Config.ChannelMax
+}
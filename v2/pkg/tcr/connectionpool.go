@@ -1,15 +1,22 @@
 package tcr
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"net"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/Workiva/go-datastructures/queue"
+	"github.com/houseofcat/turbocookedrabbit/v2/pkg/resilience"
 	"github.com/streadway/amqp"
 )
 
+// minFrameMax is the smallest frame_max AMQP 0-9-1 allows.
+const minFrameMax = 4096
+
 // ConnectionPool houses the pool of RabbitMQ connections.
 type ConnectionPool struct {
 	Config               PoolConfig
@@ -24,6 +31,13 @@ type ConnectionPool struct {
 	sleepOnErrorInterval time.Duration
 	errorHandler         func(error)
 	unhealthyHandler     func(error)
+	tlsReloader          *TLSReloader
+	health               *poolHealth
+	channelMax           *channelMaxState
+	returnSubscribers    *returnSubscribers
+	connectionHosts      []*ConnectionHost // by ConnectionID, for channel distribution policies
+	distributionCounter  uint64
+	keepAlive            *keepAlive
 }
 
 // NewConnectionPool creates hosting structure for the ConnectionPool.
@@ -51,6 +65,14 @@ func NewConnectionPoolWithHandlers(config *PoolConfig, errorHandler func(error),
 		return nil, errors.New("connectionpool maxconnectioncount can't be 0")
 	}
 
+	if config.FrameMax != 0 && config.FrameMax < minFrameMax {
+		return nil, fmt.Errorf("connectionpool framemax can't be below %d", minFrameMax)
+	}
+
+	if config.ChannelMax != 0 && uint64(config.ChannelMax)*config.MaxConnectionCount < config.MaxCacheChannelCount {
+		return nil, fmt.Errorf("connectionpool channelmax %d per connection can't hold %d cached channels", config.ChannelMax, config.MaxCacheChannelCount)
+	}
+
 	cp := &ConnectionPool{
 		Config:               *config,
 		uri:                  config.URI,
@@ -63,12 +85,25 @@ func NewConnectionPoolWithHandlers(config *PoolConfig, errorHandler func(error),
 		sleepOnErrorInterval: time.Duration(config.SleepOnErrorInterval) * time.Millisecond,
 		errorHandler:         errorHandler,
 		unhealthyHandler:     unhealthyHandler,
+		health:               &poolHealth{clock: SystemClock{}, lock: &sync.Mutex{}},
+		channelMax:           &channelMaxState{lock: &sync.Mutex{}},
+		returnSubscribers:    &returnSubscribers{lock: &sync.RWMutex{}},
+	}
+
+	if config.TLSConfig != nil && config.TLSConfig.EnableTLS {
+		reloader, err := NewTLSReloader(config.TLSConfig, errorHandler)
+		if err != nil {
+			return nil, err
+		}
+		cp.tlsReloader = reloader
 	}
 
 	if ok := cp.initializeConnections(); !ok {
 		return nil, errors.New("initialization failed during connection creation")
 	}
 
+	cp.startKeepAlive()
+
 	return cp, nil
 }
 
@@ -76,16 +111,20 @@ func (cp *ConnectionPool) initializeConnections() bool {
 
 	cp.connectionID = 0
 	cp.connections = queue.New(int64(cp.Config.MaxConnectionCount))
+	cp.connectionHosts = make([]*ConnectionHost, 0, cp.Config.MaxConnectionCount)
 
 	for i := uint64(0); i < cp.Config.MaxConnectionCount; i++ {
 
-		connectionHost, err := NewConnectionHost(
+		connectionHost, err := newConnectionHost(
 			cp.uri,
 			cp.Config.ApplicationName+"-"+strconv.FormatUint(cp.connectionID, 10),
 			cp.connectionID,
 			cp.heartbeatInterval,
 			cp.connectionTimeout,
-			cp.Config.TLSConfig)
+			cp.Config.TLSConfig,
+			cp.tlsReloader,
+			cp.createDialer(),
+			connectionLimits{frameMax: int(cp.Config.FrameMax), channelMax: int(cp.Config.ChannelMax)})
 
 		if err != nil {
 			cp.handleError(err)
@@ -96,6 +135,7 @@ func (cp *ConnectionPool) initializeConnections() bool {
 			cp.handleError(err)
 			return false
 		}
+		cp.connectionHosts = append(cp.connectionHosts, connectionHost)
 
 		cp.connectionID++
 	}
@@ -165,17 +205,20 @@ func (cp *ConnectionPool) verifyHealthyConnection(connHost *ConnectionHost) {
 
 func (cp *ConnectionPool) triggerConnectionRecovery(connHost *ConnectionHost) {
 
+	cp.health.recoveryStarted()
+	defer cp.health.recoveryFinished()
+
 	// InfiniteLoop: Stay here till we reconnect.
+	attempt := uint32(1)
 	for {
 		ok := connHost.ConnectWithErrorHandler(cp.unhealthyHandler)
 		if !ok {
-			if cp.sleepOnErrorInterval > 0 {
-				time.Sleep(cp.sleepOnErrorInterval)
-			}
+			attempt = cp.backoff(attempt)
 			continue
 		}
 		break
 	}
+	cp.retried()
 
 	// Flush any pending errors.
 	for {
@@ -208,6 +251,21 @@ func (cp *ConnectionPool) GetChannelFromPool() *ChannelHost {
 	return <-cp.channels
 }
 
+// GetChannelFromPoolWithContext gets a cached ackable channel from the Pool, giving up when the context is done.
+func (cp *ConnectionPool) GetChannelFromPoolWithContext(ctx context.Context) (*ChannelHost, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	select {
+	case chanHost := <-cp.channels:
+		return chanHost, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 // ReturnChannel returns a Channel.
 // If Channel is not a cached channel, it is simply closed here.
 // If Cache Channel, we check if erred, new Channel is created instead and then returned to the cache.
@@ -240,9 +298,13 @@ func (cp *ConnectionPool) reconnectChannel(chanHost *ChannelHost) {
 
 		err := chanHost.MakeChannel() // Creates a new channel and flushes internal buffers automatically.
 		if err != nil {
-			cp.handleError(err)
+			if !cp.backOffOnChannelMax(err) {
+				cp.handleError(err)
+			}
 			continue
 		}
+		cp.channelCreated()
+		cp.watchReturns(chanHost)
 		break
 	}
 }
@@ -252,7 +314,7 @@ func (cp *ConnectionPool) createCacheChannel(id uint64) *ChannelHost {
 
 	// InfiniteLoop: Stay till we have a good channel.
 	for {
-		connHost, err := cp.GetConnection()
+		connHost, pooled, err := cp.distributedConnection(&id, true)
 		if err != nil {
 			cp.handleError(err)
 			continue
@@ -260,12 +322,19 @@ func (cp *ConnectionPool) createCacheChannel(id uint64) *ChannelHost {
 
 		chanHost, err := NewChannelHost(connHost, id, connHost.ConnectionID, true, true)
 		if err != nil {
+			if cp.backOffOnChannelMax(err) {
+				cp.releaseConnection(connHost, pooled, false)
+				continue
+			}
 			cp.handleError(err)
-			cp.ReturnConnection(connHost, true)
+			cp.releaseConnection(connHost, pooled, true)
 			continue
 		}
 
-		cp.ReturnConnection(connHost, false)
+		cp.channelCreated()
+		cp.watchReturns(chanHost)
+		connHost.CachedChannelCount++ // cached channels are only created while initializing
+		cp.releaseConnection(connHost, pooled, false)
 		return chanHost
 	}
 }
@@ -275,7 +344,7 @@ func (cp *ConnectionPool) GetTransientChannel(ackable bool) *amqp.Channel {
 
 	// InfiniteLoop: Stay till we have a good channel.
 	for {
-		connHost, err := cp.GetConnection()
+		connHost, pooled, err := cp.distributedConnection(nil, ackable)
 		if err != nil {
 			cp.handleError(err)
 			continue
@@ -283,12 +352,17 @@ func (cp *ConnectionPool) GetTransientChannel(ackable bool) *amqp.Channel {
 
 		channel, err := connHost.Connection.Channel()
 		if err != nil {
+			if cp.backOffOnChannelMax(err) {
+				cp.releaseConnection(connHost, pooled, false)
+				continue
+			}
 			cp.handleError(err)
-			cp.ReturnConnection(connHost, true)
+			cp.releaseConnection(connHost, pooled, true)
 			continue
 		}
 
-		cp.ReturnConnection(connHost, false)
+		cp.channelCreated()
+		cp.releaseConnection(connHost, pooled, false)
 
 		if ackable {
 			err := channel.Confirm(false)
@@ -333,6 +407,8 @@ func (cp *ConnectionPool) Shutdown() {
 		return
 	}
 
+	cp.stopKeepAlive()
+
 	wg := &sync.WaitGroup{}
 ChannelFlushLoop:
 	for {
@@ -379,6 +455,100 @@ ChannelFlushLoop:
 	cp.connections = queue.New(int64(cp.Config.MaxConnectionCount))
 	cp.flaggedConnections = make(map[uint64]bool)
 	cp.connectionID = 0
+
+	if cp.tlsReloader != nil {
+		cp.tlsReloader.Stop()
+	}
+}
+
+// createDialer determines how connections reach the broker, nil uses the amqp default TCP dialer.
+func (cp *ConnectionPool) createDialer() func(network, addr string) (net.Conn, error) {
+
+	if cp.Config.WebSocketConfig != nil && cp.Config.WebSocketConfig.Enabled {
+		webSocketConfig := cp.Config.WebSocketConfig
+		return func(network, addr string) (net.Conn, error) {
+			return DialWebSocket(webSocketConfig, cp.connectionTimeout)
+		}
+	}
+
+	return nil
+}
+
+// UnhealthyFor returns how long the pool has been recovering connections or failing a Publisher's probes,
+// zero when healthy.
+func (cp *ConnectionPool) UnhealthyFor() time.Duration {
+	return cp.health.unhealthyFor()
+}
+
+// poolHealth tracks connections currently in recovery.
+type poolHealth struct {
+	recovering     int
+	unhealthySince time.Time
+	probeSince     time.Time // first of the consecutive failed probes
+	probeDown      bool      // the probe's FailureThreshold was reached
+	clock          Clock
+	retryPolicy    resilience.Policy
+	lock           *sync.Mutex
+}
+
+func (ph *poolHealth) recoveryStarted() {
+	ph.lock.Lock()
+	defer ph.lock.Unlock()
+
+	if ph.recovering == 0 {
+		ph.unhealthySince = ph.clock.Now()
+	}
+	ph.recovering++
+}
+
+func (ph *poolHealth) recoveryFinished() {
+	ph.lock.Lock()
+	defer ph.lock.Unlock()
+
+	ph.recovering--
+	if ph.recovering == 0 {
+		ph.unhealthySince = time.Time{}
+	}
+}
+
+func (ph *poolHealth) probeFailed() {
+	ph.lock.Lock()
+	defer ph.lock.Unlock()
+
+	ph.probeSince = ph.clock.Now()
+}
+
+func (ph *poolHealth) probeFailing() {
+	ph.lock.Lock()
+	defer ph.lock.Unlock()
+
+	ph.probeDown = true
+}
+
+func (ph *poolHealth) probeRecovered() {
+	ph.lock.Lock()
+	defer ph.lock.Unlock()
+
+	ph.probeSince = time.Time{}
+	ph.probeDown = false
+}
+
+func (ph *poolHealth) unhealthyFor() time.Duration {
+	ph.lock.Lock()
+	defer ph.lock.Unlock()
+
+	var unhealthy time.Duration
+	if ph.recovering > 0 {
+		unhealthy = ph.clock.Now().Sub(ph.unhealthySince)
+	}
+
+	if ph.probeDown {
+		if probing := ph.clock.Now().Sub(ph.probeSince); probing > unhealthy {
+			unhealthy = probing
+		}
+	}
+
+	return unhealthy
 }
 
 func (cp *ConnectionPool) handleError(err error) {
@@ -6,6 +6,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/houseofcat/turbocookedrabbit/v2/pkg/resilience"
 	"github.com/streadway/amqp"
 )
 
@@ -29,13 +30,42 @@ type Consumer struct {
 	noWait               bool
 	args                 amqp.Table
 	qosCountOverride     int
+	processingDeadline   time.Duration
+	progressInterval     time.Duration
+	processingBudget     time.Duration
+	progressHandler      func(*ReceivedMessage, time.Duration)
+	poisonHandler        func(*ReceivedMessage)
+	tap                  func(*ReceivedMessage)
+	marshaller           Marshaller
+	blobStore            BlobStore
+	shutdownHooks        []*shutdownHook
+	recorder             *DeliveryRecorder
+	encryption           *EncryptionConfig
+	rateLimiter          *rateLimiter
+	clock                Clock
+	workers              *workerPool
+	tuner                *AutoTuner
+	consumeChannel       *ChannelHost
+	transactional        bool
+	retryPolicy          resilience.Policy
+	ownedQueue           *OwnedQueue
+	queueDeleted         *QueueDeletedConfig
+	polling              *PollingConfig
+	latency              *latencyStats
+	maxClockSkew         time.Duration
+	watermarks           *watermarks
+	deadLetterScanLimit  int
+	leaseLocker          LeaseLocker
 	conLock              *sync.Mutex
 }
 
 // NewConsumerFromConfig creates a new Consumer to receive messages from a specific queuename.
+// A Marshaller the config names but that isn't registered is reported on Errors, NewConsumer fails instead.
 func NewConsumerFromConfig(config *ConsumerConfig, cp *ConnectionPool) *Consumer {
 
-	return &Consumer{
+	marshaller, marshallerErr := configuredMarshaller(config.Marshaller)
+
+	con := &Consumer{
 		Config:               config,
 		ConnectionPool:       cp,
 		Enabled:              config.Enabled,
@@ -52,8 +82,25 @@ func NewConsumerFromConfig(config *ConsumerConfig, cp *ConnectionPool) *Consumer
 		noWait:               config.NoWait,
 		args:                 amqp.Table(config.Args),
 		qosCountOverride:     config.QosCountOverride,
+		processingDeadline:   time.Duration(config.ProcessingDeadline) * time.Millisecond,
+		progressInterval:     time.Duration(config.ProgressInterval) * time.Millisecond,
+		processingBudget:     time.Duration(config.ProcessingBudget) * time.Millisecond,
+		marshaller:           marshaller,
+		rateLimiter:          newRateLimiter(config.MaxProcessingRate, config.ProcessingBurst),
+		ownedQueue:           config.OwnedQueue,
+		queueDeleted:         config.QueueDeleted,
+		polling:              config.Polling,
+		latency:              newLatencyStats(),
+		maxClockSkew:         maxClockSkew(config.MaxClockSkew),
 		conLock:              &sync.Mutex{},
+		clock:                SystemClock{},
+	}
+
+	if marshallerErr != nil {
+		con.errors <- fmt.Errorf("consumer %q: %w", con.ConsumerName, marshallerErr)
 	}
+
+	return con
 }
 
 // NewConsumer creates a new Consumer to receive messages from a specific queuename.
@@ -76,7 +123,12 @@ func NewConsumer(
 		return nil, fmt.Errorf("consumer %q was not found in config", consumerName)
 	}
 
-	return &Consumer{
+	marshaller, err := configuredMarshaller(config.Marshaller)
+	if err != nil {
+		return nil, fmt.Errorf("consumer %q: %w", consumerName, err)
+	}
+
+	con := &Consumer{
 		Config:               config,
 		ConnectionPool:       cp,
 		Enabled:              true,
@@ -95,8 +147,21 @@ func NewConsumer(
 		noWait:               noWait,
 		args:                 args,
 		qosCountOverride:     qosCountOverride,
+		processingDeadline:   time.Duration(config.ProcessingDeadline) * time.Millisecond,
+		progressInterval:     time.Duration(config.ProgressInterval) * time.Millisecond,
+		processingBudget:     time.Duration(config.ProcessingBudget) * time.Millisecond,
+		marshaller:           marshaller,
+		rateLimiter:          newRateLimiter(config.MaxProcessingRate, config.ProcessingBurst),
+		ownedQueue:           config.OwnedQueue,
+		queueDeleted:         config.QueueDeleted,
+		polling:              config.Polling,
+		latency:              newLatencyStats(),
+		maxClockSkew:         maxClockSkew(config.MaxClockSkew),
 		conLock:              &sync.Mutex{},
-	}, nil
+		clock:                SystemClock{},
+	}
+
+	return con, nil
 }
 
 // Get gets a single message from any queue. Auto-Acknowledges.
@@ -164,6 +229,9 @@ func (con *Consumer) StartConsuming() {
 
 		con.FlushErrors()
 		con.FlushStop()
+		if err := RegisterConsumer(con); err != nil {
+			con.errors <- err
+		}
 
 		go con.startConsumeLoop(nil)
 		con.started = true
@@ -179,6 +247,9 @@ func (con *Consumer) StartConsumingWithAction(action func(*ReceivedMessage)) {
 
 		con.FlushErrors()
 		con.FlushStop()
+		if err := RegisterConsumer(con); err != nil {
+			con.errors <- err
+		}
 
 		go con.startConsumeLoop(action)
 		con.started = true
@@ -187,12 +258,17 @@ func (con *Consumer) StartConsumingWithAction(action func(*ReceivedMessage)) {
 
 func (con *Consumer) startConsumeLoop(action func(*ReceivedMessage)) {
 
+	attempt := uint32(1)
+	recreate := false // the queue was deleted under the recreate policy
+	polling := con.pollsAlways()
+
 ConsumeLoop:
 	for {
 		// Detect if we should stop consuming.
 		select {
 		case stop := <-con.consumeStop:
 			if stop {
+				con.runShutdownHooks()
 				break ConsumeLoop
 			}
 		default:
@@ -200,31 +276,88 @@ ConsumeLoop:
 		}
 
 		// Get ChannelHost
-		chanHost := con.ConnectionPool.GetChannelFromPool()
+		chanHost := con.consumerChannel()
 
 		// Configure RabbitMQ channel QoS for Consumer
 		if con.qosCountOverride > 0 {
 			_ = chanHost.Channel.Qos(con.qosCountOverride, 0, false)
 		}
 
+		con.conLock.Lock()
+		con.consumeChannel = chanHost
+		tuner := con.tuner
+		con.conLock.Unlock()
+
+		if tuner != nil && tuner.config.MaxPrefetch > 0 {
+			_, prefetch := tuner.Current()
+			con.applyPrefetch(prefetch)
+		}
+
+		// (Re)declare the queue the consumer owns, the server deleted it with the old connection.
+		if err := con.declareOwnedQueue(chanHost); err != nil {
+			con.errors <- err
+			con.ConnectionPool.ReturnChannel(chanHost, true)
+			attempt = con.backoff(attempt)
+			continue
+		}
+
+		if recreate {
+			if err := con.recreateQueue(chanHost); err != nil {
+				con.errors <- err
+				con.ConnectionPool.ReturnChannel(chanHost, true)
+				attempt = con.backoff(attempt)
+				continue
+			}
+			recreate = false
+		}
+
+		if polling {
+			if con.pollDeliveries(chanHost, action) {
+				break ConsumeLoop
+			}
+			attempt = con.backoff(attempt)
+			continue
+		}
+
 		// Initiate consuming process.
 		deliveryChan, err := chanHost.Channel.Consume(con.QueueName, con.ConsumerName, con.autoAck, con.exclusive, false, con.noWait, nil)
 		if err != nil {
 			con.ConnectionPool.ReturnChannel(chanHost, true)
-			if con.sleepOnErrorInterval > 0 {
-				time.Sleep(con.sleepOnErrorInterval)
+			if con.fallsBackToPolling(err) {
+				polling = true
+				continue
 			}
+			if isNotFound(err) {
+				var stop bool
+				if stop, recreate = con.handleQueueDeleted(); stop {
+					con.runShutdownHooks()
+					break ConsumeLoop
+				}
+			}
+			attempt = con.backoff(attempt)
 			continue
 		}
+		attempt = 1
+		con.retried()
 
 		// Process delivered messages by the consumer, returns true when we are to stop all consuming.
-		if con.processDeliveries(deliveryChan, chanHost, action) {
+		stop, queueDeleted := con.processDeliveries(deliveryChan, chanHost, action)
+		if stop {
 			break ConsumeLoop
 		}
+
+		if queueDeleted {
+			if stop, recreate = con.handleQueueDeleted(); stop {
+				con.runShutdownHooks()
+				break ConsumeLoop
+			}
+		}
+		attempt = con.backoff(attempt)
 	}
 
 	con.conLock.Lock()
 	immediateStop := con.stopImmediate
+	con.consumeChannel = nil
 	con.conLock.Unlock()
 
 	if !immediateStop {
@@ -237,8 +370,9 @@ ConsumeLoop:
 	con.conLock.Unlock()
 }
 
-// ProcessDeliveries is the inner loop for processing the deliveries and returns true to break outer loop.
-func (con *Consumer) processDeliveries(deliveryChan <-chan amqp.Delivery, chanHost *ChannelHost, action func(*ReceivedMessage)) bool {
+// ProcessDeliveries is the inner loop for processing the deliveries and returns true to break outer loop, or
+// queueDeleted when the server cancelled the consumer because its queue is gone.
+func (con *Consumer) processDeliveries(deliveryChan <-chan amqp.Delivery, chanHost *ChannelHost, action func(*ReceivedMessage)) (stop bool, queueDeleted bool) {
 
 	for {
 		// Listen for channel closure (close errors).
@@ -247,11 +381,8 @@ func (con *Consumer) processDeliveries(deliveryChan <-chan amqp.Delivery, chanHo
 		case errorMessage := <-chanHost.Errors:
 			if errorMessage != nil {
 				con.ConnectionPool.ReturnChannel(chanHost, true)
-				con.errors <- fmt.Errorf("consumer's current channel closed\r\n[reason: %s]\r\n[code: %d]", errorMessage.Reason, errorMessage.Code)
-				if con.sleepOnErrorInterval > 0 {
-					time.Sleep(con.sleepOnErrorInterval)
-				}
-				return false
+				con.errors <- fmt.Errorf("consumer %q current channel closed\r\n[reason: %s]\r\n[code: %d]", con.ConsumerName, errorMessage.Reason, errorMessage.Code)
+				return false, false
 			}
 		default:
 			break
@@ -259,18 +390,20 @@ func (con *Consumer) processDeliveries(deliveryChan <-chan amqp.Delivery, chanHo
 
 		// Convert amqp.Delivery into our internal struct for later use.
 		select {
-		case delivery := <-deliveryChan: // all buffered deliveries are wiped on a channel close error
-
-			msg := NewReceivedMessage(
-				!con.autoAck,
-				delivery)
-
-			if action != nil {
-				action(msg)
-			} else {
-				con.receivedMessages <- msg
+		case delivery, ok := <-deliveryChan: // all buffered deliveries are wiped on a channel close error
+			if !ok {
+				// the server cancelled the consumer, ex. its queue was deleted or a quorum queue lost its leader
+				con.ConnectionPool.ReturnChannel(chanHost, true)
+				exists, err := con.queueExists()
+				if err != nil {
+					con.errors <- err
+				}
+				return false, err == nil && !exists
 			}
 
+			con.recordDelivery(delivery)
+			con.handleDelivery(delivery, action)
+
 		default:
 			if con.sleepOnIdleInterval > 0 {
 				time.Sleep(con.sleepOnIdleInterval)
@@ -282,8 +415,10 @@ func (con *Consumer) processDeliveries(deliveryChan <-chan amqp.Delivery, chanHo
 		select {
 		case stop := <-con.consumeStop:
 			if stop {
+				con.messageGroup.Wait() // workers finish (and ack) their messages before the hooks and the release
+				con.runShutdownHooks()
 				con.ConnectionPool.ReturnChannel(chanHost, false)
-				return true
+				return true, false
 			}
 		default:
 			break
@@ -291,6 +426,57 @@ func (con *Consumer) processDeliveries(deliveryChan <-chan amqp.Delivery, chanHo
 	}
 }
 
+// handleDelivery converts the amqp.Delivery into a ReceivedMessage and hands it to the action or internal buffer.
+func (con *Consumer) handleDelivery(delivery amqp.Delivery, action func(*ReceivedMessage)) {
+
+	con.observeLatency(delivery)
+
+	msg := NewReceivedMessage(
+		!con.autoAck,
+		delivery)
+	msg.marshaller = con.marshaller
+
+	// tapped as it arrived, before the body is restored, decrypted or decompressed
+	con.tapMessage(msg)
+
+	if !con.restoreBody(msg) {
+		return
+	}
+
+	if !con.decryptBody(msg) {
+		return
+	}
+
+	if !con.decompressBody(msg) {
+		return
+	}
+
+	if con.rejectPoisonMessage(msg) {
+		return
+	}
+
+	if con.rejectExhaustedMessage(msg) {
+		return
+	}
+
+	if con.checkProvenance(msg) {
+		return
+	}
+
+	if con.skipProcessed(msg) {
+		return
+	}
+
+	con.throttle()
+
+	if action == nil {
+		con.receivedMessages <- msg
+		return
+	}
+
+	con.dispatch(msg, action)
+}
+
 // StopConsuming allows you to signal stop to the consumer.
 // Will stop on the consumer channelclose or responding to signal after getting all remaining deviveries.
 // FlushMessages empties the internal buffer of messages received by queue. Ackable messages are still in
@@ -305,6 +491,7 @@ func (con *Consumer) StopConsuming(immediate bool, flushMessages bool) error {
 
 	con.stopImmediate = immediate
 	con.consumeStop <- true
+	unregisterConsumer(con)
 
 	// This helps terminate all goroutines trying to add messages too.
 	if flushMessages {
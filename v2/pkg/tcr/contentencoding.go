@@ -0,0 +1,190 @@
+package tcr
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"mime"
+	"strings"
+)
+
+// SetCompression compresses every letter body on publish and stamps the content-encoding, nil (or disabled)
+// only compresses letters asking for it with Envelope.Compression.
+func (pub *Publisher) SetCompression(compression *CompressionConfig) {
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	pub.compression = compression
+}
+
+// compressBody compresses the body per the envelope or the Publisher's CompressionConfig, returning the body
+// and the content encoding to publish.
+func (pub *Publisher) compressBody(letter *Letter, contentType string) ([]byte, string, error) {
+
+	pub.pubRWLock.RLock()
+	compression := pub.compression
+	pub.pubRWLock.RUnlock()
+
+	encoding := letter.Envelope.Compression
+	heuristic := false
+	if encoding == "" && compression != nil && compression.Enabled {
+		if !compression.worthCompressing(letter.Body, contentType) {
+			return letter.Body, "", nil
+		}
+
+		heuristic = true
+		encoding = compression.Type
+		if encoding == "" {
+			encoding = GzipCompressionType
+		}
+	}
+
+	if encoding == "" {
+		return letter.Body, "", nil
+	}
+
+	buffer := acquireBuffer()
+	defer releaseBuffer(buffer)
+
+	var err error
+	switch encoding {
+	case GzipCompressionType:
+		err = CompressWithGzip(letter.Body, buffer)
+	case ZstdCompressionType:
+		err = CompressWithZstd(letter.Body, buffer)
+	default:
+		return nil, "", fmt.Errorf("LetterID: %s asks for unsupported compression %q", letter.LetterID.String(), encoding)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("compressing the body of LetterID: %s failed: %w", letter.LetterID.String(), err)
+	}
+
+	if heuristic && buffer.Len() >= len(letter.Body) {
+		return letter.Body, "", nil // no size benefit
+	}
+
+	// the buffer goes back to the pool, the body is sent (and maybe retried) after this returns
+	body := make([]byte, buffer.Len())
+	copy(body, buffer.Bytes())
+
+	return body, encoding, nil
+}
+
+// DefaultMaxEntropy is the bits per byte above which a body is considered compressed already.
+const DefaultMaxEntropy = 7.5
+
+// entropySampleSize is how much of a body is inspected to estimate its compressibility.
+const entropySampleSize = 4096
+
+// defaultSkipContentTypes are media types that are compressed already.
+var defaultSkipContentTypes = []string{
+	"image/*", "video/*", "audio/*",
+	"application/zip", "application/gzip", "application/x-gzip", "application/zstd",
+	"application/x-7z-compressed", "application/x-bzip2", "application/x-xz", "application/x-rar-compressed",
+}
+
+// worthCompressing skips small bodies, compressed media types and bodies that look random.
+func (cc *CompressionConfig) worthCompressing(body []byte, contentType string) bool {
+
+	if len(body) < cc.MinSize {
+		return false
+	}
+
+	skip := cc.SkipContentTypes
+	if skip == nil {
+		skip = defaultSkipContentTypes
+	}
+	if contentType != "" && matchesMediaType(contentType, skip) {
+		return false
+	}
+
+	maxEntropy := cc.MaxEntropy
+	if maxEntropy == 0 {
+		maxEntropy = DefaultMaxEntropy
+	}
+
+	return sampleEntropy(body) <= maxEntropy
+}
+
+// matchesMediaType compares the media type against patterns, a pattern of type/* matches the whole type.
+func matchesMediaType(contentType string, patterns []string) bool {
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(contentType)
+	}
+
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if pattern == mediaType {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sampleEntropy estimates the Shannon entropy, in bits per byte, of the start of the body.
+func sampleEntropy(body []byte) float64 {
+
+	if len(body) > entropySampleSize {
+		body = body[:entropySampleSize]
+	}
+	if len(body) == 0 {
+		return 0
+	}
+
+	var counts [256]int
+	for _, b := range body {
+		counts[b]++
+	}
+
+	entropy := 0.0
+	size := float64(len(body))
+	for _, count := range counts {
+		if count == 0 {
+			continue
+		}
+		p := float64(count) / size
+		entropy -= p * math.Log2(p)
+	}
+
+	return entropy
+}
+
+// decompressBody decodes gzip and zstd content-encodings when the Consumer is configured to and clears the
+// Delivery's ContentEncoding, false when it failed and the message was nacked.
+func (con *Consumer) decompressBody(msg *ReceivedMessage) bool {
+
+	if !con.Config.AutoDecompress {
+		return true
+	}
+
+	encoding := msg.Delivery.ContentEncoding
+	if encoding != GzipCompressionType && encoding != ZstdCompressionType {
+		return true
+	}
+
+	buffer := bytes.NewBuffer(msg.Body)
+	var err error
+	if encoding == GzipCompressionType {
+		err = DecompressWithGzip(buffer)
+	} else {
+		err = DecompressWithZstd(buffer)
+	}
+
+	if err != nil {
+		con.errors <- fmt.Errorf("consumer %q failed to decompress the %s body of MessageID %s: %w", con.ConsumerName, encoding, msg.MessageID, err)
+		if msg.IsAckable {
+			_ = msg.Nack(false) // a corrupt body won't decompress any better on redelivery
+		}
+		return false
+	}
+
+	msg.Body = buffer.Bytes()
+	msg.Delivery.ContentEncoding = "" // the body isn't encoded anymore
+	return true
+}
@@ -0,0 +1,219 @@
+package tcr
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// dedupCache remembers the most recent keys (least recently seen are evicted first), for ttl when set.
+type dedupCache struct {
+	capacity int
+	ttl      time.Duration
+	order    *list.List
+	keys     map[string]*list.Element
+	lock     *sync.Mutex
+}
+
+func newDedupCache(capacity int) *dedupCache {
+
+	if capacity <= 0 {
+		capacity = 10000
+	}
+
+	return &dedupCache{
+		capacity: capacity,
+		order:    list.New(),
+		keys:     make(map[string]*list.Element, capacity),
+		lock:     &sync.Mutex{},
+	}
+}
+
+type dedupEntry struct {
+	key  string
+	seen time.Time
+}
+
+// add records the key, returning false when it was already seen.
+func (dc *dedupCache) add(key string) bool {
+	return dc.addAt(key, time.Now())
+}
+
+// addAt records the key seen at now, returning false when it was already seen within the ttl.
+func (dc *dedupCache) addAt(key string, now time.Time) bool {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	if element, ok := dc.keys[key]; ok {
+		entry := element.Value.(*dedupEntry)
+		if dc.ttl <= 0 || now.Sub(entry.seen) < dc.ttl {
+			dc.order.MoveToFront(element)
+			return false
+		}
+
+		entry.seen = now
+		dc.order.MoveToFront(element)
+		return true
+	}
+
+	dc.keys[key] = dc.order.PushFront(&dedupEntry{key: key, seen: now})
+	if dc.order.Len() > dc.capacity {
+		oldest := dc.order.Back()
+		dc.order.Remove(oldest)
+		delete(dc.keys, oldest.Value.(*dedupEntry).key)
+	}
+
+	return true
+}
+
+// has reports whether the key was seen within the ttl, without recording it.
+func (dc *dedupCache) has(key string) bool {
+	return dc.hasAt(key, time.Now())
+}
+
+// hasAt reports whether the key was seen within the ttl at now, without recording it.
+func (dc *dedupCache) hasAt(key string, now time.Time) bool {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	element, ok := dc.keys[key]
+	return ok && (dc.ttl <= 0 || now.Sub(element.Value.(*dedupEntry).seen) < dc.ttl)
+}
+
+// remove forgets the key so it may be seen again.
+func (dc *dedupCache) remove(key string) {
+	dc.lock.Lock()
+	defer dc.lock.Unlock()
+
+	if element, ok := dc.keys[key]; ok {
+		dc.order.Remove(element)
+		delete(dc.keys, key)
+	}
+}
+
+// DeduplicationConfig makes the Publisher skip letters whose MessageID (or LetterID without one) it already
+// published, ex. retries of letters whose failure notification was wrong about the original.
+type DeduplicationConfig struct {
+	Window int    `json:"Window,omitempty" yaml:"Window,omitempty"` // most recent ids remembered, defaults to 10000
+	TTL    uint32 `json:"TTL,omitempty" yaml:"TTL,omitempty"`       // ms an id is remembered, zero until evicted
+}
+
+// publishDedup is the Publisher's dedupCache of published ids and the ids of letters still publishing.
+type publishDedup struct {
+	published  *dedupCache
+	publishing map[string]chan struct{} // closed once the letter settled
+	lock       *sync.Mutex
+}
+
+func newPublishDedup(config *DeduplicationConfig) *publishDedup {
+
+	if config == nil {
+		return nil
+	}
+
+	published := newDedupCache(config.Window)
+	published.ttl = time.Duration(config.TTL) * time.Millisecond
+	return &publishDedup{
+		published:  published,
+		publishing: make(map[string]chan struct{}),
+		lock:       &sync.Mutex{},
+	}
+}
+
+// SetDeduplication skips publishing letters whose MessageID/LetterID was published successfully within the
+// window, nil disables it. Skipped letters succeed without being sent and count as Deduplicated in the Stats.
+// A letter whose id is still publishing waits for it to settle, it is skipped once that succeeded and publishes
+// in its place when it failed.
+func (pub *Publisher) SetDeduplication(config *DeduplicationConfig) {
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	pub.dedup = newPublishDedup(config)
+}
+
+// deduplicate claims the letter's id for publishing, reporting whether it was already published. It waits for
+// (or until ctx is done) a letter of the same id still publishing. settle records the outcome of the publish,
+// it is nil when deduplication is disabled or the letter has no id.
+func (pub *Publisher) deduplicate(ctx context.Context, letter *Letter) (settle func(published bool), duplicate bool, err error) {
+
+	pub.pubRWLock.RLock()
+	dedup := pub.dedup
+	pub.pubRWLock.RUnlock()
+
+	if dedup == nil {
+		return nil, false, nil
+	}
+
+	key := dedupKey(letter)
+	if key == "" {
+		return nil, false, nil
+	}
+
+	clock := pub.currentClock()
+	for {
+		dedup.lock.Lock()
+		if dedup.published.hasAt(key, clock.Now()) {
+			dedup.lock.Unlock()
+			pub.stats.deduplicate()
+			return nil, true, nil
+		}
+
+		publishing, ok := dedup.publishing[key]
+		if !ok {
+			break
+		}
+		dedup.lock.Unlock()
+
+		select {
+		case <-publishing:
+		case <-ctx.Done():
+			return nil, false, fmt.Errorf("LetterID: %s waited for the publish of its duplicate: %w", letter.LetterID.String(), ctx.Err())
+		}
+	}
+
+	settled := make(chan struct{})
+	dedup.publishing[key] = settled
+	dedup.lock.Unlock()
+
+	return func(published bool) {
+		dedup.lock.Lock()
+		defer dedup.lock.Unlock()
+
+		if published {
+			dedup.published.addAt(key, clock.Now())
+		}
+		delete(dedup.publishing, key)
+		close(settled)
+	}, false, nil
+}
+
+// forget drops the id of a letter that was published but discarded afterwards (ex. a rolled back transaction).
+func (pub *Publisher) forget(key string) {
+
+	pub.pubRWLock.RLock()
+	dedup := pub.dedup
+	pub.pubRWLock.RUnlock()
+
+	if dedup != nil {
+		dedup.published.remove(key)
+	}
+}
+
+// dedupKey is the letter's MessageID, or its LetterID without one.
+func dedupKey(letter *Letter) string {
+
+	switch {
+	case letter == nil:
+		return ""
+	case letter.Envelope != nil && letter.Envelope.MessageID != "":
+		return letter.Envelope.MessageID
+	case letter.LetterID != uuid.Nil:
+		return letter.LetterID.String()
+	default:
+		return ""
+	}
+}
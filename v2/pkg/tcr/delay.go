@@ -0,0 +1,209 @@
+package tcr
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// DelayModeAuto uses the x-delayed-message exchange when the management API reports the plugin, TTL otherwise.
+	DelayModeAuto = "auto"
+
+	// DelayModePlugin delays with the rabbitmq_delayed_message_exchange plugin.
+	DelayModePlugin = "plugin"
+
+	// DelayModeTTL delays in a wait queue per exchange and delay, dead lettering back to the exchange.
+	DelayModeTTL = "ttl"
+
+	// DefaultDelayPrefix prefixes the names of the delay topology.
+	DefaultDelayPrefix = "tcr.delay"
+
+	delayedExchangeType = "x-delayed-message"
+)
+
+// DelayConfig configures PublishWithDelay.
+type DelayConfig struct {
+	Mode   string `json:"Mode,omitempty" yaml:"Mode,omitempty"`     // auto (default), plugin or ttl
+	Prefix string `json:"Prefix,omitempty" yaml:"Prefix,omitempty"` // delay exchange/queue names, defaults to tcr.delay
+}
+
+// SetManagement lets the Publisher use the management API, ex. to detect the delayed message plugin.
+func (pub *Publisher) SetManagement(management *ManagementClient) {
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	pub.management = management
+}
+
+// PublishWithDelay publishes the letter (with confirmation) so it reaches its exchange only after the delay.
+// The delay topology is declared on first use: with the plugin a delayed exchange per exchange, bound to it,
+// otherwise a wait queue per exchange and delay whose TTL dead letters back to the exchange with the letter's
+// routing key. The default exchange is always delayed with TTL as it can't be bound to.
+func (pub *Publisher) PublishWithDelay(letter *Letter, delay time.Duration) error {
+
+	if letter.Envelope == nil {
+		return fmt.Errorf("LetterID: %s has no envelope to address it with", letter.LetterID.String())
+	}
+
+	if delay <= 0 {
+		return pub.PublishWithConfirmationError(letter, 0)
+	}
+
+	exchange, routingKey, err := pub.resolveAddress(letter.Envelope)
+	if err != nil {
+		return err
+	}
+
+	mode, err := pub.delayMode()
+	if err != nil {
+		return err
+	}
+
+	envelope := *letter.Envelope
+	envelope.Alias = ""
+	envelope.RoutingKey = routingKey
+
+	delayMs := delay.Milliseconds()
+	if mode == DelayModePlugin && exchange != "" {
+		envelope.Exchange, err = pub.declareDelayedExchange(exchange)
+		envelope.Headers = mergeHeaders(envelope.Headers, amqp.Table{"x-delay": delayMs})
+	} else {
+		envelope.Exchange, err = pub.declareWaitQueue(exchange, delayMs)
+	}
+	if err != nil {
+		return err
+	}
+
+	delayed := *letter
+	delayed.Envelope = &envelope
+
+	return pub.PublishWithConfirmationError(&delayed, 0)
+}
+
+// delayMode resolves auto through the management API, caching the outcome.
+func (pub *Publisher) delayMode() (string, error) {
+
+	pub.pubRWLock.RLock()
+	mode := DelayModeAuto
+	if pub.Config != nil && pub.Config.PublisherConfig != nil && pub.Config.PublisherConfig.DelayConfig != nil && pub.Config.PublisherConfig.DelayConfig.Mode != "" {
+		mode = pub.Config.PublisherConfig.DelayConfig.Mode
+	}
+	detected := pub.delayDetected
+	management := pub.management
+	pub.pubRWLock.RUnlock()
+
+	switch mode {
+	case DelayModePlugin, DelayModeTTL:
+		return mode, nil
+	case DelayModeAuto:
+	default:
+		return "", fmt.Errorf("unknown delay mode %q", mode)
+	}
+
+	if detected != "" {
+		return detected, nil
+	}
+
+	detected = DelayModeTTL
+	if management != nil {
+		types, err := management.ExchangeTypes()
+		if err != nil {
+			return "", fmt.Errorf("detecting the delayed message plugin failed: %w", err)
+		}
+		for _, exchangeType := range types {
+			if exchangeType == delayedExchangeType {
+				detected = DelayModePlugin
+			}
+		}
+	}
+
+	pub.pubRWLock.Lock()
+	pub.delayDetected = detected
+	pub.pubRWLock.Unlock()
+
+	return detected, nil
+}
+
+func (pub *Publisher) delayPrefix() string {
+
+	if pub.Config != nil && pub.Config.PublisherConfig != nil && pub.Config.PublisherConfig.DelayConfig != nil && pub.Config.PublisherConfig.DelayConfig.Prefix != "" {
+		return pub.Config.PublisherConfig.DelayConfig.Prefix
+	}
+
+	return DefaultDelayPrefix
+}
+
+// declareDelayedExchange declares the x-delayed-message exchange of the exchange and binds the exchange to it.
+func (pub *Publisher) declareDelayedExchange(exchange string) (string, error) {
+
+	name := pub.delayPrefix() + "." + exchange
+	err := pub.declareDelayTopology(name, func(channel *amqp.Channel) error {
+		err := channel.ExchangeDeclare(name, delayedExchangeType, true, false, false, false, amqp.Table{"x-delayed-type": "topic"})
+		if err != nil {
+			return err
+		}
+
+		return channel.ExchangeBind(exchange, "#", name, false, nil)
+	})
+
+	return name, err
+}
+
+// declareWaitQueue declares the fanout exchange and wait queue of the exchange and delay. The queue dead letters
+// to the exchange once the TTL expired and removes itself when it hasn't been used for a while.
+func (pub *Publisher) declareWaitQueue(exchange string, delayMs int64) (string, error) {
+
+	target := exchange
+	if target == "" {
+		target = "default"
+	}
+
+	name := pub.delayPrefix() + "." + target + "." + strconv.FormatInt(delayMs, 10)
+	err := pub.declareDelayTopology(name, func(channel *amqp.Channel) error {
+		err := channel.ExchangeDeclare(name, amqp.ExchangeFanout, true, false, false, false, nil)
+		if err != nil {
+			return err
+		}
+
+		_, err = channel.QueueDeclare(name, true, false, false, false, amqp.Table{
+			"x-message-ttl":          delayMs,
+			"x-dead-letter-exchange": exchange,
+			"x-expires":              delayMs*2 + time.Hour.Milliseconds(),
+		})
+		if err != nil {
+			return err
+		}
+
+		return channel.QueueBind(name, "", name, false, nil)
+	})
+
+	return name, err
+}
+
+// declareDelayTopology declares the topology once per Publisher on a transient channel.
+func (pub *Publisher) declareDelayTopology(name string, declare func(*amqp.Channel) error) error {
+
+	pub.pubRWLock.RLock()
+	declared := pub.delayTopology[name]
+	pub.pubRWLock.RUnlock()
+
+	if declared {
+		return nil
+	}
+
+	channel := pub.ConnectionPool.GetTransientChannel(false)
+	defer func() { _ = channel.Close() }()
+
+	if err := declare(channel); err != nil {
+		return fmt.Errorf("declaring the delay topology %s failed: %w", name, err)
+	}
+
+	pub.pubRWLock.Lock()
+	pub.delayTopology[name] = true
+	pub.pubRWLock.Unlock()
+
+	return nil
+}
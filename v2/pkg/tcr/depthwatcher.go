@@ -0,0 +1,209 @@
+package tcr
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// QueueDepth is a single observation of a queue.
+type QueueDepth struct {
+	QueueName string
+	Messages  int // ready messages, including unacknowledged ones when read from the management API
+	Consumers int
+	Time      time.Time
+}
+
+// depthWatch is a threshold registered on a queue.
+type depthWatch struct {
+	threshold int
+	callback  func(depth *QueueDepth, above bool)
+	above     bool
+}
+
+// QueueDepthWatcher polls queue depths and invokes callbacks when they cross thresholds, ex. for alerting
+// or scaling up consumers. Depths come from the Topologer's management client when it has one, otherwise
+// from a passive queue declare.
+type QueueDepthWatcher struct {
+	topologer    *Topologer
+	interval     time.Duration
+	watches      map[string][]*depthWatch
+	errorHandler func(error)
+	lock         *sync.Mutex
+	stop         chan struct{}
+	done         *sync.WaitGroup
+	started      bool
+}
+
+// NewQueueDepthWatcher creates a QueueDepthWatcher polling every interval.
+func NewQueueDepthWatcher(top *Topologer, interval time.Duration) *QueueDepthWatcher {
+
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	return &QueueDepthWatcher{
+		topologer: top,
+		interval:  interval,
+		watches:   make(map[string][]*depthWatch),
+		lock:      &sync.Mutex{},
+		done:      &sync.WaitGroup{},
+	}
+}
+
+// OnThreshold registers a callback invoked with above true when the depth of the queue reaches threshold
+// and with above false once it drops back below it. The threshold is at least 1, an empty queue is never above.
+func (w *QueueDepthWatcher) OnThreshold(queueName string, threshold int, callback func(depth *QueueDepth, above bool)) error {
+
+	if threshold < 1 {
+		return fmt.Errorf("queue %s can't be watched for a depth threshold of %d, it has to be at least 1", queueName, threshold)
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.watches[queueName] = append(w.watches[queueName], &depthWatch{
+		threshold: threshold,
+		callback:  callback,
+	})
+
+	return nil
+}
+
+// SetErrorHandler receives the errors of failed polls.
+func (w *QueueDepthWatcher) SetErrorHandler(errorHandler func(error)) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.errorHandler = errorHandler
+}
+
+// Start begins polling.
+func (w *QueueDepthWatcher) Start() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if w.started {
+		return
+	}
+
+	w.started = true
+	w.stop = make(chan struct{})
+	w.done.Add(1)
+	go w.watchLoop(w.stop)
+}
+
+// Stop ends polling and waits for the current poll to finish.
+func (w *QueueDepthWatcher) Stop() {
+	w.lock.Lock()
+	if !w.started {
+		w.lock.Unlock()
+		return
+	}
+
+	w.started = false
+	close(w.stop)
+	w.lock.Unlock()
+
+	w.done.Wait()
+}
+
+// Poll checks every watched queue once.
+func (w *QueueDepthWatcher) Poll() {
+
+	w.lock.Lock()
+	queueNames := make([]string, 0, len(w.watches))
+	for queueName := range w.watches {
+		queueNames = append(queueNames, queueName)
+	}
+	w.lock.Unlock()
+
+	for _, queueName := range queueNames {
+		depth, err := w.queueDepth(queueName)
+		if err != nil {
+			w.handleError(err)
+			continue
+		}
+
+		w.evaluate(depth)
+	}
+}
+
+func (w *QueueDepthWatcher) watchLoop(stop chan struct{}) {
+	defer w.done.Done()
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			w.Poll()
+		}
+	}
+}
+
+func (w *QueueDepthWatcher) queueDepth(queueName string) (*QueueDepth, error) {
+
+	if w.topologer.Management != nil {
+		queue, err := w.topologer.Management.GetQueue(queueName)
+		if err != nil {
+			return nil, err
+		}
+
+		return &QueueDepth{
+			QueueName: queueName,
+			Messages:  queue.Messages,
+			Consumers: queue.Consumers,
+			Time:      time.Now(),
+		}, nil
+	}
+
+	queue, err := w.topologer.InspectQueue(queueName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &QueueDepth{
+		QueueName: queueName,
+		Messages:  queue.Messages,
+		Consumers: queue.Consumers,
+		Time:      time.Now(),
+	}, nil
+}
+
+// evaluate fires the callbacks of the thresholds crossed since the last poll.
+func (w *QueueDepthWatcher) evaluate(depth *QueueDepth) {
+
+	type crossing struct {
+		callback func(*QueueDepth, bool)
+		above    bool
+	}
+
+	w.lock.Lock()
+	crossings := make([]crossing, 0)
+	for _, watch := range w.watches[depth.QueueName] {
+		above := depth.Messages >= watch.threshold
+		if above != watch.above {
+			watch.above = above
+			crossings = append(crossings, crossing{callback: watch.callback, above: above})
+		}
+	}
+	w.lock.Unlock()
+
+	for _, c := range crossings {
+		c.callback(depth, c.above)
+	}
+}
+
+func (w *QueueDepthWatcher) handleError(err error) {
+	w.lock.Lock()
+	errorHandler := w.errorHandler
+	w.lock.Unlock()
+
+	if errorHandler != nil {
+		errorHandler(err)
+	}
+}
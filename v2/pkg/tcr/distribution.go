@@ -0,0 +1,120 @@
+package tcr
+
+import "sync/atomic"
+
+const (
+	// ChannelDistributionSpread round robins every channel over the connections (default).
+	ChannelDistributionSpread = "spread"
+
+	// ChannelDistributionPack fills a connection with ChannelsPerConnection cached channels before using the next.
+	ChannelDistributionPack = "pack"
+
+	// ChannelDistributionDedicatedConfirms keeps confirm mode channels (cached channels and ackable transient
+	// channels) on the first ConfirmConnectionCount connections and consumers and other transient channels on
+	// the rest, so confirm-heavy publishing and consume-heavy channels don't interfere on one connection.
+	ChannelDistributionDedicatedConfirms = "dedicated-confirms"
+)
+
+// distributedConnection picks the connection for the cached channel id or transient channel under the pool's
+// ChannelDistribution. When pooled is true the connection came from the round robin queue and has to be
+// returned to it, otherwise it is shared and must not be.
+func (cp *ConnectionPool) distributedConnection(cacheChannelID *uint64, confirms bool) (connHost *ConnectionHost, pooled bool, err error) {
+
+	count := uint64(len(cp.connectionHosts))
+
+	var index uint64
+	switch cp.Config.ChannelDistribution {
+	case ChannelDistributionPack:
+		if cacheChannelID == nil {
+			break // transient channels are still spread
+		}
+
+		perConnection := cp.Config.ChannelsPerConnection
+		if perConnection == 0 {
+			perConnection = (cp.Config.MaxCacheChannelCount + count - 1) / count
+		}
+		index = *cacheChannelID / perConnection
+		if index >= count {
+			index = count - 1
+		}
+
+		return cp.sharedConnection(index), false, nil
+
+	case ChannelDistributionDedicatedConfirms:
+		confirmCount := cp.Config.ConfirmConnectionCount
+		if confirmCount == 0 {
+			confirmCount = 1
+		}
+		if confirmCount >= count {
+			break // nothing left to dedicate, share them all
+		}
+
+		next := atomic.AddUint64(&cp.distributionCounter, 1)
+		if confirms {
+			index = next % confirmCount
+		} else {
+			index = confirmCount + next%(count-confirmCount)
+		}
+
+		return cp.sharedConnection(index), false, nil
+	}
+
+	connHost, err = cp.GetConnection()
+	return connHost, true, err
+}
+
+// sharedConnection verifies the connection without taking it out of the round robin queue.
+func (cp *ConnectionPool) sharedConnection(index uint64) *ConnectionHost {
+
+	connHost := cp.connectionHosts[index]
+	cp.verifyHealthyConnection(connHost)
+
+	return connHost
+}
+
+// releaseConnection returns a pooled connection to the queue, or only flags a shared one.
+func (cp *ConnectionPool) releaseConnection(connHost *ConnectionHost, pooled bool, flag bool) {
+
+	if pooled {
+		cp.ReturnConnection(connHost, flag)
+		return
+	}
+
+	if flag {
+		cp.flagConnection(connHost.ConnectionID)
+	}
+}
+
+// GetConsumerChannel gets the channel a Consumer consumes on. Under ChannelDistributionDedicatedConfirms it is
+// a channel (without confirm mode) on a connection not dedicated to confirms, closed when returned with
+// ReturnChannel. Otherwise it is a cached channel, just like GetChannelFromPool.
+func (cp *ConnectionPool) GetConsumerChannel() *ChannelHost {
+
+	if cp.Config.ChannelDistribution != ChannelDistributionDedicatedConfirms {
+		return cp.GetChannelFromPool()
+	}
+
+	// InfiniteLoop: Stay till we have a good channel.
+	for {
+		connHost, pooled, err := cp.distributedConnection(nil, false)
+		if err != nil {
+			cp.handleError(err)
+			continue
+		}
+
+		chanHost, err := NewChannelHost(connHost, atomic.AddUint64(&cp.distributionCounter, 1), connHost.ConnectionID, false, false)
+		if err != nil {
+			if cp.backOffOnChannelMax(err) {
+				cp.releaseConnection(connHost, pooled, false)
+				continue
+			}
+			cp.handleError(err)
+			cp.releaseConnection(connHost, pooled, true)
+			continue
+		}
+
+		cp.channelCreated()
+		cp.releaseConnection(connHost, pooled, false)
+		return chanHost
+	}
+}
@@ -0,0 +1,251 @@
+package tcr
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ErrDeadLettersUnseen is a settle that stopped at the scan limit before reaching the end of the dead letter queue,
+// MessageIDs further down the queue weren't seen - see SetDeadLetterScanLimit.
+var ErrDeadLettersUnseen = errors.New("dead letter queue scan limit reached, the rest of the queue was not seen")
+
+// DeathRecord is one entry of the x-death header the broker adds when dead lettering a message.
+type DeathRecord struct {
+	Queue       string
+	Reason      string // rejected, expired, maxlen or delivery_limit
+	Count       int64
+	Exchange    string
+	RoutingKeys []string
+	Time        time.Time
+}
+
+// DeadLetter is a message peeked from a dead letter queue with its decoded failure headers.
+type DeadLetter struct {
+	MessageID        string
+	FirstDeathQueue  string // the queue the message was dead lettered from first
+	FirstDeathReason string
+	Deaths           []*DeathRecord // most recent first
+	Delivery         *amqp.Delivery // settled already, for its body and properties only
+}
+
+// ParseDeaths decodes the x-death header of the delivery, nil when it never was dead lettered.
+func ParseDeaths(delivery *amqp.Delivery) []*DeathRecord {
+
+	entries, ok := delivery.Headers["x-death"].([]interface{})
+	if !ok {
+		return nil
+	}
+
+	deaths := make([]*DeathRecord, 0, len(entries))
+	for _, entry := range entries {
+		table, ok := entry.(amqp.Table)
+		if !ok {
+			continue
+		}
+
+		death := &DeathRecord{}
+		death.Queue, _ = table["queue"].(string)
+		death.Reason, _ = table["reason"].(string)
+		death.Exchange, _ = table["exchange"].(string)
+		death.Time, _ = table["time"].(time.Time)
+
+		switch count := table["count"].(type) {
+		case int64:
+			death.Count = count
+		case int32:
+			death.Count = int64(count)
+		case int:
+			death.Count = int64(count)
+		}
+
+		if keys, ok := table["routing-keys"].([]interface{}); ok {
+			for _, key := range keys {
+				if routingKey, ok := key.(string); ok {
+					death.RoutingKeys = append(death.RoutingKeys, routingKey)
+				}
+			}
+		}
+
+		deaths = append(deaths, death)
+	}
+
+	return deaths
+}
+
+// newDeadLetter decodes the failure headers of the delivery.
+func newDeadLetter(delivery *amqp.Delivery) *DeadLetter {
+
+	deadLetter := &DeadLetter{
+		MessageID: delivery.MessageId,
+		Deaths:    ParseDeaths(delivery),
+		Delivery:  delivery,
+	}
+
+	deadLetter.FirstDeathQueue, _ = delivery.Headers["x-first-death-queue"].(string)
+	deadLetter.FirstDeathReason, _ = delivery.Headers["x-first-death-reason"].(string)
+	if deadLetter.FirstDeathQueue == "" && len(deadLetter.Deaths) > 0 {
+		oldest := deadLetter.Deaths[len(deadLetter.Deaths)-1]
+		deadLetter.FirstDeathQueue = oldest.Queue
+		deadLetter.FirstDeathReason = oldest.Reason
+	}
+
+	return deadLetter
+}
+
+// BrowseDeadLetters peeks at up to max messages of the dead letter queue without removing them.
+func (con *Consumer) BrowseDeadLetters(queueName string, max int) ([]*DeadLetter, error) {
+
+	deadLetters := make([]*DeadLetter, 0, max)
+	_, err := con.InspectQueue(queueName, max, nil, func(delivery *amqp.Delivery) InspectDecision {
+		deadLetters = append(deadLetters, newDeadLetter(delivery))
+		return InspectRequeue
+	})
+
+	return deadLetters, err
+}
+
+// RequeueDeadLetters moves the messages with the MessageIDs from the dead letter queue back to the queue they were
+// first dead lettered from, published on the default exchange with confirmation before they are acked. Up to the
+// scan limit (SetDeadLetterScanLimit) of messages are scanned and the others returned to the queue, when the limit
+// is reached the count is returned with ErrDeadLettersUnseen. The broker appends to x-death
+// if they die again.
+func (con *Consumer) RequeueDeadLetters(queueName string, messageIDs ...string) (int, error) {
+	return con.settleDeadLetters(queueName, messageIDs, true)
+}
+
+// DiscardDeadLetters removes the messages with the MessageIDs from the dead letter queue for good, scanning it like
+// RequeueDeadLetters.
+func (con *Consumer) DiscardDeadLetters(queueName string, messageIDs ...string) (int, error) {
+	return con.settleDeadLetters(queueName, messageIDs, false)
+}
+
+// SetDeadLetterScanLimit sets how many messages RequeueDeadLetters and DiscardDeadLetters get from the dead letter
+// queue at most, every scanned message stays unacked until the scan ends. 0 restores DefaultInspectScanLimit.
+func (con *Consumer) SetDeadLetterScanLimit(limit int) {
+	con.conLock.Lock()
+	defer con.conLock.Unlock()
+
+	con.deadLetterScanLimit = limit
+}
+
+func (con *Consumer) currentDeadLetterScanLimit() int {
+	con.conLock.Lock()
+	defer con.conLock.Unlock()
+
+	if con.deadLetterScanLimit < 1 {
+		return DefaultInspectScanLimit
+	}
+
+	return con.deadLetterScanLimit
+}
+
+func (con *Consumer) settleDeadLetters(queueName string, messageIDs []string, requeue bool) (int, error) {
+
+	if len(messageIDs) == 0 {
+		return 0, errors.New("no MessageIDs given to settle")
+	}
+
+	selected := make(map[string]bool, len(messageIDs))
+	for _, messageID := range messageIDs {
+		selected[messageID] = true
+	}
+
+	channel := con.ConnectionPool.GetTransientChannel(true)
+	defer channel.Close()
+
+	confirmations := channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+	returns := channel.NotifyReturn(make(chan amqp.Return, 1))
+
+	settled := 0
+	held := make([]uint64, 0)
+	defer func() {
+		for _, tag := range held {
+			_ = channel.Nack(tag, false, true)
+		}
+	}()
+
+	for scanned, limit := 0, con.currentDeadLetterScanLimit(); ; scanned++ {
+		if scanned == limit {
+			return settled, ErrDeadLettersUnseen
+		}
+
+		delivery, ok, err := channel.Get(queueName, false)
+		if err != nil {
+			return settled, err
+		}
+
+		if !ok {
+			return settled, nil
+		}
+
+		if !selected[delivery.MessageId] {
+			held = append(held, delivery.DeliveryTag) // held until the end so Get moves on to the next message
+			continue
+		}
+
+		if requeue {
+			if err := republishDeadLetter(channel, confirmations, returns, newDeadLetter(&delivery)); err != nil {
+				held = append(held, delivery.DeliveryTag)
+				return settled, err
+			}
+		}
+
+		if err := delivery.Ack(false); err != nil {
+			return settled, err
+		}
+		settled++
+	}
+}
+
+// republishDeadLetter publishes the dead letter to its original queue, waiting for the confirmation.
+func republishDeadLetter(channel *amqp.Channel, confirmations <-chan amqp.Confirmation, returns <-chan amqp.Return, deadLetter *DeadLetter) error {
+
+	if deadLetter.FirstDeathQueue == "" {
+		return fmt.Errorf("MessageID %s has no x-death header to requeue it by", deadLetter.MessageID)
+	}
+
+	delivery := deadLetter.Delivery
+	err := channel.Publish(
+		"",
+		deadLetter.FirstDeathQueue,
+		true,  // mandatory
+		false, // immediate
+		amqp.Publishing{
+			Headers:         delivery.Headers,
+			ContentType:     delivery.ContentType,
+			ContentEncoding: delivery.ContentEncoding,
+			DeliveryMode:    delivery.DeliveryMode,
+			Priority:        delivery.Priority,
+			CorrelationId:   delivery.CorrelationId,
+			ReplyTo:         delivery.ReplyTo,
+			MessageId:       delivery.MessageId,
+			Timestamp:       delivery.Timestamp,
+			Type:            delivery.Type,
+			UserId:          delivery.UserId,
+			AppId:           delivery.AppId,
+			Body:            delivery.Body,
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	confirmation, ok := <-confirmations
+	if !ok {
+		return fmt.Errorf("channel closed before requeueing MessageID %s was confirmed", deadLetter.MessageID)
+	}
+	if !confirmation.Ack {
+		return fmt.Errorf("requeueing MessageID %s to queue %q was nacked", deadLetter.MessageID, deadLetter.FirstDeathQueue)
+	}
+
+	// The broker sends basic.return before the basic.ack of the same publish.
+	select {
+	case ret := <-returns:
+		return fmt.Errorf("requeueing MessageID %s was returned, queue %q is gone [reason: %s]", deadLetter.MessageID, deadLetter.FirstDeathQueue, ret.ReplyText)
+	default:
+		return nil
+	}
+}
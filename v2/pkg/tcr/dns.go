@@ -0,0 +1,72 @@
+package tcr
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// resolvingDial resolves the host on every dial (every connect and reconnect) instead of reusing an earlier
+// resolution, so a connection follows DNS changes (ex. a Kubernetes service moving to a new pod). Resolved
+// addresses are tried starting from a rotating offset so a dead address isn't always attempted first.
+func resolvingDial(connectionTimeout time.Duration) func(network, addr string) (net.Conn, error) {
+
+	var attempt uint32
+
+	return func(network, addr string) (net.Conn, error) {
+
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(connectionTimeout)
+
+		addresses := []string{host}
+		if net.ParseIP(host) == nil {
+			ctx, cancel := context.WithDeadline(context.Background(), deadline)
+			addresses, err = net.DefaultResolver.LookupHost(ctx, host)
+			cancel()
+			if err != nil {
+				return nil, err
+			}
+
+			if len(addresses) == 0 {
+				return nil, errors.New("no addresses found for host " + host)
+			}
+		}
+
+		offset := int(atomic.AddUint32(&attempt, 1)-1) % len(addresses)
+
+		var lastErr error
+		for i := range addresses {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				break
+			}
+
+			address := addresses[(offset+i)%len(addresses)]
+			conn, err := net.DialTimeout(network, net.JoinHostPort(address, port), remaining)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+
+			// Heartbeating hasn't started yet, don't stall forever on a dead server (cleared by amqp once open).
+			if err := conn.SetDeadline(deadline); err != nil {
+				conn.Close()
+				return nil, err
+			}
+
+			return conn, nil
+		}
+
+		if lastErr == nil {
+			lastErr = errors.New("connection timeout exceeded dialing " + addr)
+		}
+
+		return nil, lastErr
+	}
+}
@@ -0,0 +1,123 @@
+package tcr
+
+import (
+	"fmt"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// HeaderEncryption names the algorithm a letter body was transparently encrypted with.
+	HeaderEncryption = "x-tcr-encryption"
+
+	// HeaderEncryptionKeyVersion is the EncryptionConfig KeyVersion the body was encrypted with.
+	HeaderEncryptionKeyVersion = "x-tcr-encryption-key-version"
+
+	// EncryptionAesGcm is the HeaderEncryption value of AES-GCM encrypted bodies.
+	EncryptionAesGcm = "aes-gcm"
+
+	encryptionNonceSize = 12
+)
+
+// SetEncryption encrypts every letter body on publish when the config is enabled and has a Hashkey.
+// Publishers created from a RabbitSeasoning use its EncryptionConfig.
+func (pub *Publisher) SetEncryption(encryption *EncryptionConfig) {
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	pub.encryption = encryption
+}
+
+// encryptBody encrypts the body and stamps the headers identifying algorithm and key version.
+// Bodies already encrypted as RabbitService payloads are left alone.
+func (pub *Publisher) encryptBody(letter *Letter, body []byte) ([]byte, amqp.Table, error) {
+
+	pub.pubRWLock.RLock()
+	encryption := pub.encryption
+	pub.pubRWLock.RUnlock()
+
+	if letter.encrypted || encryption == nil || !encryption.Enabled || len(encryption.Hashkey) == 0 {
+		return body, nil, nil
+	}
+
+	encrypted, err := EncryptWithAes(body, encryption.Hashkey, encryptionNonceSize)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encrypting the body of LetterID: %s failed: %w", letter.LetterID.String(), err)
+	}
+
+	return encrypted, amqp.Table{
+		HeaderEncryption:           EncryptionAesGcm,
+		HeaderEncryptionKeyVersion: encryption.KeyVersion,
+	}, nil
+}
+
+// mergeHeaders copies the headers with the extra ones added, leaving the letter's own table untouched.
+func mergeHeaders(headers amqp.Table, extra amqp.Table) amqp.Table {
+
+	merged := make(amqp.Table, len(headers)+len(extra))
+	for header, value := range headers {
+		merged[header] = value
+	}
+	for header, value := range extra {
+		merged[header] = value
+	}
+
+	return merged
+}
+
+// SetEncryption lets the Consumer decrypt bodies a Publisher transparently encrypted before the handler sees them.
+func (con *Consumer) SetEncryption(encryption *EncryptionConfig) {
+	con.conLock.Lock()
+	defer con.conLock.Unlock()
+
+	con.encryption = encryption
+}
+
+// decryptBody decrypts bodies carrying HeaderEncryption, false when it failed and the message was nacked.
+func (con *Consumer) decryptBody(msg *ReceivedMessage) bool {
+
+	algorithm, ok := msg.Delivery.Headers[HeaderEncryption].(string)
+	if !ok {
+		return true
+	}
+
+	con.conLock.Lock()
+	encryption := con.encryption
+	con.conLock.Unlock()
+
+	if encryption == nil {
+		return true // hand it over as is, the handler may decrypt it itself
+	}
+
+	version, _ := msg.Delivery.Headers[HeaderEncryptionKeyVersion].(string)
+
+	var err error
+	key := encryption.key(version)
+	if algorithm != EncryptionAesGcm {
+		err = fmt.Errorf("unsupported encryption %q", algorithm)
+	} else if len(key) == 0 {
+		err = fmt.Errorf("no key for key version %q", version)
+	} else {
+		msg.Body, err = DecryptWithAes(msg.Body, key, encryptionNonceSize)
+	}
+
+	if err != nil {
+		con.errors <- fmt.Errorf("consumer %q failed to decrypt the body of MessageID %s: %w", con.ConsumerName, msg.MessageID, err)
+		if msg.IsAckable {
+			_ = msg.Nack(false) // redelivery won't find a better key
+		}
+		return false
+	}
+
+	return true
+}
+
+// key returns the Hashkey of the key version, current or previous.
+func (ec *EncryptionConfig) key(version string) []byte {
+
+	if version == ec.KeyVersion {
+		return ec.Hashkey
+	}
+
+	return ec.PreviousHashkeys[version]
+}
@@ -0,0 +1,78 @@
+package tcr
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// endpointSchemePrefix marks a URI (ex. amqp+unix:///var/run/rabbitmq.sock?vhost=orders) whose endpoint is
+// reached by the registered EndpointDialer named after the plus instead of TCP.
+const endpointSchemePrefix = "amqp+"
+
+// EndpointDialer connects to the endpoint of an amqp+<name> URI, its host and path (ex. a socket file).
+type EndpointDialer func(endpoint string, timeout time.Duration) (net.Conn, error)
+
+var endpointDialers = map[string]EndpointDialer{
+	"unix": func(endpoint string, timeout time.Duration) (net.Conn, error) {
+		return net.DialTimeout("unix", endpoint, timeout)
+	},
+}
+var endpointDialersLock = &sync.RWMutex{}
+
+// RegisterEndpointDialer lets pools reach amqp+<name> URIs through the dialer, ex. a sidecar proxy or an in-memory
+// pipe to an embedded broker in tests. amqp+unix dials unix domain sockets out of the box.
+func RegisterEndpointDialer(name string, dialer EndpointDialer) {
+	endpointDialersLock.Lock()
+	defer endpointDialersLock.Unlock()
+
+	if dialer == nil {
+		delete(endpointDialers, name)
+		return
+	}
+
+	endpointDialers[name] = dialer
+}
+
+// resolveEndpoint turns an amqp+<name> URI into the plain amqp URI carrying its credentials and vhost (the vhost
+// query parameter) and the dial reaching its endpoint, a nil dial for any other URI.
+func resolveEndpoint(uri string, timeout time.Duration) (string, func(network, addr string) (net.Conn, error), error) {
+
+	if !strings.HasPrefix(uri, endpointSchemePrefix) {
+		return uri, nil, nil
+	}
+
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return "", nil, err
+	}
+
+	name := strings.TrimPrefix(parsed.Scheme, endpointSchemePrefix)
+	endpointDialersLock.RLock()
+	dialer, ok := endpointDialers[name]
+	endpointDialersLock.RUnlock()
+	if !ok {
+		return "", nil, fmt.Errorf("no endpoint dialer is registered for scheme %s", parsed.Scheme)
+	}
+
+	endpoint := parsed.Host + parsed.Path
+	if endpoint == "" {
+		return "", nil, fmt.Errorf("uri with scheme %s has no endpoint", parsed.Scheme)
+	}
+
+	amqpURI := &url.URL{
+		Scheme: "amqp",
+		User:   parsed.User,
+		Host:   "localhost", // only named in the handshake, the dialer ignores the address
+	}
+	if vhost := parsed.Query().Get("vhost"); vhost != "" {
+		amqpURI.Path = "/" + vhost
+	}
+
+	return amqpURI.String(), func(network, addr string) (net.Conn, error) {
+		return dialer(endpoint, timeout)
+	}, nil
+}
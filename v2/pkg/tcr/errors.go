@@ -0,0 +1,90 @@
+package tcr
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Typed errors of PublishReceipts (and the *Error publish variants), branch on them with errors.Is.
+var (
+	// ErrChannelAcquire is a publish abandoned waiting for a channel, the context error is still unwrappable.
+	ErrChannelAcquire = errors.New("publisher couldn't acquire a channel")
+
+	// ErrNack is a publish the server nacked (and kept nacking on republish).
+	ErrNack = errors.New("publish was nacked by the server")
+
+	// ErrReturned is a mandatory letter the server returned as unroutable, see ReturnedLetter.Err.
+	ErrReturned = errors.New("letter was returned unroutable by the server")
+
+	// ErrFallback is a nacked letter that was published to the fallback exchange instead, see SetFallbackExchange.
+	ErrFallback = errors.New("letter was published to the fallback exchange")
+
+	// ErrTimeout is a publish whose confirmation wasn't received in time.
+	ErrTimeout = errors.New("publish confirmation timed out")
+
+	// ErrUnknownOutcome is a publish whose channel died before confirming it, the server may or may not have
+	// routed it - republish idempotently (ex. with Deduplication on the consumers) rather than assuming it failed.
+	ErrUnknownOutcome = errors.New("publish outcome is unknown, its channel closed before confirming it")
+
+	// ErrShutdown is a letter refused or abandoned because the publisher is shut down.
+	ErrShutdown = errors.New("publisher is shut down")
+)
+
+// publishError is an error of one or more typed kinds, keeping its cause unwrappable.
+type publishError struct {
+	kinds   []error
+	message string
+	cause   error
+}
+
+// newPublishError formats the message, a cause is appended to it.
+func newPublishError(kinds []error, cause error, format string, args ...interface{}) error {
+
+	message := fmt.Sprintf(format, args...)
+	if cause != nil {
+		message += ": " + cause.Error()
+	}
+
+	return &publishError{kinds: kinds, message: message, cause: cause}
+}
+
+func (pe *publishError) Error() string {
+	return pe.message
+}
+
+// Is matches any of the error's kinds.
+func (pe *publishError) Is(target error) bool {
+	for _, kind := range pe.kinds {
+		if kind == target {
+			return true
+		}
+	}
+	return false
+}
+
+func (pe *publishError) Unwrap() error {
+	return pe.cause
+}
+
+// confirmationTimeout is the ErrTimeout of a letter, also ErrNack when the server nacked it meanwhile.
+func confirmationTimeout(nacked bool, format string, args ...interface{}) error {
+
+	kinds := []error{ErrTimeout}
+	if nacked {
+		kinds = append(kinds, ErrNack)
+		format += " (nacked)"
+	}
+
+	return newPublishError(kinds, nil, format, args...)
+}
+
+// Err is the ErrReturned error of the returned letter.
+func (rl *ReturnedLetter) Err() error {
+
+	var letterID string
+	if rl.Letter != nil {
+		letterID = rl.Letter.LetterID.String()
+	}
+
+	return newPublishError([]error{ErrReturned}, nil, "LetterID: %s was returned by the server [code: %d] %s", letterID, rl.ReplyCode, rl.ReplyText)
+}
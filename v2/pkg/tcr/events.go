@@ -0,0 +1,94 @@
+package tcr
+
+import "time"
+
+// PublisherEventType identifies what happened to a Publisher.
+type PublisherEventType string
+
+const (
+	// PublisherEventFailover is emitted when publishing switches to the standby pool.
+	PublisherEventFailover PublisherEventType = "Failover"
+
+	// PublisherEventFailback is emitted when publishing switches back to the primary pool.
+	PublisherEventFailback PublisherEventType = "Failback"
+
+	// PublisherEventChannelMaxExhausted is emitted when auto-publishing holds letters back because the pool
+	// ran out of channels (channel_max).
+	PublisherEventChannelMaxExhausted PublisherEventType = "ChannelMaxExhausted"
+
+	// PublisherEventChannelMaxRecovered is emitted when auto-publishing resumes after channel_max exhaustion.
+	PublisherEventChannelMaxRecovered PublisherEventType = "ChannelMaxRecovered"
+
+	// PublisherEventTenantQuotaExceeded is emitted when auto-publishing refuses a letter of a tenant over its quota.
+	PublisherEventTenantQuotaExceeded PublisherEventType = "TenantQuotaExceeded"
+
+	// PublisherEventPaused is emitted when auto-publishing is paused.
+	PublisherEventPaused PublisherEventType = "Paused"
+
+	// PublisherEventResumed is emitted when auto-publishing resumes after a pause.
+	PublisherEventResumed PublisherEventType = "Resumed"
+
+	// PublisherEventConfirmationTimeout is emitted when a publish with confirmation gave up, the channel was
+	// released and the letter failed with ErrTimeout.
+	PublisherEventConfirmationTimeout PublisherEventType = "ConfirmationTimeout"
+
+	// PublisherEventProbeFailing is emitted when a Probe failed FailureThreshold times in a row.
+	PublisherEventProbeFailing PublisherEventType = "ProbeFailing"
+
+	// PublisherEventProbeRecovered is emitted when a failing Probe is confirmed again.
+	PublisherEventProbeRecovered PublisherEventType = "ProbeRecovered"
+
+	// PublisherEventBodySizeNearLimit is emitted when the p99 body size reached the BodySizeAlertConfig's limit.
+	PublisherEventBodySizeNearLimit PublisherEventType = "BodySizeNearLimit"
+
+	// PublisherEventBodySizeRecovered is emitted when the p99 body size fell below the limit again.
+	PublisherEventBodySizeRecovered PublisherEventType = "BodySizeRecovered"
+
+	// PublisherEventFallbackFailed is emitted when a returned letter couldn't be published to the fallback exchange.
+	PublisherEventFallbackFailed PublisherEventType = "FallbackFailed"
+)
+
+// PublisherEvent describes a state change of the Publisher.
+type PublisherEvent struct {
+	Type          PublisherEventType
+	PublisherName string
+	Tenant        string // set on tenant quota events
+	Reason        string
+	Time          time.Time
+}
+
+// Events yields the Publisher's state changes. Events are dropped when nobody keeps up with the channel.
+func (pub *Publisher) Events() <-chan *PublisherEvent {
+	return pub.events
+}
+
+// emitEvent sends the event without ever blocking the publisher.
+func (pub *Publisher) emitEvent(eventType PublisherEventType, reason string) {
+
+	pub.sendEvent(&PublisherEvent{
+		Type:          eventType,
+		PublisherName: pub.Name,
+		Reason:        reason,
+		Time:          pub.currentClock().Now().UTC(),
+	})
+}
+
+// emitTenantEvent reports the tenant's quota overflow.
+func (pub *Publisher) emitTenantEvent(tenant string, reason string) {
+
+	pub.sendEvent(&PublisherEvent{
+		Type:          PublisherEventTenantQuotaExceeded,
+		PublisherName: pub.Name,
+		Tenant:        tenant,
+		Reason:        reason,
+		Time:          pub.currentClock().Now().UTC(),
+	})
+}
+
+func (pub *Publisher) sendEvent(event *PublisherEvent) {
+
+	select {
+	case pub.events <- event:
+	default:
+	}
+}
@@ -0,0 +1,102 @@
+package tcr
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// ErrExchangeNotFound is wrapped by the receipt error of letters addressed to an exchange that doesn't exist.
+var ErrExchangeNotFound = errors.New("exchange not found")
+
+// exchangeCache remembers the exchanges a passive declare found, per pool as pools may point at other vhosts.
+type exchangeCache struct {
+	verified map[*ConnectionPool]map[string]bool
+	lock     *sync.Mutex
+}
+
+// SetVerifyExchanges passive declares each exchange the first time it is published to, instead of letting
+// a missing exchange close the channel with an obscure 404 after the publish. Only found exchanges are cached.
+func (pub *Publisher) SetVerifyExchanges(verify bool) {
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	pub.exchangeCache = newExchangeCache(verify)
+}
+
+// newExchangeCache returns nil (no verification) unless verify is set.
+func newExchangeCache(verify bool) *exchangeCache {
+
+	if !verify {
+		return nil
+	}
+
+	return &exchangeCache{
+		verified: make(map[*ConnectionPool]map[string]bool),
+		lock:     &sync.Mutex{},
+	}
+}
+
+// ForgetExchanges clears the verified exchanges, ex. after deleting an exchange the Publisher used.
+func (pub *Publisher) ForgetExchanges() {
+
+	pub.pubRWLock.RLock()
+	cache := pub.exchangeCache
+	pub.pubRWLock.RUnlock()
+
+	if cache == nil {
+		return
+	}
+
+	cache.lock.Lock()
+	cache.verified = make(map[*ConnectionPool]map[string]bool)
+	cache.lock.Unlock()
+}
+
+// verifyExchange fails letters addressed to an exchange the broker doesn't know, the default exchange always exists.
+func (pub *Publisher) verifyExchange(pool *ConnectionPool, letter *Letter, exchange string) error {
+
+	pub.pubRWLock.RLock()
+	cache := pub.exchangeCache
+	pub.pubRWLock.RUnlock()
+
+	if cache == nil || exchange == "" {
+		return nil
+	}
+
+	cache.lock.Lock()
+	verified := cache.verified[pool][exchange]
+	cache.lock.Unlock()
+
+	if verified {
+		return nil
+	}
+
+	// a failed passive declare closes the channel, so never use a cached one
+	channel := pool.GetTransientChannel(false)
+	err := channel.ExchangeDeclarePassive(exchange, "direct" /* ignored when passive */, false, false, false, false, nil)
+	if err == nil {
+		_ = channel.Close()
+	}
+
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound {
+		return fmt.Errorf(
+			"LetterID: %s can't be published, %w: %q (declare it with Topologer.CreateExchange or BuildTopology, or fix the Envelope.Exchange)",
+			letter.LetterID.String(), ErrExchangeNotFound, exchange)
+	}
+	if err != nil {
+		return fmt.Errorf("LetterID: %s failed verifying exchange %q: %w", letter.LetterID.String(), exchange, err)
+	}
+
+	cache.lock.Lock()
+	if cache.verified[pool] == nil {
+		cache.verified[pool] = make(map[string]bool)
+	}
+	cache.verified[pool][exchange] = true
+	cache.lock.Unlock()
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package tcr
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/streadway/amqp"
+)
+
+const (
+	// HeaderFallbackReason is why a letter was published to the fallback exchange, FallbackReasonNack or
+	// FallbackReasonReturned.
+	HeaderFallbackReason = "x-tcr-fallback-reason"
+
+	// HeaderOriginalExchange is the exchange a fallback letter was published to first.
+	HeaderOriginalExchange = "x-tcr-original-exchange"
+
+	// HeaderOriginalRoutingKey is the routing key a fallback letter was published with first.
+	HeaderOriginalRoutingKey = "x-tcr-original-routing-key"
+
+	// HeaderReturnCode is the reply code of the basic.return of a returned fallback letter.
+	HeaderReturnCode = "x-tcr-return-code"
+
+	// HeaderReturnText is the reply text of the basic.return of a returned fallback letter.
+	HeaderReturnText = "x-tcr-return-text"
+
+	// HeaderFailedAt is the unix time in ms the letter was nacked or returned.
+	HeaderFailedAt = "x-tcr-failed-at"
+
+	// FallbackReasonNack is a letter the server nacked.
+	FallbackReasonNack = "nack"
+
+	// FallbackReasonReturned is a mandatory letter the server returned as unroutable.
+	FallbackReasonReturned = "returned"
+)
+
+// FallbackExchangeConfig parks letters the server nacked or returned on an alternate exchange (ex. an unroutable
+// or parking exchange) instead of losing or endlessly republishing them.
+type FallbackExchangeConfig struct {
+	Exchange   string `json:"Exchange" yaml:"Exchange"`
+	RoutingKey string `json:"RoutingKey,omitempty" yaml:"RoutingKey,omitempty"` // defaults to the letter's routing key
+}
+
+// SetFallbackExchange publishes nacked letters (instead of republishing them) and returned mandatory letters to the
+// fallback exchange, with the failure in the HeaderFallbackReason, HeaderOriginalExchange, HeaderOriginalRoutingKey,
+// HeaderFailedAt (and for returns HeaderReturnCode/Text) headers. Fallback publishes are neither mandatory nor
+// confirmed. A nacked letter parked this way fails with ErrNack and ErrFallback, so it isn't retried. Returns are
+// parked from every pool the Publisher watches the returns of - like Returns, Publishers sharing a pool see each
+// other's returns, set the fallback on one of them. Nil stops parking letters.
+func (pub *Publisher) SetFallbackExchange(config *FallbackExchangeConfig) {
+	pub.pubRWLock.Lock()
+	watched := make([]*ConnectionPool, 0, len(pub.returnPools))
+	for pool := range pub.returnPools {
+		watched = append(watched, pool)
+	}
+	pub.fallbackExchange = config
+	pub.pubRWLock.Unlock()
+
+	for _, pool := range watched {
+		pub.watchPoolReturns(pool) // parks their returns from now on
+	}
+}
+
+func (pub *Publisher) fallbackConfig() *FallbackExchangeConfig {
+	pub.pubRWLock.RLock()
+	defer pub.pubRWLock.RUnlock()
+
+	return pub.fallbackExchange
+}
+
+// parkNacked publishes the nacked letter to the fallback exchange instead of republishing it.
+func (pub *Publisher) parkNacked(prepared *preparedLetter, config *FallbackExchangeConfig) error {
+
+	headers := amqp.Table{HeaderFallbackReason: FallbackReasonNack}
+	if err := pub.publishFallback(prepared.pool, config, prepared.exchange, prepared.routingKey, prepared.publishing, headers); err != nil {
+		return newPublishError([]error{ErrNack}, err, "LetterID: %s was nacked, publishing it to the fallback exchange %s failed", prepared.letterID.String(), config.Exchange)
+	}
+
+	return newPublishError([]error{ErrNack, ErrFallback}, nil, "LetterID: %s was nacked and published to the fallback exchange %s", prepared.letterID.String(), config.Exchange)
+}
+
+// parkReturns publishes the pool's returns to the fallback exchange until stopReturns closes the channel.
+func (pub *Publisher) parkReturns(pool *ConnectionPool, returns <-chan *ReturnedLetter) {
+
+	for returned := range returns {
+		config := pub.fallbackConfig()
+		envelope := returned.Letter.Envelope
+		if config == nil || envelope.Exchange == config.Exchange {
+			continue
+		}
+
+		publishing := amqp.Publishing{
+			ContentType:     envelope.ContentType,
+			ContentEncoding: returned.ContentEncoding,
+			CorrelationId:   envelope.CorrelationID,
+			ReplyTo:         envelope.ReplyTo,
+			Expiration:      envelope.Expiration,
+			Timestamp:       envelope.Timestamp,
+			Type:            envelope.Type,
+			UserId:          envelope.UserID,
+			AppId:           envelope.AppID,
+			MessageId:       envelope.MessageID,
+			Headers:         envelope.Headers,
+			DeliveryMode:    envelope.DeliveryMode,
+			Priority:        envelope.Priority,
+			Body:            returned.Letter.Body,
+		}
+		if returned.Letter.LetterID != uuid.Nil {
+			publishing.MessageId = returned.Letter.LetterID.String()
+		}
+
+		headers := amqp.Table{
+			HeaderFallbackReason: FallbackReasonReturned,
+			HeaderReturnCode:     int32(returned.ReplyCode),
+			HeaderReturnText:     returned.ReplyText,
+		}
+		if err := pub.publishFallback(pool, config, envelope.Exchange, envelope.RoutingKey, publishing, headers); err != nil {
+			pub.emitEvent(PublisherEventFallbackFailed, err.Error())
+		}
+	}
+}
+
+// publishFallback publishes a copy of the publishing with the failure headers to the fallback exchange.
+func (pub *Publisher) publishFallback(pool *ConnectionPool, config *FallbackExchangeConfig, exchange string, routingKey string, publishing amqp.Publishing, failure amqp.Table) error {
+
+	failure[HeaderOriginalExchange] = exchange
+	failure[HeaderOriginalRoutingKey] = routingKey
+	failure[HeaderFailedAt] = pub.currentClock().Now().UnixMilli()
+	publishing.Headers = mergeHeaders(publishing.Headers, failure)
+
+	if config.RoutingKey != "" {
+		routingKey = config.RoutingKey
+	}
+
+	chanHost := pool.GetChannelFromPool()
+	err := chanHost.Channel.Publish(config.Exchange, routingKey, false, false, publishing)
+	pool.ReturnChannel(chanHost, err != nil)
+
+	if err != nil {
+		return fmt.Errorf("MessageID %s failed to publish to the fallback exchange %s: %w", publishing.MessageId, config.Exchange, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package tcr
+
+import (
+	"context"
+	"sync"
+)
+
+// pendingLetters counts letters from QueueLetter until the auto-publisher is done with them.
+type pendingLetters struct {
+	count int
+	idle  chan struct{} // closed while count is zero
+	lock  *sync.Mutex
+}
+
+func newPendingLetters() *pendingLetters {
+
+	idle := make(chan struct{})
+	close(idle)
+
+	return &pendingLetters{
+		idle: idle,
+		lock: &sync.Mutex{},
+	}
+}
+
+func (pl *pendingLetters) add() {
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+
+	if pl.count == 0 {
+		pl.idle = make(chan struct{})
+	}
+	pl.count++
+}
+
+func (pl *pendingLetters) done() {
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+
+	pl.count--
+	if pl.count == 0 {
+		close(pl.idle)
+	}
+}
+
+func (pl *pendingLetters) wait(ctx context.Context) error {
+
+	pl.lock.Lock()
+	idle := pl.idle
+	pl.lock.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Flush blocks until every letter queued with QueueLetter has been published and confirmed (or failed, with its
+// receipt sent) or the context is done. Letters queued meanwhile are waited for too. Flushing requires
+// auto-publishing to be running, StopAutoPublishing leaves queued letters behind.
+func (pub *Publisher) Flush(ctx context.Context) error {
+	return pub.pending.wait(ctx)
+}
+
+// GracefulShutdown stops QueueLetter intake (ErrPublisherClosed), publishes the letters still queued and waits for
+// their confirmations and receipts until the context is done, then shuts the Publisher down and closes
+// PublishReceipts so readers can range over it. Auto-publishing is started (or resumed) to flush the queue.
+// When the context ends first the Publisher is shut down anyway, letters still queued are left behind (in the
+// outbox, if any) and PublishReceipts stays open while receipts are on their way to it.
+func (pub *Publisher) GracefulShutdown(ctx context.Context, shutdownPools bool) error {
+
+	pub.pubRWLock.Lock()
+	pub.intakeStopped = true
+	pub.pubRWLock.Unlock()
+
+	pub.Resume()
+	pub.StartAutoPublishing()
+
+	err := pub.Flush(ctx)
+	pub.Shutdown(shutdownPools)
+	if err != nil {
+		return err
+	}
+
+	return pub.closeReceipts(ctx)
+}
+
+// closeReceipts refuses further receipts and closes PublishReceipts once the ones on their way arrived.
+func (pub *Publisher) closeReceipts(ctx context.Context) error {
+
+	pub.pubRWLock.Lock()
+	if pub.receiptsClosed {
+		pub.pubRWLock.Unlock()
+		return nil
+	}
+	pub.receiptsClosed = true
+	pub.pubRWLock.Unlock()
+
+	delivered := make(chan struct{})
+	go func() {
+		pub.receiptGroup.Wait()
+		close(delivered)
+	}()
+
+	select {
+	case <-delivered:
+		close(pub.publishReceipts)
+		return nil
+	case <-ctx.Done():
+		go func() { // close it once the stragglers are read after all
+			<-delivered
+			close(pub.publishReceipts)
+		}()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,214 @@
+package tcr
+
+import (
+	"bytes"
+	"encoding/hex"
+	stdjson "encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/streadway/amqp"
+)
+
+// InspectDecision is what InspectQueue does with an inspected message.
+type InspectDecision int
+
+const (
+	// InspectRequeue returns the message to the queue untouched (peek).
+	InspectRequeue InspectDecision = iota
+
+	// InspectAck removes the message from the queue.
+	InspectAck
+
+	// InspectReject rejects the message without requeue (dead lettered if configured).
+	InspectReject
+)
+
+// DefaultInspectScanLimit is how many messages InspectQueue gets at most when the filter sets no MaxScanned.
+const DefaultInspectScanLimit = 1000
+
+// MessageFilter selects messages by routing key and headers while debugging a queue.
+type MessageFilter struct {
+	RoutingKey string            // topic style pattern, * matches one word and # zero or more
+	Headers    map[string]string // headers that must be present with these (stringified) values
+	MaxScanned int               // messages got (matching or not) before InspectQueue stops, DefaultInspectScanLimit when 0
+}
+
+// scanLimit is how many messages InspectQueue may get from the queue to find max matching ones.
+func (filter *MessageFilter) scanLimit(max int) int {
+
+	limit := DefaultInspectScanLimit
+	if filter != nil && filter.MaxScanned > 0 {
+		limit = filter.MaxScanned
+	}
+
+	if limit < max {
+		return max
+	}
+
+	return limit
+}
+
+// Matches returns true when the delivery passes every condition of the filter.
+func (filter *MessageFilter) Matches(delivery *amqp.Delivery) bool {
+
+	if filter == nil {
+		return true
+	}
+
+	if filter.RoutingKey != "" && !topicMatches(filter.RoutingKey, delivery.RoutingKey) {
+		return false
+	}
+
+	for header, expected := range filter.Headers {
+		value, ok := delivery.Headers[header]
+		if !ok || fmt.Sprint(value) != expected {
+			return false
+		}
+	}
+
+	return true
+}
+
+// topicMatches matches a routing key against a topic exchange style pattern.
+func topicMatches(pattern string, routingKey string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(routingKey, "."))
+}
+
+func matchWords(pattern []string, words []string) bool {
+
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if matchWords(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && matchWords(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && matchWords(pattern[1:], words[1:])
+	}
+}
+
+// InspectQueue gets up to max messages matching the filter from the queue without auto acknowledgement
+// and lets decide (ex. an ack/requeue prompt) settle each one. Messages not matching the filter, and every
+// message when decide is nil (peek mode), are requeued. Non matching messages stay unacked until the scan
+// ends, so the scan stops after the filter's MaxScanned (DefaultInspectScanLimit) messages even when fewer
+// than max matched. Requeued messages keep their position only when no other consumer is active on the queue.
+func (con *Consumer) InspectQueue(
+	queueName string,
+	max int,
+	filter *MessageFilter,
+	decide func(*amqp.Delivery) InspectDecision) (int, error) {
+
+	if max < 1 {
+		return 0, errors.New("can't inspect less than 1 message")
+	}
+
+	channel := con.ConnectionPool.GetTransientChannel(false)
+	defer channel.Close()
+
+	inspected := 0
+	requeue := make([]uint64, 0)
+	for scanned, limit := 0, filter.scanLimit(max); inspected < max && scanned < limit; scanned++ {
+		delivery, ok, err := channel.Get(queueName, false)
+		if err != nil {
+			return inspected, err
+		}
+
+		if !ok {
+			break
+		}
+
+		if !filter.Matches(&delivery) {
+			requeue = append(requeue, delivery.DeliveryTag) // held until the end so Get moves on to the next message
+			continue
+		}
+
+		inspected++
+
+		decision := InspectRequeue
+		if decide != nil {
+			decision = decide(&delivery)
+		}
+
+		switch decision {
+		case InspectAck:
+			err = delivery.Ack(false)
+		case InspectReject:
+			err = delivery.Reject(false)
+		default:
+			requeue = append(requeue, delivery.DeliveryTag)
+		}
+
+		if err != nil {
+			return inspected, err
+		}
+	}
+
+	for _, tag := range requeue {
+		if err := channel.Nack(tag, false, true); err != nil {
+			return inspected, err
+		}
+	}
+
+	return inspected, nil
+}
+
+// FormatDelivery renders a delivery for humans: properties, sorted headers and the body,
+// re-indented when it is JSON, as text when printable and as a hex dump otherwise.
+func FormatDelivery(delivery *amqp.Delivery) string {
+
+	builder := &strings.Builder{}
+	fmt.Fprintf(builder, "Exchange: %q RoutingKey: %q DeliveryTag: %d Redelivered: %v\n", delivery.Exchange, delivery.RoutingKey, delivery.DeliveryTag, delivery.Redelivered)
+	fmt.Fprintf(builder, "MessageId: %s CorrelationId: %s ContentType: %s Timestamp: %s\n", delivery.MessageId, delivery.CorrelationId, delivery.ContentType, delivery.Timestamp.UTC().Format("2006-01-02T15:04:05.000Z"))
+
+	headers := make([]string, 0, len(delivery.Headers))
+	for header := range delivery.Headers {
+		headers = append(headers, header)
+	}
+	sort.Strings(headers)
+
+	for _, header := range headers {
+		fmt.Fprintf(builder, "  %s: %v\n", header, delivery.Headers[header])
+	}
+
+	fmt.Fprintf(builder, "Body (%d bytes):\n%s\n", len(delivery.Body), FormatBody(delivery.Body))
+	return builder.String()
+}
+
+// FormatBody re-indents JSON (keeping the order of its keys and the spelling of its numbers), returns printable
+// UTF-8 as is and hex dumps binary bodies.
+func FormatBody(body []byte) string {
+
+	indented := &bytes.Buffer{}
+	if stdjson.Indent(indented, body, "", "  ") == nil {
+		return indented.String()
+	}
+
+	if utf8.Valid(body) && isPrintable(string(body)) {
+		return string(body)
+	}
+
+	return hex.Dump(body)
+}
+
+func isPrintable(text string) bool {
+
+	for _, r := range text {
+		if r < 0x20 && r != '\n' && r != '\r' && r != '\t' {
+			return false
+		}
+	}
+
+	return true
+}
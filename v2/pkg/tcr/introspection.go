@@ -0,0 +1,62 @@
+package tcr
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// PublishError is the last publish that failed, for probes and dashboards.
+type PublishError struct {
+	LetterID uuid.UUID
+	Err      error
+	Time     time.Time
+}
+
+// QueueDepth is the number of letters queued for auto-publishing over all lanes.
+func (pub *Publisher) QueueDepth() int {
+	return pub.queueDepth()
+}
+
+// InFlightCount is the number of letters being published right now, direct and auto-publishes alike, from
+// entering the middleware until their outcome (with confirmation, their confirmation) is known.
+func (pub *Publisher) InFlightCount() int {
+	return int(atomic.LoadInt32(&pub.inFlight))
+}
+
+// IsAutoPublishing is true while the auto-publisher is running, between StartAutoPublishing and stopping it.
+func (pub *Publisher) IsAutoPublishing() bool {
+	pub.pubLock.Lock()
+	defer pub.pubLock.Unlock()
+
+	return pub.autoStarted
+}
+
+// LastError is the last failed publish, nil when none failed yet.
+func (pub *Publisher) LastError() *PublishError {
+	pub.pubRWLock.RLock()
+	defer pub.pubRWLock.RUnlock()
+
+	if pub.lastError == nil {
+		return nil
+	}
+
+	lastError := *pub.lastError
+	return &lastError
+}
+
+// recordError keeps the failure as the LastError.
+func (pub *Publisher) recordError(letter *Letter, err error) {
+
+	lastError := &PublishError{
+		LetterID: letter.LetterID,
+		Err:      err,
+		Time:     pub.currentClock().Now(),
+	}
+
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	pub.lastError = lastError
+}
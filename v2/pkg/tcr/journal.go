@@ -0,0 +1,191 @@
+package tcr
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ReceiptJournalConfig writes failed PublishReceipts to an append only JSONL file for crash forensics.
+type ReceiptJournalConfig struct {
+	Path       string `json:"Path" yaml:"Path"`
+	MaxSize    int64  `json:"MaxSize" yaml:"MaxSize"`       // bytes before rotating, defaults to 100 MiB
+	MaxBackups int    `json:"MaxBackups" yaml:"MaxBackups"` // rotated files kept as <Path>.1 ... <Path>.N, defaults to 5
+	Sync       bool   `json:"Sync" yaml:"Sync"`             // fsync every entry so it survives a crash of the host
+}
+
+// ReceiptJournalEntry is one failed publish in the journal.
+type ReceiptJournalEntry struct {
+	Time          time.Time `json:"Time"`
+	PublisherName string    `json:"PublisherName"`
+	LetterID      uuid.UUID `json:"LetterID"`
+	Exchange      string    `json:"Exchange,omitempty"`
+	RoutingKey    string    `json:"RoutingKey,omitempty"`
+	RetryCount    uint32    `json:"RetryCount"`
+	Error         string    `json:"Error"`
+}
+
+// ReceiptJournal is a size rotated JSONL file of failed publishes.
+type ReceiptJournal struct {
+	Config *ReceiptJournalConfig
+	file   *os.File
+	size   int64
+	lock   *sync.Mutex
+}
+
+// NewReceiptJournal opens (or creates) the journal for appending.
+func NewReceiptJournal(config *ReceiptJournalConfig) (*ReceiptJournal, error) {
+
+	if config == nil || config.Path == "" {
+		return nil, errors.New("receipt journal requires a path")
+	}
+
+	if config.MaxSize <= 0 {
+		config.MaxSize = 100 * 1024 * 1024
+	}
+
+	if config.MaxBackups <= 0 {
+		config.MaxBackups = 5
+	}
+
+	journal := &ReceiptJournal{
+		Config: config,
+		lock:   &sync.Mutex{},
+	}
+
+	if err := journal.open(); err != nil {
+		return nil, err
+	}
+
+	return journal, nil
+}
+
+// Write appends the entry, rotating the file once it is full.
+func (journal *ReceiptJournal) Write(entry *ReceiptJournalEntry) error {
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+
+	if journal.file == nil {
+		return errors.New("receipt journal is closed")
+	}
+
+	if journal.size > 0 && journal.size+int64(len(data)) > journal.Config.MaxSize {
+		if err := journal.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := journal.file.Write(data)
+	journal.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	if journal.Config.Sync {
+		return journal.file.Sync()
+	}
+
+	return nil
+}
+
+// Close closes the journal file.
+func (journal *ReceiptJournal) Close() error {
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+
+	if journal.file == nil {
+		return nil
+	}
+
+	err := journal.file.Close()
+	journal.file = nil
+	return err
+}
+
+func (journal *ReceiptJournal) open() error {
+
+	file, err := os.OpenFile(journal.Config.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	journal.file = file
+	journal.size = info.Size()
+	return nil
+}
+
+// rotate shifts <Path>.N-1 to <Path>.N ... <Path> to <Path>.1, requires the lock.
+func (journal *ReceiptJournal) rotate() error {
+
+	if err := journal.file.Close(); err != nil {
+		return err
+	}
+	journal.file = nil
+
+	path := journal.Config.Path
+	_ = os.Remove(path + "." + strconv.Itoa(journal.Config.MaxBackups))
+	for i := journal.Config.MaxBackups - 1; i >= 1; i-- {
+		_ = os.Rename(path+"."+strconv.Itoa(i), path+"."+strconv.Itoa(i+1))
+	}
+
+	if err := os.Rename(path, path+".1"); err != nil {
+		return err
+	}
+
+	return journal.open()
+}
+
+// SetReceiptJournal writes every failed PublishReceipt to the journal.
+func (pub *Publisher) SetReceiptJournal(journal *ReceiptJournal) {
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	pub.receiptJournal = journal
+}
+
+// journalFailure records the failed letter, journal errors go to the error handler.
+func (pub *Publisher) journalFailure(letter *Letter, err error) {
+
+	pub.pubRWLock.RLock()
+	journal := pub.receiptJournal
+	errorHandler := pub.errorHandler
+	pub.pubRWLock.RUnlock()
+
+	if journal == nil {
+		return
+	}
+
+	entry := &ReceiptJournalEntry{
+		Time:          pub.currentClock().Now().UTC(),
+		PublisherName: pub.Name,
+		LetterID:      letter.LetterID,
+		RetryCount:    letter.RetryCount,
+		Error:         err.Error(),
+	}
+
+	if letter.Envelope != nil {
+		entry.Exchange = letter.Envelope.Exchange
+		entry.RoutingKey = letter.Envelope.RoutingKey
+	}
+
+	if writeErr := journal.Write(entry); writeErr != nil && errorHandler != nil {
+		errorHandler(writeErr)
+	}
+}
@@ -0,0 +1,150 @@
+package tcr
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// keepAlive periodically probes the pool's connections so sockets silently dropped by a NAT or load balancer
+// are recycled before a publish or consume hits them. Heartbeats alone only notice after two missed intervals.
+type keepAlive struct {
+	interval time.Duration
+	timeout  time.Duration
+	stop     chan struct{}
+	stopOnce *sync.Once
+}
+
+// trackingDial remembers the socket of the latest dial so a probe failure can sever it.
+func (ch *ConnectionHost) trackingDial(dial func(network, addr string) (net.Conn, error)) func(network, addr string) (net.Conn, error) {
+
+	return func(network, addr string) (net.Conn, error) {
+
+		conn, err := dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		ch.netConnLock.Lock()
+		ch.netConn = conn
+		ch.netConnLock.Unlock()
+
+		return conn, nil
+	}
+}
+
+// Probe opens and closes a channel, failing when the broker doesn't answer within the timeout.
+func (ch *ConnectionHost) Probe(timeout time.Duration) error {
+
+	connection := ch.Connection
+	if connection == nil || connection.IsClosed() {
+		return errors.New("connection is closed")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		channel, err := connection.Channel()
+		if err == nil {
+			err = channel.Close()
+		}
+		done <- err
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("no answer from the broker within %s", timeout)
+	}
+}
+
+// sever closes the underlying socket, amqp.Connection.Close would wait on a peer that is gone.
+// Waits up to the timeout for the connection to notice so the next recovery actually reconnects.
+func (ch *ConnectionHost) sever(timeout time.Duration) {
+
+	ch.netConnLock.Lock()
+	conn := ch.netConn
+	ch.netConnLock.Unlock()
+
+	if conn != nil {
+		_ = conn.Close()
+	}
+
+	deadline := time.Now().Add(timeout)
+	for ch.Connection != nil && !ch.Connection.IsClosed() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// startKeepAlive probes every connection each PoolConfig KeepAliveInterval when it is set.
+func (cp *ConnectionPool) startKeepAlive() {
+
+	if cp.Config.KeepAliveInterval == 0 {
+		return
+	}
+
+	timeout := time.Duration(cp.Config.KeepAliveTimeout) * time.Millisecond
+	if timeout == 0 {
+		timeout = cp.connectionTimeout
+	}
+
+	cp.keepAlive = &keepAlive{
+		interval: time.Duration(cp.Config.KeepAliveInterval) * time.Millisecond,
+		timeout:  timeout,
+		stop:     make(chan struct{}),
+		stopOnce: &sync.Once{},
+	}
+
+	go cp.probeConnections(cp.keepAlive)
+}
+
+func (cp *ConnectionPool) probeConnections(ka *keepAlive) {
+
+	ticker := time.NewTicker(ka.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ka.stop:
+			return
+		case <-ticker.C:
+		}
+
+		for _, connHost := range cp.connectionHosts {
+			if connHost.Connection.IsClosed() {
+				continue // already dead, recovery happens on the next GetConnection
+			}
+
+			err := connHost.Probe(ka.timeout)
+			if err == nil {
+				continue
+			}
+
+			select {
+			case <-ka.stop:
+				return // the pool closed the connection under the probe
+			default:
+			}
+
+			if cp.unhealthyHandler != nil {
+				cp.unhealthyHandler(fmt.Errorf("connection %d failed its keepalive probe: %w", connHost.ConnectionID, err))
+			}
+
+			cp.flagConnection(connHost.ConnectionID)
+			connHost.sever(ka.timeout)
+		}
+	}
+}
+
+// stopKeepAlive ends the probing, before Shutdown closes the connections.
+func (cp *ConnectionPool) stopKeepAlive() {
+
+	if cp.keepAlive != nil {
+		cp.keepAlive.stopOnce.Do(func() { close(cp.keepAlive.stop) })
+	}
+}
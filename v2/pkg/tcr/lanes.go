@@ -0,0 +1,232 @@
+package tcr
+
+import (
+	"errors"
+	"sync"
+)
+
+// ConsumerLane is a Consumer taking part in PriorityLanes with its dispatch weight.
+type ConsumerLane struct {
+	Consumer *Consumer // nil for a lane only fed through LaneAction
+	Weight   int       // relative share of dispatches when several lanes have messages waiting
+	Capacity int       // buffered messages before the consumer is held back, defaults to 100
+}
+
+// lane is the buffered state of a ConsumerLane.
+type lane struct {
+	*ConsumerLane
+	buffer        []*ReceivedMessage
+	currentWeight int
+}
+
+// PriorityLanes consumes several queues into one pool of workers. Instead of interleaving deliveries
+// round-robin, waiting messages are dispatched with smooth weighted round-robin so a lane of weight 10
+// gets ten dispatches for every one of a lane of weight 1 while both have work.
+type PriorityLanes struct {
+	lanes   []*lane
+	workers int
+	lock    *sync.Mutex
+	cond    *sync.Cond
+	group   *sync.WaitGroup
+	action  func(*ReceivedMessage)
+	started bool
+	stopped bool
+}
+
+// NewPriorityLanes creates PriorityLanes dispatching to the given number of workers.
+func NewPriorityLanes(workers int, consumerLanes ...*ConsumerLane) (*PriorityLanes, error) {
+
+	if len(consumerLanes) == 0 {
+		return nil, errors.New("priority lanes require at least one consumer lane")
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	lock := &sync.Mutex{}
+	pl := &PriorityLanes{
+		workers: workers,
+		lock:    lock,
+		cond:    sync.NewCond(lock),
+		group:   &sync.WaitGroup{},
+	}
+
+	for _, consumerLane := range consumerLanes {
+		if consumerLane.Weight < 1 {
+			consumerLane.Weight = 1
+		}
+
+		if consumerLane.Capacity < 1 {
+			consumerLane.Capacity = 100
+		}
+
+		pl.lanes = append(pl.lanes, &lane{ConsumerLane: consumerLane})
+	}
+
+	return pl, nil
+}
+
+// StartConsumingWithAction starts every lane's Consumer and the workers invoking the action.
+func (pl *PriorityLanes) StartConsumingWithAction(action func(*ReceivedMessage)) {
+	pl.lock.Lock()
+	if pl.started {
+		pl.lock.Unlock()
+		return
+	}
+
+	pl.started = true
+	pl.stopped = false
+	pl.action = action
+	pl.lock.Unlock()
+
+	for i := 0; i < pl.workers; i++ {
+		pl.group.Add(1)
+		go pl.work(action)
+	}
+
+	for _, l := range pl.lanes {
+		if l.Consumer != nil {
+			l.Consumer.StartConsumingWithAction(pl.LaneAction(l.ConsumerLane))
+		}
+	}
+}
+
+// LaneAction is the action buffering messages on the ConsumerLane, to feed it from elsewhere than its Consumer
+// (ex. Consumer.Replay of a recording). Nil when the lane isn't one of the PriorityLanes.
+func (pl *PriorityLanes) LaneAction(consumerLane *ConsumerLane) func(*ReceivedMessage) {
+
+	for _, l := range pl.lanes {
+		if l.ConsumerLane == consumerLane {
+			l := l
+			return func(msg *ReceivedMessage) {
+				pl.enqueue(l, msg)
+			}
+		}
+	}
+
+	return nil
+}
+
+// StopConsuming stops the Consumers, then the workers once every buffered message was dispatched.
+// An immediate stop instead nacks (with requeue) the buffered ackable messages. A delivery a Consumer was
+// still handing over once the lanes stopped is nacked (with requeue) as well, or - when it can't be nacked -
+// run by the action right away, so nothing is left behind in a buffer no worker drains anymore.
+func (pl *PriorityLanes) StopConsuming(immediate bool) error {
+	pl.lock.Lock()
+	if !pl.started {
+		pl.lock.Unlock()
+		return errors.New("can't stop stopped priority lanes")
+	}
+	pl.lock.Unlock()
+
+	var firstErr error
+	for _, l := range pl.lanes {
+		if l.Consumer == nil {
+			continue
+		}
+		if err := l.Consumer.StopConsuming(immediate, false); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	pl.lock.Lock()
+	pl.stopped = true
+	if immediate {
+		for _, l := range pl.lanes {
+			for _, msg := range l.buffer {
+				if msg.IsAckable {
+					_ = msg.Nack(true)
+				}
+			}
+			l.buffer = nil
+		}
+	}
+	pl.cond.Broadcast()
+	pl.lock.Unlock()
+
+	pl.group.Wait()
+
+	pl.lock.Lock()
+	pl.started = false
+	pl.lock.Unlock()
+
+	return firstErr
+}
+
+// enqueue buffers the message on its lane, holding the consumer back while the lane is full.
+func (pl *PriorityLanes) enqueue(l *lane, msg *ReceivedMessage) {
+	pl.lock.Lock()
+
+	for len(l.buffer) >= l.Capacity && !pl.stopped {
+		pl.cond.Wait()
+	}
+
+	if pl.stopped {
+		// the workers may be gone already
+		action := pl.action
+		pl.lock.Unlock()
+
+		if msg.IsAckable {
+			_ = msg.Nack(true)
+		} else if action != nil {
+			action(msg)
+		}
+		return
+	}
+
+	l.buffer = append(l.buffer, msg)
+	pl.cond.Broadcast()
+	pl.lock.Unlock()
+}
+
+func (pl *PriorityLanes) work(action func(*ReceivedMessage)) {
+	defer pl.group.Done()
+
+	for {
+		pl.lock.Lock()
+		msg := pl.next()
+		for msg == nil {
+			if pl.stopped {
+				pl.lock.Unlock()
+				return
+			}
+
+			pl.cond.Wait()
+			msg = pl.next()
+		}
+		pl.cond.Broadcast() // room for the lane's consumer
+		pl.lock.Unlock()
+
+		action(msg)
+	}
+}
+
+// next pops the message of the lane picked by smooth weighted round-robin, requires the lock.
+func (pl *PriorityLanes) next() *ReceivedMessage {
+
+	var picked *lane
+	total := 0
+	for _, l := range pl.lanes {
+		if len(l.buffer) == 0 {
+			continue
+		}
+
+		l.currentWeight += l.Weight
+		total += l.Weight
+		if picked == nil || l.currentWeight > picked.currentWeight {
+			picked = l
+		}
+	}
+
+	if picked == nil {
+		return nil
+	}
+
+	picked.currentWeight -= total
+	msg := picked.buffer[0]
+	picked.buffer[0] = nil
+	picked.buffer = picked.buffer[1:]
+
+	return msg
+}
@@ -0,0 +1,169 @@
+package tcr
+
+import (
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// HeaderPublishedAt is the unix time in ms the Publisher sent the message at, see SetLatencyStamping.
+	HeaderPublishedAt = "x-tcr-published-at"
+
+	// HeaderBrokerTimestamp is the unix time in ms the broker received the message at, stamped by the
+	// rabbitmq_message_timestamp plugin.
+	HeaderBrokerTimestamp = "timestamp_in_ms"
+
+	// DefaultMaxClockSkew is how far the consumer's clock may run behind the stamping clock.
+	DefaultMaxClockSkew = time.Second
+)
+
+// endToEndLatencyBounds are the upper bounds of the EndToEndLatency buckets, the last bucket is unbounded.
+var endToEndLatencyBounds = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+	30 * time.Second,
+	time.Minute,
+}
+
+// SetLatencyStamping stamps HeaderPublishedAt on every publish, so Consumers measure the EndToEndLatency. Each
+// retry is stamped anew, the latency starts at the publish that was delivered.
+func (pub *Publisher) SetLatencyStamping(enabled bool) {
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	pub.stampPublishedAt = enabled
+}
+
+// stampPublishTime adds HeaderPublishedAt to a copy of the headers, which may be the letter's own.
+func (pub *Publisher) stampPublishTime(headers amqp.Table) amqp.Table {
+
+	pub.pubRWLock.RLock()
+	enabled := pub.stampPublishedAt
+	pub.pubRWLock.RUnlock()
+
+	if !enabled {
+		return headers
+	}
+
+	return mergeHeaders(headers, amqp.Table{HeaderPublishedAt: pub.currentClock().Now().UnixMilli()})
+}
+
+// EndToEndLatency is the time from publishing (or the broker receiving) a message to the Consumer receiving it.
+type EndToEndLatency struct {
+	Latency          *LatencyHistogram
+	BrokerStamped    uint64 // measured from HeaderBrokerTimestamp, which is preferred as only the broker's clock skews
+	PublisherStamped uint64 // measured from HeaderPublishedAt
+	Skewed           uint64 // dropped, the stamp was further in the future than the MaxClockSkew
+}
+
+// latencyStats is the Consumer's EndToEndLatency.
+type latencyStats struct {
+	latency          LatencyHistogram
+	brokerStamped    uint64
+	publisherStamped uint64
+	skewed           uint64
+	lock             *sync.Mutex
+}
+
+func newLatencyStats() *latencyStats {
+	return &latencyStats{
+		latency: LatencyHistogram{Buckets: newLatencyBuckets(endToEndLatencyBounds)},
+		lock:    &sync.Mutex{},
+	}
+}
+
+// observeLatency measures the delivery's latency when it carries a stamp. Stamps ahead of the Consumer's clock by
+// up to the MaxClockSkew are measured as zero latency.
+func (con *Consumer) observeLatency(delivery amqp.Delivery) {
+
+	stampedAt, broker, ok := latencyStamp(delivery.Headers)
+	if !ok {
+		return
+	}
+
+	latency := con.currentClock().Now().Sub(stampedAt)
+
+	con.latency.lock.Lock()
+	defer con.latency.lock.Unlock()
+
+	if latency < 0 {
+		if -latency > con.maxClockSkew {
+			con.latency.skewed++
+			return
+		}
+		latency = 0
+	}
+
+	if broker {
+		con.latency.brokerStamped++
+	} else {
+		con.latency.publisherStamped++
+	}
+
+	con.latency.latency.observe(latency)
+}
+
+// latencyStamp is the broker's timestamp, or else the publisher's, true for the broker's.
+func latencyStamp(headers amqp.Table) (time.Time, bool, bool) {
+
+	if ms, ok := headerMillis(headers[HeaderBrokerTimestamp]); ok {
+		return time.UnixMilli(ms), true, true
+	}
+
+	if ms, ok := headerMillis(headers[HeaderPublishedAt]); ok {
+		return time.UnixMilli(ms), false, true
+	}
+
+	return time.Time{}, false, false
+}
+
+// headerMillis reads a positive ms header.
+func headerMillis(value interface{}) (int64, bool) {
+
+	switch ms := value.(type) {
+	case int64:
+		return ms, ms > 0
+	case int32:
+		return int64(ms), ms > 0
+	case int:
+		return int64(ms), ms > 0
+	case float64: // tables decoded from JSON, ex. replayed recordings
+		return int64(ms), ms > 0
+	default:
+		return 0, false
+	}
+}
+
+// EndToEndLatency is a snapshot of the latencies of the stamped messages the Consumer received.
+func (con *Consumer) EndToEndLatency() *EndToEndLatency {
+	con.latency.lock.Lock()
+	defer con.latency.lock.Unlock()
+
+	latency := con.latency.latency
+	latency.Buckets = append([]LatencyBucket(nil), con.latency.latency.Buckets...)
+
+	return &EndToEndLatency{
+		Latency:          &latency,
+		BrokerStamped:    con.latency.brokerStamped,
+		PublisherStamped: con.latency.publisherStamped,
+		Skewed:           con.latency.skewed,
+	}
+}
+
+// maxClockSkew is the configured ms, or the DefaultMaxClockSkew.
+func maxClockSkew(ms uint32) time.Duration {
+	if ms == 0 {
+		return DefaultMaxClockSkew
+	}
+	return time.Duration(ms) * time.Millisecond
+}
@@ -0,0 +1,139 @@
+package tcr
+
+import (
+	"errors"
+	"net"
+)
+
+// LeakReport cross-references the pool's connections with what the management API reports for them.
+type LeakReport struct {
+	Connections []*ConnectionLeakStatus
+	Orphaned    []*ManagementConnection // broker connections named like the pool's that the pool doesn't hold, ex. left behind by a crash
+}
+
+// ConnectionLeakStatus is a pool connection and its broker side view.
+type ConnectionLeakStatus struct {
+	ConnectionID      uint64
+	ConnectionName    string
+	Broker            *ManagementConnection // nil when the broker doesn't report it, the pool holds a dead connection
+	CachedChannels    int                   // channels the pool caches on the connection
+	UnmanagedChannels int                   // remaining channels open on the broker, consumer and transient channels
+}
+
+// Leaking reports orphaned or missing connections, or connections with more than maxUnmanaged channels
+// open beyond the cached ones (ex. transient channels that are never closed).
+func (report *LeakReport) Leaking(maxUnmanaged int) bool {
+
+	if len(report.Orphaned) > 0 {
+		return true
+	}
+
+	for _, status := range report.Connections {
+		if status.Broker == nil || status.UnmanagedChannels > maxUnmanaged {
+			return true
+		}
+	}
+
+	return false
+}
+
+// LeakReport asks the management API for the broker's connections. Connections are matched by connection_name,
+// and by the client port when the broker sees it (no NAT or proxy in between), as names are shared by every
+// process using the same ApplicationName.
+func (cp *ConnectionPool) LeakReport(mc *ManagementClient) (*LeakReport, error) {
+
+	if mc == nil {
+		return nil, errors.New("leak report requires a management client")
+	}
+
+	brokerConnections, err := mc.ListConnections()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool, len(cp.connectionHosts))
+	for _, connHost := range cp.connectionHosts {
+		names[connHost.connectionName] = true
+	}
+
+	candidates := make([]*ManagementConnection, 0)
+	for _, brokerConnection := range brokerConnections {
+		if names[brokerConnection.ClientProperties.ConnectionName] {
+			candidates = append(candidates, brokerConnection)
+		}
+	}
+
+	report := &LeakReport{Connections: make([]*ConnectionLeakStatus, len(cp.connectionHosts))}
+	matched := make(map[*ManagementConnection]bool, len(candidates))
+
+	// by name and client port first, then by name alone for what's left
+	for _, byPort := range []bool{true, false} {
+		for i, connHost := range cp.connectionHosts {
+			if report.Connections[i] != nil {
+				continue
+			}
+
+			port := connHost.localPort()
+			for _, candidate := range candidates {
+				if matched[candidate] || candidate.ClientProperties.ConnectionName != connHost.connectionName {
+					continue
+				}
+				if byPort && (port == 0 || candidate.PeerPort != port) {
+					continue
+				}
+
+				matched[candidate] = true
+				report.Connections[i] = newConnectionLeakStatus(connHost, candidate)
+				break
+			}
+		}
+	}
+
+	for i, connHost := range cp.connectionHosts {
+		if report.Connections[i] == nil {
+			report.Connections[i] = newConnectionLeakStatus(connHost, nil)
+		}
+	}
+
+	for _, candidate := range candidates {
+		if !matched[candidate] {
+			report.Orphaned = append(report.Orphaned, candidate)
+		}
+	}
+
+	return report, nil
+}
+
+func newConnectionLeakStatus(connHost *ConnectionHost, broker *ManagementConnection) *ConnectionLeakStatus {
+
+	status := &ConnectionLeakStatus{
+		ConnectionID:   connHost.ConnectionID,
+		ConnectionName: connHost.connectionName,
+		Broker:         broker,
+		CachedChannels: int(connHost.CachedChannelCount),
+	}
+
+	if broker != nil && broker.Channels > status.CachedChannels {
+		status.UnmanagedChannels = broker.Channels - status.CachedChannels
+	}
+
+	return status
+}
+
+// localPort is the client side TCP port of the connection, zero when unknown.
+func (ch *ConnectionHost) localPort() int {
+
+	ch.netConnLock.Lock()
+	conn := ch.netConn
+	ch.netConnLock.Unlock()
+
+	if conn == nil {
+		return 0
+	}
+
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		return addr.Port
+	}
+
+	return 0
+}
@@ -0,0 +1,259 @@
+package tcr
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ErrProcessingDeadline is returned when acking a message whose processing deadline already expired.
+var ErrProcessingDeadline = errors.New("processing deadline exceeded, message was already nacked for redelivery")
+
+// ErrLeaseLocked is returned by a LeaseLocker when another consumer holds the lock of the message.
+var ErrLeaseLocked = errors.New("message is locked by the lease of another consumer")
+
+// lease tracks the processing deadline of a ReceivedMessage.
+type lease struct {
+	started  time.Time
+	deadline time.Time
+	settled  bool
+	expired  bool
+	clock    Clock
+	lock     *sync.Mutex
+}
+
+func newLease(clock Clock, deadline time.Duration) *lease {
+	now := clock.Now()
+	return &lease{
+		started:  now,
+		deadline: now.Add(deadline),
+		clock:    clock,
+		lock:     &sync.Mutex{},
+	}
+}
+
+// settle marks the message as acked/nacked, false when the lease already expired.
+func (l *lease) settle() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.expired {
+		return false
+	}
+
+	l.settled = true
+	return true
+}
+
+// expire marks the lease expired if it is past its deadline and hasn't been settled.
+func (l *lease) expire(now time.Time) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.settled || l.expired || now.Before(l.deadline) {
+		return false
+	}
+
+	l.expired = true
+	return true
+}
+
+// ExtendDeadline pushes the processing deadline of the message out by the extension.
+// Long running handlers call this (typically from the progress handler) to keep their lease.
+// Returns false if the message has no deadline or it already expired.
+func (msg *ReceivedMessage) ExtendDeadline(extension time.Duration) bool {
+	if msg.lease == nil {
+		return false
+	}
+
+	msg.lease.lock.Lock()
+	defer msg.lease.lock.Unlock()
+
+	if msg.lease.expired {
+		return false
+	}
+
+	msg.lease.deadline = msg.lease.clock.Now().Add(extension)
+	return true
+}
+
+// Deadline returns the current processing deadline of the message, zero if the consumer has no ProcessingDeadline.
+func (msg *ReceivedMessage) Deadline() time.Time {
+	if msg.lease == nil {
+		return time.Time{}
+	}
+
+	msg.lease.lock.Lock()
+	defer msg.lease.lock.Unlock()
+
+	return msg.lease.deadline
+}
+
+// settleLease must succeed before a message can be acked, nacked or rejected.
+func (msg *ReceivedMessage) settleLease() error {
+	if msg.lease != nil && !msg.lease.settle() {
+		return ErrProcessingDeadline
+	}
+
+	return nil
+}
+
+// SetProgressHandler registers a callback invoked every ProgressInterval while a handler is processing a message.
+// The callback receives the elapsed processing time and can call ExtendDeadline on the message.
+func (con *Consumer) SetProgressHandler(progressHandler func(*ReceivedMessage, time.Duration)) {
+	con.conLock.Lock()
+	defer con.conLock.Unlock()
+
+	con.progressHandler = progressHandler
+}
+
+// SetLeaseLocker locks every message (with a MessageID) for as long as it is processed under a
+// ProcessingDeadline, so a redelivery after the deadline passed isn't processed elsewhere meanwhile. Locked
+// messages are requeued after a ProgressInterval, nil disables locking.
+func (con *Consumer) SetLeaseLocker(locker LeaseLocker) {
+	con.conLock.Lock()
+	defer con.conLock.Unlock()
+
+	con.leaseLocker = locker
+}
+
+// actWithLease runs the action while a watchdog reports progress and enforces the processing deadline.
+// When the deadline passes without an extension the message is nacked (requeued) and the action's own
+// ack will return ErrProcessingDeadline. Without a LeaseLocker the lease is local to this consumer and
+// another one may process the redelivery meanwhile.
+func (con *Consumer) actWithLease(msg *ReceivedMessage, action func(*ReceivedMessage)) {
+
+	clock := con.currentClock()
+
+	con.conLock.Lock()
+	progressHandler := con.progressHandler
+	locker := con.leaseLocker
+	con.conLock.Unlock()
+
+	interval := con.progressInterval
+	if interval <= 0 {
+		interval = con.processingDeadline / 4
+	}
+
+	if locker != nil && msg.MessageID != "" {
+		unlock, err := locker.Lock(con.QueueName, msg.MessageID)
+		switch {
+		case errors.Is(err, ErrLeaseLocked):
+			<-clock.After(interval) // the lock holder likely needs a while, don't spin
+			if msg.IsAckable {
+				if err := msg.Nack(true); err != nil {
+					con.errors <- err
+				}
+			}
+			return
+		case err != nil:
+			con.errors <- fmt.Errorf("consumer %q can't lock MessageID %s, processing it unlocked: %w", con.ConsumerName, msg.MessageID, err)
+		default:
+			defer unlock()
+		}
+	}
+
+	msg.lease = newLease(clock, con.processingDeadline)
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-clock.After(interval):
+				now := clock.Now()
+				if progressHandler != nil {
+					progressHandler(msg, now.Sub(msg.lease.started))
+				}
+
+				if msg.lease.expire(now) {
+					con.errors <- fmt.Errorf("consumer %q exceeded processing deadline for MessageID %s", con.ConsumerName, msg.MessageID)
+					if msg.IsAckable && msg.Delivery.Acknowledger != nil {
+						if err := msg.Delivery.Acknowledger.Nack(msg.Delivery.DeliveryTag, false, true); err != nil {
+							con.errors <- err
+						}
+					}
+					return
+				}
+			}
+		}
+	}()
+
+	action(msg)
+	close(done)
+	<-stopped // the watchdog's nack is done before the message counts as handled
+}
+
+// LeaseLocker holds a lock per message across consumers (and processes) while it is processed.
+type LeaseLocker interface {
+	Lock(queueName string, messageID string) (unlock func(), err error) // ErrLeaseLocked when held elsewhere
+}
+
+// QueueLeaseLocker locks a message by declaring an exclusive lock queue named after it, which the broker
+// refuses to declare on other connections. The lock is released by deleting the queue and by the broker when
+// the connection dies, so a crashed consumer doesn't keep its messages locked.
+type QueueLeaseLocker struct {
+	ConnectionPool *ConnectionPool
+}
+
+// heldLeaseLocks are the lock queues declared by this process, whose consumers may share the connection
+// a lock queue is exclusive to.
+var heldLeaseLocks = struct {
+	names map[string]bool
+	lock  *sync.Mutex
+}{names: make(map[string]bool), lock: &sync.Mutex{}}
+
+// NewQueueLeaseLocker creates a QueueLeaseLocker declaring the lock queues on the ConnectionPool.
+func NewQueueLeaseLocker(cp *ConnectionPool) *QueueLeaseLocker {
+	return &QueueLeaseLocker{ConnectionPool: cp}
+}
+
+// Lock declares the lock queue of the message, ErrLeaseLocked when it is exclusive to another connection.
+func (locker *QueueLeaseLocker) Lock(queueName string, messageID string) (func(), error) {
+
+	name := LeaseLockQueueName(queueName, messageID)
+
+	heldLeaseLocks.lock.Lock()
+	if heldLeaseLocks.names[name] {
+		heldLeaseLocks.lock.Unlock()
+		return nil, ErrLeaseLocked
+	}
+	heldLeaseLocks.names[name] = true
+	heldLeaseLocks.lock.Unlock()
+
+	release := func() {
+		heldLeaseLocks.lock.Lock()
+		delete(heldLeaseLocks.names, name)
+		heldLeaseLocks.lock.Unlock()
+	}
+
+	channel := locker.ConnectionPool.GetTransientChannel(false)
+	if _, err := channel.QueueDeclare(name, false, false, true, false, nil); err != nil {
+		release()
+
+		var amqpErr *amqp.Error
+		if errors.As(err, &amqpErr) && amqpErr.Code == amqp.ResourceLocked {
+			return nil, ErrLeaseLocked
+		}
+		return nil, err
+	}
+
+	return func() {
+		defer release()
+		defer channel.Close()
+
+		_, _ = channel.QueueDelete(name, false, false, false)
+	}, nil
+}
+
+// LeaseLockQueueName is the name of the lock queue of a message of the queue.
+func LeaseLockQueueName(queueName string, messageID string) string {
+	return "tcr.lease." + queueName + "." + messageID
+}
@@ -1,6 +1,8 @@
 package tcr
 
 import (
+	"time"
+
 	"github.com/google/uuid"
 	"github.com/streadway/amqp"
 )
@@ -9,22 +11,35 @@ import (
 type Letter struct {
 	LetterID   uuid.UUID
 	RetryCount uint32
+	Sequence   uint64    // producer defined position (ex. a changefeed offset) recorded in the SequenceStore once confirmed
+	Lane       QueueLane // auto-publish lane QueueLetter puts the letter in
 	Body       []byte
 	Envelope   *Envelope
+	encrypted  bool   // the body already is an encrypted RabbitService payload
+	retries    uint32 // of SetAutoRetry so far
 }
 
 // Envelope contains all the address details of where a letter is going.
 type Envelope struct {
+	Alias         string // logical exchange name resolved by the Publisher, overrides Exchange
+	Pool          string // named ConnectionPool from the Publisher's PoolManager, empty uses the Publisher's pool
 	Exchange      string
 	RoutingKey    string
 	ContentType   string
 	CorrelationID string
+	ReplyTo       string
+	Expiration    string    // per message TTL in milliseconds, ex. "60000"
+	MessageID     string    // overrides the LetterID, receipts still use the LetterID but Returns can't link back to it
+	Timestamp     time.Time // zero publishes the current time
 	Type          string
+	UserID        string // must match the authenticated user when set
+	AppID         string // defaults to the pool's ApplicationName
 	Mandatory     bool
 	Immediate     bool
 	Headers       amqp.Table
 	DeliveryMode  uint8
 	Priority      uint8
+	Compression   string // gzip or zstd compresses the body on publish, overrides the Publisher's CompressionConfig
 }
 
 // WrappedBody is to go inside a Letter struct with indications of the body of data being modified (ex., compressed).
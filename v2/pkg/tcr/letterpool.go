@@ -0,0 +1,76 @@
+package tcr
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// maxPooledBufferSize keeps the odd huge body from pinning its buffer in the pool.
+const maxPooledBufferSize = 1 << 20
+
+var letterPool = sync.Pool{
+	New: func() interface{} {
+		return &Letter{Envelope: &Envelope{}}
+	},
+}
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return &bytes.Buffer{}
+	},
+}
+
+// AcquireLetter takes a Letter with a new LetterID and an empty Envelope from the pool, saving the two allocations
+// per publish on hot paths. Body keeps the capacity of its last use, append into Body[:0] to reuse it.
+func AcquireLetter() *Letter {
+
+	letter := letterPool.Get().(*Letter)
+	letter.LetterID = uuid.New()
+
+	return letter
+}
+
+// ReleaseLetter resets the letter and returns it to the pool. Only release a letter once the Publisher is done with
+// it, after PublishWithConfirmation returned or its receipt arrived, and don't touch it (or its Envelope) after.
+func ReleaseLetter(letter *Letter) {
+
+	if letter == nil {
+		return
+	}
+
+	envelope := letter.Envelope
+	if envelope == nil {
+		envelope = &Envelope{}
+	}
+
+	headers := envelope.Headers
+	for key := range headers {
+		delete(headers, key)
+	}
+
+	*envelope = Envelope{Headers: headers}
+	*letter = Letter{Body: letter.Body[:0], Envelope: envelope}
+	if cap(letter.Body) > maxPooledBufferSize {
+		letter.Body = nil
+	}
+
+	letterPool.Put(letter)
+}
+
+// acquireBuffer takes an empty buffer from the pool.
+func acquireBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// releaseBuffer resets the buffer and returns it to the pool, nothing may hold on to its bytes.
+func releaseBuffer(buffer *bytes.Buffer) {
+
+	if buffer.Cap() > maxPooledBufferSize {
+		return
+	}
+
+	buffer.Reset()
+	bufferPool.Put(buffer)
+}
@@ -0,0 +1,260 @@
+package tcr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ManagementConfig allows access to the RabbitMQ management HTTP API for operations AMQP can't perform.
+type ManagementConfig struct {
+	URI      string `json:"URI" yaml:"URI"` // ex.) http://localhost:15672
+	Username string `json:"Username" yaml:"Username"`
+	Password string `json:"Password" yaml:"Password"`
+	VHost    string `json:"VHost" yaml:"VHost"`     // defaults to "/"
+	Timeout  uint32 `json:"Timeout" yaml:"Timeout"` // seconds, defaults to 10
+}
+
+// ManagementBinding is a binding as reported by the management API.
+type ManagementBinding struct {
+	Source          string                 `json:"source"`
+	VHost           string                 `json:"vhost"`
+	Destination     string                 `json:"destination"`
+	DestinationType string                 `json:"destination_type"` // "queue" or "exchange"
+	RoutingKey      string                 `json:"routing_key"`
+	Arguments       map[string]interface{} `json:"arguments"`
+	PropertiesKey   string                 `json:"properties_key"`
+}
+
+// ManagementClient is a small client for the RabbitMQ management HTTP API.
+type ManagementClient struct {
+	Config     *ManagementConfig
+	baseURL    string
+	vhost      string
+	httpClient *http.Client
+}
+
+// NewManagementClient creates a ManagementClient from config.
+func NewManagementClient(config *ManagementConfig) (*ManagementClient, error) {
+
+	if config == nil || config.URI == "" {
+		return nil, errors.New("management config requires a URI")
+	}
+
+	vhost := config.VHost
+	if vhost == "" {
+		vhost = "/"
+	}
+
+	timeout := time.Duration(config.Timeout) * time.Second
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	return &ManagementClient{
+		Config:     config,
+		baseURL:    strings.TrimSuffix(config.URI, "/") + "/api",
+		vhost:      vhost,
+		httpClient: &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// do executes a management API request, decoding the JSON response into out when provided.
+func (mc *ManagementClient) do(method string, path string, in interface{}, out interface{}) error {
+
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	request, err := http.NewRequest(method, mc.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+
+	request.SetBasicAuth(mc.Config.Username, mc.Config.Password)
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := mc.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("management api %s %s failed with status %s: %s", method, path, response.Status, strings.TrimSpace(string(data)))
+	}
+
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(data, out)
+}
+
+// escapedVHost returns the vhost ready for use in a request path.
+func (mc *ManagementClient) escapedVHost() string {
+	return url.PathEscape(mc.vhost)
+}
+
+// ListExchangeBindings lists the bindings where the exchange is the source (asSource) or the destination.
+func (mc *ManagementClient) ListExchangeBindings(exchangeName string, asSource bool) ([]*ManagementBinding, error) {
+
+	direction := "destination"
+	if asSource {
+		direction = "source"
+	}
+
+	bindings := make([]*ManagementBinding, 0)
+	err := mc.do(http.MethodGet, fmt.Sprintf("/exchanges/%s/%s/bindings/%s", mc.escapedVHost(), url.PathEscape(exchangeName), direction), nil, &bindings)
+	return bindings, err
+}
+
+// DeleteBinding removes a binding reported by the management API.
+func (mc *ManagementClient) DeleteBinding(binding *ManagementBinding) error {
+
+	destinationType := "q"
+	if binding.DestinationType == "exchange" {
+		destinationType = "e"
+	}
+
+	propertiesKey := binding.PropertiesKey
+	if propertiesKey == "" {
+		propertiesKey = "~" // the management API's key for an empty routing key without arguments
+	}
+
+	return mc.do(
+		http.MethodDelete,
+		fmt.Sprintf("/bindings/%s/e/%s/%s/%s/%s",
+			mc.escapedVHost(),
+			url.PathEscape(binding.Source),
+			destinationType,
+			url.PathEscape(binding.Destination),
+			url.PathEscape(propertiesKey)),
+		nil,
+		nil)
+}
+
+// ManagementQueue is the state of a queue as reported by the management API.
+type ManagementQueue struct {
+	Name                   string `json:"name"`
+	VHost                  string `json:"vhost"`
+	Messages               int    `json:"messages"`
+	MessagesReady          int    `json:"messages_ready"`
+	MessagesUnacknowledged int    `json:"messages_unacknowledged"`
+	Consumers              int    `json:"consumers"`
+}
+
+// GetQueue returns the state of the queue.
+func (mc *ManagementClient) GetQueue(queueName string) (*ManagementQueue, error) {
+
+	queue := &ManagementQueue{}
+	err := mc.do(http.MethodGet, fmt.Sprintf("/queues/%s/%s", mc.escapedVHost(), url.PathEscape(queueName)), nil, queue)
+	if err != nil {
+		return nil, err
+	}
+
+	return queue, nil
+}
+
+// vhostOrDefault escapes the vhost, falling back to the client's.
+func (mc *ManagementClient) vhostOrDefault(vhost string) string {
+
+	if vhost == "" {
+		return mc.escapedVHost()
+	}
+
+	return url.PathEscape(vhost)
+}
+
+// PutUser creates or updates the user.
+func (mc *ManagementClient) PutUser(name string, password string, tags string) error {
+	return mc.do(http.MethodPut, "/users/"+url.PathEscape(name), map[string]string{
+		"password": password,
+		"tags":     tags,
+	}, nil)
+}
+
+// DeleteUser removes the user.
+func (mc *ManagementClient) DeleteUser(name string) error {
+	return mc.do(http.MethodDelete, "/users/"+url.PathEscape(name), nil, nil)
+}
+
+// PutPermission sets the user's permissions on the vhost.
+func (mc *ManagementClient) PutPermission(user string, permission *Permission) error {
+	return mc.do(http.MethodPut, fmt.Sprintf("/permissions/%s/%s", mc.vhostOrDefault(permission.VHost), url.PathEscape(user)), map[string]string{
+		"configure": permission.Configure,
+		"write":     permission.Write,
+		"read":      permission.Read,
+	}, nil)
+}
+
+// PutTopicPermission sets the user's topic permissions on the vhost.
+func (mc *ManagementClient) PutTopicPermission(user string, permission *TopicPermission) error {
+	return mc.do(http.MethodPut, fmt.Sprintf("/topic-permissions/%s/%s", mc.vhostOrDefault(permission.VHost), url.PathEscape(user)), map[string]string{
+		"exchange": permission.Exchange,
+		"write":    permission.Write,
+		"read":     permission.Read,
+	}, nil)
+}
+
+// ExchangeTypes lists the exchange types the broker supports, including those of plugins (ex. x-delayed-message).
+func (mc *ManagementClient) ExchangeTypes() ([]string, error) {
+
+	overview := &struct {
+		ExchangeTypes []struct {
+			Name string `json:"name"`
+		} `json:"exchange_types"`
+	}{}
+	if err := mc.do(http.MethodGet, "/overview", nil, overview); err != nil {
+		return nil, err
+	}
+
+	types := make([]string, 0, len(overview.ExchangeTypes))
+	for _, exchangeType := range overview.ExchangeTypes {
+		types = append(types, exchangeType.Name)
+	}
+
+	return types, nil
+}
+
+// ManagementConnection is a client connection as reported by the management API.
+type ManagementConnection struct {
+	Name             string `json:"name"`
+	VHost            string `json:"vhost"`
+	User             string `json:"user"`
+	State            string `json:"state"`
+	Channels         int    `json:"channels"`
+	PeerHost         string `json:"peer_host"`
+	PeerPort         int    `json:"peer_port"`
+	ConnectedAt      int64  `json:"connected_at"` // ms since the epoch
+	ClientProperties struct {
+		ConnectionName string `json:"connection_name"`
+	} `json:"client_properties"`
+}
+
+// ListConnections lists the client connections of every vhost the user can see.
+func (mc *ManagementClient) ListConnections() ([]*ManagementConnection, error) {
+
+	connections := make([]*ManagementConnection, 0)
+	if err := mc.do(http.MethodGet, "/connections", nil, &connections); err != nil {
+		return nil, err
+	}
+
+	return connections, nil
+}
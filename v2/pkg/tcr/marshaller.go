@@ -0,0 +1,182 @@
+package tcr
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+)
+
+const (
+	// ContentTypeJSON is the content type of the JSONMarshaller.
+	ContentTypeJSON = "application/json"
+
+	// ContentTypePolicyIgnore publishes mismatched content types as they are (default).
+	ContentTypePolicyIgnore = "ignore"
+
+	// ContentTypePolicyWarn publishes mismatched content types and reports them to the error handler.
+	ContentTypePolicyWarn = "warn"
+
+	// ContentTypePolicyFail refuses to publish letters with mismatched content types.
+	ContentTypePolicyFail = "fail"
+)
+
+// Marshaller turns values into letter bodies and knows the content type it produces.
+type Marshaller interface {
+	Marshal(value interface{}) ([]byte, error)
+	Unmarshal(data []byte, value interface{}) error
+	ContentType() string
+}
+
+// JSONMarshaller marshals values as JSON.
+type JSONMarshaller struct{}
+
+// Marshal encodes the value as JSON.
+func (JSONMarshaller) Marshal(value interface{}) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+// Unmarshal decodes JSON into the value.
+func (JSONMarshaller) Unmarshal(data []byte, value interface{}) error {
+	return json.Unmarshal(data, value)
+}
+
+// ContentType is application/json.
+func (JSONMarshaller) ContentType() string {
+	return ContentTypeJSON
+}
+
+// SetMarshaller sets the Marshaller of the Publisher. Letters without a ContentType then get the marshaller's,
+// and letters with a different one are handled by the PublisherConfig ContentTypePolicy.
+func (pub *Publisher) SetMarshaller(marshaller Marshaller) {
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	pub.marshaller = marshaller
+	pub.marshallerErr = nil
+}
+
+// SetErrorHandler receives the Publisher's non fatal errors, ex. content type warnings.
+func (pub *Publisher) SetErrorHandler(errorHandler func(error)) {
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	pub.errorHandler = errorHandler
+}
+
+// CreateLetter marshals the value with the Publisher's Marshaller (JSON when none is set) into a new Letter.
+func (pub *Publisher) CreateLetter(exchange string, routingKey string, value interface{}) (*Letter, error) {
+
+	return pub.marshalLetter(value, &Envelope{
+		Exchange:     exchange,
+		RoutingKey:   routingKey,
+		DeliveryMode: 2,
+	})
+}
+
+// PublishStruct marshals the value with the Publisher's Marshaller (JSON when none is set) and publishes it
+// to the envelope's address. The envelope's ContentType defaults to the Marshaller's.
+func (pub *Publisher) PublishStruct(value interface{}, envelope *Envelope) error {
+
+	letter, err := pub.marshalLetter(value, envelope)
+	if err != nil {
+		return err
+	}
+
+	return pub.PublishWithError(letter, true)
+}
+
+// marshalLetter builds a Letter around a copy of the envelope, so callers can reuse theirs.
+func (pub *Publisher) marshalLetter(value interface{}, envelope *Envelope) (*Letter, error) {
+
+	if envelope == nil {
+		return nil, errors.New("can't marshal a letter without an envelope to address it with")
+	}
+
+	pub.pubRWLock.RLock()
+	marshaller := pub.marshaller
+	marshallerErr := pub.marshallerErr
+	pub.pubRWLock.RUnlock()
+
+	if marshallerErr != nil {
+		return nil, marshallerErr
+	}
+
+	if marshaller == nil {
+		marshaller = JSONMarshaller{}
+	}
+
+	body, err := marshaller.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	letterEnvelope := *envelope
+	if letterEnvelope.ContentType == "" {
+		letterEnvelope.ContentType = marshaller.ContentType()
+	}
+
+	return &Letter{
+		LetterID: pub.newLetterID(),
+		Body:     body,
+		Envelope: &letterEnvelope,
+	}, nil
+}
+
+// negotiateContentType derives the content type of the letter from the Marshaller and enforces the policy.
+func (pub *Publisher) negotiateContentType(letter *Letter) (string, error) {
+
+	pub.pubRWLock.RLock()
+	marshaller := pub.marshaller
+	marshallerErr := pub.marshallerErr
+	errorHandler := pub.errorHandler
+	pub.pubRWLock.RUnlock()
+
+	if marshallerErr != nil {
+		return "", fmt.Errorf("LetterID: %s can't be published: %w", letter.LetterID.String(), marshallerErr)
+	}
+
+	contentType := letter.Envelope.ContentType
+	if marshaller == nil {
+		return contentType, nil
+	}
+
+	if contentType == "" {
+		return marshaller.ContentType(), nil
+	}
+
+	if sameMediaType(contentType, marshaller.ContentType()) || framingContentType(contentType) {
+		return contentType, nil
+	}
+
+	err := fmt.Errorf("LetterID: %s has content type %q but the publisher marshals %q", letter.LetterID.String(), contentType, marshaller.ContentType())
+
+	switch strings.ToLower(pub.contentTypePolicy) {
+	case ContentTypePolicyFail:
+		return "", err
+	case ContentTypePolicyWarn:
+		if errorHandler != nil {
+			errorHandler(err)
+		}
+	}
+
+	return contentType, nil
+}
+
+// framingContentType is true for the content types of bodies the library framed itself (ex. a StreamBatcher's
+// sub-entry batch of marshalled letters), which the Marshaller's content type policy doesn't apply to.
+func framingContentType(contentType string) bool {
+	return sameMediaType(contentType, ContentTypeSubEntryBatch)
+}
+
+// sameMediaType compares content types ignoring parameters (ex. charset) and case.
+func sameMediaType(a string, b string) bool {
+
+	mediaTypeA, _, errA := mime.ParseMediaType(a)
+	mediaTypeB, _, errB := mime.ParseMediaType(b)
+	if errA != nil || errB != nil {
+		return strings.EqualFold(a, b)
+	}
+
+	return mediaTypeA == mediaTypeB
+}
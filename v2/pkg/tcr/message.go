@@ -11,10 +11,13 @@ import (
 
 // PublishReceipt is a way to monitor publishing success and to initiate a retry when using async publishing.
 type PublishReceipt struct {
-	LetterID     uuid.UUID
-	FailedLetter *Letter
-	Success      bool
-	Error        error
+	PublisherName  string
+	LetterID       uuid.UUID
+	FailedLetter   *Letter
+	Success        bool
+	Error          error
+	UnknownOutcome bool              // the channel died before confirming the letter, see SetUnknownOutcomeReceipts
+	Batch          []*PublishReceipt // per letter receipts of a PublishBatch
 }
 
 // ToString allows you to quickly log the PublishReceipt struct as a string.
@@ -33,7 +36,11 @@ type ReceivedMessage struct {
 	MessageID     string // LetterID
 	ApplicationID string
 	PublishDate   string
+	DeliveryCount int64         // previous deliveries, read from x-delivery-count on quorum queues
 	Delivery      amqp.Delivery // Access everything.
+	lease         *lease
+	watermark     *watermark
+	marshaller    Marshaller
 }
 
 // NewReceivedMessage creates a new ReceivedMessage.
@@ -47,6 +54,7 @@ func NewReceivedMessage(
 		MessageID:     delivery.MessageId,
 		ApplicationID: delivery.AppId,
 		PublishDate:   JSONUtcTimestampFromTime(delivery.Timestamp),
+		DeliveryCount: deliveryCount(delivery),
 		Delivery:      delivery,
 	}
 }
@@ -63,6 +71,14 @@ func (msg *ReceivedMessage) Acknowledge() error {
 		return errors.New("can't acknowledge, internal channel is nil")
 	}
 
+	if err := msg.settleLease(); err != nil {
+		return err
+	}
+
+	if err := msg.saveWatermark(); err != nil {
+		return err
+	}
+
 	return msg.Delivery.Acknowledger.Ack(msg.Delivery.DeliveryTag, false)
 }
 
@@ -77,7 +93,16 @@ func (msg *ReceivedMessage) Nack(requeue bool) error {
 		return errors.New("can't nack, internal channel is nil")
 	}
 
-	return msg.Delivery.Acknowledger.Nack(msg.Delivery.DeliveryTag, false, requeue)
+	if err := msg.settleLease(); err != nil {
+		return err
+	}
+
+	if err := msg.Delivery.Acknowledger.Nack(msg.Delivery.DeliveryTag, false, requeue); err != nil {
+		return err
+	}
+
+	msg.releaseWatermark(requeue)
+	return nil
 }
 
 // Reject allows for you to reject on the original channel it was received.
@@ -91,7 +116,16 @@ func (msg *ReceivedMessage) Reject(requeue bool) error {
 		return errors.New("can't reject, internal channel is nil")
 	}
 
-	return msg.Delivery.Acknowledger.Reject(msg.Delivery.DeliveryTag, requeue)
+	if err := msg.settleLease(); err != nil {
+		return err
+	}
+
+	if err := msg.Delivery.Acknowledger.Reject(msg.Delivery.DeliveryTag, requeue); err != nil {
+		return err
+	}
+
+	msg.releaseWatermark(requeue)
+	return nil
 }
 
 // ErrorMessage allow for you to replay a message that was returned.
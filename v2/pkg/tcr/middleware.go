@@ -0,0 +1,61 @@
+package tcr
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// PublishFunc publishes a letter, the error is the outcome the caller sees (or receives in its receipt).
+type PublishFunc func(letter *Letter) error
+
+// PublishMiddleware wraps a PublishFunc, ex. to log, measure, stamp headers on or validate letters.
+type PublishMiddleware func(next PublishFunc) PublishFunc
+
+// Use adds the middleware around every publish, direct and auto-publish alike. Middleware added first runs
+// outermost. It sees the letter before it is prepared (aliases, marshalling, compression, encryption...)
+// and the outcome afterwards - retries on nacks and channel errors happen inside next.
+func (pub *Publisher) Use(middleware PublishMiddleware) {
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	pub.middleware = append(pub.middleware, middleware)
+}
+
+// intercept copies the trace of the inbound message carried by ctx (see PropagateTrace), stamps the letter,
+// skips duplicates, waits for the publish rate limit then runs publish through the middleware chain, counting
+// the letter in the InFlightCount meanwhile.
+func (pub *Publisher) intercept(ctx context.Context, letter *Letter, publish PublishFunc) (err error) {
+
+	atomic.AddInt32(&pub.inFlight, 1)
+	defer func() {
+		atomic.AddInt32(&pub.inFlight, -1)
+		if err != nil {
+			pub.recordError(letter, err)
+		}
+	}()
+
+	PropagateTrace(ctx, letter)
+	pub.stampLetter(letter)
+
+	settle, duplicate, err := pub.deduplicate(ctx, letter)
+	if err != nil || duplicate {
+		return err
+	}
+	if settle != nil {
+		defer func() { settle(err == nil) }()
+	}
+
+	if err := pub.throttle(ctx, letter); err != nil {
+		return err
+	}
+
+	pub.pubRWLock.RLock()
+	middleware := pub.middleware
+	pub.pubRWLock.RUnlock()
+
+	for i := len(middleware) - 1; i >= 0; i-- {
+		publish = middleware[i](publish)
+	}
+
+	return publish(letter)
+}
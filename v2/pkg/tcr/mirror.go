@@ -0,0 +1,163 @@
+package tcr
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// MirrorConsumer consumes the same (mirrored) queue from several clusters at once for active-active
+// disaster recovery. Messages are deduplicated client side by MessageID, the first copy reaches the action
+// and copies arriving after it was acknowledged are acknowledged and dropped. Messages without a MessageID
+// are never deduplicated.
+type MirrorConsumer struct {
+	consumers []*Consumer
+	seen      *dedupCache
+	inFlight  map[string]bool
+	lock      *sync.Mutex
+}
+
+// NewMirrorConsumer creates a MirrorConsumer remembering the last dedupCapacity MessageIDs.
+func NewMirrorConsumer(dedupCapacity int, consumers ...*Consumer) (*MirrorConsumer, error) {
+
+	if len(consumers) == 0 {
+		return nil, errors.New("mirror consumer requires at least one consumer")
+	}
+
+	return &MirrorConsumer{
+		consumers: consumers,
+		seen:      newDedupCache(dedupCapacity),
+		inFlight:  make(map[string]bool),
+		lock:      &sync.Mutex{},
+	}, nil
+}
+
+// Consumers returns the underlying Consumers, one per cluster.
+func (mc *MirrorConsumer) Consumers() []*Consumer {
+	return mc.consumers
+}
+
+// StartConsumingWithAction starts every Consumer, each unique message is given to the action once.
+func (mc *MirrorConsumer) StartConsumingWithAction(action func(*ReceivedMessage)) {
+
+	handler := mc.Handler(action)
+	for _, con := range mc.consumers {
+		con.StartConsumingWithAction(handler)
+	}
+}
+
+// Handler wraps the action into the deduplicating action StartConsumingWithAction gives every Consumer,
+// ex. for Consumer.Replay.
+//
+// A MessageID is only seen once its message is acknowledged, a nacked or rejected message (requeued or not)
+// reaches the action again, as does its mirrored copy. A copy arriving while another is still processed is
+// requeued until that one settles. Messages that aren't ackable are seen once the action returns.
+func (mc *MirrorConsumer) Handler(action func(*ReceivedMessage)) func(*ReceivedMessage) {
+
+	return func(msg *ReceivedMessage) {
+		if msg.MessageID == "" {
+			action(msg)
+			return
+		}
+
+		seen, inFlight := mc.claim(msg.MessageID)
+		switch {
+		case seen:
+			if msg.IsAckable {
+				_ = msg.Acknowledge()
+			}
+			return
+		case inFlight:
+			if msg.IsAckable {
+				_ = msg.Nack(true)
+			}
+			return
+		}
+
+		if !msg.IsAckable {
+			action(msg)
+			mc.settle(msg.MessageID, true)
+			return
+		}
+
+		msg.Delivery.Acknowledger = &mirrorAcknowledger{
+			Acknowledger: msg.Delivery.Acknowledger,
+			settle:       func(acked bool) { mc.settle(msg.MessageID, acked) },
+			once:         &sync.Once{},
+		}
+		action(msg)
+	}
+}
+
+// claim marks the MessageID in flight unless it was already seen or is in flight.
+func (mc *MirrorConsumer) claim(messageID string) (seen bool, inFlight bool) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	if mc.inFlight[messageID] {
+		return false, true
+	}
+
+	if mc.seen.has(messageID) {
+		return true, false
+	}
+
+	mc.inFlight[messageID] = true
+	return false, false
+}
+
+// settle ends the processing of the MessageID, remembering it as seen when its message was acknowledged.
+func (mc *MirrorConsumer) settle(messageID string, acked bool) {
+	mc.lock.Lock()
+	defer mc.lock.Unlock()
+
+	delete(mc.inFlight, messageID)
+	if acked {
+		mc.seen.add(messageID)
+	}
+}
+
+// Forget removes a MessageID from the dedup cache, ex. when its processing failed after the ack and a
+// mirrored copy should be processed instead.
+func (mc *MirrorConsumer) Forget(messageID string) {
+	mc.seen.remove(messageID)
+}
+
+// StopConsuming stops every Consumer, returning the first error.
+func (mc *MirrorConsumer) StopConsuming(immediate bool, flushMessages bool) error {
+
+	var firstErr error
+	for _, con := range mc.consumers {
+		if err := con.StopConsuming(immediate, flushMessages); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// mirrorAcknowledger settles the MessageID of a deduplicated message with its first ack, nack or reject.
+type mirrorAcknowledger struct {
+	amqp.Acknowledger
+	settle func(acked bool)
+	once   *sync.Once
+}
+
+func (ma *mirrorAcknowledger) Ack(tag uint64, multiple bool) error {
+	err := ma.Acknowledger.Ack(tag, multiple)
+	ma.once.Do(func() { ma.settle(err == nil) })
+	return err
+}
+
+func (ma *mirrorAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	err := ma.Acknowledger.Nack(tag, multiple, requeue)
+	ma.once.Do(func() { ma.settle(false) })
+	return err
+}
+
+func (ma *mirrorAcknowledger) Reject(tag uint64, requeue bool) error {
+	err := ma.Acknowledger.Reject(tag, requeue)
+	ma.once.Do(func() { ma.settle(false) })
+	return err
+}
@@ -0,0 +1,316 @@
+package tcr
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// OutboxStore persists queued letters until they are confirmed, so a crashed process can replay what was
+// still sitting in the auto-publish queue. Adapters for embedded databases (ex. BoltDB, badger) only need
+// to key the letters by publisher and LetterID.
+type OutboxStore interface {
+	SaveLetter(publisherName string, letter *Letter) error
+	DeleteLetter(publisherName string, letterID uuid.UUID) error
+	LoadLetters(publisherName string) ([]*Letter, error) // in the order they were saved
+}
+
+// SetOutbox persists every letter queued for auto-publishing in the store before queueing it and deletes it
+// once confirmed (or dropped by the drop-oldest QueueOverflow policy), letters failing to publish stay in the
+// store. The letters the store still holds from a previous run are queued again first, their count is returned.
+// Call it before queueing letters, a nil store stops persisting.
+func (pub *Publisher) SetOutbox(store OutboxStore) (int, error) {
+
+	if store == nil {
+		pub.pubRWLock.Lock()
+		pub.outbox = nil
+		pub.pubRWLock.Unlock()
+		return 0, nil
+	}
+
+	letters, err := store.LoadLetters(pub.Name)
+	if err != nil {
+		return 0, err
+	}
+
+	pub.pubRWLock.Lock()
+	pub.outbox = store
+	pub.pubRWLock.Unlock()
+
+	for i, letter := range letters {
+		if err := pub.queueLetter(letter); err != nil {
+			return i, fmt.Errorf("replaying LetterID: %s from the outbox failed: %w", letter.LetterID.String(), err)
+		}
+	}
+
+	return len(letters), nil
+}
+
+func (pub *Publisher) currentOutbox() OutboxStore {
+	pub.pubRWLock.RLock()
+	defer pub.pubRWLock.RUnlock()
+
+	return pub.outbox
+}
+
+// persist saves the letter before it is queued, assigning a LetterID to key it by.
+func (pub *Publisher) persist(letter *Letter) error {
+
+	outbox := pub.currentOutbox()
+	if outbox == nil || letter == nil {
+		return nil
+	}
+
+	if letter.LetterID == uuid.Nil {
+		letter.LetterID = pub.newLetterID()
+	}
+
+	if err := outbox.SaveLetter(pub.Name, letter); err != nil {
+		return fmt.Errorf("LetterID: %s couldn't be saved to the outbox: %w", letter.LetterID.String(), err)
+	}
+
+	return nil
+}
+
+// unpersist deletes a letter that no longer needs replaying.
+func (pub *Publisher) unpersist(letter *Letter) {
+
+	outbox := pub.currentOutbox()
+	if outbox == nil || letter == nil {
+		return
+	}
+
+	if err := outbox.DeleteLetter(pub.Name, letter.LetterID); err != nil {
+		pub.pubRWLock.RLock()
+		errorHandler := pub.errorHandler
+		pub.pubRWLock.RUnlock()
+
+		if errorHandler != nil {
+			errorHandler(fmt.Errorf("LetterID: %s couldn't be deleted from the outbox: %w", letter.LetterID.String(), err))
+		}
+	}
+}
+
+// outboxRecord is how FileOutbox stores a letter, keeping the unexported state JSON would drop.
+type outboxRecord struct {
+	Letter    *Letter `json:"Letter"`
+	Encrypted bool    `json:"Encrypted,omitempty"`
+}
+
+// FileOutbox keeps one fsynced JSON file per letter in a directory per publisher, named after the nanosecond
+// it was first saved (kept increasing within the process) so the names sort in save order. Header values round
+// trip through JSON, numbers are replayed as float64.
+type FileOutbox struct {
+	directory string
+	files     map[string]map[uuid.UUID]string // file names of the letters per publisher
+	saved     int64                           // the sequence of the last file name
+	lock      *sync.Mutex
+}
+
+// NewFileOutbox creates the directory when needed.
+func NewFileOutbox(directory string) (*FileOutbox, error) {
+
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+
+	return &FileOutbox{
+		directory: directory,
+		files:     make(map[string]map[uuid.UUID]string),
+		lock:      &sync.Mutex{},
+	}, nil
+}
+
+// SaveLetter writes the letter durably (write, fsync then rename), saving it again keeps its place.
+func (store *FileOutbox) SaveLetter(publisherName string, letter *Letter) error {
+
+	data, err := json.Marshal(&outboxRecord{Letter: letter, Encrypted: letter.encrypted})
+	if err != nil {
+		return err
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	files, err := store.letterFiles(publisherName)
+	if err != nil {
+		return err
+	}
+
+	name, ok := files[letter.LetterID]
+	if !ok {
+		name = store.nextFileName(letter.LetterID)
+	}
+
+	path := filepath.Join(store.publisherDirectory(publisherName), name)
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	files[letter.LetterID] = name
+	return nil
+}
+
+// DeleteLetter removes the letter, deleting a missing one is not an error.
+func (store *FileOutbox) DeleteLetter(publisherName string, letterID uuid.UUID) error {
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	files, err := store.letterFiles(publisherName)
+	if err != nil {
+		return err
+	}
+
+	name, ok := files[letterID]
+	if !ok {
+		return nil
+	}
+
+	err = os.Remove(filepath.Join(store.publisherDirectory(publisherName), name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	delete(files, letterID)
+	return nil
+}
+
+// LoadLetters reads the letters of the publisher in the order they were saved.
+func (store *FileOutbox) LoadLetters(publisherName string) ([]*Letter, error) {
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	delete(store.files, publisherName) // read the directory afresh
+	files, err := store.letterFiles(publisherName)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(files))
+	for _, name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	letters := make([]*Letter, 0, len(names))
+	for _, name := range names {
+		data, err := ioutil.ReadFile(filepath.Join(store.publisherDirectory(publisherName), name))
+		if err != nil {
+			return nil, err
+		}
+
+		record := &outboxRecord{}
+		if err := json.Unmarshal(data, record); err != nil {
+			return nil, fmt.Errorf("outbox file %s is corrupt: %w", name, err)
+		}
+
+		record.Letter.encrypted = record.Encrypted
+		letters = append(letters, record.Letter)
+	}
+
+	return letters, nil
+}
+
+// letterFiles returns the file names of the publisher's letters, reading its directory the first time.
+func (store *FileOutbox) letterFiles(publisherName string) (map[uuid.UUID]string, error) {
+
+	if files, ok := store.files[publisherName]; ok {
+		return files, nil
+	}
+
+	directory := store.publisherDirectory(publisherName)
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[uuid.UUID]string, len(entries))
+	for _, entry := range entries {
+		saved, letterID, ok := parseOutboxFileName(entry.Name())
+		if entry.IsDir() || !ok {
+			continue // ex. a .tmp file of a save the crash interrupted
+		}
+
+		files[letterID] = entry.Name()
+		if saved > store.saved {
+			store.saved = saved
+		}
+	}
+
+	store.files[publisherName] = files
+	return files, nil
+}
+
+// nextFileName names the file of a letter saved now, after every file named before.
+func (store *FileOutbox) nextFileName(letterID uuid.UUID) string {
+
+	saved := time.Now().UnixNano()
+	if saved <= store.saved {
+		saved = store.saved + 1 // same tick or the clock went back
+	}
+	store.saved = saved
+
+	return fmt.Sprintf("%020d-%s.json", saved, letterID.String())
+}
+
+// parseOutboxFileName reads the save sequence and LetterID from the name of a letter's file.
+func parseOutboxFileName(name string) (int64, uuid.UUID, bool) {
+
+	if !strings.HasSuffix(name, ".json") {
+		return 0, uuid.Nil, false
+	}
+
+	parts := strings.SplitN(strings.TrimSuffix(name, ".json"), "-", 2)
+	if len(parts) != 2 {
+		return 0, uuid.Nil, false
+	}
+
+	saved, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, uuid.Nil, false
+	}
+
+	letterID, err := uuid.Parse(parts[1])
+	if err != nil {
+		return 0, uuid.Nil, false
+	}
+
+	return saved, letterID, true
+}
+
+func (store *FileOutbox) publisherDirectory(publisherName string) string {
+	return filepath.Join(store.directory, filepath.Base(publisherName))
+}
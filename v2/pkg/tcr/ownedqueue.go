@@ -0,0 +1,70 @@
+package tcr
+
+import "fmt"
+
+// OwnedQueue is a queue the Consumer declares (and binds) on its own channel, ex. an exclusive or auto-delete
+// queue subscribed to a fanout exchange, which the server deletes along with the consumer's connection.
+type OwnedQueue struct {
+	Queue    *Queue          `json:"Queue" yaml:"Queue"`                           // Name defaults to the consumer's QueueName
+	Bindings []*QueueBinding `json:"Bindings,omitempty" yaml:"Bindings,omitempty"` // QueueName defaults to the owned queue
+}
+
+// OwnQueue makes the Consumer declare the queue and its bindings every time it (re)starts consuming, so
+// reconnecting restores a queue the server deleted with the old connection and its subscriptions. The queue
+// is declared on the consuming channel, exclusive queues belong to the consumer's connection. Nil disowns it.
+func (con *Consumer) OwnQueue(queue *Queue, bindings ...*QueueBinding) {
+	con.conLock.Lock()
+	defer con.conLock.Unlock()
+
+	if queue == nil {
+		con.ownedQueue = nil
+		return
+	}
+
+	con.ownedQueue = &OwnedQueue{Queue: queue, Bindings: bindings}
+}
+
+// declareOwnedQueue declares the owned queue and binds it before consuming from it.
+func (con *Consumer) declareOwnedQueue(chanHost *ChannelHost) error {
+
+	con.conLock.Lock()
+	owned := con.ownedQueue
+	con.conLock.Unlock()
+
+	if owned == nil {
+		return nil
+	}
+
+	return con.declareQueue(chanHost, owned)
+}
+
+// declareQueue declares the queue and its bindings, names default to the consumer's QueueName.
+func (con *Consumer) declareQueue(chanHost *ChannelHost, owned *OwnedQueue) error {
+
+	if owned.Queue == nil {
+		return nil
+	}
+
+	queue := owned.Queue
+	name := queue.Name
+	if name == "" {
+		name = con.QueueName
+	}
+
+	if _, err := chanHost.Channel.QueueDeclare(name, queue.Durable, queue.AutoDelete, queue.Exclusive, queue.NoWait, queue.Args); err != nil {
+		return fmt.Errorf("consumer %q failed declaring its queue %q: %w", con.ConsumerName, name, err)
+	}
+
+	for _, binding := range owned.Bindings {
+		queueName := binding.QueueName
+		if queueName == "" {
+			queueName = name
+		}
+
+		if err := chanHost.Channel.QueueBind(queueName, binding.RoutingKey, binding.ExchangeName, binding.NoWait, binding.Args); err != nil {
+			return fmt.Errorf("consumer %q failed binding its queue %q to exchange %q: %w", con.ConsumerName, queueName, binding.ExchangeName, err)
+		}
+	}
+
+	return nil
+}
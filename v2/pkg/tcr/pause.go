@@ -0,0 +1,81 @@
+package tcr
+
+import (
+	"sync"
+	"time"
+)
+
+// pauseCheckInterval bounds how long a paused auto-publisher takes to notice it is being stopped.
+const pauseCheckInterval = 100 * time.Millisecond
+
+// pauseState holds the auto-publisher back while paused, resumed is closed while running.
+type pauseState struct {
+	paused  bool
+	resumed chan struct{}
+	lock    *sync.Mutex
+}
+
+func newPauseState() *pauseState {
+
+	resumed := make(chan struct{})
+	close(resumed)
+
+	return &pauseState{
+		resumed: resumed,
+		lock:    &sync.Mutex{},
+	}
+}
+
+// Pause halts auto-publishing after the letters already being published, ex. during broker maintenance.
+// Queued letters stay queued and QueueLetter keeps accepting them (up to the queue's capacity).
+// Direct publishes are not affected.
+func (pub *Publisher) Pause() {
+	pub.pause.lock.Lock()
+	defer pub.pause.lock.Unlock()
+
+	if pub.pause.paused {
+		return
+	}
+
+	pub.pause.paused = true
+	pub.pause.resumed = make(chan struct{})
+	pub.emitEvent(PublisherEventPaused, "auto-publishing paused")
+}
+
+// Resume continues auto-publishing the queued letters.
+func (pub *Publisher) Resume() {
+	pub.pause.lock.Lock()
+	defer pub.pause.lock.Unlock()
+
+	if !pub.pause.paused {
+		return
+	}
+
+	pub.pause.paused = false
+	close(pub.pause.resumed)
+	pub.emitEvent(PublisherEventResumed, "auto-publishing resumed")
+}
+
+// Paused reports whether auto-publishing is paused.
+func (pub *Publisher) Paused() bool {
+	pub.pause.lock.Lock()
+	defer pub.pause.lock.Unlock()
+
+	return pub.pause.paused
+}
+
+// waitWhilePaused returns once resumed, or after the pauseCheckInterval so stop signals are still seen.
+func (pub *Publisher) waitWhilePaused() {
+
+	pub.pause.lock.Lock()
+	resumed := pub.pause.resumed
+	pub.pause.lock.Unlock()
+
+	timer := time.NewTimer(pauseCheckInterval)
+	defer timer.Stop()
+
+	select {
+	case <-resumed:
+	case <-timer.C:
+	}
+}
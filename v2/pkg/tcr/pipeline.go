@@ -0,0 +1,94 @@
+package tcr
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// PipelineHandler processes a message into zero or more letters to forward.
+type PipelineHandler func(*ReceivedMessage) ([]*Letter, error)
+
+// Pipeline wires a Consumer to a Publisher for at-least-once stream processing (process-and-forward). The letters
+// a message produces are published with confirmations before the message is Acked, a failure to publish any of them
+// Nacks it for redelivery - so outputs may be published more than once, consumers downstream should be idempotent.
+// Handler errors Nack the message, requeued only when RequeueOnFailure is set. See NewTransactionalPipeline for
+// publishing the outputs and acking atomically instead.
+type Pipeline struct {
+	RequeueOnFailure bool
+	consumer         *Consumer
+	publisher        *Publisher
+	handler          PipelineHandler
+	timeout          time.Duration
+	txLock           *sync.Mutex // set for transactional pipelines
+}
+
+// NewPipeline creates a Pipeline, timeout bounds the confirmation of each letter (the Publisher's
+// PublishTimeOutInterval when zero). Requires an ackable (AutoAck false) consumer.
+func NewPipeline(con *Consumer, pub *Publisher, timeout time.Duration, handler PipelineHandler) (*Pipeline, error) {
+
+	if con == nil || pub == nil || handler == nil {
+		return nil, errors.New("pipeline requires a consumer, a publisher and a handler")
+	}
+
+	if con.autoAck {
+		return nil, fmt.Errorf("consumer %q can't be used in a pipeline with AutoAck enabled", con.ConsumerName)
+	}
+
+	if timeout == 0 {
+		timeout = pub.publishTimeOutDuration
+	}
+
+	return &Pipeline{
+		consumer:  con,
+		publisher: pub,
+		handler:   handler,
+		timeout:   timeout,
+	}, nil
+}
+
+// StartConsuming starts the Consumer, errors are sent to the consumer's Errors.
+func (p *Pipeline) StartConsuming() {
+	p.consumer.StartConsumingWithAction(p.process)
+}
+
+// StopConsuming stops the Consumer, the Publisher is left as is.
+func (p *Pipeline) StopConsuming(immediate bool, flushMessages bool) error {
+	return p.consumer.StopConsuming(immediate, flushMessages)
+}
+
+func (p *Pipeline) process(msg *ReceivedMessage) {
+
+	if p.txLock != nil {
+		p.processTx(msg)
+		return
+	}
+
+	letters, err := p.handler(msg)
+	if err != nil {
+		p.fail(msg, fmt.Errorf("pipeline handler failed for MessageID %s: %w", msg.MessageID, err), p.RequeueOnFailure)
+		return
+	}
+
+	for _, letter := range letters {
+		if err := p.publisher.PublishWithConfirmationError(letter, p.timeout); err != nil {
+			p.fail(msg, fmt.Errorf("pipeline failed forwarding LetterID %s of MessageID %s: %w", letter.LetterID.String(), msg.MessageID, err), true)
+			return
+		}
+	}
+
+	if err := msg.Acknowledge(); err != nil {
+		// The outputs are already published, the broker will redeliver the input.
+		p.consumer.errors <- fmt.Errorf("pipeline forwarded but ack failed for MessageID %s: %w", msg.MessageID, err)
+	}
+}
+
+func (p *Pipeline) fail(msg *ReceivedMessage, err error, requeue bool) {
+
+	p.consumer.errors <- err
+
+	if nackErr := msg.Nack(requeue); nackErr != nil {
+		p.consumer.errors <- fmt.Errorf("pipeline nack failed for MessageID %s: %w", msg.MessageID, nackErr)
+	}
+}
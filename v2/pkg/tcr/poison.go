@@ -0,0 +1,116 @@
+package tcr
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// HeaderDeliveryCount is stamped by quorum queues on every redelivery.
+	HeaderDeliveryCount = "x-delivery-count"
+)
+
+// PoisonMessageConfig rejects messages that keep being redelivered before they reach the handler.
+// Quorum queues provide the count via the x-delivery-count header, classic queues never have a count
+// so only their first redelivery can be detected (as a count of 1).
+type PoisonMessageConfig struct {
+	Enabled          bool  `json:"Enabled" yaml:"Enabled"`
+	MaxDeliveryCount int64 `json:"MaxDeliveryCount" yaml:"MaxDeliveryCount"` // messages delivered more than this are rejected (dead lettered)
+}
+
+// deliveryCount reads the amount of previous deliveries, the broker can use any integer width for the header
+// and a JSON round trip (ex. a recording) turns it into a float64 or a string.
+func deliveryCount(delivery amqp.Delivery) int64 {
+
+	if value, ok := delivery.Headers[HeaderDeliveryCount]; ok {
+		switch count := value.(type) {
+		case int64:
+			return count
+		case int32:
+			return int64(count)
+		case int16:
+			return int64(count)
+		case int8:
+			return int64(count)
+		case int:
+			return int64(count)
+		case uint64:
+			if count <= math.MaxInt64 {
+				return int64(count)
+			}
+			return math.MaxInt64
+		case uint32:
+			return int64(count)
+		case uint16:
+			return int64(count)
+		case uint8:
+			return int64(count)
+		case float64:
+			return int64(count)
+		case float32:
+			return int64(count)
+		case string:
+			if parsed, err := strconv.ParseInt(count, 10, 64); err == nil {
+				return parsed
+			}
+		}
+	}
+
+	if delivery.Redelivered {
+		return 1
+	}
+
+	return 0
+}
+
+// SetPoisonMessageHandler registers a callback invoked with every message rejected by the PoisonMessageConfig.
+func (con *Consumer) SetPoisonMessageHandler(poisonHandler func(*ReceivedMessage)) {
+	con.conLock.Lock()
+	defer con.conLock.Unlock()
+
+	con.poisonHandler = poisonHandler
+}
+
+// poisoned checks the delivery count against the PoisonMessageConfig and the Consumer's retry policy.
+func (con *Consumer) poisoned(msg *ReceivedMessage) bool {
+
+	config := con.Config.PoisonMessageConfig
+	if config != nil && config.Enabled && msg.DeliveryCount > config.MaxDeliveryCount {
+		return true
+	}
+
+	if policy := con.currentRetryPolicy(); policy != nil && msg.DeliveryCount > 0 {
+		_, retry := policy.Backoff(uint32(msg.DeliveryCount))
+		return !retry
+	}
+
+	return false
+}
+
+// rejectPoisonMessage returns true when the message exceeded the policy and was rejected without requeue.
+func (con *Consumer) rejectPoisonMessage(msg *ReceivedMessage) bool {
+
+	if !msg.IsAckable || !con.poisoned(msg) {
+		return false
+	}
+
+	if err := msg.Reject(false); err != nil {
+		con.errors <- err
+		return false
+	}
+
+	con.errors <- fmt.Errorf("consumer %q rejected MessageID %s as a poison message (delivery count: %d)", con.ConsumerName, msg.MessageID, msg.DeliveryCount)
+
+	con.conLock.Lock()
+	poisonHandler := con.poisonHandler
+	con.conLock.Unlock()
+
+	if poisonHandler != nil {
+		poisonHandler(msg)
+	}
+
+	return true
+}
@@ -0,0 +1,154 @@
+package tcr
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// PollingModeFallback polls once the broker (or a proxy) refuses basic.consume (default).
+	PollingModeFallback = "fallback"
+
+	// PollingModeAlways never consumes, the queue is polled from the start.
+	PollingModeAlways = "always"
+
+	// DefaultPollingMinInterval is the wait between polls after an empty one, doubling up to the max interval.
+	DefaultPollingMinInterval = 10 * time.Millisecond
+
+	// DefaultPollingMaxInterval is the longest wait between two empty polls.
+	DefaultPollingMaxInterval = time.Second
+)
+
+// PollingConfig lets a Consumer receive with a basic.get loop on restricted brokers where basic.consume is
+// disabled. Messages reach the same action (or ReceivedMessages) as consumed ones. Empty polls back off from
+// MinInterval to MaxInterval, a message resets the interval.
+type PollingConfig struct {
+	Mode        string `json:"Mode,omitempty" yaml:"Mode,omitempty"`               // fallback (default) or always
+	MinInterval uint32 `json:"MinInterval,omitempty" yaml:"MinInterval,omitempty"` // ms, defaults to 10
+	MaxInterval uint32 `json:"MaxInterval,omitempty" yaml:"MaxInterval,omitempty"` // ms, defaults to 1000
+}
+
+// SetPolling replaces the ConsumerConfig's Polling, nil only consumes. Takes effect on the next (re)start of
+// consuming.
+func (con *Consumer) SetPolling(config *PollingConfig) {
+	con.conLock.Lock()
+	defer con.conLock.Unlock()
+
+	con.polling = config
+}
+
+// pollingConfig is the Consumer's config, nil without polling.
+func (con *Consumer) pollingConfig() *PollingConfig {
+	con.conLock.Lock()
+	defer con.conLock.Unlock()
+
+	return con.polling
+}
+
+// pollsAlways is true when the Consumer never consumes.
+func (con *Consumer) pollsAlways() bool {
+	config := con.pollingConfig()
+	return config != nil && config.Mode == PollingModeAlways
+}
+
+// fallsBackToPolling is true when the Consumer polls after the consume was refused with the error.
+func (con *Consumer) fallsBackToPolling(err error) bool {
+
+	if con.pollingConfig() == nil {
+		return false
+	}
+
+	var amqpErr *amqp.Error
+	if !errors.As(err, &amqpErr) {
+		return false
+	}
+
+	switch amqpErr.Code {
+	case amqp.AccessRefused, amqp.NotAllowed, amqp.NotImplemented:
+		con.errors <- fmt.Errorf("consumer %q falls back to polling queue %q, consuming was refused: %w", con.ConsumerName, con.QueueName, err)
+		return true
+	default:
+		return false
+	}
+}
+
+// pollDeliveries is processDeliveries with basic.get, returns true to break the outer loop.
+func (con *Consumer) pollDeliveries(chanHost *ChannelHost, action func(*ReceivedMessage)) bool {
+
+	minInterval, maxInterval := DefaultPollingMinInterval, DefaultPollingMaxInterval
+	if config := con.pollingConfig(); config != nil {
+		if config.MinInterval > 0 {
+			minInterval = time.Duration(config.MinInterval) * time.Millisecond
+		}
+		if config.MaxInterval > 0 {
+			maxInterval = time.Duration(config.MaxInterval) * time.Millisecond
+		}
+	}
+	if maxInterval < minInterval {
+		maxInterval = minInterval
+	}
+
+	interval := minInterval
+	for {
+		select {
+		case errorMessage := <-chanHost.Errors:
+			if errorMessage != nil {
+				con.ConnectionPool.ReturnChannel(chanHost, true)
+				con.errors <- fmt.Errorf("consumer %q current channel closed\r\n[reason: %s]\r\n[code: %d]", con.ConsumerName, errorMessage.Reason, errorMessage.Code)
+				return false
+			}
+		default:
+			break
+		}
+
+		delivery, ok, err := chanHost.Channel.Get(con.QueueName, con.autoAck)
+		if err != nil {
+			con.ConnectionPool.ReturnChannel(chanHost, true)
+			con.errors <- fmt.Errorf("consumer %q failed to poll queue %q: %w", con.ConsumerName, con.QueueName, err)
+			return false
+		}
+
+		var wait <-chan time.Time
+		if ok {
+			interval = minInterval
+			con.recordDelivery(delivery)
+			con.handleDelivery(delivery, action)
+		} else {
+			wait = time.After(interval)
+			if interval *= 2; interval > maxInterval {
+				interval = maxInterval
+			}
+		}
+
+		// Detect if we should stop consuming, waiting out an empty poll.
+		if con.stopRequested(wait) {
+			con.messageGroup.Wait() // workers finish (and ack) their messages before the hooks and the release
+			con.runShutdownHooks()
+			con.ConnectionPool.ReturnChannel(chanHost, false)
+			return true
+		}
+	}
+}
+
+// stopRequested waits out the wait (nil doesn't wait) unless consuming is stopped meanwhile.
+func (con *Consumer) stopRequested(wait <-chan time.Time) bool {
+
+	if wait == nil {
+		select {
+		case stop := <-con.consumeStop:
+			return stop
+		default:
+			return false
+		}
+	}
+
+	select {
+	case stop := <-con.consumeStop:
+		return stop
+	case <-wait:
+		return false
+	}
+}
@@ -0,0 +1,94 @@
+package tcr
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// PoolManager keeps named ConnectionPools (ex. one per tenant vhost or cluster) so letters can be
+// routed to a specific pool by name, see Envelope.Pool.
+type PoolManager struct {
+	pools map[string]*ConnectionPool
+	lock  *sync.RWMutex
+}
+
+// NewPoolManager creates an empty PoolManager.
+func NewPoolManager() *PoolManager {
+	return &PoolManager{
+		pools: make(map[string]*ConnectionPool),
+		lock:  &sync.RWMutex{},
+	}
+}
+
+// AddPool registers an existing ConnectionPool under the name.
+func (pm *PoolManager) AddPool(name string, cp *ConnectionPool) error {
+	pm.lock.Lock()
+	defer pm.lock.Unlock()
+
+	if _, ok := pm.pools[name]; ok {
+		return fmt.Errorf("a pool named %s is already registered", name)
+	}
+
+	pm.pools[name] = cp
+	return nil
+}
+
+// CreatePool creates a ConnectionPool from config and registers it under the name.
+func (pm *PoolManager) CreatePool(name string, config *PoolConfig) (*ConnectionPool, error) {
+
+	cp, err := NewConnectionPool(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := pm.AddPool(name, cp); err != nil {
+		cp.Shutdown()
+		return nil, err
+	}
+
+	return cp, nil
+}
+
+// GetPool returns the ConnectionPool registered under the name.
+func (pm *PoolManager) GetPool(name string) (*ConnectionPool, bool) {
+	pm.lock.RLock()
+	defer pm.lock.RUnlock()
+
+	cp, ok := pm.pools[name]
+	return cp, ok
+}
+
+// RemovePool unregisters the pool, optionally shutting it down.
+func (pm *PoolManager) RemovePool(name string, shutdownPool bool) {
+	pm.lock.Lock()
+	cp, ok := pm.pools[name]
+	delete(pm.pools, name)
+	pm.lock.Unlock()
+
+	if ok && shutdownPool {
+		cp.Shutdown()
+	}
+}
+
+// PoolNames returns the sorted names of the registered pools.
+func (pm *PoolManager) PoolNames() []string {
+	pm.lock.RLock()
+	defer pm.lock.RUnlock()
+
+	names := make([]string, 0, len(pm.pools))
+	for name := range pm.pools {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Shutdown shuts down and unregisters every pool.
+func (pm *PoolManager) Shutdown() {
+
+	for _, name := range pm.PoolNames() {
+		pm.RemovePool(name, true)
+	}
+}
@@ -0,0 +1,41 @@
+package tcr
+
+import "time"
+
+// PoolStats is a point in time snapshot of a ConnectionPool.
+type PoolStats struct {
+	MaxConnections        uint64
+	IdleConnections       int64 // connections in the queue, the rest are in use
+	FlaggedConnections    int
+	RecoveringConnections int
+	MaxChannels           uint64
+	IdleChannels          int // cached channels in the pool, the rest are in use
+	UnhealthyFor          time.Duration
+}
+
+// Stats returns a snapshot of the pool for metrics.
+func (cp *ConnectionPool) Stats() *PoolStats {
+
+	cp.poolRWLock.RLock()
+	flagged := 0
+	for _, isFlagged := range cp.flaggedConnections {
+		if isFlagged {
+			flagged++
+		}
+	}
+	cp.poolRWLock.RUnlock()
+
+	cp.health.lock.Lock()
+	recovering := cp.health.recovering
+	cp.health.lock.Unlock()
+
+	return &PoolStats{
+		MaxConnections:        cp.Config.MaxConnectionCount,
+		IdleConnections:       cp.connections.Len(),
+		FlaggedConnections:    flagged,
+		RecoveringConnections: recovering,
+		MaxChannels:           cp.Config.MaxCacheChannelCount,
+		IdleChannels:          len(cp.channels),
+		UnhealthyFor:          cp.UnhealthyFor(),
+	}
+}
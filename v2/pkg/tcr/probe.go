@@ -0,0 +1,213 @@
+package tcr
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// HeaderProbe marks the probes published by a Publisher's Probe, consumers of the probe queue should drop them.
+const HeaderProbe = "x-tcr-probe"
+
+// ProbeConfig describes the probes a Publisher publishes to check its primary ConnectionPool end to end.
+type ProbeConfig struct {
+	QueueName        string `json:"QueueName" yaml:"QueueName"`                                   // probes are published to it on the default exchange
+	Interval         uint32 `json:"Interval,omitempty" yaml:"Interval,omitempty"`                 // ms between probes, defaults to 5000
+	Timeout          uint32 `json:"Timeout,omitempty" yaml:"Timeout,omitempty"`                   // ms a probe waits for its confirmation, defaults to 2000
+	FailureThreshold int    `json:"FailureThreshold,omitempty" yaml:"FailureThreshold,omitempty"` // consecutive failures marking the pool unhealthy, defaults to 3
+}
+
+// ProbeHealth is a snapshot of a Probe's outcomes.
+type ProbeHealth struct {
+	Probes              uint64
+	Failures            uint64
+	ConsecutiveFailures int
+	Failing             bool          // the FailureThreshold was reached, the pool reports itself unhealthy
+	LastProbe           time.Time     // zero before the first probe finished
+	LastRoundTrip       time.Duration // publish to confirmation of the last successful probe
+	LastError           error
+}
+
+// Probe periodically publishes a small mandatory probe with confirmation and tracks the round trip.
+type Probe struct {
+	publisher *Publisher
+	config    ProbeConfig
+	interval  time.Duration
+	timeout   time.Duration
+	health    ProbeHealth
+	stopped   bool
+	stop      chan struct{}
+	stopOnce  *sync.Once
+	lock      *sync.Mutex
+}
+
+// StartProbe starts probing the Publisher's primary ConnectionPool. Once FailureThreshold probes failed in a row
+// the pool's UnhealthyFor counts from the first of them, so standby failover also covers a broker that still
+// accepts connections but no longer confirms or routes publishes. Probes expire in the queue after the timeout.
+func (pub *Publisher) StartProbe(config *ProbeConfig) (*Probe, error) {
+
+	if config == nil || config.QueueName == "" {
+		return nil, errors.New("probing requires a probe queue")
+	}
+
+	probe := &Probe{
+		publisher: pub,
+		config:    *config,
+		interval:  time.Duration(config.Interval) * time.Millisecond,
+		timeout:   time.Duration(config.Timeout) * time.Millisecond,
+		stop:      make(chan struct{}),
+		stopOnce:  &sync.Once{},
+		lock:      &sync.Mutex{},
+	}
+
+	if probe.interval == 0 {
+		probe.interval = 5 * time.Second
+	}
+	if probe.timeout == 0 {
+		probe.timeout = 2 * time.Second
+	}
+	if probe.config.FailureThreshold <= 0 {
+		probe.config.FailureThreshold = 3
+	}
+
+	go probe.probeLoop()
+	return probe, nil
+}
+
+// Stop ends probing and clears the probe's hold on the pool's health.
+func (pr *Probe) Stop() {
+	pr.stopOnce.Do(func() {
+		close(pr.stop)
+
+		pr.lock.Lock()
+		pr.stopped = true
+		pr.publisher.ConnectionPool.health.probeRecovered()
+		pr.lock.Unlock()
+	})
+}
+
+// Health returns the probe outcomes so far.
+func (pr *Probe) Health() ProbeHealth {
+	pr.lock.Lock()
+	defer pr.lock.Unlock()
+
+	return pr.health
+}
+
+func (pr *Probe) probeLoop() {
+
+	ticker := time.NewTicker(pr.interval)
+	defer ticker.Stop()
+
+	for {
+		// a probe waits for a channel while the pool is recovering, which the pool's health already reports
+		outcome := make(chan error, 1)
+		started := time.Now()
+		go func() { outcome <- pr.probe() }()
+
+		select {
+		case <-pr.stop:
+			return
+		case err := <-outcome:
+			pr.record(time.Since(started), err)
+		}
+
+		select {
+		case <-pr.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe publishes on its own transient channel as a missing probe queue may close it.
+func (pr *Probe) probe() error {
+
+	channel := pr.publisher.ConnectionPool.GetTransientChannel(true)
+	defer func() { _ = channel.Close() }()
+
+	confirmations := channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+	returns := channel.NotifyReturn(make(chan amqp.Return, 1))
+
+	err := channel.Publish(
+		"",
+		pr.config.QueueName,
+		true,  // mandatory
+		false, // immediate
+		amqp.Publishing{
+			MessageId:  pr.publisher.newLetterID().String(),
+			Timestamp:  pr.publisher.currentClock().Now().UTC(),
+			Headers:    amqp.Table{HeaderProbe: true},
+			Expiration: strconv.FormatInt(pr.timeout.Milliseconds(), 10),
+			AppId:      pr.publisher.ConnectionPool.Config.ApplicationName,
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("probe to queue %q failed publishing: %w", pr.config.QueueName, err)
+	}
+
+	select {
+	case confirmation, ok := <-confirmations:
+		if !ok {
+			return fmt.Errorf("channel closed before the probe to queue %q was confirmed", pr.config.QueueName)
+		}
+		if !confirmation.Ack {
+			return fmt.Errorf("probe to queue %q was nacked", pr.config.QueueName)
+		}
+	case <-pr.publisher.currentClock().After(pr.timeout):
+		return fmt.Errorf("probe to queue %q was not confirmed within %s", pr.config.QueueName, pr.timeout)
+	}
+
+	// The broker sends basic.return before the basic.ack of the same publish.
+	select {
+	case ret := <-returns:
+		return fmt.Errorf("probe to queue %q was returned [reason: %s] [code: %d]", pr.config.QueueName, ret.ReplyText, ret.ReplyCode)
+	default:
+		return nil
+	}
+}
+
+func (pr *Probe) record(roundTrip time.Duration, err error) {
+
+	pr.lock.Lock()
+	if pr.stopped {
+		pr.lock.Unlock()
+		return
+	}
+
+	pr.health.Probes++
+	pr.health.LastProbe = pr.publisher.currentClock().Now()
+	pr.health.LastError = err
+
+	var failing, recovered bool
+	if err != nil {
+		pr.health.Failures++
+		pr.health.ConsecutiveFailures++
+		if pr.health.ConsecutiveFailures == 1 {
+			pr.publisher.ConnectionPool.health.probeFailed()
+		}
+		failing = !pr.health.Failing && pr.health.ConsecutiveFailures >= pr.config.FailureThreshold
+		if failing {
+			pr.health.Failing = true
+			pr.publisher.ConnectionPool.health.probeFailing()
+		}
+	} else {
+		pr.health.LastRoundTrip = roundTrip
+		pr.health.ConsecutiveFailures = 0
+		recovered = pr.health.Failing
+		pr.health.Failing = false
+		pr.publisher.ConnectionPool.health.probeRecovered()
+	}
+	pr.lock.Unlock()
+
+	switch {
+	case failing:
+		pr.publisher.emitEvent(PublisherEventProbeFailing, err.Error())
+	case recovered:
+		pr.publisher.emitEvent(PublisherEventProbeRecovered, fmt.Sprintf("probe confirmed in %s", roundTrip))
+	}
+}
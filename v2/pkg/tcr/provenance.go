@@ -0,0 +1,72 @@
+package tcr
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/streadway/amqp"
+)
+
+// ProvenanceConfig gives fleet wide message provenance. Publishers stamp the fixed Headers (ex. service name,
+// version, environment, datacenter) on every letter, Consumers validate that the RequiredHeaders are present.
+type ProvenanceConfig struct {
+	Headers         map[string]string `json:"Headers,omitempty" yaml:"Headers,omitempty"`                 // publisher, a letter's own headers take precedence
+	RequiredHeaders []string          `json:"RequiredHeaders,omitempty" yaml:"RequiredHeaders,omitempty"` // consumer
+	RejectMissing   bool              `json:"RejectMissing,omitempty" yaml:"RejectMissing,omitempty"`     // consumer, reject (dead letter) instead of only reporting
+}
+
+// stampHeaders adds the provenance headers missing from the letter's headers.
+func (pub *Publisher) stampHeaders(headers amqp.Table) amqp.Table {
+
+	if pub.Config == nil || pub.Config.PublisherConfig == nil {
+		return headers
+	}
+
+	config := pub.Config.PublisherConfig.ProvenanceConfig
+	if config == nil || len(config.Headers) == 0 {
+		return headers
+	}
+
+	stamped := make(amqp.Table, len(headers)+len(config.Headers))
+	for header, value := range config.Headers {
+		stamped[header] = value
+	}
+	for header, value := range headers {
+		stamped[header] = value
+	}
+
+	return stamped
+}
+
+// checkProvenance reports messages missing required headers, returns true when the message was rejected.
+func (con *Consumer) checkProvenance(msg *ReceivedMessage) bool {
+
+	config := con.Config.ProvenanceConfig
+	if config == nil || len(config.RequiredHeaders) == 0 {
+		return false
+	}
+
+	missing := make([]string, 0)
+	for _, header := range config.RequiredHeaders {
+		if _, ok := msg.Delivery.Headers[header]; !ok {
+			missing = append(missing, header)
+		}
+	}
+
+	if len(missing) == 0 {
+		return false
+	}
+
+	con.errors <- fmt.Errorf("consumer %q received MessageID %s without provenance headers: %s", con.ConsumerName, msg.MessageID, strings.Join(missing, ", "))
+
+	if !config.RejectMissing || !msg.IsAckable {
+		return false
+	}
+
+	if err := msg.Reject(false); err != nil {
+		con.errors <- err
+		return false
+	}
+
+	return true
+}
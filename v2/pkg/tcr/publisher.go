@@ -6,16 +6,33 @@ import (
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/houseofcat/turbocookedrabbit/v2/pkg/resilience"
 	"github.com/streadway/amqp"
 )
 
 // Publisher contains everything you need to publish a message.
 type Publisher struct {
+	Name                   string
 	Config                 *RabbitSeasoning
 	ConnectionPool         *ConnectionPool
-	letters                chan *Letter
+	letters                chan *Letter // QueueLaneNormal
+	highLetters            chan *Letter
+	lowLetters             chan *Letter
+	queueOverflow          string
+	autoPublishWorkers     int
+	pending                *pendingLetters
+	pause                  *pauseState
+	clock                  Clock
+	ids                    IDGenerator
+	retryPolicy            resilience.Policy
+	autoRetry              bool
+	receiptHandler         func(*PublishReceipt)
 	autoStop               chan bool
 	publishReceipts        chan *PublishReceipt
+	receiptGroup           *sync.WaitGroup // receipts on their way to PublishReceipts
+	receiptsClosed         bool
+	intakeStopped          bool
 	autoStarted            bool
 	autoPublishGroup       *sync.WaitGroup
 	sleepOnIdleInterval    time.Duration
@@ -23,9 +40,57 @@ type Publisher struct {
 	publishTimeOutDuration time.Duration
 	pubLock                *sync.Mutex
 	pubRWLock              *sync.RWMutex
+	aliases                map[string]*exchangeAlias
+	archiveSink            ArchiveSink
+	archiveSampleRate      float64
+	archiveBodies          bool
+	poolManager            *PoolManager
+	standby                *standbyPool
+	standbyHealth          func() time.Duration
+	shards                 *publisherShards
+	events                 chan *PublisherEvent
+	marshaller             Marshaller
+	marshallerErr          error // the PublisherConfig named an unknown Marshaller
+	contentTypePolicy      string
+	errorHandler           func(error)
+	sequenceStore          SequenceStore
+	lastSequence           *SequenceRecord
+	sequences              *SequenceWatermark
+	blobStore              BlobStore
+	blobThreshold          int
+	stats                  *publisherStats
+	bodySizeAlert          *bodySizeAlert
+	outbox                 OutboxStore
+	confirmWindowSize      int
+	streamWindow           int
+	confirmWindows         map[*ConnectionPool]*confirmWindow
+	strictExchanges        map[string]map[string]bool // by Envelope.Pool
+	receiptJournal         *ReceiptJournal
+	returns                chan *ReturnedLetter
+	returnPools            map[*ConnectionPool]bool
+	fallbackExchange       *FallbackExchangeConfig
+	fallbackPools          map[*ConnectionPool]chan *ReturnedLetter
+	tenantQuotas           *tenantQuotas
+	rateLimit              *publishRateLimit
+	exchangeCache          *exchangeCache
+	autoDeclarer           *autoDeclarer
+	inFlight               int32
+	lastError              *PublishError
+	stampMessageID         string
+	stampTimestamp         bool
+	stampPublishedAt       bool
+	notifyUnknownOutcomes  bool
+	dedup                  *publishDedup
+	compression            *CompressionConfig
+	encryption             *EncryptionConfig
+	middleware             []PublishMiddleware
+	management             *ManagementClient
+	delayDetected          string
+	delayTopology          map[string]bool
 }
 
-// NewPublisherFromConfig creates and configures a new Publisher.
+// NewPublisherFromConfig creates and configures a new Publisher. When the config names a Marshaller that isn't
+// registered every publish fails with that error until SetMarshaller replaces it, NewRabbitService refuses it.
 func NewPublisherFromConfig(
 	config *RabbitSeasoning,
 	cp *ConnectionPool) *Publisher {
@@ -34,20 +99,78 @@ func NewPublisherFromConfig(
 		config.PublisherConfig.MaxRetryCount = 5
 	}
 
-	return &Publisher{
+	name := config.PublisherConfig.Name
+	if name == "" {
+		name = nextPublisherName()
+	}
+
+	marshaller, marshallerErr := configuredMarshaller(config.PublisherConfig.Marshaller)
+
+	pub := &Publisher{
+		Name:                   name,
 		Config:                 config,
 		ConnectionPool:         cp,
-		letters:                make(chan *Letter, 1000),
+		letters:                make(chan *Letter, queueCapacity(config.PublisherConfig.QueueCapacity)),
+		highLetters:            make(chan *Letter, queueCapacity(config.PublisherConfig.QueueCapacity)),
+		lowLetters:             make(chan *Letter, queueCapacity(config.PublisherConfig.QueueCapacity)),
+		queueOverflow:          config.PublisherConfig.QueueOverflow,
+		autoPublishWorkers:     config.PublisherConfig.AutoPublishWorkers,
+		pending:                newPendingLetters(),
+		pause:                  newPauseState(),
+		clock:                  SystemClock{},
+		ids:                    UUIDGenerator{},
 		autoStop:               make(chan bool, 1),
 		autoPublishGroup:       &sync.WaitGroup{},
 		publishReceipts:        make(chan *PublishReceipt, 1000),
+		receiptGroup:           &sync.WaitGroup{},
+		events:                 make(chan *PublisherEvent, 100),
+		returns:                make(chan *ReturnedLetter, 100),
+		fallbackPools:          make(map[*ConnectionPool]chan *ReturnedLetter),
+		returnPools:            make(map[*ConnectionPool]bool),
+		delayTopology:          make(map[string]bool),
+		confirmWindows:         make(map[*ConnectionPool]*confirmWindow),
 		sleepOnIdleInterval:    time.Duration(config.PublisherConfig.SleepOnIdleInterval) * time.Millisecond,
 		sleepOnErrorInterval:   time.Duration(config.PublisherConfig.SleepOnErrorInterval) * time.Millisecond,
 		publishTimeOutDuration: time.Duration(config.PublisherConfig.PublishTimeOutInterval) * time.Millisecond,
 		pubLock:                &sync.Mutex{},
 		pubRWLock:              &sync.RWMutex{},
 		autoStarted:            false,
+		aliases:                compileExchangeAliases(config.PublisherConfig.ExchangeAliases),
+		archiveSampleRate:      config.PublisherConfig.ArchiveSampleRate,
+		archiveBodies:          config.PublisherConfig.ArchiveBodies,
+		contentTypePolicy:      config.PublisherConfig.ContentTypePolicy,
+		marshaller:             marshaller,
+		marshallerErr:          marshallerErr,
+		stats:                  newPublisherStats(config.PublisherConfig.StatsRoutingKeyLimit),
+		tenantQuotas:           newTenantQuotas(config.PublisherConfig.TenantQuota),
+		rateLimit:              newPublishRateLimit(config.PublisherConfig.RateLimit),
+		exchangeCache:          newExchangeCache(config.PublisherConfig.VerifyExchanges),
+		stampMessageID:         config.PublisherConfig.StampMessageID,
+		stampTimestamp:         config.PublisherConfig.StampTimestamp,
+		stampPublishedAt:       config.PublisherConfig.StampPublishedAt,
+		fallbackExchange:       config.PublisherConfig.FallbackExchange,
+		notifyUnknownOutcomes:  config.PublisherConfig.NotifyUnknownOutcomes,
+		dedup:                  newPublishDedup(config.PublisherConfig.Deduplication),
+		confirmWindowSize:      config.PublisherConfig.ConfirmWindow,
+		streamWindow:           config.PublisherConfig.StreamWindow,
+		autoRetry:              config.PublisherConfig.AutoRetry,
+		compression:            config.PublisherConfig.Compression,
+		encryption:             config.EncryptionConfig,
+	}
+
+	if config.PublisherConfig.AutoDeclare != nil {
+		pub.SetAutoDeclare(config.PublisherConfig.AutoDeclare)
+	}
+
+	if config.PublisherConfig.StrictTopology != nil {
+		pub.SetStrictTopology("", config.PublisherConfig.StrictTopology)
 	}
+
+	if config.PublisherConfig.BodySizeAlert != nil {
+		pub.SetBodySizeAlert(config.PublisherConfig.BodySizeAlert)
+	}
+
+	return pub
 }
 
 // NewPublisher creates and configures a new Publisher.
@@ -57,19 +180,37 @@ func NewPublisher(
 	sleepOnErrorInterval time.Duration,
 	publishTimeOutDuration time.Duration) *Publisher {
 
-	return &Publisher{
+	pub := &Publisher{
+		Name:                   nextPublisherName(),
 		ConnectionPool:         cp,
-		letters:                make(chan *Letter, 1000),
+		letters:                make(chan *Letter, DefaultQueueCapacity),
+		highLetters:            make(chan *Letter, DefaultQueueCapacity),
+		lowLetters:             make(chan *Letter, DefaultQueueCapacity),
+		pending:                newPendingLetters(),
+		pause:                  newPauseState(),
+		clock:                  SystemClock{},
+		ids:                    UUIDGenerator{},
 		autoStop:               make(chan bool, 1),
 		autoPublishGroup:       &sync.WaitGroup{},
 		publishReceipts:        make(chan *PublishReceipt, 1000),
+		receiptGroup:           &sync.WaitGroup{},
+		events:                 make(chan *PublisherEvent, 100),
+		returns:                make(chan *ReturnedLetter, 100),
+		fallbackPools:          make(map[*ConnectionPool]chan *ReturnedLetter),
+		returnPools:            make(map[*ConnectionPool]bool),
+		delayTopology:          make(map[string]bool),
+		confirmWindows:         make(map[*ConnectionPool]*confirmWindow),
 		sleepOnIdleInterval:    sleepOnIdleInterval,
 		sleepOnErrorInterval:   sleepOnErrorInterval,
 		publishTimeOutDuration: publishTimeOutDuration,
 		pubLock:                &sync.Mutex{},
 		pubRWLock:              &sync.RWMutex{},
 		autoStarted:            false,
+		aliases:                make(map[string]*exchangeAlias),
+		stats:                  newPublisherStats(DefaultStatsRoutingKeyLimit),
 	}
+
+	return pub
 }
 
 // Publish sends a single message to the address on the letter using a cached ChannelHost.
@@ -78,32 +219,7 @@ func NewPublisher(
 // For proper resilience (at least once delivery guarantee over shaky network) use PublishWithConfirmation
 func (pub *Publisher) Publish(letter *Letter, skipReceipt bool) {
 
-	chanHost := pub.ConnectionPool.GetChannelFromPool()
-
-	err := chanHost.Channel.Publish(
-		letter.Envelope.Exchange,
-		letter.Envelope.RoutingKey,
-		letter.Envelope.Mandatory,
-		letter.Envelope.Immediate,
-		amqp.Publishing{
-			ContentType:   letter.Envelope.ContentType,
-			Body:          letter.Body,
-			Headers:       letter.Envelope.Headers,
-			DeliveryMode:  letter.Envelope.DeliveryMode,
-			Priority:      letter.Envelope.Priority,
-			MessageId:     letter.LetterID.String(),
-			CorrelationId: letter.Envelope.CorrelationID,
-			Type:          letter.Envelope.Type,
-			Timestamp:     time.Now().UTC(),
-			AppId:         pub.ConnectionPool.Config.ApplicationName,
-		},
-	)
-
-	if !skipReceipt {
-		pub.publishReceipt(letter, err)
-	}
-
-	pub.ConnectionPool.ReturnChannel(chanHost, err != nil)
+	_ = pub.PublishWithError(letter, skipReceipt)
 }
 
 // PublishWithError sends a single message to the address on the letter using a cached ChannelHost.
@@ -111,32 +227,27 @@ func (pub *Publisher) Publish(letter *Letter, skipReceipt bool) {
 // For proper resilience (at least once delivery guarantee over shaky network) use PublishWithConfirmation
 func (pub *Publisher) PublishWithError(letter *Letter, skipReceipt bool) error {
 
-	chanHost := pub.ConnectionPool.GetChannelFromPool()
-
-	err := chanHost.Channel.Publish(
-		letter.Envelope.Exchange,
-		letter.Envelope.RoutingKey,
-		letter.Envelope.Mandatory,
-		letter.Envelope.Immediate,
-		amqp.Publishing{
-			ContentType:   letter.Envelope.ContentType,
-			Body:          letter.Body,
-			Headers:       letter.Envelope.Headers,
-			DeliveryMode:  letter.Envelope.DeliveryMode,
-			Priority:      letter.Envelope.Priority,
-			MessageId:     letter.LetterID.String(),
-			CorrelationId: letter.Envelope.CorrelationID,
-			Type:          letter.Envelope.Type,
-			Timestamp:     time.Now().UTC(),
-			AppId:         pub.ConnectionPool.Config.ApplicationName,
-		},
-	)
-
+	err := pub.intercept(context.Background(), letter, pub.publishWithError)
 	if !skipReceipt {
 		pub.publishReceipt(letter, err)
 	}
 
-	pub.ConnectionPool.ReturnChannel(chanHost, err != nil)
+	return err
+}
+
+// publishWithError publishes on a cached ChannelHost.
+func (pub *Publisher) publishWithError(letter *Letter) error {
+
+	prepared, err := pub.prepareLetter(letter)
+	if err != nil {
+		return err
+	}
+
+	chanHost := prepared.pool.GetChannelFromPool()
+
+	err = prepared.publish(chanHost.Channel)
+
+	prepared.pool.ReturnChannel(chanHost, err != nil)
 	return err
 }
 
@@ -145,7 +256,20 @@ func (pub *Publisher) PublishWithError(letter *Letter, skipReceipt bool) error {
 // For proper resilience (at least once delivery guarantee over shaky network) use PublishWithConfirmation
 func (pub *Publisher) PublishWithTransient(letter *Letter) error {
 
-	channel := pub.ConnectionPool.GetTransientChannel(false)
+	return pub.intercept(context.Background(), letter, func(letter *Letter) error {
+		return pub.publishWithTransient(letter)
+	})
+}
+
+// publishWithTransient publishes on a transient channel.
+func (pub *Publisher) publishWithTransient(letter *Letter) error {
+
+	prepared, err := pub.prepareLetter(letter)
+	if err != nil {
+		return err
+	}
+
+	channel := prepared.pool.GetTransientChannel(false)
 	defer func() {
 		defer func() {
 			_ = recover()
@@ -153,92 +277,50 @@ func (pub *Publisher) PublishWithTransient(letter *Letter) error {
 		channel.Close()
 	}()
 
-	return channel.Publish(
-		letter.Envelope.Exchange,
-		letter.Envelope.RoutingKey,
-		letter.Envelope.Mandatory,
-		letter.Envelope.Immediate,
-		amqp.Publishing{
-			ContentType:   letter.Envelope.ContentType,
-			Body:          letter.Body,
-			Headers:       letter.Envelope.Headers,
-			DeliveryMode:  letter.Envelope.DeliveryMode,
-			Priority:      letter.Envelope.Priority,
-			MessageId:     letter.LetterID.String(),
-			CorrelationId: letter.Envelope.CorrelationID,
-			Type:          letter.Envelope.Type,
-			Timestamp:     time.Now().UTC(),
-			AppId:         pub.ConnectionPool.Config.ApplicationName,
-		},
-	)
+	return prepared.publish(channel)
 }
 
-// PublishWithConfirmation sends a single message to the address on the letter with confirmation capabilities.
+// PublishWithContext sends a single message to the address on the letter using a cached ChannelHost.
+// Waiting for a channel is abandoned when the context is done. The trace of an inbound message carried by the
+// context (see ReceivedMessage.Context) is copied onto the letter.
 //
-// This is an expensive and slow call - use this when delivery confirmation on publish is your highest priority.
-// A timeout failure drops the letter back in the PublishReceipts.
-// A confirmation failure keeps trying to publish (at least until timeout failure occurs.)
-func (pub *Publisher) PublishWithConfirmation(letter *Letter, timeout time.Duration) {
+// For proper resilience (at least once delivery guarantee over shaky network) use PublishWithConfirmationContext
+func (pub *Publisher) PublishWithContext(ctx context.Context, letter *Letter) error {
 
-	if timeout == 0 {
-		timeout = pub.publishTimeOutDuration
-	}
-
-	for {
-		// Has to use an Ackable channel for Publish Confirmations.
-		chanHost := pub.ConnectionPool.GetChannelFromPool()
-		chanHost.FlushConfirms() // Flush all previous publish confirmations
+	return pub.intercept(ctx, letter, func(letter *Letter) error {
+		return pub.publishWithContext(ctx, letter)
+	})
+}
 
-	Publish:
-		timeoutAfter := time.After(timeout) // timeoutAfter resets everytime we try to publish.
-		err := chanHost.Channel.Publish(
-			letter.Envelope.Exchange,
-			letter.Envelope.RoutingKey,
-			letter.Envelope.Mandatory,
-			letter.Envelope.Immediate,
-			amqp.Publishing{
-				ContentType:   letter.Envelope.ContentType,
-				Body:          letter.Body,
-				Headers:       letter.Envelope.Headers,
-				DeliveryMode:  letter.Envelope.DeliveryMode,
-				Priority:      letter.Envelope.Priority,
-				MessageId:     letter.LetterID.String(),
-				CorrelationId: letter.Envelope.CorrelationID,
-				Type:          letter.Envelope.Type,
-				Timestamp:     time.Now().UTC(),
-				AppId:         pub.ConnectionPool.Config.ApplicationName,
-			},
-		)
-		if err != nil {
-			pub.ConnectionPool.ReturnChannel(chanHost, true)
-			continue // Take it again! From the top!
-		}
+// publishWithContext publishes on a cached ChannelHost acquired within the context.
+func (pub *Publisher) publishWithContext(ctx context.Context, letter *Letter) error {
 
-		// Wait for very next confirmation on this channel, which should be our confirmation.
-		for {
-			select {
-			case <-timeoutAfter:
-				pub.publishReceipt(letter, fmt.Errorf("publish confirmation for LetterID: %s wasn't received in a timely manner - recommend retry/requeue", letter.LetterID.String()))
-				pub.ConnectionPool.ReturnChannel(chanHost, false) // not a channel error
-				return
+	prepared, err := pub.prepareLetter(letter)
+	if err != nil {
+		return err
+	}
 
-			case confirmation := <-chanHost.Confirmations:
+	chanHost, err := prepared.pool.GetChannelFromPoolWithContext(ctx)
+	if err != nil {
+		return newPublishError([]error{ErrChannelAcquire}, err, "publish of LetterID: %s abandoned waiting for a channel", letter.LetterID.String())
+	}
 
-				if !confirmation.Ack {
-					goto Publish //nack has occurred, republish
-				}
+	err = prepared.publish(chanHost.Channel)
+	prepared.pool.ReturnChannel(chanHost, err != nil)
 
-				// Happy Path, publish was received by server and we didn't timeout client side.
-				pub.publishReceipt(letter, nil)
-				pub.ConnectionPool.ReturnChannel(chanHost, false)
-				return
+	return err
+}
 
-			default:
+// PublishWithConfirmation sends a single message to the address on the letter with confirmation capabilities.
+//
+// This is an expensive and slow call - use this when delivery confirmation on publish is your highest priority.
+// A timeout failure drops the letter back in the PublishReceipts.
+// A confirmation failure keeps trying to publish (at least until timeout failure occurs.)
+// The timeout (PublishTimeOutInterval when zero) bounds the whole publish, waiting for a channel and republishing
+// included, so a broker that never confirms (ex. after a failover) can't hold the call forever.
+func (pub *Publisher) PublishWithConfirmation(letter *Letter, timeout time.Duration) {
 
-				time.Sleep(time.Duration(time.Millisecond * 1)) // limits CPU spin up
-			}
-		}
-	}
+	pub.publishReceipt(letter, pub.PublishWithConfirmationError(letter, timeout))
 }
 
 // PublishWithConfirmationError sends a single message to the address on the letter with confirmation capabilities.
@@ -248,186 +330,156 @@ func (pub *Publisher) PublishWithConfirmation(letter *Letter, timeout time.Durat
 // A confirmation failure keeps trying to publish (at least until timeout failure occurs.)
 func (pub *Publisher) PublishWithConfirmationError(letter *Letter, timeout time.Duration) error {
 
-	if timeout == 0 {
-		timeout = pub.publishTimeOutDuration
-	}
-
-	for {
-		// Has to use an Ackable channel for Publish Confirmations.
-		chanHost := pub.ConnectionPool.GetChannelFromPool()
-		chanHost.FlushConfirms() // Flush all previous publish confirmations
-
-	Publish:
-		timeoutAfter := time.After(timeout) // timeoutAfter resets everytime we try to publish.
-		err := chanHost.Channel.Publish(
-			letter.Envelope.Exchange,
-			letter.Envelope.RoutingKey,
-			letter.Envelope.Mandatory,
-			letter.Envelope.Immediate,
-			amqp.Publishing{
-				ContentType:   letter.Envelope.ContentType,
-				Body:          letter.Body,
-				Headers:       letter.Envelope.Headers,
-				DeliveryMode:  letter.Envelope.DeliveryMode,
-				Priority:      letter.Envelope.Priority,
-				MessageId:     letter.LetterID.String(),
-				CorrelationId: letter.Envelope.CorrelationID,
-				Type:          letter.Envelope.Type,
-				Timestamp:     time.Now().UTC(),
-				AppId:         pub.ConnectionPool.Config.ApplicationName,
-			},
-		)
-		if err != nil {
-			pub.ConnectionPool.ReturnChannel(chanHost, true)
-			continue // Take it again! From the top!
-		}
-
-		// Wait for very next confirmation on this channel, which should be our confirmation.
-		for {
-			select {
-			case <-timeoutAfter:
-				pub.ConnectionPool.ReturnChannel(chanHost, false) // not a channel error
-				return fmt.Errorf("publish confirmation for LetterID: %s wasn't received in a timely manner - recommend retry/requeue", letter.LetterID.String())
+	return pub.intercept(context.Background(), letter, func(letter *Letter) error {
+		return pub.publishWithConfirmationError(letter, timeout)
+	})
+}
 
-			case confirmation := <-chanHost.Confirmations:
+// publishWithConfirmationError publishes on cached ChannelHosts until confirmed or the timeout, which bounds the
+// whole publish however often it is republished.
+func (pub *Publisher) publishWithConfirmationError(letter *Letter, timeout time.Duration) error {
 
-				if !confirmation.Ack {
-					goto Publish //nack has occurred, republish
-				}
+	prepared, err := pub.prepareLetter(letter)
+	if err != nil {
+		return err
+	}
 
-				// Happy Path, publish was received by server and we didn't timeout client side.
-				pub.ConnectionPool.ReturnChannel(chanHost, false)
-				return nil
+	if timeout == 0 {
+		timeout = pub.publishTimeOutDuration
+	}
 
-			default:
+	ctx, cancel := pub.confirmationContext(timeout)
+	defer cancel()
 
-				time.Sleep(time.Duration(time.Millisecond * 1)) // limits CPU spin up
-			}
+	return pub.publishConfirmed(ctx, prepared, func(nacked bool, acquireErr error) error {
+		if acquireErr != nil {
+			return newPublishError([]error{ErrTimeout, ErrChannelAcquire}, nil, "publish of LetterID: %s timed out after %s waiting for a channel - recommend retry/requeue", letter.LetterID.String(), timeout)
 		}
-	}
+		return confirmationTimeout(nacked, "publish confirmation for LetterID: %s wasn't received in a timely manner - recommend retry/requeue", letter.LetterID.String())
+	})
 }
 
 // PublishWithConfirmationContext sends a single message to the address on the letter with confirmation capabilities.
 // This is an expensive and slow call - use this when delivery confirmation on publish is your highest priority.
 // A timeout failure drops the letter back in the PublishReceipts.
 // A confirmation failure keeps trying to publish (at least until timeout failure occurs.)
+// The trace of an inbound message carried by the context is copied onto the letter like PublishWithContext.
 func (pub *Publisher) PublishWithConfirmationContext(ctx context.Context, letter *Letter) {
 
-	for {
-		// Has to use an Ackable channel for Publish Confirmations.
-		chanHost := pub.ConnectionPool.GetChannelFromPool()
-		chanHost.FlushConfirms() // Flush all previous publish confirmations
+	pub.publishReceipt(letter, pub.PublishWithConfirmationContextError(ctx, letter))
+}
 
-	Publish:
-		err := chanHost.Channel.Publish(
-			letter.Envelope.Exchange,
-			letter.Envelope.RoutingKey,
-			letter.Envelope.Mandatory,
-			letter.Envelope.Immediate,
-			amqp.Publishing{
-				ContentType:   letter.Envelope.ContentType,
-				Body:          letter.Body,
-				Headers:       letter.Envelope.Headers,
-				DeliveryMode:  letter.Envelope.DeliveryMode,
-				Priority:      letter.Envelope.Priority,
-				MessageId:     letter.LetterID.String(),
-				CorrelationId: letter.Envelope.CorrelationID,
-				Type:          letter.Envelope.Type,
-				Timestamp:     time.Now().UTC(),
-				AppId:         pub.ConnectionPool.Config.ApplicationName,
-			},
-		)
-		if err != nil {
-			pub.ConnectionPool.ReturnChannel(chanHost, true)
-			continue // Take it again! From the top!
-		}
+// PublishWithConfirmationContextError sends a single message to the address on the letter with confirmation capabilities.
+// This is an expensive and slow call - use this when delivery confirmation on publish is your highest priority.
+// A timeout failure drops the letter back in the PublishReceipts.
+// A confirmation failure keeps trying to publish (at least until timeout failure occurs.)
+// The trace of an inbound message carried by the context is copied onto the letter like PublishWithContext.
+func (pub *Publisher) PublishWithConfirmationContextError(ctx context.Context, letter *Letter) error {
 
-		// Wait for very next confirmation on this channel, which should be our confirmation.
-		for {
-			select {
-			case <-ctx.Done():
-				pub.publishReceipt(letter, fmt.Errorf("publish confirmation for LetterID: %s wasn't received before context expired - recommend retry/requeue", letter.LetterID.String()))
-				pub.ConnectionPool.ReturnChannel(chanHost, false) // not a channel error
-				return
+	return pub.intercept(ctx, letter, func(letter *Letter) error {
+		return pub.publishWithConfirmationContextError(ctx, letter)
+	})
+}
 
-			case confirmation := <-chanHost.Confirmations:
+// publishWithConfirmationContextError publishes on cached ChannelHosts until confirmed or the context is done.
+func (pub *Publisher) publishWithConfirmationContextError(ctx context.Context, letter *Letter) error {
 
-				if !confirmation.Ack {
-					goto Publish //nack has occurred, republish
-				}
+	prepared, err := pub.prepareLetter(letter)
+	if err != nil {
+		return err
+	}
 
-				// Happy Path, publish was received by server and we didn't timeout client side.
-				pub.publishReceipt(letter, nil)
-				pub.ConnectionPool.ReturnChannel(chanHost, false)
-				return
+	return pub.publishConfirmed(ctx, prepared, func(nacked bool, acquireErr error) error {
+		if acquireErr != nil {
+			return newPublishError([]error{ErrChannelAcquire}, acquireErr, "publish of LetterID: %s abandoned waiting for a channel", letter.LetterID.String())
+		}
+		return confirmationTimeout(nacked, "publish confirmation for LetterID: %s wasn't received before context expired - recommend retry/requeue", letter.LetterID.String())
+	})
+}
 
-			default:
+// publishConfirmed publishes on cached ChannelHosts until confirmed, nacks republish. Once the context is done
+// the channel is released and expired builds the error, acquireErr is set when no channel could be acquired.
+func (pub *Publisher) publishConfirmed(ctx context.Context, prepared *preparedLetter, expired func(nacked bool, acquireErr error) error) error {
 
-				time.Sleep(time.Duration(time.Millisecond * 1)) // limits CPU spin up
-			}
-		}
+	pub.trackSequence(prepared.sequence)
+
+	if pub.ConfirmWindow() > 1 {
+		return pub.publishWindowed(ctx, prepared, expired)
 	}
-}
 
-// PublishWithConfirmationContextError sends a single message to the address on the letter with confirmation capabilities.
-// This is an expensive and slow call - use this when delivery confirmation on publish is your highest priority.
-// A timeout failure drops the letter back in the PublishReceipts.
-// A confirmation failure keeps trying to publish (at least until timeout failure occurs.)
-func (pub *Publisher) PublishWithConfirmationContextError(ctx context.Context, letter *Letter) error {
+	nacked := false
 
 	for {
 		// Has to use an Ackable channel for Publish Confirmations.
-		chanHost := pub.ConnectionPool.GetChannelFromPool()
+		chanHost, err := prepared.pool.GetChannelFromPoolWithContext(ctx)
+		if err != nil {
+			err = prepared.outcomeError(expired(nacked, err))
+			pub.emitEvent(PublisherEventConfirmationTimeout, err.Error())
+			return err
+		}
 		chanHost.FlushConfirms() // Flush all previous publish confirmations
 
 	Publish:
-		err := chanHost.Channel.Publish(
-			letter.Envelope.Exchange,
-			letter.Envelope.RoutingKey,
-			letter.Envelope.Mandatory,
-			letter.Envelope.Immediate,
-			amqp.Publishing{
-				ContentType:   letter.Envelope.ContentType,
-				Body:          letter.Body,
-				Headers:       letter.Envelope.Headers,
-				DeliveryMode:  letter.Envelope.DeliveryMode,
-				Priority:      letter.Envelope.Priority,
-				MessageId:     letter.LetterID.String(),
-				CorrelationId: letter.Envelope.CorrelationID,
-				Type:          letter.Envelope.Type,
-				Timestamp:     time.Now().UTC(),
-				AppId:         pub.ConnectionPool.Config.ApplicationName,
-			},
-		)
+		err = prepared.publish(chanHost.Channel)
 		if err != nil {
-			pub.ConnectionPool.ReturnChannel(chanHost, true)
-			continue // Take it again! From the top!
+			go prepared.pool.ReturnChannel(chanHost, true) // reconnecting blocks while the broker is unreachable
+			continue                                       // Take it again! From the top!
 		}
 
 		// Wait for very next confirmation on this channel, which should be our confirmation.
-		for {
-			select {
-			case <-ctx.Done():
-				pub.ConnectionPool.ReturnChannel(chanHost, false) // not a channel error
-				return fmt.Errorf("publish confirmation for LetterID: %s wasn't received before context expired - recommend retry/requeue", letter.LetterID.String())
-
-			case confirmation := <-chanHost.Confirmations:
+		select {
+		case <-ctx.Done():
+			prepared.pool.ReturnChannel(chanHost, false) // not a channel error
+			prepared.unconfirmed(FailureReasonTimeout)
+			err = prepared.outcomeError(expired(nacked, nil))
+			pub.emitEvent(PublisherEventConfirmationTimeout, err.Error())
+			return err
+
+		case confirmation, ok := <-chanHost.Confirmations:
+
+			if !ok {
+				// The channel closed (ex. a broker failover), this confirmation will never arrive.
+				prepared.lost()
+				go prepared.pool.ReturnChannel(chanHost, true)
+				continue
+			}
 
-				if !confirmation.Ack {
-					goto Publish //nack has occurred, republish
+			if !confirmation.Ack {
+				prepared.unconfirmed(FailureReasonNack)
+				if fallback := pub.fallbackConfig(); fallback != nil {
+					prepared.pool.ReturnChannel(chanHost, false)
+					return pub.parkNacked(prepared, fallback)
 				}
+				nacked = true
+				goto Publish //nack has occurred, republish
+			}
 
-				pub.ConnectionPool.ReturnChannel(chanHost, false)
-				return nil
-
-			default:
+			prepared.confirmed()
 
-				time.Sleep(time.Duration(time.Millisecond * 1)) // limits CPU spin up
-			}
+			// Happy Path, publish was received by server and we didn't timeout client side.
+			prepared.pool.ReturnChannel(chanHost, false)
+			return nil
 		}
 	}
 }
 
+// confirmationContext is done once the timeout passed on the Publisher's clock.
+func (pub *Publisher) confirmationContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	timeoutAfter := pub.currentClock().After(timeout)
+
+	go func() {
+		select {
+		case <-timeoutAfter:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
 // PublishWithConfirmationTransient sends a single message to the address on the letter with confirmation capabilities on transient Channels.
 // This is an expensive and slow call - use this when delivery confirmation on publish is your highest priority.
 // A timeout failure drops the letter back in the PublishReceipts. When combined with QueueLetter, it automatically
@@ -435,36 +487,37 @@ func (pub *Publisher) PublishWithConfirmationContextError(ctx context.Context, l
 // A confirmation failure keeps trying to publish (at least until timeout failure occurs.)
 func (pub *Publisher) PublishWithConfirmationTransient(letter *Letter, timeout time.Duration) {
 
+	pub.publishReceipt(letter, pub.intercept(context.Background(), letter, func(letter *Letter) error {
+		return pub.publishWithConfirmationTransient(letter, timeout)
+	}))
+}
+
+// publishWithConfirmationTransient publishes on transient channels until confirmed or the timeout, which bounds
+// the whole publish however often it is republished.
+func (pub *Publisher) publishWithConfirmationTransient(letter *Letter, timeout time.Duration) error {
+
+	prepared, err := pub.prepareLetter(letter)
+	if err != nil {
+		return err
+	}
+	pub.trackSequence(prepared.sequence)
+
+	nacked := false
+
 	if timeout == 0 {
 		timeout = pub.publishTimeOutDuration
 	}
 
+	timeoutAfter := pub.currentClock().After(timeout)
+
 	for {
 		// Has to use an Ackable channel for Publish Confirmations.
-		channel := pub.ConnectionPool.GetTransientChannel(true)
+		channel := prepared.pool.GetTransientChannel(true)
 		confirms := make(chan amqp.Confirmation, 1)
 		channel.NotifyPublish(confirms)
 
 	Publish:
-		timeoutAfter := time.After(timeout)
-		err := channel.Publish(
-			letter.Envelope.Exchange,
-			letter.Envelope.RoutingKey,
-			letter.Envelope.Mandatory,
-			letter.Envelope.Immediate,
-			amqp.Publishing{
-				ContentType:   letter.Envelope.ContentType,
-				Body:          letter.Body,
-				Headers:       letter.Envelope.Headers,
-				DeliveryMode:  letter.Envelope.DeliveryMode,
-				Priority:      letter.Envelope.Priority,
-				MessageId:     letter.LetterID.String(),
-				CorrelationId: letter.Envelope.CorrelationID,
-				Type:          letter.Envelope.Type,
-				Timestamp:     time.Now().UTC(),
-				AppId:         pub.ConnectionPool.Config.ApplicationName,
-			},
-		)
+		err := prepared.publish(channel)
 		if err != nil {
 			channel.Close()
 			if pub.sleepOnErrorInterval < 0 {
@@ -474,28 +527,37 @@ func (pub *Publisher) PublishWithConfirmationTransient(letter *Letter, timeout t
 		}
 
 		// Wait for very next confirmation on this channel, which should be our confirmation.
-		for {
-			select {
-			case <-timeoutAfter:
-				pub.publishReceipt(letter, fmt.Errorf("publish confirmation for LetterID: %s wasn't received in a timely manner (%dms) - recommend retry/requeue", letter.LetterID.String(), timeout))
-				channel.Close()
-				return
+		select {
+		case <-timeoutAfter:
+			prepared.unconfirmed(FailureReasonTimeout)
+			channel.Close()
+			err = prepared.outcomeError(confirmationTimeout(nacked, "publish confirmation for LetterID: %s wasn't received in a timely manner (%s) - recommend retry/requeue", letter.LetterID.String(), timeout))
+			pub.emitEvent(PublisherEventConfirmationTimeout, err.Error())
+			return err
 
-			case confirmation := <-confirms:
+		case confirmation, ok := <-confirms:
 
-				if !confirmation.Ack {
-					goto Publish //nack has occurred, republish
-				}
+			if !ok {
+				// The channel closed (ex. a broker failover), this confirmation will never arrive.
+				prepared.lost()
+				continue
+			}
 
-				// Happy Path, publish was received by server and we didn't timeout client side.
-				pub.publishReceipt(letter, nil)
-				channel.Close()
-				return
+			if !confirmation.Ack {
+				prepared.unconfirmed(FailureReasonNack)
+				if fallback := pub.fallbackConfig(); fallback != nil {
+					channel.Close()
+					return pub.parkNacked(prepared, fallback)
+				}
+				nacked = true
+				goto Publish //nack has occurred, republish
+			}
 
-			default:
+			prepared.confirmed()
 
-				time.Sleep(time.Duration(time.Millisecond * 4)) // limits CPU spin up
-			}
+			// Happy Path, publish was received by server and we didn't timeout client side.
+			channel.Close()
+			return nil
 		}
 	}
 }
@@ -544,38 +606,72 @@ AutoPublishLoop:
 
 func (pub *Publisher) deliverLetters() bool {
 
-	// Allow parallel publishing with transient channels.
-	parallelPublishSemaphore := make(chan struct{}, pub.ConnectionPool.Config.MaxCacheChannelCount/2+1)
+	// Allow parallel publishing, each worker on a cached channel of its own.
+	parallelPublishSemaphore := make(chan struct{}, pub.autoPublishWorkerCount())
+
+	channelMaxExhausted := false
 
 	for {
 
+		// Hold letters in the queue instead of failing them while the pool has no channels to give.
+		if exhausted := pub.ConnectionPool.ChannelMaxExhausted(); exhausted != channelMaxExhausted {
+			channelMaxExhausted = exhausted
+			if exhausted {
+				pub.emitEvent(PublisherEventChannelMaxExhausted, ErrChannelMaxExhausted.Error())
+			} else {
+				pub.emitEvent(PublisherEventChannelMaxRecovered, "channels are available again")
+			}
+		}
+
 		// Publish the letter.
 	PublishLoop:
-		for {
-			select {
-			case letter := <-pub.letters:
-
-				parallelPublishSemaphore <- struct{}{}
-				go func(letter *Letter) {
-					pub.PublishWithConfirmation(letter, pub.publishTimeOutDuration)
-					<-parallelPublishSemaphore
-				}(letter)
-
-			default:
+		for !channelMaxExhausted && !pub.Paused() {
+			// Take a worker before the letter so a high lane letter queued meanwhile isn't overtaken.
+			parallelPublishSemaphore <- struct{}{}
 
+			letter, ok := pub.nextLetter()
+			if !ok {
+				<-parallelPublishSemaphore
 				if pub.sleepOnIdleInterval > 0 {
 					time.Sleep(pub.sleepOnIdleInterval)
 				}
 				break PublishLoop
+			}
 
+			// Refuse letters of tenants over their quota instead of letting them slow everyone down.
+			if tenant, err := pub.admitTenant(letter); err != nil {
+				pub.emitTenantEvent(tenant, err.Error())
+				pub.publishReceipt(letter, err)
+				pub.pending.done()
+				<-parallelPublishSemaphore
+				continue
 			}
+
+			go func(letter *Letter) {
+				err := pub.PublishWithConfirmationError(letter, pub.publishTimeOutDuration)
+				if err == nil {
+					pub.unpersist(letter)
+				} else if pub.retryLetter(letter, err) {
+					<-parallelPublishSemaphore
+					return
+				}
+				pub.publishReceipt(letter, err)
+				pub.pending.done()
+				<-parallelPublishSemaphore
+			}(letter)
+		}
+
+		if channelMaxExhausted {
+			time.Sleep(channelMaxMinBackoff)
+		} else if pub.Paused() {
+			pub.waitWhilePaused()
 		}
 
 		// Detect if we should stop publishing.
 		select {
 		case stop := <-pub.autoStop:
 			if stop {
-				close(pub.letters)
+				pub.closeLanes()
 				return true
 			}
 		default:
@@ -597,11 +693,12 @@ func (pub *Publisher) stopAutoPublish() {
 }
 
 // QueueLetters allows you to bulk queue letters that will be consumed by AutoPublish. By default, AutoPublish uses PublishWithConfirmation as the mechanism for publishing.
+// Stops at the first letter that couldn't be queued, see QueueLetter.
 func (pub *Publisher) QueueLetters(letters []*Letter) bool {
 
 	for _, letter := range letters {
 
-		if ok := pub.safeSend(letter); !ok {
+		if err := pub.enqueue(letter); err != nil {
 			return false
 		}
 	}
@@ -610,48 +707,246 @@ func (pub *Publisher) QueueLetters(letters []*Letter) bool {
 }
 
 // QueueLetter queues up a letter that will be consumed by AutoPublish. By default, AutoPublish uses PublishWithConfirmation as the mechanism for publishing.
+// False when the publisher is shut down or, with the error QueueOverflow policy, when the queue is full.
 func (pub *Publisher) QueueLetter(letter *Letter) bool {
 
-	return pub.safeSend(letter)
+	return pub.enqueue(letter) == nil
 }
 
-// safeSend should handle a scenario on publishing to a closed channel.
-func (pub *Publisher) safeSend(letter *Letter) (closed bool) {
-	defer func() {
-		if recover() != nil {
-			closed = false
-		}
-	}()
+// QueueLetterWithError is QueueLetter telling why the letter wasn't queued, ErrQueueFull or ErrPublisherClosed.
+func (pub *Publisher) QueueLetterWithError(letter *Letter) error {
 
-	pub.letters <- letter
-	return true // success
+	return pub.enqueue(letter)
 }
 
 // publishReceipt sends the status to the receipt channel.
 func (pub *Publisher) publishReceipt(letter *Letter, err error) {
 
-	go func(*Letter, error) {
-		publishReceipt := &PublishReceipt{
-			LetterID: letter.LetterID,
-			Error:    err,
-		}
+	if err != nil {
+		pub.journalFailure(letter, err) // before the receipt so the journal is ahead of any retry
+	}
+
+	publishReceipt := &PublishReceipt{
+		PublisherName: pub.Name,
+		LetterID:      letter.LetterID,
+		Error:         err,
+	}
+
+	if err == nil {
+		publishReceipt.Success = true
+	} else {
+		publishReceipt.FailedLetter = letter
+	}
 
-		if err == nil {
-			publishReceipt.Success = true
-		} else {
-			publishReceipt.FailedLetter = letter
+	pub.sendReceipt(publishReceipt)
+}
+
+// preparedLetter is a Letter resolved into everything needed to go out on the wire.
+type preparedLetter struct {
+	pub        *Publisher
+	pool       *ConnectionPool
+	letterID   uuid.UUID
+	sequence   uint64
+	exchange   string
+	routingKey string
+	mandatory  bool
+	immediate  bool
+	publishing amqp.Publishing
+	attempts   int
+	sentAt     time.Time
+	lostOnce   bool // an earlier publish went out on a channel that died unconfirmed
+}
+
+// publish sends the preparedLetter on the provided amqp Channel.
+func (pl *preparedLetter) publish(channel *amqp.Channel) error {
+	pl.attempts++
+	if pl.attempts > 1 {
+		pl.pub.stats.retry()
+	}
+
+	pl.sentAt = pl.pub.currentClock().Now()
+	err := channel.Publish(pl.exchange, pl.routingKey, pl.mandatory, pl.immediate, pl.publishing)
+	pl.pub.stats.record(pl, err)
+	if err == nil {
+		pl.pub.archive(pl)
+		pl.pub.checkBodySizes()
+	}
+
+	return err
+}
+
+// unconfirmed is called when the server nacked the preparedLetter or its confirmation never arrived.
+func (pl *preparedLetter) unconfirmed(reason string) {
+	pl.pub.stats.unpublish(pl, reason)
+}
+
+// confirmed is called once the server confirmed the preparedLetter.
+func (pl *preparedLetter) confirmed() {
+	pl.pub.stats.confirm(pl.pub.currentClock().Now().Sub(pl.sentAt))
+	pl.pub.recordSequence(pl)
+}
+
+// prepareLetter resolves the address of the letter and builds the amqp.Publishing for it.
+// An error here is never a channel error so it should be surfaced without touching the pool.
+func (pub *Publisher) prepareLetter(letter *Letter) (*preparedLetter, error) {
+	return pub.prepareLetterOn(letter, nil)
+}
+
+// prepareLetterOn is prepareLetter with letters without an Envelope.Pool prepared for the pinned pool (unless nil)
+// instead of resolving one, callers holding a channel of a pool keep every letter on it as shards rotate.
+func (pub *Publisher) prepareLetterOn(letter *Letter, pinned *ConnectionPool) (*preparedLetter, error) {
+
+	if letter.Envelope == nil {
+		return nil, fmt.Errorf("LetterID: %s has no envelope to address it with", letter.LetterID.String())
+	}
+
+	exchange, routingKey, err := pub.resolveAddress(letter.Envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = pub.checkDeclaredExchange(letter, exchange); err != nil {
+		return nil, err
+	}
+
+	pool := pinned
+	if pool == nil || letter.Envelope.Pool != "" {
+		if pool, err = pub.resolvePool(letter.Envelope); err != nil {
+			return nil, err
 		}
+	}
+
+	if err = pub.autoDeclare(pool, letter, exchange, routingKey); err != nil {
+		return nil, err
+	}
+
+	if err = pub.verifyExchange(pool, letter, exchange); err != nil {
+		return nil, err
+	}
+
+	contentType, err := pub.negotiateContentType(letter)
+	if err != nil {
+		return nil, err
+	}
+
+	body, contentEncoding, err := pub.compressBody(letter, contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	body, encryptionHeaders, err := pub.encryptBody(letter, body)
+	if err != nil {
+		return nil, err
+	}
+
+	body, headers, err := pub.offloadBody(letter, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if encryptionHeaders != nil {
+		headers = mergeHeaders(headers, encryptionHeaders)
+	}
+
+	if letter.Envelope.Mandatory || letter.Envelope.Immediate {
+		pub.watchPoolReturns(pool)
+	}
+
+	return &preparedLetter{
+		pub:        pub,
+		pool:       pool,
+		letterID:   letter.LetterID,
+		sequence:   letter.Sequence,
+		exchange:   exchange,
+		routingKey: routingKey,
+		mandatory:  letter.Envelope.Mandatory,
+		immediate:  letter.Envelope.Immediate,
+		publishing: amqp.Publishing{
+			ContentType:     contentType,
+			ContentEncoding: contentEncoding,
+			Body:            body,
+			Headers:         pub.stampPublishTime(pub.stampHeaders(headers)),
+			DeliveryMode:    letter.Envelope.DeliveryMode,
+			Priority:        letter.Envelope.Priority,
+			MessageId:       messageID(letter),
+			CorrelationId:   letter.Envelope.CorrelationID,
+			ReplyTo:         letter.Envelope.ReplyTo,
+			Expiration:      letter.Envelope.Expiration,
+			Type:            letter.Envelope.Type,
+			UserId:          letter.Envelope.UserID,
+			Timestamp:       pub.timestamp(letter.Envelope),
+			AppId:           appID(pool, letter.Envelope),
+		},
+	}, nil
+}
 
-		pub.publishReceipts <- publishReceipt
-	}(letter, err)
+// messageID is the Envelope's MessageID, or the LetterID.
+func messageID(letter *Letter) string {
+	if letter.Envelope.MessageID != "" {
+		return letter.Envelope.MessageID
+	}
+	return letter.LetterID.String()
+}
+
+// timestamp is the Envelope's Timestamp, or now.
+func (pub *Publisher) timestamp(envelope *Envelope) time.Time {
+	if !envelope.Timestamp.IsZero() {
+		return envelope.Timestamp.UTC()
+	}
+	return pub.currentClock().Now().UTC()
+}
+
+// appID is the Envelope's AppID, or the pool's ApplicationName.
+func appID(pool *ConnectionPool, envelope *Envelope) string {
+	if envelope.AppID != "" {
+		return envelope.AppID
+	}
+	return pool.Config.ApplicationName
+}
+
+// SetPoolManager lets letters choose the ConnectionPool they are published on with Envelope.Pool.
+func (pub *Publisher) SetPoolManager(pm *PoolManager) {
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	pub.poolManager = pm
+}
+
+// resolvePool returns the pool named on the envelope, or the Publisher's active ConnectionPool.
+func (pub *Publisher) resolvePool(envelope *Envelope) (*ConnectionPool, error) {
+
+	if envelope.Pool == "" {
+		return pub.activePool(), nil
+	}
+
+	pub.pubRWLock.RLock()
+	pm := pub.poolManager
+	pub.pubRWLock.RUnlock()
+
+	if pm == nil {
+		return nil, fmt.Errorf("can't publish to pool %s, the publisher has no PoolManager", envelope.Pool)
+	}
+
+	pool, ok := pm.GetPool(envelope.Pool)
+	if !ok {
+		return nil, fmt.Errorf("can't publish to pool %s, no such pool is registered", envelope.Pool)
+	}
+
+	return pool, nil
 }
 
 // Shutdown cleanly shutdown the publisher and resets it's internal state.
 func (pub *Publisher) Shutdown(shutdownPools bool) {
 
 	pub.stopAutoPublish()
+	pub.stopStandby()
+	pub.stopReturns()
+	pub.closeConfirmWindows()
+	unregisterPublisher(pub)
 
 	if shutdownPools { // in case the ChannelPool is shared between structs, you can prevent it from shutting down
-		pub.ConnectionPool.Shutdown()
+		for _, pool := range pub.Shards() {
+			pool.Shutdown()
+		}
 	}
 }
@@ -0,0 +1,74 @@
+package tcr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// PublishTx publishes the letters in one AMQP transaction on a dedicated tx mode channel: the broker routes all
+// of them on commit or none of them. Unlike confirms this makes the group atomic, at the cost of a round trip
+// per commit and a channel per call. Every letter must be addressed to the same ConnectionPool as a transaction
+// can't span connections. No receipts are sent, the error (if any) covers the whole group.
+func (pub *Publisher) PublishTx(letters []*Letter) error {
+
+	if len(letters) == 0 {
+		return errors.New("can't publish an empty transaction")
+	}
+
+	if letters[0] == nil || letters[0].Envelope == nil {
+		return errors.New("can't publish a transaction with a letter missing its envelope")
+	}
+
+	pool, err := pub.resolvePool(letters[0].Envelope)
+	if err != nil {
+		return err
+	}
+
+	chanHost := pool.GetTxChannel()
+	defer pool.ReturnChannel(chanHost, false)
+
+	for i, letter := range letters {
+		err := pub.intercept(context.Background(), letter, func(letter *Letter) error {
+			prepared, err := pub.prepareLetterOn(letter, pool)
+			if err != nil {
+				return err
+			}
+
+			if prepared.pool != pool {
+				return fmt.Errorf("LetterID: %s is addressed to another pool than the transaction's, a transaction can't span connections", letter.LetterID.String())
+			}
+
+			return prepared.publish(chanHost.Channel)
+		})
+		if err != nil {
+			pub.rollbackTx(chanHost, letters[:i])
+			return fmt.Errorf("transaction of %d letters rolled back, letter %d failed: %w", len(letters), i, err)
+		}
+	}
+
+	if err := chanHost.Channel.TxCommit(); err != nil {
+		// A failed commit closes the channel, nothing was routed.
+		pub.forgetTx(letters)
+		return fmt.Errorf("transaction of %d letters failed to commit: %w", len(letters), err)
+	}
+
+	return nil
+}
+
+// rollbackTx discards the letters published in the transaction so far.
+func (pub *Publisher) rollbackTx(chanHost *ChannelHost, published []*Letter) {
+
+	_ = chanHost.Channel.TxRollback() // a closed channel discarded them already
+	pub.forgetTx(published)
+}
+
+// forgetTx lets deduplication publish the letters of a failed transaction again.
+func (pub *Publisher) forgetTx(letters []*Letter) {
+
+	for _, letter := range letters {
+		if key := dedupKey(letter); key != "" {
+			pub.forget(key)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package tcr
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	// DefaultQueueCapacity is how many letters QueueLetter holds for the auto-publisher by default.
+	DefaultQueueCapacity = 1000
+
+	// QueueOverflowBlock waits for room in a full queue (default).
+	QueueOverflowBlock = "block"
+
+	// QueueOverflowError refuses letters while the queue is full.
+	QueueOverflowError = "error"
+
+	// QueueOverflowDropOldest makes room by failing the oldest queued letter with ErrLetterDropped.
+	QueueOverflowDropOldest = "drop-oldest"
+)
+
+// QueueLane orders queued letters for the auto-publisher, every waiting high letter is published before any
+// normal one and every normal one before any low one. Each lane holds up to the queue capacity.
+type QueueLane int
+
+const (
+	// QueueLaneNormal is the lane of letters without a Lane (default).
+	QueueLaneNormal QueueLane = iota
+
+	// QueueLaneHigh jumps the backlog, ex. urgent control messages.
+	QueueLaneHigh
+
+	// QueueLaneLow waits for the other lanes to drain, ex. bulk exports.
+	QueueLaneLow
+)
+
+var (
+	// ErrQueueFull is returned by QueueLetterWithError with the error QueueOverflow policy.
+	ErrQueueFull = errors.New("publisher queue is full")
+
+	// ErrLetterDropped is the receipt error of letters dropped by the drop-oldest QueueOverflow policy.
+	ErrLetterDropped = errors.New("letter dropped from the full publisher queue for a newer one")
+
+	// ErrPublisherClosed is returned when queueing letters on a Publisher that was shut down, it is ErrShutdown.
+	ErrPublisherClosed = ErrShutdown
+)
+
+func queueCapacity(capacity int) int {
+	if capacity <= 0 {
+		return DefaultQueueCapacity
+	}
+	return capacity
+}
+
+// enqueue persists the letter to the outbox, if any, before queueing it.
+func (pub *Publisher) enqueue(letter *Letter) error {
+
+	pub.pubRWLock.RLock()
+	intakeStopped := pub.intakeStopped
+	pub.pubRWLock.RUnlock()
+
+	if intakeStopped {
+		return ErrPublisherClosed
+	}
+
+	if err := pub.persist(letter); err != nil {
+		return err
+	}
+
+	if err := pub.queueLetter(letter); err != nil {
+		pub.unpersist(letter)
+		return err
+	}
+
+	return nil
+}
+
+// lane is the channel of the letter's QueueLane.
+func (pub *Publisher) lane(letter *Letter) chan *Letter {
+
+	switch letter.Lane {
+	case QueueLaneHigh:
+		return pub.highLetters
+	case QueueLaneLow:
+		return pub.lowLetters
+	default:
+		return pub.letters
+	}
+}
+
+// nextLetter takes the letter of the highest lane with one waiting, false when every lane is empty.
+func (pub *Publisher) nextLetter() (*Letter, bool) {
+
+	for _, lane := range []chan *Letter{pub.highLetters, pub.letters, pub.lowLetters} {
+		select {
+		case letter, ok := <-lane:
+			if ok {
+				return letter, true
+			}
+		default:
+		}
+	}
+
+	return nil, false
+}
+
+// queueDepth is the number of letters waiting in all lanes.
+func (pub *Publisher) queueDepth() int {
+	return len(pub.highLetters) + len(pub.letters) + len(pub.lowLetters)
+}
+
+// closeLanes closes every lane, queueing afterwards fails with ErrPublisherClosed.
+func (pub *Publisher) closeLanes() {
+	close(pub.highLetters)
+	close(pub.letters)
+	close(pub.lowLetters)
+}
+
+// queueLetter applies the QueueOverflow policy and handles a scenario on publishing to a closed channel.
+func (pub *Publisher) queueLetter(letter *Letter) (err error) {
+	pub.pending.add()
+	defer func() {
+		if recover() != nil {
+			err = ErrPublisherClosed
+		}
+		if err != nil {
+			pub.pending.done()
+		} else {
+			pub.trackSequence(letter.Sequence) // in flight from now on, not from when a worker takes it
+		}
+	}()
+
+	lane := pub.lane(letter)
+
+	switch strings.ToLower(pub.queueOverflow) {
+	case QueueOverflowError:
+		select {
+		case lane <- letter:
+			return nil
+		default:
+			return ErrQueueFull
+		}
+
+	case QueueOverflowDropOldest:
+		for {
+			select {
+			case lane <- letter:
+				return nil
+			default:
+			}
+
+			select {
+			case dropped, ok := <-lane:
+				if !ok {
+					return ErrPublisherClosed
+				}
+				pub.unpersist(dropped)
+				pub.publishReceipt(dropped, ErrLetterDropped)
+				pub.pending.done()
+			default: // the auto-publisher made room meanwhile
+			}
+		}
+
+	default:
+		lane <- letter
+		return nil
+	}
+}
+
+// SetAutoPublishWorkers sets how many letters auto-publishing publishes concurrently, taking effect on the next
+// StartAutoPublishing. Zero restores the default of half the pool's MaxCacheChannelCount plus one.
+func (pub *Publisher) SetAutoPublishWorkers(workers int) {
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	pub.autoPublishWorkers = workers
+}
+
+// autoPublishWorkerCount is capped at MaxCacheChannelCount, more workers would only wait for channels.
+func (pub *Publisher) autoPublishWorkerCount() int {
+
+	pub.pubRWLock.RLock()
+	workers := pub.autoPublishWorkers
+	pub.pubRWLock.RUnlock()
+
+	channels := pub.channelCapacity()
+	if workers <= 0 {
+		return channels/2 + 1
+	}
+
+	if channels > 0 && workers > channels {
+		return channels
+	}
+
+	return workers
+}
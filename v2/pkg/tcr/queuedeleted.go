@@ -0,0 +1,100 @@
+package tcr
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// QueueDeletedResubscribe keeps trying to consume the queue until someone declares it again (default).
+	QueueDeletedResubscribe = "resubscribe"
+
+	// QueueDeletedRecreate declares the queue again from the QueueDeletedConfig and resubscribes.
+	QueueDeletedRecreate = "recreate"
+
+	// QueueDeletedStop stops consuming, as StopConsuming would.
+	QueueDeletedStop = "stop"
+)
+
+// ErrQueueDeleted is sent to Errors when the queue of a Consumer was deleted while consuming it.
+var ErrQueueDeleted = errors.New("queue was deleted")
+
+// QueueDeletedConfig is how a Consumer reacts to its queue being deleted while consuming.
+type QueueDeletedConfig struct {
+	Policy string      `json:"Policy,omitempty" yaml:"Policy,omitempty"` // resubscribe (default), recreate or stop
+	Queue  *OwnedQueue `json:"Queue,omitempty" yaml:"Queue,omitempty"`   // declared (and bound) by the recreate policy, defaults to the OwnedQueue
+}
+
+// SetQueueDeletedPolicy replaces the ConsumerConfig's QueueDeleted, nil resubscribes.
+func (con *Consumer) SetQueueDeletedPolicy(config *QueueDeletedConfig) {
+	con.conLock.Lock()
+	defer con.conLock.Unlock()
+
+	con.queueDeleted = config
+}
+
+// handleQueueDeleted reports the deleted queue, returning whether to stop consuming and whether to recreate it.
+func (con *Consumer) handleQueueDeleted() (stop bool, recreate bool) {
+
+	con.conLock.Lock()
+	config := con.queueDeleted
+	con.conLock.Unlock()
+
+	policy := QueueDeletedResubscribe
+	if config != nil && config.Policy != "" {
+		policy = config.Policy
+	}
+
+	con.errors <- fmt.Errorf("consumer %q lost queue %q (policy: %s): %w", con.ConsumerName, con.QueueName, policy, ErrQueueDeleted)
+
+	switch policy {
+	case QueueDeletedStop:
+		return true, false
+	case QueueDeletedRecreate:
+		return false, true
+	default:
+		return false, false
+	}
+}
+
+// recreateQueue declares the queue of the recreate policy on the consuming channel, the owned queue is declared
+// there anyway.
+func (con *Consumer) recreateQueue(chanHost *ChannelHost) error {
+
+	con.conLock.Lock()
+	config := con.queueDeleted
+	con.conLock.Unlock()
+
+	if config == nil || config.Queue == nil {
+		return nil
+	}
+
+	return con.declareQueue(chanHost, config.Queue)
+}
+
+// queueExists passively declares the queue on a transient channel, the server closes it when the queue is gone.
+func (con *Consumer) queueExists() (bool, error) {
+
+	channel := con.ConnectionPool.GetTransientChannel(false)
+	_, err := channel.QueueDeclarePassive(con.QueueName, false, false, false, false, nil)
+	if err == nil {
+		channel.Close()
+		return true, nil
+	}
+
+	if isNotFound(err) {
+		return false, nil
+	}
+
+	channel.Close()
+	return false, err
+}
+
+// isNotFound is the channel exception of a queue (or exchange) that doesn't exist.
+func isNotFound(err error) bool {
+
+	var amqpErr *amqp.Error
+	return errors.As(err, &amqpErr) && amqpErr.Code == amqp.NotFound
+}
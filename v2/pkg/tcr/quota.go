@@ -0,0 +1,148 @@
+package tcr
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrTenantQuotaExceeded is the receipt error of letters the auto-publisher refused because their tenant
+// exceeded its quota.
+var ErrTenantQuotaExceeded = errors.New("tenant quota exceeded")
+
+// TenantQuotaConfig limits how fast letters of each tenant, identified by the value of Header on the
+// Envelope, are auto-published. Letters without the header are not limited.
+type TenantQuotaConfig struct {
+	Header            string                  `json:"Header" yaml:"Header"`
+	MessagesPerSecond float64                 `json:"MessagesPerSecond,omitempty" yaml:"MessagesPerSecond,omitempty"` // 0 is unlimited
+	BytesPerSecond    float64                 `json:"BytesPerSecond,omitempty" yaml:"BytesPerSecond,omitempty"`       // 0 is unlimited
+	Burst             int                     `json:"Burst,omitempty" yaml:"Burst,omitempty"`                         // messages allowed at once, defaults to 1
+	Tenants           map[string]*TenantQuota `json:"Tenants,omitempty" yaml:"Tenants,omitempty"`                     // per tenant overrides
+}
+
+// TenantQuota overrides the default quota of a single tenant.
+type TenantQuota struct {
+	MessagesPerSecond float64 `json:"MessagesPerSecond,omitempty" yaml:"MessagesPerSecond,omitempty"`
+	BytesPerSecond    float64 `json:"BytesPerSecond,omitempty" yaml:"BytesPerSecond,omitempty"`
+	Burst             int     `json:"Burst,omitempty" yaml:"Burst,omitempty"`
+}
+
+// tenantQuotas tracks a message and a byte bucket per tenant.
+type tenantQuotas struct {
+	config  *TenantQuotaConfig
+	tenants map[string]*tenantBuckets
+	lock    *sync.Mutex
+}
+
+type tenantBuckets struct {
+	messages *rateLimiter
+	bytes    *rateLimiter
+}
+
+// newTenantQuotas returns nil (unlimited) without a config or header.
+func newTenantQuotas(config *TenantQuotaConfig) *tenantQuotas {
+
+	if config == nil || config.Header == "" {
+		return nil
+	}
+
+	return &tenantQuotas{
+		config:  config,
+		tenants: make(map[string]*tenantBuckets),
+		lock:    &sync.Mutex{},
+	}
+}
+
+// SetTenantQuota enforces the quotas in the auto-publish loop, nil removes them.
+func (pub *Publisher) SetTenantQuota(config *TenantQuotaConfig) {
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	pub.tenantQuotas = newTenantQuotas(config)
+}
+
+// admitTenant returns the letter's tenant and ErrTenantQuotaExceeded when the tenant is over its quota.
+func (pub *Publisher) admitTenant(letter *Letter) (string, error) {
+
+	pub.pubRWLock.RLock()
+	tq := pub.tenantQuotas
+	pub.pubRWLock.RUnlock()
+
+	if tq == nil || letter.Envelope == nil {
+		return "", nil
+	}
+
+	tenant, ok := letter.Envelope.Headers[tq.config.Header].(string)
+	if !ok || tenant == "" {
+		return "", nil
+	}
+
+	buckets := tq.buckets(tenant)
+	if !buckets.messages.allow(1) {
+		return tenant, fmt.Errorf("%w: tenant %s is over %v messages/sec", ErrTenantQuotaExceeded, tenant, buckets.messages.rate)
+	}
+
+	if !buckets.bytes.allow(float64(len(letter.Body))) {
+		return tenant, fmt.Errorf("%w: tenant %s is over %v bytes/sec", ErrTenantQuotaExceeded, tenant, buckets.bytes.rate)
+	}
+
+	return tenant, nil
+}
+
+func (tq *tenantQuotas) buckets(tenant string) *tenantBuckets {
+	tq.lock.Lock()
+	defer tq.lock.Unlock()
+
+	buckets, ok := tq.tenants[tenant]
+	if ok {
+		return buckets
+	}
+
+	quota := &TenantQuota{
+		MessagesPerSecond: tq.config.MessagesPerSecond,
+		BytesPerSecond:    tq.config.BytesPerSecond,
+		Burst:             tq.config.Burst,
+	}
+	if override, ok := tq.config.Tenants[tenant]; ok && override != nil {
+		quota = override
+	}
+
+	buckets = &tenantBuckets{
+		messages: newRateLimiter(quota.MessagesPerSecond, quota.Burst),
+		bytes:    newRateLimiter(quota.BytesPerSecond, int(quota.BytesPerSecond)), // a second worth of bytes
+	}
+	tq.tenants[tenant] = buckets
+
+	return buckets
+}
+
+// allow takes n tokens without blocking. Requests larger than the burst need a full bucket.
+// A nil rateLimiter always allows.
+func (rl *rateLimiter) allow(n float64) bool {
+
+	if rl == nil {
+		return true
+	}
+
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	now := time.Now()
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+	if rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+	rl.last = now
+
+	if n > rl.burst {
+		n = rl.burst
+	}
+
+	if rl.tokens < n {
+		return false
+	}
+
+	rl.tokens -= n
+	return true
+}
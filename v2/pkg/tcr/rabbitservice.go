@@ -17,9 +17,11 @@ type RabbitService struct {
 	ConnectionPool       *ConnectionPool
 	Topologer            *Topologer
 	Publisher            *Publisher
+	PoolManager          *PoolManager // the seasoning's named Pools, nil without any
 	encryptionConfigured bool
 	centralErr           chan error
 	consumers            map[string]*Consumer
+	publishers           map[string]*Publisher
 	shutdownSignal       chan bool
 	shutdown             bool
 	monitorSleepInterval time.Duration
@@ -51,6 +53,10 @@ func NewRabbitServiceWithConnectionPool(
 	processPublishReceipts func(*PublishReceipt),
 	processError func(error)) (*RabbitService, error) {
 
+	if _, err := configuredMarshaller(config.PublisherConfig.Marshaller); err != nil {
+		return nil, fmt.Errorf("publisher: %w", err)
+	}
+
 	publisher := NewPublisherFromConfig(config, connectionPool)
 	return NewRabbitServiceWithPublisher(publisher, config, passphrase, salt, processPublishReceipts, processError)
 }
@@ -65,6 +71,14 @@ func NewRabbitServiceWithPublisher(
 	processError func(error)) (*RabbitService, error) {
 
 	topologer := NewTopologer(publisher.ConnectionPool)
+	if config.ManagementConfig != nil {
+		management, err := NewManagementClient(config.ManagementConfig)
+		if err != nil {
+			return nil, err
+		}
+		topologer.Management = management
+		publisher.SetManagement(management)
+	}
 
 	rs := &RabbitService{
 		ConnectionPool:       publisher.ConnectionPool,
@@ -74,13 +88,24 @@ func NewRabbitServiceWithPublisher(
 		centralErr:           make(chan error, 1000),
 		shutdownSignal:       make(chan bool, 1),
 		consumers:            make(map[string]*Consumer),
+		publishers:           make(map[string]*Publisher),
 		monitorSleepInterval: time.Duration(200) * time.Millisecond,
 		serviceLock:          &sync.Mutex{},
 	}
 
+	if err := rs.createPools(config.Pools); err != nil {
+		return nil, err
+	}
+
+	if err := rs.createPublishers(config.PublisherConfigs); err != nil {
+		rs.shutdownPools()
+		return nil, err
+	}
+
 	// Build a Map for Consumer retrieval.
 	err := rs.createConsumers(config.ConsumerConfigs)
 	if err != nil {
+		rs.shutdownPools()
 		return nil, err
 	}
 
@@ -108,6 +133,10 @@ func NewRabbitServiceWithPublisher(
 		go rs.processPublishReceipts()
 	}
 
+	for _, publisher := range rs.publishers {
+		go rs.collectPublishReceipts(publisher)
+	}
+
 	// Monitors all errors
 	if processError != nil {
 		go rs.invokeProcessError(processError)
@@ -126,13 +155,23 @@ func (rs *RabbitService) createConsumers(consumerConfigs map[string]*ConsumerCon
 
 	for consumerName, consumerConfig := range consumerConfigs {
 
-		consumer := NewConsumerFromConfig(consumerConfig, rs.ConnectionPool)
+		pool, err := rs.pool(consumerConfig.Pool)
+		if err != nil {
+			return fmt.Errorf("consumer %q: %w", consumerName, err)
+		}
+
+		if _, err := configuredMarshaller(consumerConfig.Marshaller); err != nil {
+			return fmt.Errorf("consumer %q: %w", consumerName, err)
+		}
+
+		consumer := NewConsumerFromConfig(consumerConfig, pool)
 		hostName, err := os.Hostname()
 
 		if err == nil {
 			consumer.ConsumerName = hostName + "-" + consumer.ConsumerName
 		}
 
+		consumer.SetEncryption(rs.Config.EncryptionConfig)
 		rs.consumers[consumerName] = consumer
 	}
 
@@ -154,7 +193,7 @@ func (rs *RabbitService) PublishWithConfirmation(
 		return errors.New("can't have a nil body or an empty exchangename with empty routing key")
 	}
 
-	var letterID = uuid.New()
+	var letterID = rs.Publisher.newLetterID()
 	var data []byte
 	var err error
 	if wrapPayload {
@@ -173,8 +212,9 @@ func (rs *RabbitService) PublishWithConfirmation(
 	// https://github.com/streadway/amqp/issues/459
 	rs.Publisher.PublishWithConfirmationTransient(
 		&Letter{
-			LetterID: letterID,
-			Body:     data,
+			LetterID:  letterID,
+			Body:      data,
+			encrypted: rs.Config.EncryptionConfig.Enabled,
 			Envelope: &Envelope{
 				Exchange:     exchangeName,
 				RoutingKey:   routingKey,
@@ -205,7 +245,7 @@ func (rs *RabbitService) Publish(
 		return errors.New("can't have a nil input or an empty exchangename with empty routing key")
 	}
 
-	var letterID = uuid.New()
+	var letterID = rs.Publisher.newLetterID()
 	var data []byte
 	var err error
 	if wrapPayload {
@@ -222,8 +262,9 @@ func (rs *RabbitService) Publish(
 
 	rs.Publisher.Publish(
 		&Letter{
-			LetterID: letterID,
-			Body:     data,
+			LetterID:  letterID,
+			Body:      data,
+			encrypted: rs.Config.EncryptionConfig.Enabled,
 			Envelope: &Envelope{
 				Exchange:     exchangeName,
 				RoutingKey:   routingKey,
@@ -254,7 +295,7 @@ func (rs *RabbitService) PublishData(
 
 	rs.Publisher.Publish(
 		&Letter{
-			LetterID: uuid.New(),
+			LetterID: rs.Publisher.newLetterID(),
 			Body:     data,
 			Envelope: &Envelope{
 				Exchange:     exchangeName,
@@ -335,6 +376,9 @@ func (rs *RabbitService) CentralErr() <-chan error {
 func (rs *RabbitService) Shutdown(stopConsumers bool) {
 
 	rs.Publisher.Shutdown(false)
+	for _, publisher := range rs.publishers {
+		publisher.Shutdown(false)
+	}
 
 	time.Sleep(time.Second)
 	rs.shutdownSignal <- true
@@ -350,6 +394,9 @@ func (rs *RabbitService) Shutdown(stopConsumers bool) {
 	}
 
 	rs.ConnectionPool.Shutdown()
+	if rs.PoolManager != nil {
+		rs.PoolManager.Shutdown()
+	}
 }
 
 func (rs *RabbitService) monitorForShutdown() {
@@ -401,7 +448,10 @@ ProcessLoop:
 		}
 
 		select {
-		case receipt := <-rs.Publisher.PublishReceipts():
+		case receipt, ok := <-rs.Publisher.PublishReceipts():
+			if !ok {
+				break ProcessLoop // closed by GracefulShutdown
+			}
 			processReceipts(receipt)
 		default:
 			time.Sleep(rs.monitorSleepInterval)
@@ -419,23 +469,19 @@ ProcessLoop:
 		}
 
 		select {
-		case receipt := <-rs.Publisher.PublishReceipts():
-			if !receipt.Success {
-				if receipt.FailedLetter != nil {
-					if receipt.FailedLetter.RetryCount < rs.Config.PublisherConfig.MaxRetryCount {
-						receipt.FailedLetter.RetryCount++
-						rs.centralErr <- fmt.Errorf("failed to publish LetterID %s... retrying (count: %d)", receipt.LetterID.String(), receipt.FailedLetter.RetryCount)
-						if ok := rs.Publisher.QueueLetter(receipt.FailedLetter); !ok {
-							rs.centralErr <- fmt.Errorf("failed to publish a LetterID %s and autopublisher has been shutdown", receipt.LetterID.String())
-						}
-					} else {
-						rs.centralErr <- fmt.Errorf("failed to retry publish a LetterID %s, it has exhausted all of it's retries", receipt.LetterID.String())
-					}
-				} else {
-					rs.centralErr <- fmt.Errorf("failed to publish a LetterID %s and unable to retry as a copy of the letter was not received", receipt.LetterID.String())
-				}
+		case receipt, ok := <-rs.Publisher.PublishReceipts():
+			if !ok {
+				break ProcessLoop // closed by GracefulShutdown
+			}
 
+			if receipt.Batch != nil {
+				for _, result := range receipt.Batch {
+					rs.retryFailedReceipt(result)
+				}
+				continue
 			}
+
+			rs.retryFailedReceipt(receipt)
 		default:
 			time.Sleep(rs.monitorSleepInterval)
 			break
@@ -443,6 +489,53 @@ ProcessLoop:
 	}
 }
 
+// retryFailedReceipt requeues the failed letter of the receipt until it exhausted its retries.
+func (rs *RabbitService) retryFailedReceipt(receipt *PublishReceipt) {
+
+	if receipt.Success || receipt.UnknownOutcome { // the letter is still being republished
+		return
+	}
+
+	if errors.Is(receipt.Error, ErrFallback) {
+		rs.centralErr <- receipt.Error // parked, retrying would only duplicate it
+		return
+	}
+
+	if receipt.FailedLetter == nil {
+		rs.centralErr <- fmt.Errorf("failed to publish a LetterID %s and unable to retry as a copy of the letter was not received", receipt.LetterID.String())
+		return
+	}
+
+	policy := rs.Publisher.currentRetryPolicy()
+	if policy == nil {
+		policy = rs.Config.PublisherConfig.RetryPolicy.Policy(rs.Config.PublisherConfig.MaxRetryCount)
+	}
+
+	delay, retry := policy.Backoff(receipt.FailedLetter.RetryCount + 1)
+	if !retry {
+		rs.centralErr <- fmt.Errorf("failed to retry publish a LetterID %s, it has exhausted all of it's retries", receipt.LetterID.String())
+		return
+	}
+
+	receipt.FailedLetter.RetryCount++
+	rs.centralErr <- fmt.Errorf("failed to publish LetterID %s... retrying (count: %d)", receipt.LetterID.String(), receipt.FailedLetter.RetryCount)
+
+	if delay <= 0 {
+		rs.requeueFailedLetter(receipt.FailedLetter)
+		return
+	}
+
+	// Back off without holding up the other receipts.
+	rs.Publisher.currentClock().AfterFunc(delay, func() { rs.requeueFailedLetter(receipt.FailedLetter) })
+}
+
+func (rs *RabbitService) requeueFailedLetter(letter *Letter) {
+
+	if ok := rs.Publisher.QueueLetter(letter); !ok {
+		rs.centralErr <- fmt.Errorf("failed to publish a LetterID %s and autopublisher has been shutdown: %w", letter.LetterID.String(), ErrShutdown)
+	}
+}
+
 func (rs *RabbitService) invokeProcessError(processError func(error)) {
 
 ProcessLoop:
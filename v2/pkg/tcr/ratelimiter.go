@@ -0,0 +1,80 @@
+package tcr
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket allowing rate events per second with bursts up to burst.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	lock   *sync.Mutex
+}
+
+// newRateLimiter returns nil (unlimited) when rate isn't positive.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+
+	if rate <= 0 {
+		return nil
+	}
+
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		lock:   &sync.Mutex{},
+	}
+}
+
+// wait blocks until a token is available or the context is done. A nil rateLimiter never blocks.
+func (rl *rateLimiter) wait(ctx context.Context) error {
+	return rl.waitN(ctx, 1)
+}
+
+// waitN blocks until n tokens are available, requests larger than the burst wait for a full bucket.
+func (rl *rateLimiter) waitN(ctx context.Context, n float64) error {
+
+	if rl == nil {
+		return ctx.Err()
+	}
+
+	if n > rl.burst {
+		n = rl.burst
+	}
+
+	for {
+		rl.lock.Lock()
+		now := time.Now()
+		rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+		if rl.tokens > rl.burst {
+			rl.tokens = rl.burst
+		}
+		rl.last = now
+
+		if rl.tokens >= n {
+			rl.tokens -= n
+			rl.lock.Unlock()
+			return nil
+		}
+
+		delay := time.Duration((n - rl.tokens) / rl.rate * float64(time.Second))
+		rl.lock.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
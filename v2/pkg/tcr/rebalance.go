@@ -0,0 +1,383 @@
+package tcr
+
+import (
+	"errors"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/streadway/amqp"
+)
+
+// RebalanceConfig coordinates partition queue ownership between process instances over a fanout control exchange.
+type RebalanceConfig struct {
+	ControlExchange   string   `json:"ControlExchange" yaml:"ControlExchange"`
+	InstanceID        string   `json:"InstanceID,omitempty" yaml:"InstanceID,omitempty"` // generated if empty
+	Partitions        []string `json:"Partitions" yaml:"Partitions"`                     // partition queue names
+	HeartbeatInterval uint32   `json:"HeartbeatInterval" yaml:"HeartbeatInterval"`       // ms, defaults to 1000
+	MemberTimeout     uint32   `json:"MemberTimeout" yaml:"MemberTimeout"`               // ms, defaults to 3 heartbeats
+}
+
+// rebalanceHeartbeat is broadcast on the control exchange.
+type rebalanceHeartbeat struct {
+	InstanceID string `json:"InstanceID"`
+	Leaving    bool   `json:"Leaving,omitempty"`
+}
+
+// Rebalancer lets several instances agree on which of them consumes each partition queue. Every instance
+// broadcasts heartbeats and assigns partitions with rendezvous hashing over the live members, so all instances
+// reach the same assignment without a leader and only the partitions of joining/leaving instances move.
+type Rebalancer struct {
+	Config            *RebalanceConfig
+	ConnectionPool    *ConnectionPool
+	InstanceID        string
+	heartbeatInterval time.Duration
+	memberTimeout     time.Duration
+	onAssigned        func(queueName string)
+	onRevoked         func(queueName string)
+	members           map[string]time.Time
+	owned             map[string]bool
+	lock              *sync.Mutex
+	stop              chan struct{}
+	done              *sync.WaitGroup
+	started           bool
+}
+
+// NewRebalancer creates a Rebalancer. onAssigned/onRevoked are invoked as this instance gains/loses a partition,
+// see PartitionConsumers for starting and stopping Consumers with them.
+func NewRebalancer(
+	cp *ConnectionPool,
+	config *RebalanceConfig,
+	onAssigned func(queueName string),
+	onRevoked func(queueName string)) (*Rebalancer, error) {
+
+	if config.ControlExchange == "" {
+		return nil, errors.New("rebalancing requires a control exchange")
+	}
+
+	instanceID := config.InstanceID
+	if instanceID == "" {
+		instanceID = uuid.New().String()
+	}
+
+	heartbeatInterval := time.Duration(config.HeartbeatInterval) * time.Millisecond
+	if heartbeatInterval == 0 {
+		heartbeatInterval = time.Second
+	}
+
+	memberTimeout := time.Duration(config.MemberTimeout) * time.Millisecond
+	if memberTimeout == 0 {
+		memberTimeout = 3 * heartbeatInterval
+	}
+
+	return &Rebalancer{
+		Config:            config,
+		ConnectionPool:    cp,
+		InstanceID:        instanceID,
+		heartbeatInterval: heartbeatInterval,
+		memberTimeout:     memberTimeout,
+		onAssigned:        onAssigned,
+		onRevoked:         onRevoked,
+		members:           make(map[string]time.Time),
+		owned:             make(map[string]bool),
+		lock:              &sync.Mutex{},
+		done:              &sync.WaitGroup{},
+	}, nil
+}
+
+// Start joins the group.
+func (rb *Rebalancer) Start() {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	if rb.started {
+		return
+	}
+
+	rb.started = true
+	rb.stop = make(chan struct{})
+	rb.members[rb.InstanceID] = time.Now()
+
+	rb.done.Add(1)
+	go rb.coordinateLoop(rb.stop)
+}
+
+// Stop leaves the group, revoking every owned partition.
+func (rb *Rebalancer) Stop() {
+	rb.lock.Lock()
+	if !rb.started {
+		rb.lock.Unlock()
+		return
+	}
+
+	rb.started = false
+	close(rb.stop)
+	rb.lock.Unlock()
+
+	rb.done.Wait()
+
+	rb.lock.Lock()
+	rb.members = make(map[string]time.Time)
+	rb.lock.Unlock()
+	rb.rebalance()
+}
+
+// Owned returns the sorted partitions this instance currently owns.
+func (rb *Rebalancer) Owned() []string {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	owned := make([]string, 0, len(rb.owned))
+	for queueName := range rb.owned {
+		owned = append(owned, queueName)
+	}
+
+	sort.Strings(owned)
+	return owned
+}
+
+// Members returns the sorted IDs of the live instances.
+func (rb *Rebalancer) Members() []string {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	return rb.memberIDs()
+}
+
+func (rb *Rebalancer) memberIDs() []string {
+
+	members := make([]string, 0, len(rb.members))
+	for member := range rb.members {
+		members = append(members, member)
+	}
+
+	sort.Strings(members)
+	return members
+}
+
+func (rb *Rebalancer) coordinateLoop(stop chan struct{}) {
+	defer rb.done.Done()
+
+	for {
+		channel, deliveries, err := rb.joinControlExchange()
+		if err != nil {
+			select {
+			case <-stop:
+				return
+			case <-time.After(rb.heartbeatInterval):
+				continue
+			}
+		}
+
+		closed := rb.coordinate(stop, channel, deliveries)
+
+		if !closed {
+			rb.heartbeat(channel, true)
+			rb.closeChannel(channel)
+			return
+		}
+
+		rb.closeChannel(channel)
+	}
+}
+
+// coordinate exchanges heartbeats until stopped (false) or the control channel is lost (true).
+func (rb *Rebalancer) coordinate(stop chan struct{}, channel *amqp.Channel, deliveries <-chan amqp.Delivery) bool {
+
+	ticker := time.NewTicker(rb.heartbeatInterval)
+	defer ticker.Stop()
+
+	rb.heartbeat(channel, false)
+
+	for {
+		select {
+		case <-stop:
+			return false
+
+		case delivery, ok := <-deliveries:
+			if !ok {
+				return true
+			}
+
+			heartbeat := &rebalanceHeartbeat{}
+			if err := json.Unmarshal(delivery.Body, heartbeat); err != nil || heartbeat.InstanceID == "" {
+				continue
+			}
+
+			rb.lock.Lock()
+			_, known := rb.members[heartbeat.InstanceID]
+			if heartbeat.Leaving {
+				delete(rb.members, heartbeat.InstanceID)
+			} else {
+				rb.members[heartbeat.InstanceID] = time.Now()
+			}
+			rb.lock.Unlock()
+
+			if known == heartbeat.Leaving { // joined or left
+				rb.rebalance()
+			}
+
+		case <-ticker.C:
+			rb.heartbeat(channel, false)
+			rb.expireMembers()
+			rb.rebalance()
+		}
+	}
+}
+
+func (rb *Rebalancer) joinControlExchange() (*amqp.Channel, <-chan amqp.Delivery, error) {
+
+	channel := rb.ConnectionPool.GetTransientChannel(false)
+
+	err := channel.ExchangeDeclare(rb.Config.ControlExchange, "fanout", true, false, false, false, nil)
+	if err != nil {
+		rb.closeChannel(channel)
+		return nil, nil, err
+	}
+
+	queue, err := channel.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		rb.closeChannel(channel)
+		return nil, nil, err
+	}
+
+	if err := channel.QueueBind(queue.Name, "", rb.Config.ControlExchange, false, nil); err != nil {
+		rb.closeChannel(channel)
+		return nil, nil, err
+	}
+
+	deliveries, err := channel.Consume(queue.Name, "", true, true, false, false, nil)
+	if err != nil {
+		rb.closeChannel(channel)
+		return nil, nil, err
+	}
+
+	return channel, deliveries, nil
+}
+
+func (rb *Rebalancer) heartbeat(channel *amqp.Channel, leaving bool) {
+
+	body, err := json.Marshal(&rebalanceHeartbeat{InstanceID: rb.InstanceID, Leaving: leaving})
+	if err != nil {
+		return
+	}
+
+	rb.lock.Lock()
+	rb.members[rb.InstanceID] = time.Now()
+	rb.lock.Unlock()
+
+	_ = channel.Publish(rb.Config.ControlExchange, "", false, false, amqp.Publishing{
+		ContentType: "application/json",
+		Body:        body,
+		Expiration:  "60000",
+	})
+}
+
+func (rb *Rebalancer) closeChannel(channel *amqp.Channel) {
+	defer func() { _ = recover() }()
+
+	channel.Close()
+}
+
+func (rb *Rebalancer) expireMembers() {
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+
+	for member, lastSeen := range rb.members {
+		if member != rb.InstanceID && time.Since(lastSeen) > rb.memberTimeout {
+			delete(rb.members, member)
+		}
+	}
+}
+
+// rebalance recomputes the owned partitions and fires the callbacks for the changes.
+func (rb *Rebalancer) rebalance() {
+
+	rb.lock.Lock()
+	members := rb.memberIDs()
+
+	assigned := make([]string, 0)
+	revoked := make([]string, 0)
+	for _, partition := range rb.Config.Partitions {
+		owner := rendezvousOwner(partition, members)
+		owns := owner == rb.InstanceID
+
+		switch {
+		case owns && !rb.owned[partition]:
+			rb.owned[partition] = true
+			assigned = append(assigned, partition)
+		case !owns && rb.owned[partition]:
+			delete(rb.owned, partition)
+			revoked = append(revoked, partition)
+		}
+	}
+	rb.lock.Unlock()
+
+	for _, partition := range revoked {
+		if rb.onRevoked != nil {
+			rb.onRevoked(partition)
+		}
+	}
+
+	for _, partition := range assigned {
+		if rb.onAssigned != nil {
+			rb.onAssigned(partition)
+		}
+	}
+}
+
+// rendezvousOwner picks the member with the highest hash for the partition.
+func rendezvousOwner(partition string, members []string) string {
+
+	var owner string
+	var highest uint64
+	for _, member := range members {
+		hash := fnv.New64a()
+		_, _ = hash.Write([]byte(member + "/" + partition))
+
+		if weight := hash.Sum64(); owner == "" || weight > highest {
+			owner = member
+			highest = weight
+		}
+	}
+
+	return owner
+}
+
+// PartitionConsumers builds Rebalancer callbacks that start a Consumer (created by newConsumer) with the action
+// for each assigned partition queue and stop it when the partition is revoked.
+func PartitionConsumers(
+	newConsumer func(queueName string) *Consumer,
+	action func(*ReceivedMessage)) (onAssigned func(string), onRevoked func(string)) {
+
+	consumers := make(map[string]*Consumer)
+	lock := &sync.Mutex{}
+
+	onAssigned = func(queueName string) {
+		con := newConsumer(queueName)
+		if con == nil {
+			return
+		}
+
+		lock.Lock()
+		consumers[queueName] = con
+		lock.Unlock()
+
+		con.StartConsumingWithAction(action)
+	}
+
+	onRevoked = func(queueName string) {
+		lock.Lock()
+		con, ok := consumers[queueName]
+		delete(consumers, queueName)
+		lock.Unlock()
+
+		if ok {
+			_ = con.StopConsuming(false, true)
+		}
+	}
+
+	return onAssigned, onRevoked
+}
@@ -0,0 +1,136 @@
+package tcr
+
+import "sync"
+
+// ReceiptListener drains a Publisher's PublishReceipts into callbacks, see OnPublishReceipts.
+type ReceiptListener struct {
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce *sync.Once
+}
+
+// OnPublishReceipts runs a goroutine handing every receipt of the Publisher to onSuccess, onFailure or onUnknown
+// (any may be nil), replacing the usual select/sleep loop. Batch receipts are handed over per letter. UnknownOutcome
+// receipts (see SetUnknownOutcomeReceipts) go to onUnknown only, their letter is still republished and gets its
+// success or failure afterwards. Don't combine it with anything else reading PublishReceipts (ex. a RabbitService),
+// they would split the receipts.
+func OnPublishReceipts(
+	pub *Publisher,
+	onSuccess func(*PublishReceipt),
+	onFailure func(*PublishReceipt),
+	onUnknown func(*PublishReceipt)) *ReceiptListener {
+
+	rl := &ReceiptListener{
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		stopOnce: &sync.Once{},
+	}
+
+	handle := func(receipt *PublishReceipt) {
+		switch {
+		case receipt.Success:
+			if onSuccess != nil {
+				onSuccess(receipt)
+			}
+		case receipt.UnknownOutcome:
+			if onUnknown != nil {
+				onUnknown(receipt)
+			}
+		case onFailure != nil:
+			onFailure(receipt)
+		}
+	}
+
+	dispatch := func(receipt *PublishReceipt) {
+		if receipt.Batch == nil {
+			handle(receipt)
+			return
+		}
+		for _, result := range receipt.Batch {
+			handle(result)
+		}
+	}
+
+	go func() {
+		defer close(rl.done)
+
+		for {
+			select {
+			case <-rl.stop:
+				// Hand over what was already published before stopping.
+				for {
+					select {
+					case receipt, ok := <-pub.PublishReceipts():
+						if !ok {
+							return
+						}
+						dispatch(receipt)
+					default:
+						return
+					}
+				}
+			case receipt, ok := <-pub.PublishReceipts():
+				if !ok {
+					return // closed by GracefulShutdown
+				}
+				dispatch(receipt)
+			}
+		}
+	}()
+
+	return rl
+}
+
+// Stop ends the listener once the receipts already waiting were handed over, blocking until it has.
+func (rl *ReceiptListener) Stop() {
+
+	rl.stopOnce.Do(func() { close(rl.stop) })
+	<-rl.done
+}
+
+// OnPublishReceipt hands every receipt to the handler instead of the PublishReceipts channel, so nothing is left
+// blocked when nobody drains it. The handler is called concurrently from the publishing goroutines and has to
+// be safe for that, nil restores the channel. Receipts already waiting on the channel stay there, OnPublishReceipts
+// listeners only see receipts sent to the channel.
+func (pub *Publisher) OnPublishReceipt(handler func(*PublishReceipt)) {
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	pub.receiptHandler = handler
+}
+
+// sendReceipt delivers the receipt from a goroutine of its own, so publishing never waits for the receipt to be read.
+// Receipts are dropped once GracefulShutdown closed PublishReceipts.
+func (pub *Publisher) sendReceipt(receipt *PublishReceipt) {
+
+	pub.pubRWLock.RLock()
+	closed := pub.receiptsClosed
+	if !closed {
+		pub.receiptGroup.Add(1)
+	}
+	pub.pubRWLock.RUnlock()
+
+	if closed {
+		return
+	}
+
+	go func() {
+		defer pub.receiptGroup.Done()
+		pub.deliverReceipt(receipt)
+	}()
+}
+
+// deliverReceipt sends the receipt to the OnPublishReceipt handler or the PublishReceipts channel.
+func (pub *Publisher) deliverReceipt(receipt *PublishReceipt) {
+
+	pub.pubRWLock.RLock()
+	handler := pub.receiptHandler
+	pub.pubRWLock.RUnlock()
+
+	if handler != nil {
+		handler(receipt)
+		return
+	}
+
+	pub.publishReceipts <- receipt
+}
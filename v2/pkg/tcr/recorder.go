@@ -0,0 +1,250 @@
+package tcr
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// RecordedDelivery is a consumed amqp.Delivery as written by the DeliveryRecorder, one JSON document per line.
+// Header values survive the round trip as their JSON equivalents (numbers become float64).
+type RecordedDelivery struct {
+	Sequence        uint64     `json:"Sequence"`
+	Exchange        string     `json:"Exchange"`
+	RoutingKey      string     `json:"RoutingKey"`
+	Redelivered     bool       `json:"Redelivered"`
+	MessageID       string     `json:"MessageID,omitempty"`
+	CorrelationID   string     `json:"CorrelationID,omitempty"`
+	ReplyTo         string     `json:"ReplyTo,omitempty"`
+	Type            string     `json:"Type,omitempty"`
+	AppID           string     `json:"AppID,omitempty"`
+	UserID          string     `json:"UserID,omitempty"`
+	ContentType     string     `json:"ContentType,omitempty"`
+	ContentEncoding string     `json:"ContentEncoding,omitempty"`
+	DeliveryMode    uint8      `json:"DeliveryMode,omitempty"`
+	Priority        uint8      `json:"Priority,omitempty"`
+	Expiration      string     `json:"Expiration,omitempty"`
+	Timestamp       time.Time  `json:"Timestamp"`
+	Headers         amqp.Table `json:"Headers,omitempty"`
+	Body            []byte     `json:"Body"`
+}
+
+// DeliveryRecorder captures the deliveries of a Consumer, in order, as they came off the wire.
+type DeliveryRecorder struct {
+	writer   *bufio.Writer
+	closer   io.Closer
+	sequence uint64
+	lock     *sync.Mutex
+}
+
+// NewDeliveryRecorder records deliveries to the writer.
+func NewDeliveryRecorder(writer io.Writer) *DeliveryRecorder {
+	return &DeliveryRecorder{
+		writer: bufio.NewWriter(writer),
+		lock:   &sync.Mutex{},
+	}
+}
+
+// NewFileDeliveryRecorder records deliveries to the file, appending if it already exists.
+func NewFileDeliveryRecorder(path string) (*DeliveryRecorder, error) {
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	recorder := NewDeliveryRecorder(file)
+	recorder.closer = file
+
+	return recorder, nil
+}
+
+// Record writes the delivery as the next line of the recording.
+func (dr *DeliveryRecorder) Record(delivery amqp.Delivery) error {
+	dr.lock.Lock()
+	defer dr.lock.Unlock()
+
+	dr.sequence++
+	data, err := json.Marshal(&RecordedDelivery{
+		Sequence:        dr.sequence,
+		Exchange:        delivery.Exchange,
+		RoutingKey:      delivery.RoutingKey,
+		Redelivered:     delivery.Redelivered,
+		MessageID:       delivery.MessageId,
+		CorrelationID:   delivery.CorrelationId,
+		ReplyTo:         delivery.ReplyTo,
+		Type:            delivery.Type,
+		AppID:           delivery.AppId,
+		UserID:          delivery.UserId,
+		ContentType:     delivery.ContentType,
+		ContentEncoding: delivery.ContentEncoding,
+		DeliveryMode:    delivery.DeliveryMode,
+		Priority:        delivery.Priority,
+		Expiration:      delivery.Expiration,
+		Timestamp:       delivery.Timestamp,
+		Headers:         delivery.Headers,
+		Body:            delivery.Body,
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err = dr.writer.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	// Flush every delivery so a crashed consumer still leaves a usable recording.
+	return dr.writer.Flush()
+}
+
+// Close flushes the recording and closes the file it was created with.
+func (dr *DeliveryRecorder) Close() error {
+	dr.lock.Lock()
+	defer dr.lock.Unlock()
+
+	if err := dr.writer.Flush(); err != nil {
+		return err
+	}
+
+	if dr.closer != nil {
+		return dr.closer.Close()
+	}
+
+	return nil
+}
+
+// SetDeliveryRecorder records every delivery the Consumer receives, nil stops recording.
+func (con *Consumer) SetDeliveryRecorder(recorder *DeliveryRecorder) {
+	con.conLock.Lock()
+	defer con.conLock.Unlock()
+
+	con.recorder = recorder
+}
+
+// recordDelivery writes the delivery to the recorder, if there is one.
+func (con *Consumer) recordDelivery(delivery amqp.Delivery) {
+
+	con.conLock.Lock()
+	recorder := con.recorder
+	con.conLock.Unlock()
+
+	if recorder == nil {
+		return
+	}
+
+	if err := recorder.Record(delivery); err != nil {
+		con.errors <- fmt.Errorf("consumer %q failed to record a delivery: %w", con.ConsumerName, err)
+	}
+}
+
+// ReplayResult tells how the action settled the replayed deliveries, by recorded sequence (delivery tag).
+type ReplayResult struct {
+	Delivered int
+	Acked     []uint64
+	Nacked    []uint64
+	Rejected  []uint64
+	lock      *sync.Mutex
+}
+
+// Ack implements amqp.Acknowledger for replayed deliveries.
+func (rr *ReplayResult) Ack(tag uint64, multiple bool) error {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+
+	rr.Acked = append(rr.Acked, tag)
+	return nil
+}
+
+// Nack implements amqp.Acknowledger for replayed deliveries.
+func (rr *ReplayResult) Nack(tag uint64, multiple bool, requeue bool) error {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+
+	rr.Nacked = append(rr.Nacked, tag)
+	return nil
+}
+
+// Reject implements amqp.Acknowledger for replayed deliveries.
+func (rr *ReplayResult) Reject(tag uint64, requeue bool) error {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+
+	rr.Rejected = append(rr.Rejected, tag)
+	return nil
+}
+
+// Replay feeds a recording through the Consumer's handler pipeline (body restoration, taps, poison and
+// budget checks, provenance, leases) and the action, in recorded order, without a broker.
+// Deliveries are not recorded again.
+func (con *Consumer) Replay(source io.Reader, action func(*ReceivedMessage)) (*ReplayResult, error) {
+
+	if action == nil {
+		return nil, errors.New("can't replay deliveries without an action")
+	}
+
+	result := &ReplayResult{lock: &sync.Mutex{}}
+
+	reader := bufio.NewReader(source)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			recorded := &RecordedDelivery{}
+			if jsonErr := json.Unmarshal(line, recorded); jsonErr != nil {
+				return result, fmt.Errorf("recording is corrupt after %d deliveries: %w", result.Delivered, jsonErr)
+			}
+
+			con.handleDelivery(recorded.delivery(result), action)
+			result.Delivered++
+		}
+
+		if errors.Is(err, io.EOF) {
+			return result, nil
+		}
+		if err != nil {
+			return result, err
+		}
+	}
+}
+
+// ReplayFile replays the recording written by a file DeliveryRecorder.
+func (con *Consumer) ReplayFile(path string, action func(*ReceivedMessage)) (*ReplayResult, error) {
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return con.Replay(file, action)
+}
+
+// delivery rebuilds the amqp.Delivery, settled against the acknowledger.
+func (rd *RecordedDelivery) delivery(acknowledger amqp.Acknowledger) amqp.Delivery {
+	return amqp.Delivery{
+		Acknowledger:    acknowledger,
+		DeliveryTag:     rd.Sequence,
+		Exchange:        rd.Exchange,
+		RoutingKey:      rd.RoutingKey,
+		Redelivered:     rd.Redelivered,
+		MessageId:       rd.MessageID,
+		CorrelationId:   rd.CorrelationID,
+		ReplyTo:         rd.ReplyTo,
+		Type:            rd.Type,
+		AppId:           rd.AppID,
+		UserId:          rd.UserID,
+		ContentType:     rd.ContentType,
+		ContentEncoding: rd.ContentEncoding,
+		DeliveryMode:    rd.DeliveryMode,
+		Priority:        rd.Priority,
+		Expiration:      rd.Expiration,
+		Timestamp:       rd.Timestamp,
+		Headers:         rd.Headers,
+		Body:            rd.Body,
+	}
+}
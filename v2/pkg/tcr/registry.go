@@ -0,0 +1,161 @@
+package tcr
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrNameRegistered is returned when registering a Publisher or Consumer under a name another instance holds.
+var ErrNameRegistered = errors.New("name is registered by another instance")
+
+// registry is the process-wide lookup of named Publishers and Consumers so that metrics, logs and diagnostics
+// can attribute activity to a specific component.
+type registry struct {
+	publishers map[string]*Publisher
+	consumers  map[string]*Consumer
+	lock       *sync.RWMutex
+}
+
+var componentRegistry = &registry{
+	publishers: make(map[string]*Publisher),
+	consumers:  make(map[string]*Consumer),
+	lock:       &sync.RWMutex{},
+}
+
+var anonymousPublisherCount uint64
+
+// nextPublisherName names publishers that were not given a name.
+func nextPublisherName() string {
+	return "publisher-" + strconv.FormatUint(atomic.AddUint64(&anonymousPublisherCount, 1), 10)
+}
+
+// RegisterPublisher adds the Publisher under its Name, so the name in its receipts, events and stats finds it.
+// Publishers aren't registered until then, Shutdown unregisters them. Registering a Publisher again is a no-op,
+// a name another Publisher holds (ex. one built from the same config) is refused with ErrNameRegistered.
+func RegisterPublisher(pub *Publisher) error {
+	componentRegistry.lock.Lock()
+	defer componentRegistry.lock.Unlock()
+
+	if registered, ok := componentRegistry.publishers[pub.Name]; ok && registered != pub {
+		return fmt.Errorf("publisher %q can't be registered: %w", pub.Name, ErrNameRegistered)
+	}
+
+	for name, registered := range componentRegistry.publishers {
+		if registered == pub {
+			delete(componentRegistry.publishers, name) // renamed since
+		}
+	}
+	componentRegistry.publishers[pub.Name] = pub
+	return nil
+}
+
+// UnregisterPublisher removes the Publisher registered under the name.
+func UnregisterPublisher(name string) {
+	componentRegistry.lock.Lock()
+	defer componentRegistry.lock.Unlock()
+
+	delete(componentRegistry.publishers, name)
+}
+
+// unregisterPublisher removes the Publisher, even when its Name changed since it registered.
+func unregisterPublisher(pub *Publisher) {
+	componentRegistry.lock.Lock()
+	defer componentRegistry.lock.Unlock()
+
+	for name, registered := range componentRegistry.publishers {
+		if registered == pub {
+			delete(componentRegistry.publishers, name)
+		}
+	}
+}
+
+// GetPublisher finds a registered Publisher by name.
+func GetPublisher(name string) (*Publisher, bool) {
+	componentRegistry.lock.RLock()
+	defer componentRegistry.lock.RUnlock()
+
+	pub, ok := componentRegistry.publishers[name]
+	return pub, ok
+}
+
+// PublisherNames lists the names of all registered Publishers (sorted).
+func PublisherNames() []string {
+	componentRegistry.lock.RLock()
+	defer componentRegistry.lock.RUnlock()
+
+	names := make([]string, 0, len(componentRegistry.publishers))
+	for name := range componentRegistry.publishers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// RegisterConsumer adds the Consumer under its ConsumerName. Consumers register when they start consuming
+// (reporting a name another Consumer holds on Errors) and unregister when they stop, register one that only
+// gets messages explicitly. Registering a Consumer again is a no-op, a name another Consumer holds is refused
+// with ErrNameRegistered.
+func RegisterConsumer(con *Consumer) error {
+	componentRegistry.lock.Lock()
+	defer componentRegistry.lock.Unlock()
+
+	if registered, ok := componentRegistry.consumers[con.ConsumerName]; ok && registered != con {
+		return fmt.Errorf("consumer %q can't be registered: %w", con.ConsumerName, ErrNameRegistered)
+	}
+
+	for name, registered := range componentRegistry.consumers {
+		if registered == con {
+			delete(componentRegistry.consumers, name) // renamed since
+		}
+	}
+	componentRegistry.consumers[con.ConsumerName] = con
+	return nil
+}
+
+// UnregisterConsumer removes the Consumer registered under the name.
+func UnregisterConsumer(name string) {
+	componentRegistry.lock.Lock()
+	defer componentRegistry.lock.Unlock()
+
+	delete(componentRegistry.consumers, name)
+}
+
+// unregisterConsumer removes the Consumer, even when its ConsumerName changed since it registered.
+func unregisterConsumer(con *Consumer) {
+	componentRegistry.lock.Lock()
+	defer componentRegistry.lock.Unlock()
+
+	for name, registered := range componentRegistry.consumers {
+		if registered == con {
+			delete(componentRegistry.consumers, name)
+		}
+	}
+}
+
+// GetRegisteredConsumer finds a registered Consumer by name.
+func GetRegisteredConsumer(name string) (*Consumer, bool) {
+	componentRegistry.lock.RLock()
+	defer componentRegistry.lock.RUnlock()
+
+	con, ok := componentRegistry.consumers[name]
+	return con, ok
+}
+
+// ConsumerNames lists the names of all registered Consumers (sorted).
+func ConsumerNames() []string {
+	componentRegistry.lock.RLock()
+	defer componentRegistry.lock.RUnlock()
+
+	names := make([]string, 0, len(componentRegistry.consumers))
+	for name := range componentRegistry.consumers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,149 @@
+package tcr
+
+import (
+	"time"
+
+	"github.com/houseofcat/turbocookedrabbit/v2/pkg/resilience"
+)
+
+// RetryPolicy backs off between retries of failed publishes. Durations are in milliseconds.
+type RetryPolicy struct {
+	InitialDelay uint32  `json:"InitialDelay" yaml:"InitialDelay"`
+	Multiplier   float64 `json:"Multiplier" yaml:"Multiplier"` // defaults to 2
+	MaxDelay     uint32  `json:"MaxDelay,omitempty" yaml:"MaxDelay,omitempty"`
+	Jitter       float64 `json:"Jitter,omitempty" yaml:"Jitter,omitempty"` // 0-1, fraction of the delay randomized, ex.) 0.2 is +/- 20%
+}
+
+// Delay returns how long to wait before the given retry (counting from 1).
+// A nil RetryPolicy retries immediately.
+func (rp *RetryPolicy) Delay(retry uint32) time.Duration {
+
+	delay, _ := rp.Policy(0).Backoff(retry)
+	return delay
+}
+
+// Policy converts the RetryPolicy into a resilience.Policy giving up after maxRetries (zero retries forever).
+func (rp *RetryPolicy) Policy(maxRetries uint32) resilience.Policy {
+
+	if rp == nil {
+		return &resilience.Constant{MaxAttempts: maxRetries}
+	}
+
+	return &resilience.Exponential{
+		InitialDelay: time.Duration(rp.InitialDelay) * time.Millisecond,
+		Multiplier:   rp.Multiplier,
+		MaxDelay:     time.Duration(rp.MaxDelay) * time.Millisecond,
+		Jitter:       rp.Jitter,
+		MaxAttempts:  maxRetries,
+	}
+}
+
+// SetRetryPolicy replaces how the ConnectionPool backs off between reconnect attempts, nil restores waiting the
+// SleepOnErrorInterval. Pools never stop reconnecting, a policy giving up starts over from its first attempt.
+func (cp *ConnectionPool) SetRetryPolicy(policy resilience.Policy) {
+	cp.health.lock.Lock()
+	defer cp.health.lock.Unlock()
+
+	cp.health.retryPolicy = policy
+}
+
+// backoff sleeps before the next reconnect attempt, returning the attempt to count from.
+func (cp *ConnectionPool) backoff(attempt uint32) uint32 {
+
+	cp.health.lock.Lock()
+	policy := cp.health.retryPolicy
+	cp.health.lock.Unlock()
+
+	return backoff(policy, &resilience.Constant{Delay: cp.sleepOnErrorInterval}, attempt)
+}
+
+// retried tells the ConnectionPool's policy a reconnect succeeded.
+func (cp *ConnectionPool) retried() {
+
+	cp.health.lock.Lock()
+	policy := cp.health.retryPolicy
+	cp.health.lock.Unlock()
+
+	if policy != nil {
+		resilience.Succeeded(policy)
+	}
+}
+
+// SetRetryPolicy replaces how failed letters are republished by the RabbitService, nil restores the
+// PublisherConfig's RetryPolicy and MaxRetryCount.
+func (pub *Publisher) SetRetryPolicy(policy resilience.Policy) {
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	pub.retryPolicy = policy
+}
+
+func (pub *Publisher) currentRetryPolicy() resilience.Policy {
+	pub.pubRWLock.RLock()
+	defer pub.pubRWLock.RUnlock()
+
+	return pub.retryPolicy
+}
+
+// SetRetryPolicy replaces how the Consumer backs off between re-consuming after channel errors, nil restores
+// waiting the SleepOnErrorInterval. Redelivered messages the policy gives up on (by their delivery count, as in
+// PoisonMessageConfig) are rejected without requeue.
+func (con *Consumer) SetRetryPolicy(policy resilience.Policy) {
+	con.conLock.Lock()
+	defer con.conLock.Unlock()
+
+	con.retryPolicy = policy
+}
+
+func (con *Consumer) currentRetryPolicy() resilience.Policy {
+	con.conLock.Lock()
+	defer con.conLock.Unlock()
+
+	return con.retryPolicy
+}
+
+// backoff sleeps before the next re-consume attempt, returning the attempt to count from.
+func (con *Consumer) backoff(attempt uint32) uint32 {
+	return backoff(con.currentRetryPolicy(), &resilience.Constant{Delay: con.sleepOnErrorInterval}, attempt)
+}
+
+// retried tells the Consumer's policy consuming started again.
+func (con *Consumer) retried() {
+	if policy := con.currentRetryPolicy(); policy != nil {
+		resilience.Succeeded(policy)
+	}
+}
+
+// SetRetryPolicy configures the ConnectionPool, Publisher and every Consumer of the RabbitService with one policy.
+func (rs *RabbitService) SetRetryPolicy(policy resilience.Policy) {
+
+	rs.ConnectionPool.SetRetryPolicy(policy)
+	rs.Publisher.SetRetryPolicy(policy)
+
+	rs.serviceLock.Lock()
+	defer rs.serviceLock.Unlock()
+
+	for _, consumer := range rs.consumers {
+		consumer.SetRetryPolicy(policy)
+	}
+}
+
+// backoff sleeps the policy's (or the fallback's) delay for the attempt, starting over once it gives up.
+func backoff(policy resilience.Policy, fallback resilience.Policy, attempt uint32) uint32 {
+
+	if policy == nil {
+		policy = fallback
+	}
+
+	delay, retry := policy.Backoff(attempt)
+	if !retry {
+		attempt = 1
+		delay, _ = policy.Backoff(attempt)
+	}
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+
+	return attempt + 1
+}
@@ -0,0 +1,176 @@
+package tcr
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/streadway/amqp"
+)
+
+// ReturnedLetter is a mandatory (or immediate) letter the broker could not route and sent back with basic.return.
+// The Letter's Body is the body as it was on the wire, it may be compressed (see ContentEncoding), encrypted
+// (HeaderEncryption) or claim-checked (HeaderClaimCheck).
+type ReturnedLetter struct {
+	Letter          *Letter
+	ContentEncoding string // the Envelope has no field for it, publishing the Letter again would drop it
+	ReplyCode       uint16
+	ReplyText       string
+	Time            time.Time
+}
+
+// returnSubscribers fans basic.returns on a ConnectionPool's channels out to every subscribed Publisher.
+type returnSubscribers struct {
+	lock        *sync.RWMutex
+	subscribers []chan *ReturnedLetter
+}
+
+// watchReturns forwards the chanHost's returns until its channel closes.
+// Returns are dropped rather than blocking the connection when a subscriber doesn't keep up.
+func (cp *ConnectionPool) watchReturns(chanHost *ChannelHost) {
+
+	returns := chanHost.Returns
+	if returns == nil {
+		return
+	}
+
+	go func() {
+		for ret := range returns {
+			returned := newReturnedLetter(ret)
+
+			cp.returnSubscribers.lock.RLock()
+			for _, subscriber := range cp.returnSubscribers.subscribers {
+				select {
+				case subscriber <- returned:
+				default:
+				}
+			}
+			cp.returnSubscribers.lock.RUnlock()
+		}
+	}()
+}
+
+// subscribeReturns adds the channel to the pool's basic.return subscribers.
+func (cp *ConnectionPool) subscribeReturns(subscriber chan *ReturnedLetter) {
+	cp.returnSubscribers.lock.Lock()
+	defer cp.returnSubscribers.lock.Unlock()
+
+	for _, existing := range cp.returnSubscribers.subscribers {
+		if existing == subscriber {
+			return
+		}
+	}
+
+	cp.returnSubscribers.subscribers = append(cp.returnSubscribers.subscribers, subscriber)
+}
+
+// unsubscribeReturns removes the channel from the pool's basic.return subscribers.
+func (cp *ConnectionPool) unsubscribeReturns(subscriber chan *ReturnedLetter) {
+	cp.returnSubscribers.lock.Lock()
+	defer cp.returnSubscribers.lock.Unlock()
+
+	for i, existing := range cp.returnSubscribers.subscribers {
+		if existing == subscriber {
+			cp.returnSubscribers.subscribers = append(cp.returnSubscribers.subscribers[:i], cp.returnSubscribers.subscribers[i+1:]...)
+			return
+		}
+	}
+}
+
+// newReturnedLetter rebuilds the letter from what the broker returned.
+func newReturnedLetter(ret amqp.Return) *ReturnedLetter {
+
+	var messageID string
+	letterID, err := uuid.Parse(ret.MessageId)
+	if err != nil {
+		letterID = uuid.Nil
+		messageID = ret.MessageId // an Envelope.MessageID override
+	}
+
+	return &ReturnedLetter{
+		Letter: &Letter{
+			LetterID: letterID,
+			Body:     ret.Body,
+			Envelope: &Envelope{
+				Exchange:      ret.Exchange,
+				RoutingKey:    ret.RoutingKey,
+				ContentType:   ret.ContentType,
+				CorrelationID: ret.CorrelationId,
+				ReplyTo:       ret.ReplyTo,
+				Expiration:    ret.Expiration,
+				Timestamp:     ret.Timestamp,
+				Type:          ret.Type,
+				UserID:        ret.UserId,
+				AppID:         ret.AppId,
+				MessageID:     messageID,
+				Mandatory:     true,
+				Headers:       ret.Headers,
+				DeliveryMode:  ret.DeliveryMode,
+				Priority:      ret.Priority,
+			},
+		},
+		ContentEncoding: ret.ContentEncoding,
+		ReplyCode:       ret.ReplyCode,
+		ReplyText:       ret.ReplyText,
+		Time:            time.Now().UTC(),
+	}
+}
+
+// Returns yields letters the broker returned as unroutable (Envelope.Mandatory) on any pool this Publisher
+// published a mandatory letter on. Publishers sharing a ConnectionPool all see that pool's returns.
+// Returns are dropped when nobody keeps up with the channel. Bodies are returned as they were published on the
+// wire - compressed, encrypted or claim-checked - not as the Letter handed to the Publisher.
+func (pub *Publisher) Returns() <-chan *ReturnedLetter {
+	for _, pool := range pub.Shards() {
+		pub.watchPoolReturns(pool)
+	}
+
+	return pub.returns
+}
+
+// watchPoolReturns subscribes the Publisher to the pool's returns once.
+func (pub *Publisher) watchPoolReturns(pool *ConnectionPool) {
+	if pool == nil {
+		return
+	}
+
+	pub.pubRWLock.RLock()
+	watching := pub.returnPools[pool] && (pub.fallbackExchange == nil || pub.fallbackPools[pool] != nil)
+	pub.pubRWLock.RUnlock()
+
+	if watching {
+		return
+	}
+
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	if !pub.returnPools[pool] {
+		pool.subscribeReturns(pub.returns)
+		pub.returnPools[pool] = true
+	}
+
+	if pub.fallbackExchange != nil && pub.fallbackPools[pool] == nil {
+		parked := make(chan *ReturnedLetter, 100)
+		pool.subscribeReturns(parked)
+		pub.fallbackPools[pool] = parked
+		go pub.parkReturns(pool, parked)
+	}
+}
+
+// stopReturns unsubscribes the Publisher from every pool's returns.
+func (pub *Publisher) stopReturns() {
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	for pool := range pub.returnPools {
+		pool.unsubscribeReturns(pub.returns)
+		delete(pub.returnPools, pool)
+	}
+
+	for pool, parked := range pub.fallbackPools {
+		pool.unsubscribeReturns(parked)
+		close(parked) // nothing sends once unsubscribed
+		delete(pub.fallbackPools, pool)
+	}
+}
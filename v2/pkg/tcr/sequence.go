@@ -0,0 +1,251 @@
+package tcr
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SequenceRecord is the confirmed position of a publisher, see SequenceWatermark.
+type SequenceRecord struct {
+	LetterID uuid.UUID `json:"LetterID"`
+	Sequence uint64    `json:"Sequence"`
+	Time     time.Time `json:"Time"`
+}
+
+// SequenceStore persists the confirmed position per publisher so a restarted producer can resume
+// its source (ex. a database changefeed) right after it without losing letters.
+type SequenceStore interface {
+	SaveSequence(publisherName string, record *SequenceRecord) error
+	LoadSequence(publisherName string) (*SequenceRecord, error) // nil without error when nothing was saved
+}
+
+// SetSequenceStore records confirmed letters (with a Sequence) in the store and loads the last record.
+// Only confirmed publishes (PublishWithConfirmation and variants, auto-publishing) are recorded. The record is
+// the low watermark of the confirmations: the highest Sequence confirmed with every lower Sequence queued or
+// published since confirmed too. Concurrent workers or a confirm window confirming out of order never move it
+// past a letter still in flight, nor past one that failed until it is republished and confirmed - a restarted
+// producer resumes at the watermark, republishing (not skipping) what was confirmed above it.
+func (pub *Publisher) SetSequenceStore(store SequenceStore) error {
+
+	record, err := store.LoadSequence(pub.Name)
+	if err != nil {
+		return err
+	}
+
+	var position uint64
+	if record != nil {
+		position = record.Sequence
+	}
+
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	pub.sequenceStore = store
+	pub.lastSequence = record
+	pub.sequences = NewSequenceWatermark(position)
+
+	return nil
+}
+
+// trackSequence holds the watermark back until the sequence is confirmed.
+func (pub *Publisher) trackSequence(sequence uint64) {
+
+	if sequence == 0 {
+		return
+	}
+
+	pub.pubRWLock.RLock()
+	sequences := pub.sequences
+	pub.pubRWLock.RUnlock()
+
+	if sequences != nil {
+		sequences.Track(sequence)
+	}
+}
+
+// LastConfirmedSequence returns the last recorded letter, nil when none.
+func (pub *Publisher) LastConfirmedSequence() *SequenceRecord {
+	pub.pubRWLock.RLock()
+	defer pub.pubRWLock.RUnlock()
+
+	return pub.lastSequence
+}
+
+// recordSequence saves the watermark when the confirmed letter moves it forward.
+func (pub *Publisher) recordSequence(pl *preparedLetter) {
+
+	if pl.sequence == 0 {
+		return
+	}
+
+	pub.pubRWLock.Lock()
+	store := pub.sequenceStore
+	if store == nil {
+		pub.pubRWLock.Unlock()
+		return
+	}
+
+	record := pub.sequences.Confirm(&SequenceRecord{
+		LetterID: pl.letterID,
+		Sequence: pl.sequence,
+		Time:     pub.clock.Now().UTC(),
+	})
+	if record == nil {
+		pub.pubRWLock.Unlock()
+		return
+	}
+
+	pub.lastSequence = record
+	errorHandler := pub.errorHandler
+
+	// saved under the lock so the store always ends on the highest sequence
+	err := store.SaveSequence(pub.Name, record)
+	pub.pubRWLock.Unlock()
+
+	if err != nil && errorHandler != nil {
+		errorHandler(fmt.Errorf("saving sequence %d of LetterID: %s failed: %w", record.Sequence, record.LetterID.String(), err))
+	}
+}
+
+// SequenceWatermark is the highest Sequence confirmed without a lower one still in flight.
+type SequenceWatermark struct {
+	position  uint64
+	pending   map[uint64]bool
+	confirmed map[uint64]*SequenceRecord // above the position, waiting on a lower pending sequence
+	lock      *sync.Mutex
+}
+
+// NewSequenceWatermark starts at the position, ex. the loaded SequenceRecord's Sequence.
+func NewSequenceWatermark(position uint64) *SequenceWatermark {
+	return &SequenceWatermark{
+		position:  position,
+		pending:   make(map[uint64]bool),
+		confirmed: make(map[uint64]*SequenceRecord),
+		lock:      &sync.Mutex{},
+	}
+}
+
+// Track marks the sequence in flight, the watermark can't pass it until it is confirmed.
+func (sw *SequenceWatermark) Track(sequence uint64) {
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+
+	if sequence > sw.position {
+		sw.pending[sequence] = true
+	}
+}
+
+// Confirm settles the record's sequence and returns the record the watermark moved to, nil when it didn't move.
+func (sw *SequenceWatermark) Confirm(record *SequenceRecord) *SequenceRecord {
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+
+	if record.Sequence <= sw.position {
+		return nil
+	}
+
+	delete(sw.pending, record.Sequence)
+	sw.confirmed[record.Sequence] = record
+
+	var floor uint64
+	for sequence := range sw.pending {
+		if floor == 0 || sequence < floor {
+			floor = sequence
+		}
+	}
+
+	var advanced *SequenceRecord
+	for sequence, confirmed := range sw.confirmed {
+		if floor != 0 && sequence > floor {
+			continue
+		}
+		if advanced == nil || sequence > advanced.Sequence {
+			advanced = confirmed
+		}
+		delete(sw.confirmed, sequence)
+	}
+
+	if advanced != nil {
+		sw.position = advanced.Sequence
+	}
+
+	return advanced
+}
+
+// Position is the watermark, zero before the first confirmation.
+func (sw *SequenceWatermark) Position() uint64 {
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+
+	return sw.position
+}
+
+// FileSequenceStore keeps one JSON file per publisher in a directory.
+type FileSequenceStore struct {
+	directory string
+	lock      *sync.Mutex
+}
+
+// NewFileSequenceStore creates the directory when needed.
+func NewFileSequenceStore(directory string) (*FileSequenceStore, error) {
+
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+
+	return &FileSequenceStore{
+		directory: directory,
+		lock:      &sync.Mutex{},
+	}, nil
+}
+
+// SaveSequence writes the record atomically (write then rename).
+func (store *FileSequenceStore) SaveSequence(publisherName string, record *SequenceRecord) error {
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	path := store.path(publisherName)
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// LoadSequence reads the record of the publisher.
+func (store *FileSequenceStore) LoadSequence(publisherName string) (*SequenceRecord, error) {
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	data, err := ioutil.ReadFile(store.path(publisherName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	record := &SequenceRecord{}
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+func (store *FileSequenceStore) path(publisherName string) string {
+	return filepath.Join(store.directory, filepath.Base(publisherName)+".sequence.json")
+}
@@ -0,0 +1,182 @@
+package tcr
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// HandlerRegistry names the actions the consumers of a RabbitSeasoning are started with, see ConsumerConfig.Handler.
+type HandlerRegistry map[string]func(*ReceivedMessage)
+
+// Start wires the service as its seasoning declares it: builds the TopologyConfig, starts the PublisherConfigs
+// auto-publishing and every enabled consumer with a Handler consuming with the registered action. Every handler is
+// looked up before anything starts, so a typo fails the start instead of leaving a queue unconsumed. The ctx
+// bounds the startup, consumers keep running until Shutdown.
+func (rs *RabbitService) Start(ctx context.Context, handlers HandlerRegistry) error {
+
+	actions := make(map[string]func(*ReceivedMessage))
+	for _, name := range rs.consumerNames() {
+		config := rs.consumers[name].Config
+		if !config.Enabled || config.Handler == "" {
+			continue
+		}
+
+		action, ok := handlers[config.Handler]
+		if !ok || action == nil {
+			return fmt.Errorf("consumer %q has no handler named %s in the registry", name, config.Handler)
+		}
+		actions[name] = action
+	}
+
+	if rs.Config.TopologyConfig != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := rs.Topologer.BuildTopology(rs.Config.TopologyConfig, false); err != nil {
+			return fmt.Errorf("building the service topology failed: %w", err)
+		}
+	}
+
+	for _, publisher := range rs.publishers {
+		publisher.StartAutoPublishing()
+	}
+
+	for _, name := range rs.consumerNames() {
+		action, ok := actions[name]
+		if !ok {
+			continue
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rs.consumers[name].StartConsumingWithAction(action)
+	}
+
+	return nil
+}
+
+// consumerNames are the sorted names of the consumers, so they start in a stable order.
+func (rs *RabbitService) consumerNames() []string {
+
+	names := make([]string, 0, len(rs.consumers))
+	for name := range rs.consumers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// createPools builds the PoolManager of the named pools, letters choose them with Envelope.Pool.
+func (rs *RabbitService) createPools(poolConfigs map[string]*PoolConfig) error {
+
+	if len(poolConfigs) == 0 {
+		return nil
+	}
+
+	rs.PoolManager = NewPoolManager()
+	for name, poolConfig := range poolConfigs {
+		if _, err := rs.PoolManager.CreatePool(name, poolConfig); err != nil {
+			rs.PoolManager.Shutdown()
+			return fmt.Errorf("creating pool %s failed: %w", name, err)
+		}
+	}
+
+	rs.Publisher.SetPoolManager(rs.PoolManager)
+	return nil
+}
+
+// shutdownPools shuts down the named pools of a service that failed to build.
+func (rs *RabbitService) shutdownPools() {
+
+	if rs.PoolManager != nil {
+		rs.PoolManager.Shutdown()
+	}
+}
+
+// pool is the named pool, the service's ConnectionPool when the name is empty.
+func (rs *RabbitService) pool(name string) (*ConnectionPool, error) {
+
+	if name == "" {
+		return rs.ConnectionPool, nil
+	}
+
+	if rs.PoolManager != nil {
+		if pool, ok := rs.PoolManager.GetPool(name); ok {
+			return pool, nil
+		}
+	}
+
+	return nil, fmt.Errorf("pool %s is not declared in the seasoning's Pools", name)
+}
+
+// createPublishers builds the named publishers, named after their key unless their config names them.
+func (rs *RabbitService) createPublishers(publisherConfigs map[string]*PublisherConfig) error {
+
+	for name, publisherConfig := range publisherConfigs {
+		pool, err := rs.pool(publisherConfig.Pool)
+		if err != nil {
+			return fmt.Errorf("publisher %q: %w", name, err)
+		}
+
+		if _, err := configuredMarshaller(publisherConfig.Marshaller); err != nil {
+			return fmt.Errorf("publisher %q: %w", name, err)
+		}
+
+		named := *publisherConfig
+		if named.Name == "" {
+			named.Name = name
+		}
+
+		seasoning := *rs.Config
+		seasoning.PublisherConfig = &named
+
+		publisher := NewPublisherFromConfig(&seasoning, pool)
+		if rs.PoolManager != nil {
+			publisher.SetPoolManager(rs.PoolManager)
+		}
+		rs.publishers[name] = publisher
+	}
+
+	return nil
+}
+
+// GetPublisher returns the publisher the seasoning's PublisherConfigs named.
+func (rs *RabbitService) GetPublisher(publisherName string) (*Publisher, error) {
+
+	if publisher, ok := rs.publishers[publisherName]; ok {
+		return publisher, nil
+	}
+
+	return nil, fmt.Errorf("publisher %q was not found", publisherName)
+}
+
+// collectPublishReceipts reports the failures of a named publisher, which are not retried.
+func (rs *RabbitService) collectPublishReceipts(publisher *Publisher) {
+
+ProcessLoop:
+	for {
+		if rs.shutdown {
+			break ProcessLoop // Prevent leaking goroutine
+		}
+
+		select {
+		case receipt, ok := <-publisher.PublishReceipts():
+			if !ok {
+				break ProcessLoop // closed by GracefulShutdown
+			}
+
+			if !receipt.Success && !receipt.UnknownOutcome {
+				rs.centralErr <- fmt.Errorf("publisher %q failed to publish LetterID %s: %w", publisher.Name, receipt.LetterID.String(), receipt.Error)
+			}
+		default:
+			time.Sleep(rs.monitorSleepInterval)
+			break
+		}
+	}
+}
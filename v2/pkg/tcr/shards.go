@@ -0,0 +1,137 @@
+package tcr
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// ShardingRoundRobin takes turns over the shards (default).
+	ShardingRoundRobin = "round-robin"
+
+	// ShardingLeastLoaded publishes on the shard with the largest share of idle cached channels.
+	ShardingLeastLoaded = "least-loaded"
+)
+
+// publisherShards are the ConnectionPools letters without an Envelope.Pool are spread over.
+type publisherShards struct {
+	pools    []*ConnectionPool
+	strategy string
+	counter  uint64
+}
+
+// NewShardedPublisher creates a Publisher spreading its letters over the pools, so one Publisher saturates several
+// connections. The first pool is the Publisher's ConnectionPool, see SetShards.
+func NewShardedPublisher(
+	pools []*ConnectionPool,
+	strategy string,
+	sleepOnIdleInterval time.Duration,
+	sleepOnErrorInterval time.Duration,
+	publishTimeOutDuration time.Duration) (*Publisher, error) {
+
+	if len(pools) == 0 {
+		return nil, fmt.Errorf("can't shard a publisher over no pools")
+	}
+
+	pub := NewPublisher(pools[0], sleepOnIdleInterval, sleepOnErrorInterval, publishTimeOutDuration)
+	if err := pub.SetShards(strategy, pools[1:]...); err != nil {
+		return nil, err
+	}
+
+	return pub, nil
+}
+
+// SetShards spreads letters without an Envelope.Pool over the Publisher's ConnectionPool and the pools, per
+// the strategy (ShardingRoundRobin when empty). Unhealthy shards are passed over while a healthy one is left.
+// No pools removes the sharding. Failing over to the standby pool still takes precedence.
+func (pub *Publisher) SetShards(strategy string, pools ...*ConnectionPool) error {
+
+	if strategy == "" {
+		strategy = ShardingRoundRobin
+	}
+
+	if strategy != ShardingRoundRobin && strategy != ShardingLeastLoaded {
+		return fmt.Errorf("unknown sharding strategy %q", strategy)
+	}
+
+	for i, pool := range pools {
+		if pool == nil {
+			return fmt.Errorf("shard %d has no pool", i+1)
+		}
+	}
+
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	if len(pools) == 0 {
+		pub.shards = nil
+		return nil
+	}
+
+	pub.shards = &publisherShards{
+		pools:    append([]*ConnectionPool{pub.ConnectionPool}, pools...),
+		strategy: strategy,
+	}
+
+	return nil
+}
+
+// Shards are the ConnectionPools the Publisher spreads letters over, just its ConnectionPool when not sharded.
+func (pub *Publisher) Shards() []*ConnectionPool {
+	pub.pubRWLock.RLock()
+	defer pub.pubRWLock.RUnlock()
+
+	if pub.shards == nil {
+		return []*ConnectionPool{pub.ConnectionPool}
+	}
+
+	return append([]*ConnectionPool(nil), pub.shards.pools...)
+}
+
+// next picks the shard for a letter.
+func (ps *publisherShards) next() *ConnectionPool {
+
+	start := int(atomic.AddUint64(&ps.counter, 1) % uint64(len(ps.pools)))
+
+	var picked *ConnectionPool
+	pickedHealthy := false
+	for i := range ps.pools {
+		pool := ps.pools[(start+i)%len(ps.pools)]
+		healthy := pool.UnhealthyFor() == 0
+
+		switch {
+		case picked == nil, healthy && !pickedHealthy:
+			picked, pickedHealthy = pool, healthy
+		case healthy != pickedHealthy:
+			continue
+		case ps.strategy == ShardingLeastLoaded && lessLoaded(pool, picked):
+			picked = pool
+		}
+
+		if pickedHealthy && ps.strategy == ShardingRoundRobin {
+			break
+		}
+	}
+
+	return picked
+}
+
+// lessLoaded compares the shares of idle cached channels of the pools.
+func lessLoaded(pool *ConnectionPool, than *ConnectionPool) bool {
+	return uint64(len(pool.channels))*than.Config.MaxCacheChannelCount >
+		uint64(len(than.channels))*pool.Config.MaxCacheChannelCount
+}
+
+// channelCapacity is the number of cached channels over all shards.
+func (pub *Publisher) channelCapacity() int {
+
+	channels := 0
+	for _, pool := range pub.Shards() {
+		if pool != nil {
+			channels += int(pool.Config.MaxCacheChannelCount)
+		}
+	}
+
+	return channels
+}
@@ -0,0 +1,45 @@
+package tcr
+
+import "fmt"
+
+// shutdownHook is cleanup registered on a Consumer.
+type shutdownHook struct {
+	name string
+	hook func() error
+}
+
+// AddShutdownHook registers cleanup (flush a local batch, commit offsets, close a DB tx...) run when the
+// Consumer stops. Hooks run in registration order after ingestion stopped and the workers finished their
+// messages but before the channel is released, so messages they acknowledge are still ackable. A failing hook is reported on Errors and the
+// remaining hooks still run.
+func (con *Consumer) AddShutdownHook(name string, hook func() error) {
+	con.conLock.Lock()
+	defer con.conLock.Unlock()
+
+	con.shutdownHooks = append(con.shutdownHooks, &shutdownHook{name: name, hook: hook})
+}
+
+// runShutdownHooks runs every hook in order.
+func (con *Consumer) runShutdownHooks() {
+
+	con.conLock.Lock()
+	hooks := make([]*shutdownHook, len(con.shutdownHooks))
+	copy(hooks, con.shutdownHooks)
+	con.conLock.Unlock()
+
+	for _, hook := range hooks {
+		if err := con.runShutdownHook(hook); err != nil {
+			con.errors <- fmt.Errorf("consumer %q shutdown hook %q failed: %w", con.ConsumerName, hook.name, err)
+		}
+	}
+}
+
+func (con *Consumer) runShutdownHook(hook *shutdownHook) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return hook.hook()
+}
@@ -0,0 +1,94 @@
+package tcr
+
+import (
+	"crypto/rand"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// MessageIDFormatUUID stamps the LetterID as the MessageID.
+	MessageIDFormatUUID = "uuid"
+
+	// MessageIDFormatULID stamps a ULID, lexicographically sortable by publish time.
+	MessageIDFormatULID = "ulid"
+
+	crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+)
+
+// SetStamping stamps a MessageID (uuid or ulid, empty disables it) and/or a UTC Timestamp on the Envelope of
+// letters without one. Stamped values stay on the letter, so retries and requeues publish the same ones.
+func (pub *Publisher) SetStamping(messageIDFormat string, timestamp bool) {
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	pub.stampMessageID = messageIDFormat
+	pub.stampTimestamp = timestamp
+}
+
+// stampLetter fills in the MessageID and Timestamp on a copy of the Envelope, which may be shared by letters.
+func (pub *Publisher) stampLetter(letter *Letter) {
+
+	pub.pubRWLock.RLock()
+	format := strings.ToLower(pub.stampMessageID)
+	stampTimestamp := pub.stampTimestamp
+	pub.pubRWLock.RUnlock()
+
+	if letter == nil || letter.Envelope == nil {
+		return
+	}
+
+	stampID := format != "" && letter.Envelope.MessageID == ""
+	stampTime := stampTimestamp && letter.Envelope.Timestamp.IsZero()
+	if !stampID && !stampTime {
+		return
+	}
+
+	envelope := *letter.Envelope
+	now := pub.currentClock().Now().UTC()
+
+	if stampID {
+		if letter.LetterID == uuid.Nil {
+			letter.LetterID = pub.newLetterID()
+		}
+
+		envelope.MessageID = letter.LetterID.String()
+		if format == MessageIDFormatULID {
+			envelope.MessageID = newULID(now)
+		}
+	}
+
+	if stampTime {
+		envelope.Timestamp = now
+	}
+
+	letter.Envelope = &envelope
+}
+
+// newULID encodes a 48 bit millisecond timestamp and 80 random bits as 26 Crockford base32 characters.
+func newULID(now time.Time) string {
+
+	var id [16]byte
+	ms := uint64(now.UnixNano() / int64(time.Millisecond))
+	for i := 0; i < 6; i++ {
+		id[i] = byte(ms >> (40 - 8*uint(i)))
+	}
+	_, _ = rand.Read(id[6:])
+
+	// 26 characters hold 130 bits, the first two are padding
+	encoded := make([]byte, 26)
+	for i := range encoded {
+		var value byte
+		for bit := i*5 - 2; bit < i*5+3; bit++ {
+			value <<= 1
+			if bit >= 0 {
+				value |= (id[bit/8] >> (7 - uint(bit%8))) & 1
+			}
+		}
+		encoded[i] = crockfordAlphabet[value]
+	}
+
+	return string(encoded)
+}
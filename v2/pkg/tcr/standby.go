@@ -0,0 +1,137 @@
+package tcr
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// standbyPool is a warm standby ConnectionPool publishing fails over to.
+type standbyPool struct {
+	pool      *ConnectionPool
+	threshold time.Duration
+	interval  time.Duration
+	active    bool
+	stop      chan struct{}
+	done      *sync.WaitGroup
+}
+
+// SetStandbyPool keeps standby warm for the Publisher. Once the primary ConnectionPool has been unhealthy
+// for longer than threshold publishing switches to the standby, switching back when the primary recovers.
+// Both switches are sent to Events. A nil standby removes it.
+func (pub *Publisher) SetStandbyPool(standby *ConnectionPool, threshold time.Duration, checkInterval time.Duration) {
+
+	pub.stopStandby()
+
+	if standby == nil {
+		return
+	}
+
+	if checkInterval <= 0 {
+		checkInterval = time.Second
+	}
+
+	sb := &standbyPool{
+		pool:      standby,
+		threshold: threshold,
+		interval:  checkInterval,
+		stop:      make(chan struct{}),
+		done:      &sync.WaitGroup{},
+	}
+
+	pub.pubRWLock.Lock()
+	pub.standby = sb
+	pub.pubRWLock.Unlock()
+
+	sb.done.Add(1)
+	go pub.monitorStandby(sb)
+}
+
+// SetStandbyHealthCheck replaces the primary ConnectionPool's UnhealthyFor as what the standby fails over on,
+// ex. to also cover an application's own health checks. A nil check restores UnhealthyFor.
+func (pub *Publisher) SetStandbyHealthCheck(unhealthyFor func() time.Duration) {
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	pub.standbyHealth = unhealthyFor
+}
+
+// UsingStandby reports whether publishing currently goes to the standby pool.
+func (pub *Publisher) UsingStandby() bool {
+	pub.pubRWLock.RLock()
+	defer pub.pubRWLock.RUnlock()
+
+	return pub.standby != nil && pub.standby.active
+}
+
+// activePool is the pool letters without an explicit Envelope.Pool are published on.
+func (pub *Publisher) activePool() *ConnectionPool {
+	pub.pubRWLock.RLock()
+	defer pub.pubRWLock.RUnlock()
+
+	if pub.standby != nil && pub.standby.active {
+		return pub.standby.pool
+	}
+
+	if pub.shards != nil {
+		return pub.shards.next()
+	}
+
+	return pub.ConnectionPool
+}
+
+func (pub *Publisher) monitorStandby(sb *standbyPool) {
+	defer sb.done.Done()
+
+	clock := pub.currentClock()
+	for {
+		select {
+		case <-sb.stop:
+			return
+		case <-clock.After(sb.interval):
+		}
+
+		pub.pubRWLock.RLock()
+		healthCheck := pub.standbyHealth
+		pub.pubRWLock.RUnlock()
+
+		var unhealthyFor time.Duration
+		if healthCheck != nil {
+			unhealthyFor = healthCheck()
+		} else {
+			unhealthyFor = pub.ConnectionPool.UnhealthyFor()
+		}
+
+		pub.pubRWLock.Lock()
+		switch {
+		case !sb.active && unhealthyFor > 0 && unhealthyFor >= sb.threshold:
+			sb.active = true
+			pub.pubRWLock.Unlock()
+			pub.emitEvent(PublisherEventFailover, fmt.Sprintf("primary pool unhealthy for %s", unhealthyFor))
+
+		case sb.active && unhealthyFor == 0:
+			sb.active = false
+			pub.pubRWLock.Unlock()
+			pub.emitEvent(PublisherEventFailback, "primary pool recovered")
+
+		default:
+			pub.pubRWLock.Unlock()
+		}
+	}
+}
+
+// stopStandby stops monitoring and returns publishing to the primary pool.
+func (pub *Publisher) stopStandby() {
+
+	pub.pubRWLock.Lock()
+	sb := pub.standby
+	pub.standby = nil
+	pub.pubRWLock.Unlock()
+
+	if sb == nil {
+		return
+	}
+
+	close(sb.stop)
+	sb.done.Wait()
+}
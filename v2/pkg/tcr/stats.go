@@ -0,0 +1,305 @@
+package tcr
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultStatsRoutingKeyLimit bounds the exchange/routing key pairs tracked by a Publisher.
+const DefaultStatsRoutingKeyLimit = 1000
+
+const (
+	// FailureReasonPublish counts publishes the channel refused.
+	FailureReasonPublish = "publish"
+
+	// FailureReasonNack counts publishes the server nacked.
+	FailureReasonNack = "nack"
+
+	// FailureReasonTimeout counts publishes whose confirmation didn't arrive in time.
+	FailureReasonTimeout = "timeout"
+)
+
+// confirmLatencyBounds are the upper bounds of the ConfirmLatency buckets, the last bucket is unbounded.
+var confirmLatencyBounds = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// LatencyBucket counts the latencies up to UpperBound (and above the previous bucket), zero is unbounded.
+type LatencyBucket struct {
+	UpperBound time.Duration
+	Count      uint64
+}
+
+// LatencyHistogram is the distribution of observed latencies.
+type LatencyHistogram struct {
+	Count   uint64
+	Sum     time.Duration
+	Max     time.Duration
+	Buckets []LatencyBucket
+}
+
+// Mean is the average latency, zero without observations.
+func (lh *LatencyHistogram) Mean() time.Duration {
+	if lh.Count == 0 {
+		return 0
+	}
+	return lh.Sum / time.Duration(lh.Count)
+}
+
+// Quantile is the upper bound of the bucket holding the q (0-1) quantile, Max for the unbounded bucket.
+func (lh *LatencyHistogram) Quantile(q float64) time.Duration {
+
+	rank := uint64(q * float64(lh.Count))
+	var seen uint64
+	for _, bucket := range lh.Buckets {
+		seen += bucket.Count
+		if seen > rank || (seen == lh.Count && seen > 0) {
+			if bucket.UpperBound == 0 {
+				return lh.Max
+			}
+			return bucket.UpperBound
+		}
+	}
+
+	return 0
+}
+
+// RoutingKeyStats are the publish statistics of one exchange and routing key.
+type RoutingKeyStats struct {
+	Exchange        string
+	RoutingKey      string
+	Published       uint64
+	Failed          uint64
+	BodyBytes       uint64 // total of published bodies
+	AverageBodySize float64
+	FailureRate     float64 // Failed / (Published + Failed)
+}
+
+// PublisherStats is a snapshot of a Publisher's statistics.
+type PublisherStats struct {
+	PublisherName    string
+	Published        uint64
+	Failed           uint64
+	FailuresByReason map[string]uint64 // FailureReasonPublish, FailureReasonNack or FailureReasonTimeout
+	Retries          uint64            // publishes of a letter after its first attempt
+	Deduplicated     uint64            // letters skipped as already published
+	BodyBytes        uint64
+	QueueDepth       int // letters queued for auto-publishing
+	ConfirmLatency   *LatencyHistogram
+	BodySizes        *SizeHistogram     // of every publish the channel accepted
+	RoutingKeys      []*RoutingKeyStats // most published first, least recently used pairs are evicted beyond the limit
+}
+
+type routingKeyStatsKey struct {
+	exchange   string
+	routingKey string
+}
+
+// publisherStats counts publishes in total and per exchange/routing key with LRU bounded cardinality.
+type publisherStats struct {
+	published uint64
+	failed    uint64
+	reasons   map[string]uint64
+	retries   uint64
+	deduped   uint64
+	bodyBytes uint64
+	confirms  LatencyHistogram
+	bodySizes SizeHistogram
+	limit     int
+	order     *list.List
+	keys      map[routingKeyStatsKey]*list.Element
+	lock      *sync.Mutex
+}
+
+func newPublisherStats(limit int) *publisherStats {
+
+	if limit <= 0 {
+		limit = DefaultStatsRoutingKeyLimit
+	}
+
+	return &publisherStats{
+		reasons:   make(map[string]uint64),
+		confirms:  LatencyHistogram{Buckets: newLatencyBuckets(confirmLatencyBounds)},
+		bodySizes: SizeHistogram{Buckets: newSizeBuckets(bodySizeBounds)},
+		limit:     limit,
+		order:     list.New(),
+		keys:      make(map[routingKeyStatsKey]*list.Element),
+		lock:      &sync.Mutex{},
+	}
+}
+
+// record counts a publish of the letter, err is the publish (or confirmation) failure.
+func (ps *publisherStats) record(pl *preparedLetter, err error) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	entry := ps.entry(pl.exchange, pl.routingKey)
+	if err != nil {
+		ps.failed++
+		ps.reasons[FailureReasonPublish]++
+		entry.Failed++
+		return
+	}
+
+	size := uint64(len(pl.publishing.Body))
+	ps.bodySizes.observe(len(pl.publishing.Body))
+	ps.published++
+	ps.bodyBytes += size
+	entry.Published++
+	entry.BodyBytes += size
+}
+
+// unpublish moves a publish that was later not confirmed to the failures.
+func (ps *publisherStats) unpublish(pl *preparedLetter, reason string) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	size := uint64(len(pl.publishing.Body))
+	entry := ps.entry(pl.exchange, pl.routingKey)
+	if entry.Published > 0 {
+		entry.Published--
+		entry.BodyBytes -= size
+	}
+	entry.Failed++
+
+	if ps.published > 0 {
+		ps.published--
+		ps.bodyBytes -= size
+	}
+	ps.failed++
+	ps.reasons[reason]++
+}
+
+func (ps *publisherStats) retry() {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	ps.retries++
+}
+
+func (ps *publisherStats) deduplicate() {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	ps.deduped++
+}
+
+// confirm observes the latency between publishing and the server's confirmation.
+func (ps *publisherStats) confirm(latency time.Duration) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	ps.confirms.observe(latency)
+}
+
+func (lh *LatencyHistogram) observe(latency time.Duration) {
+
+	lh.Count++
+	lh.Sum += latency
+	if latency > lh.Max {
+		lh.Max = latency
+	}
+
+	for i := range lh.Buckets {
+		bound := lh.Buckets[i].UpperBound
+		if bound == 0 || latency <= bound {
+			lh.Buckets[i].Count++
+			return
+		}
+	}
+}
+
+func newLatencyBuckets(bounds []time.Duration) []LatencyBucket {
+
+	buckets := make([]LatencyBucket, len(bounds)+1)
+	for i, bound := range bounds {
+		buckets[i].UpperBound = bound
+	}
+
+	return buckets
+}
+
+// entry returns the stats of the pair, requires the lock.
+func (ps *publisherStats) entry(exchange string, routingKey string) *RoutingKeyStats {
+
+	key := routingKeyStatsKey{exchange: exchange, routingKey: routingKey}
+	if element, ok := ps.keys[key]; ok {
+		ps.order.MoveToFront(element)
+		return element.Value.(*RoutingKeyStats)
+	}
+
+	entry := &RoutingKeyStats{Exchange: exchange, RoutingKey: routingKey}
+	ps.keys[key] = ps.order.PushFront(entry)
+
+	if ps.order.Len() > ps.limit {
+		oldest := ps.order.Back()
+		ps.order.Remove(oldest)
+		evicted := oldest.Value.(*RoutingKeyStats)
+		delete(ps.keys, routingKeyStatsKey{exchange: evicted.Exchange, routingKey: evicted.RoutingKey})
+	}
+
+	return entry
+}
+
+func (ps *publisherStats) snapshot(publisherName string) *PublisherStats {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	confirms := ps.confirms
+	confirms.Buckets = append([]LatencyBucket(nil), ps.confirms.Buckets...)
+
+	bodySizes := ps.bodySizes
+	bodySizes.Buckets = append([]SizeBucket(nil), ps.bodySizes.Buckets...)
+
+	stats := &PublisherStats{
+		PublisherName:    publisherName,
+		Published:        ps.published,
+		Failed:           ps.failed,
+		FailuresByReason: make(map[string]uint64, len(ps.reasons)),
+		Retries:          ps.retries,
+		Deduplicated:     ps.deduped,
+		BodyBytes:        ps.bodyBytes,
+		ConfirmLatency:   &confirms,
+		BodySizes:        &bodySizes,
+		RoutingKeys:      make([]*RoutingKeyStats, 0, ps.order.Len()),
+	}
+
+	for reason, count := range ps.reasons {
+		stats.FailuresByReason[reason] = count
+	}
+
+	for element := ps.order.Front(); element != nil; element = element.Next() {
+		entry := *element.Value.(*RoutingKeyStats)
+		if entry.Published > 0 {
+			entry.AverageBodySize = float64(entry.BodyBytes) / float64(entry.Published)
+		}
+		if total := entry.Published + entry.Failed; total > 0 {
+			entry.FailureRate = float64(entry.Failed) / float64(total)
+		}
+		stats.RoutingKeys = append(stats.RoutingKeys, &entry)
+	}
+
+	sort.SliceStable(stats.RoutingKeys, func(i, j int) bool {
+		return stats.RoutingKeys[i].Published > stats.RoutingKeys[j].Published
+	})
+
+	return stats
+}
+
+// Stats returns the publish statistics of the Publisher.
+func (pub *Publisher) Stats() *PublisherStats {
+	stats := pub.stats.snapshot(pub.Name)
+	stats.QueueDepth = pub.queueDepth()
+	return stats
+}
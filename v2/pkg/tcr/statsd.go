@@ -0,0 +1,216 @@
+package tcr
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatsDConfig pushes pool metrics to a StatsD (or DogStatsD) agent over UDP.
+type StatsDConfig struct {
+	Address   string            `json:"Address" yaml:"Address"`     // ex.) 127.0.0.1:8125
+	Prefix    string            `json:"Prefix" yaml:"Prefix"`       // ex.) myservice.rabbit
+	Tags      map[string]string `json:"Tags" yaml:"Tags"`           // only sent when DogStatsD is enabled
+	DogStatsD bool              `json:"DogStatsD" yaml:"DogStatsD"` // use the DogStatsD tag extension
+	Interval  uint32            `json:"Interval" yaml:"Interval"`   // ms, defaults to 10000
+}
+
+// StatsDEmitter periodically pushes the Stats of ConnectionPools and the EndToEndLatency of Consumers as gauges.
+type StatsDEmitter struct {
+	Config    *StatsDConfig
+	conn      net.Conn
+	pools     map[string]*ConnectionPool
+	consumers map[string]*Consumer
+	tags      string
+	interval  time.Duration
+	lock      *sync.Mutex
+	stop      chan struct{}
+	done      *sync.WaitGroup
+	started   bool
+}
+
+// NewStatsDEmitter creates a StatsDEmitter sending to the configured address.
+func NewStatsDEmitter(config *StatsDConfig) (*StatsDEmitter, error) {
+
+	if config == nil || config.Address == "" {
+		return nil, errors.New("statsd config requires an address")
+	}
+
+	conn, err := net.Dial("udp", config.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	interval := time.Duration(config.Interval) * time.Millisecond
+	if interval == 0 {
+		interval = 10 * time.Second
+	}
+
+	return &StatsDEmitter{
+		Config:    config,
+		conn:      conn,
+		pools:     make(map[string]*ConnectionPool),
+		consumers: make(map[string]*Consumer),
+		tags:      formatDogStatsDTags(config),
+		interval:  interval,
+		lock:      &sync.Mutex{},
+		done:      &sync.WaitGroup{},
+	}, nil
+}
+
+// AddPool includes the pool in every push, its metrics are named <prefix>.pool.<name>.<metric>.
+func (se *StatsDEmitter) AddPool(name string, cp *ConnectionPool) {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+
+	se.pools[name] = cp
+}
+
+// AddConsumer includes the consumer's EndToEndLatency in every push, named <prefix>.consumer.<name>.latency.<metric>
+// in ms, for SLO tracking.
+func (se *StatsDEmitter) AddConsumer(name string, con *Consumer) {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+
+	se.consumers[name] = con
+}
+
+// Start begins pushing metrics every interval.
+func (se *StatsDEmitter) Start() {
+	se.lock.Lock()
+	defer se.lock.Unlock()
+
+	if se.started {
+		return
+	}
+
+	se.started = true
+	se.stop = make(chan struct{})
+	se.done.Add(1)
+	go se.emitLoop(se.stop)
+}
+
+// Stop stops pushing and closes the connection to the agent.
+func (se *StatsDEmitter) Stop() {
+	se.lock.Lock()
+	if se.started {
+		se.started = false
+		close(se.stop)
+	}
+	se.lock.Unlock()
+
+	se.done.Wait()
+	_ = se.conn.Close()
+}
+
+// Emit pushes the current metrics once, write failures are dropped as StatsD is best effort.
+func (se *StatsDEmitter) Emit() {
+
+	se.lock.Lock()
+	names := make([]string, 0, len(se.pools))
+	pools := make(map[string]*ConnectionPool, len(se.pools))
+	for name, cp := range se.pools {
+		names = append(names, name)
+		pools[name] = cp
+	}
+	consumerNames := make([]string, 0, len(se.consumers))
+	consumers := make(map[string]*Consumer, len(se.consumers))
+	for name, con := range se.consumers {
+		consumerNames = append(consumerNames, name)
+		consumers[name] = con
+	}
+	se.lock.Unlock()
+
+	sort.Strings(names)
+	for _, name := range names {
+		stats := pools[name].Stats()
+		metric := "pool." + name + "."
+
+		buffer := &bytes.Buffer{}
+		se.gauge(buffer, metric+"connections.max", int64(stats.MaxConnections))
+		se.gauge(buffer, metric+"connections.idle", stats.IdleConnections)
+		se.gauge(buffer, metric+"connections.flagged", int64(stats.FlaggedConnections))
+		se.gauge(buffer, metric+"connections.recovering", int64(stats.RecoveringConnections))
+		se.gauge(buffer, metric+"channels.max", int64(stats.MaxChannels))
+		se.gauge(buffer, metric+"channels.idle", int64(stats.IdleChannels))
+		se.gauge(buffer, metric+"unhealthy_ms", stats.UnhealthyFor.Milliseconds())
+
+		_, _ = se.conn.Write(buffer.Bytes())
+	}
+
+	sort.Strings(consumerNames)
+	for _, name := range consumerNames {
+		latency := consumers[name].EndToEndLatency()
+		metric := "consumer." + name + ".latency."
+
+		buffer := &bytes.Buffer{}
+		se.gauge(buffer, metric+"count", int64(latency.Latency.Count))
+		se.gauge(buffer, metric+"mean_ms", latency.Latency.Mean().Milliseconds())
+		se.gauge(buffer, metric+"p50_ms", latency.Latency.Quantile(0.5).Milliseconds())
+		se.gauge(buffer, metric+"p99_ms", latency.Latency.Quantile(0.99).Milliseconds())
+		se.gauge(buffer, metric+"max_ms", latency.Latency.Max.Milliseconds())
+		se.gauge(buffer, metric+"skewed", int64(latency.Skewed))
+
+		_, _ = se.conn.Write(buffer.Bytes())
+	}
+}
+
+func (se *StatsDEmitter) emitLoop(stop chan struct{}) {
+	defer se.done.Done()
+
+	ticker := time.NewTicker(se.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			se.Emit()
+		}
+	}
+}
+
+// gauge appends a gauge line to the buffer.
+func (se *StatsDEmitter) gauge(buffer *bytes.Buffer, name string, value int64) {
+
+	if buffer.Len() > 0 {
+		buffer.WriteByte('\n')
+	}
+
+	if se.Config.Prefix != "" {
+		buffer.WriteString(strings.TrimSuffix(se.Config.Prefix, "."))
+		buffer.WriteByte('.')
+	}
+
+	buffer.WriteString(name)
+	buffer.WriteByte(':')
+	buffer.WriteString(strconv.FormatInt(value, 10))
+	buffer.WriteString("|g")
+	buffer.WriteString(se.tags)
+}
+
+// formatDogStatsDTags renders the sorted tags as the DogStatsD |#k:v,... suffix.
+func formatDogStatsDTags(config *StatsDConfig) string {
+
+	if !config.DogStatsD || len(config.Tags) == 0 {
+		return ""
+	}
+
+	tags := make([]string, 0, len(config.Tags))
+	for key, value := range config.Tags {
+		if value == "" {
+			tags = append(tags, key)
+			continue
+		}
+		tags = append(tags, key+":"+value)
+	}
+
+	sort.Strings(tags)
+	return "|#" + strings.Join(tags, ",")
+}
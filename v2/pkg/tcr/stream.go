@@ -0,0 +1,125 @@
+package tcr
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/streadway/amqp"
+)
+
+// StreamBlobStore is a BlobStore that can take a body as a stream, so PublishStream offloads it without holding
+// it in memory.
+type StreamBlobStore interface {
+	BlobStore
+	PutBlobStream(key string, body io.Reader, length int64) error
+}
+
+// PutBlobStream writes the blob from the stream.
+func (store *FileBlobStore) PutBlobStream(key string, body io.Reader, length int64) error {
+
+	file, err := os.OpenFile(store.path(key), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err = copyExactly(file, body, length); err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// PublishStream publishes a body of a known length read from the stream, with confirmation. Bodies over the
+// SetBlobStore threshold go straight from the stream to a StreamBlobStore with only the claim check published,
+// so files of any size can be forwarded - unless the envelope compresses or the publisher encrypts, which needs
+// the whole body. Other bodies are read into a single buffer of the length, the amqp client frames bodies from
+// memory. A stream shorter or longer than the length fails the publish.
+func (pub *Publisher) PublishStream(envelope *Envelope, body io.Reader, length int64) error {
+
+	if envelope == nil {
+		return errors.New("can't publish a stream without an envelope to address it with")
+	}
+
+	if length < 0 {
+		return fmt.Errorf("can't publish a stream of negative length %d", length)
+	}
+
+	letter := &Letter{
+		LetterID: pub.newLetterID(),
+		Envelope: envelope,
+	}
+
+	offloaded, err := pub.offloadStream(letter, body, length)
+	if err != nil {
+		return err
+	}
+
+	if !offloaded {
+		letter.Body = make([]byte, length)
+		if _, err := io.ReadFull(body, letter.Body); err != nil {
+			return fmt.Errorf("reading the %d byte body of LetterID: %s failed: %w", length, letter.LetterID.String(), err)
+		}
+		if err := streamEnded(body); err != nil {
+			return fmt.Errorf("reading the body of LetterID: %s failed: %w", letter.LetterID.String(), err)
+		}
+	}
+
+	return pub.PublishWithConfirmationError(letter, 0)
+}
+
+// offloadStream streams the body into the StreamBlobStore and addresses the letter with its claim check.
+func (pub *Publisher) offloadStream(letter *Letter, body io.Reader, length int64) (bool, error) {
+
+	pub.pubRWLock.RLock()
+	store, streaming := pub.blobStore.(StreamBlobStore)
+	threshold := pub.blobThreshold
+	encryption := pub.encryption
+	pub.pubRWLock.RUnlock()
+
+	encrypted := encryption != nil && encryption.Enabled && len(encryption.Hashkey) > 0
+	if !streaming || length <= int64(threshold) || letter.Envelope.Compression != "" || encrypted {
+		return false, nil
+	}
+
+	key := pub.newLetterID().String() // unique per offload, letters may share (or lack) a LetterID
+	if err := store.PutBlobStream(key, body, length); err != nil {
+		return false, fmt.Errorf("offloading the body of LetterID: %s failed: %w", letter.LetterID.String(), err)
+	}
+
+	envelope := *letter.Envelope
+	envelope.Headers = make(amqp.Table, len(letter.Envelope.Headers)+2)
+	for header, value := range letter.Envelope.Headers {
+		envelope.Headers[header] = value
+	}
+	envelope.Headers[HeaderClaimCheck] = key
+	envelope.Headers[HeaderClaimCheckSize] = length
+
+	letter.Envelope = &envelope
+	letter.Body = []byte{}
+	return true, nil
+}
+
+// copyExactly copies length bytes, failing on a stream of any other length.
+func copyExactly(dst io.Writer, src io.Reader, length int64) (int64, error) {
+
+	written, err := io.CopyN(dst, src, length)
+	if err != nil {
+		return written, fmt.Errorf("stream ended after %d of %d bytes: %w", written, length, err)
+	}
+
+	return written, streamEnded(src)
+}
+
+// streamEnded fails when the stream has more than the expected length.
+func streamEnded(src io.Reader) error {
+
+	var extra [1]byte
+	if n, _ := src.Read(extra[:]); n > 0 {
+		return errors.New("stream is longer than its length")
+	}
+
+	return nil
+}
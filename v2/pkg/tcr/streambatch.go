@@ -0,0 +1,209 @@
+package tcr
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/streadway/amqp"
+)
+
+const (
+	// HeaderSubEntryCount marks a message as a batch of sub-entries and holds how many it contains.
+	HeaderSubEntryCount = "x-tcr-sub-entries"
+
+	// ContentTypeSubEntryBatch is the content type of a sub-entry batch message.
+	ContentTypeSubEntryBatch = "application/vnd.tcr.sub-entries"
+
+	subEntryHeaderSize = 16 + 4 // LetterID + body length
+)
+
+// SubEntry is a single letter packed inside a sub-entry batch message.
+type SubEntry struct {
+	LetterID uuid.UUID
+	Body     []byte
+}
+
+// StreamBatcher packs many letters into one AMQP message to reach stream queue throughput.
+// AMQP 0-9-1 has no native sub-entry batching, so each sub-entry is framed as
+// [16 byte LetterID][4 byte big endian length][body] and unpacked with UnpackSubEntries.
+// Batches are published with confirmation, bounded by the publisher's PublishTimeOutInterval, so Add and Flush
+// block while a batch is confirmed. One PublishReceipt is produced per batch, its FailedLetter carries the whole
+// batch for a retry.
+type StreamBatcher struct {
+	pub        *Publisher
+	exchange   string
+	routingKey string
+	maxEntries int
+	maxBytes   int
+	linger     time.Duration
+	entries    int
+	buffer     []byte
+	lock       *sync.Mutex
+	stop       chan struct{}
+	stopOnce   *sync.Once
+	done       *sync.WaitGroup
+}
+
+// NewStreamBatcher creates a StreamBatcher publishing to exchange/routingKey with the publisher.
+// A batch is sent once it holds maxEntries letters, exceeds maxBytes or it has lingered (when linger > 0).
+func NewStreamBatcher(
+	pub *Publisher,
+	exchange string,
+	routingKey string,
+	maxEntries int,
+	maxBytes int,
+	linger time.Duration) *StreamBatcher {
+
+	if maxEntries <= 0 {
+		maxEntries = 100
+	}
+
+	if maxBytes <= 0 {
+		maxBytes = 1024 * 1024
+	}
+
+	sb := &StreamBatcher{
+		pub:        pub,
+		exchange:   exchange,
+		routingKey: routingKey,
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		linger:     linger,
+		lock:       &sync.Mutex{},
+		stop:       make(chan struct{}),
+		stopOnce:   &sync.Once{},
+		done:       &sync.WaitGroup{},
+	}
+
+	if linger > 0 {
+		sb.done.Add(1)
+		go sb.lingerLoop()
+	}
+
+	return sb
+}
+
+// Add appends a letter's body to the current batch, publishing the batch when it is full.
+// Only the LetterID and Body are kept, the batch is addressed by the StreamBatcher.
+func (sb *StreamBatcher) Add(letter *Letter) error {
+
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+
+	if len(sb.buffer) > 0 && len(sb.buffer)+subEntryHeaderSize+len(letter.Body) > sb.maxBytes {
+		if err := sb.flush(); err != nil {
+			return err
+		}
+	}
+
+	var header [subEntryHeaderSize]byte
+	copy(header[:16], letter.LetterID[:])
+	binary.BigEndian.PutUint32(header[16:], uint32(len(letter.Body)))
+
+	sb.buffer = append(sb.buffer, header[:]...)
+	sb.buffer = append(sb.buffer, letter.Body...)
+	sb.entries++
+
+	if sb.entries >= sb.maxEntries {
+		return sb.flush()
+	}
+
+	return nil
+}
+
+// Flush publishes the current batch, if any.
+func (sb *StreamBatcher) Flush() error {
+
+	sb.lock.Lock()
+	defer sb.lock.Unlock()
+
+	return sb.flush()
+}
+
+// Stop flushes the remaining entries and stops the linger loop.
+func (sb *StreamBatcher) Stop() error {
+
+	sb.stopOnce.Do(func() { close(sb.stop) })
+	sb.done.Wait()
+
+	return sb.Flush()
+}
+
+func (sb *StreamBatcher) flush() error {
+
+	if sb.entries == 0 {
+		return nil
+	}
+
+	letter := &Letter{
+		LetterID: sb.pub.newLetterID(),
+		Body:     sb.buffer,
+		Envelope: &Envelope{
+			Exchange:     sb.exchange,
+			RoutingKey:   sb.routingKey,
+			ContentType:  ContentTypeSubEntryBatch,
+			DeliveryMode: amqp.Persistent,
+			Headers:      amqp.Table{HeaderSubEntryCount: int32(sb.entries)},
+		},
+	}
+
+	sb.buffer = nil
+	sb.entries = 0
+
+	err := sb.pub.PublishWithConfirmationError(letter, 0)
+	sb.pub.publishReceipt(letter, err)
+
+	return err
+}
+
+func (sb *StreamBatcher) lingerLoop() {
+	defer sb.done.Done()
+
+	ticker := time.NewTicker(sb.linger)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sb.stop:
+			return
+		case <-ticker.C:
+			_ = sb.Flush() // failures surface on the PublishReceipts
+		}
+	}
+}
+
+// IsSubEntryBatch reports whether the message was published by a StreamBatcher.
+func (msg *ReceivedMessage) IsSubEntryBatch() bool {
+	_, ok := msg.Delivery.Headers[HeaderSubEntryCount]
+	return ok
+}
+
+// UnpackSubEntries splits a sub-entry batch body back into its entries.
+func UnpackSubEntries(body []byte) ([]*SubEntry, error) {
+
+	entries := make([]*SubEntry, 0)
+	for len(body) > 0 {
+		if len(body) < subEntryHeaderSize {
+			return nil, errors.New("sub-entry batch is truncated")
+		}
+
+		entry := &SubEntry{}
+		copy(entry.LetterID[:], body[:16])
+
+		size := int(binary.BigEndian.Uint32(body[16:subEntryHeaderSize]))
+		body = body[subEntryHeaderSize:]
+		if size > len(body) {
+			return nil, fmt.Errorf("sub-entry %s is truncated", entry.LetterID.String())
+		}
+
+		entry.Body = body[:size]
+		body = body[size:]
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
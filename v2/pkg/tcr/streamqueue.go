@@ -0,0 +1,195 @@
+package tcr
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// HeaderStreamFilterValue is the value stream consumers filter messages by (x-stream-filter), RabbitMQ 3.13+.
+	HeaderStreamFilterValue = "x-stream-filter-value"
+
+	// DefaultStreamWindow is how many letters PublishToStream publishes before their confirmations arrive.
+	DefaultStreamWindow = 1000
+)
+
+// StreamQueue is the Queue declaring a stream, maxAge (ex. 7D, 12h) and maxLengthBytes retain it, empty or zero
+// is unlimited. Segments of maxSegmentBytes (zero is the broker's 500MB) are truncated as a whole.
+func StreamQueue(name string, maxAge string, maxLengthBytes int64, maxSegmentBytes int64) *Queue {
+
+	args := amqp.Table{"x-queue-type": QueueTypeStream}
+	if maxAge != "" {
+		args["x-max-age"] = maxAge
+	}
+	if maxLengthBytes > 0 {
+		args["x-max-length-bytes"] = maxLengthBytes
+	}
+	if maxSegmentBytes > 0 {
+		args["x-stream-max-segment-size-bytes"] = maxSegmentBytes
+	}
+
+	return &Queue{
+		Name:    name,
+		Durable: true,
+		Type:    QueueTypeStream,
+		Args:    args,
+	}
+}
+
+// StampStreamFilter sets the HeaderStreamFilterValue of the letter, ex. a region or tenant.
+func StampStreamFilter(letter *Letter, value string) {
+
+	if letter.Envelope.Headers == nil {
+		letter.Envelope.Headers = amqp.Table{}
+	}
+
+	letter.Envelope.Headers[HeaderStreamFilterValue] = value
+}
+
+// StreamPublishResult is the outcome of PublishToStream.
+type StreamPublishResult struct {
+	Stream    string
+	Confirmed int
+	Sequences []uint64  // publish sequence number of every letter in order, zero when it was never published
+	Failed    []*Letter // nacked, refused, or unconfirmed when the context was done - publish them again
+	Error     error     // first failure
+}
+
+// Success is true when the stream confirmed every letter.
+func (spr *StreamPublishResult) Success() bool {
+	return spr.Error == nil
+}
+
+// streamPublish is a letter of PublishToStream waiting for its confirmation.
+type streamPublish struct {
+	letter   *Letter
+	prepared *preparedLetter
+	outcome  <-chan bool
+}
+
+// PublishToStream publishes the letters to the stream through the default exchange of the active pool and waits
+// for their confirmations, pipelining up to SetStreamWindow letters unconfirmed on a dedicated channel so large
+// batches reach stream throughput. Letters are persistent and keep their middleware, headers and Sequence, the
+// publish sequence number (delivery tag) of every letter is tracked in the result. Envelopes are copied, they may
+// be shared. Middleware sees a letter as published once it is sent, its confirmation is awaited afterwards.
+func (pub *Publisher) PublishToStream(ctx context.Context, stream string, letters []*Letter) *StreamPublishResult {
+
+	result := &StreamPublishResult{
+		Stream:    stream,
+		Sequences: make([]uint64, len(letters)),
+	}
+
+	fail := func(letter *Letter, err error) {
+		result.Failed = append(result.Failed, letter)
+		if result.Error == nil {
+			result.Error = err
+		}
+	}
+
+	pool := pub.activePool()
+	window := newConfirmWindow(pool, pub.streamWindowSize())
+	defer func() { window.close() }()
+
+	publishes := make([]*streamPublish, 0, len(letters))
+	for i, letter := range letters {
+		addressed, err := streamLetter(letter, stream)
+		if err != nil {
+			fail(letter, err)
+			continue
+		}
+
+		sp := &streamPublish{letter: letter}
+		err = pub.intercept(ctx, addressed, func(addressed *Letter) error {
+			prepared, err := pub.prepareLetterOn(addressed, pool)
+			if err != nil {
+				return err
+			}
+			pub.trackSequence(prepared.sequence)
+
+			tag, outcome, err := window.publish(ctx, prepared)
+			if err != nil {
+				return err
+			}
+
+			sp.prepared, sp.outcome = prepared, outcome
+			result.Sequences[i] = tag
+			return nil
+		})
+		if err != nil {
+			fail(letter, fmt.Errorf("LetterID: %s was not published to stream %s: %w", letter.LetterID.String(), stream, err))
+			if window.isClosed() && ctx.Err() == nil {
+				// the letters after it go out on a fresh channel
+				window = newConfirmWindow(pool, pub.streamWindowSize())
+			}
+			continue
+		}
+
+		if sp.outcome != nil { // middleware may have skipped it
+			publishes = append(publishes, sp)
+		} else {
+			result.Confirmed++
+		}
+	}
+
+	for _, sp := range publishes {
+		select {
+		case <-ctx.Done():
+			sp.prepared.unconfirmed(FailureReasonTimeout)
+			fail(sp.letter, fmt.Errorf("LetterID: %s confirmation from stream %s did not arrive: %w", sp.letter.LetterID.String(), stream, ctx.Err()))
+
+		case ack, ok := <-sp.outcome:
+			switch {
+			case !ok:
+				sp.prepared.lost()
+				fail(sp.letter, newPublishError([]error{ErrUnknownOutcome}, nil, "LetterID: %s channel closed before stream %s confirmed it", sp.letter.LetterID.String(), stream))
+			case !ack:
+				sp.prepared.unconfirmed(FailureReasonNack)
+				fail(sp.letter, fmt.Errorf("LetterID: %s was nacked by stream %s", sp.letter.LetterID.String(), stream))
+			default:
+				sp.prepared.confirmed()
+				result.Confirmed++
+			}
+		}
+	}
+
+	return result
+}
+
+// streamLetter addresses a copy of the letter to the stream.
+func streamLetter(letter *Letter, stream string) (*Letter, error) {
+
+	if letter.Envelope == nil {
+		return nil, fmt.Errorf("LetterID: %s has no envelope to address it with", letter.LetterID.String())
+	}
+
+	envelope := *letter.Envelope
+	envelope.Exchange = ""
+	envelope.RoutingKey = stream
+	envelope.DeliveryMode = amqp.Persistent
+
+	addressed := *letter
+	addressed.Envelope = &envelope
+	return &addressed, nil
+}
+
+// SetStreamWindow is how many letters PublishToStream publishes before their confirmations arrive, zero restores
+// the DefaultStreamWindow.
+func (pub *Publisher) SetStreamWindow(size int) {
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	pub.streamWindow = size
+}
+
+func (pub *Publisher) streamWindowSize() int {
+	pub.pubRWLock.RLock()
+	defer pub.pubRWLock.RUnlock()
+
+	if pub.streamWindow <= 0 {
+		return DefaultStreamWindow
+	}
+
+	return pub.streamWindow
+}
@@ -0,0 +1,98 @@
+package tcr
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrExchangeNotDeclared is wrapped by the receipt error of letters a strict Publisher refused, their exchange isn't
+// declared in the topology attached with SetStrictTopology.
+var ErrExchangeNotDeclared = errors.New("exchange not declared in the topology")
+
+// SetStrictTopology refuses letters addressed (through Envelope.Pool) to the pool whose exchange the topology
+// doesn't declare, before anything is sent, so a typo'd exchange fails in development instead of production.
+// An empty pool is the Publisher's own, a nil topology lifts the restriction. The default exchange and the
+// broker's amq.* exchanges are always allowed.
+func (pub *Publisher) SetStrictTopology(pool string, topology *TopologyConfig) {
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	if topology == nil {
+		delete(pub.strictExchanges, pool)
+		return
+	}
+
+	exchanges := make(map[string]bool, len(topology.Exchanges))
+	for _, exchange := range topology.Exchanges {
+		exchanges[exchange.Name] = true
+	}
+
+	if pub.strictExchanges == nil {
+		pub.strictExchanges = make(map[string]map[string]bool)
+	}
+	pub.strictExchanges[pool] = exchanges
+}
+
+// checkDeclaredExchange fails letters to exchanges the strict topology of their pool doesn't declare.
+func (pub *Publisher) checkDeclaredExchange(letter *Letter, exchange string) error {
+
+	pub.pubRWLock.RLock()
+	exchanges, strict := pub.strictExchanges[letter.Envelope.Pool]
+	pub.pubRWLock.RUnlock()
+
+	if !strict || exchange == "" || strings.HasPrefix(exchange, "amq.") || exchanges[exchange] {
+		return nil
+	}
+
+	if suggestion := closestName(exchange, exchanges); suggestion != "" {
+		return fmt.Errorf("LetterID: %s can't be published, %w: %q (did you mean %q?)", letter.LetterID.String(), ErrExchangeNotDeclared, exchange, suggestion)
+	}
+
+	return fmt.Errorf("LetterID: %s can't be published, %w: %q", letter.LetterID.String(), ErrExchangeNotDeclared, exchange)
+}
+
+// closestName is the name within a third of the name's length in edits, empty when nothing is that close.
+func closestName(name string, names map[string]bool) string {
+
+	closest := ""
+	best := len(name)/3 + 1
+	for candidate := range names {
+		if distance := editDistance(name, candidate); distance < best || (distance == best && closest != "" && candidate < closest) {
+			closest, best = candidate, distance
+		}
+	}
+
+	return closest
+}
+
+// editDistance is the Levenshtein distance of a and b.
+func editDistance(a string, b string) int {
+
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(minInt(previous[j]+1, current[j-1]+1), previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,86 @@
+package tcr
+
+import (
+	"fmt"
+	"math/rand"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// HeaderTappedFrom identifies the queue a tapped copy was consumed from.
+	HeaderTappedFrom = "x-tcr-tapped-from"
+)
+
+// TapConfig duplicates a sample of consumed messages to a diagnostic queue (and/or the tap callback) before
+// the handler sees them. The original message is not modified or acknowledged by the tap. Messages are tapped as
+// they arrived: a claim-checked, encrypted or compressed body is tapped as such, with the headers and
+// content-encoding describing it, never as the plaintext the handler sees.
+type TapConfig struct {
+	Enabled    bool    `json:"Enabled" yaml:"Enabled"`
+	SampleRate float64 `json:"SampleRate" yaml:"SampleRate"`                   // percentage (0-100) of messages tapped
+	QueueName  string  `json:"QueueName,omitempty" yaml:"QueueName,omitempty"` // diagnostic queue, published to via the default exchange
+}
+
+// SetTap registers a callback receiving the tapped messages. The callback must not ack/nack the message.
+func (con *Consumer) SetTap(tap func(*ReceivedMessage)) {
+	con.conLock.Lock()
+	defer con.conLock.Unlock()
+
+	con.tap = tap
+}
+
+// tapMessage copies a sample of messages to the configured tap destinations.
+func (con *Consumer) tapMessage(msg *ReceivedMessage) {
+
+	config := con.Config.TapConfig
+	if config == nil || !config.Enabled || config.SampleRate <= 0 {
+		return
+	}
+
+	if config.SampleRate < 100 && rand.Float64()*100 >= config.SampleRate {
+		return
+	}
+
+	con.conLock.Lock()
+	tap := con.tap
+	con.conLock.Unlock()
+
+	if tap != nil {
+		tap(msg)
+	}
+
+	if config.QueueName == "" {
+		return
+	}
+
+	headers := make(amqp.Table, len(msg.Delivery.Headers)+1)
+	for key, value := range msg.Delivery.Headers {
+		headers[key] = value
+	}
+	headers[HeaderTappedFrom] = con.QueueName
+
+	chanHost := con.ConnectionPool.GetChannelFromPool()
+	err := chanHost.Channel.Publish(
+		"",
+		config.QueueName,
+		false,
+		false,
+		amqp.Publishing{
+			ContentType:     msg.Delivery.ContentType,
+			ContentEncoding: msg.Delivery.ContentEncoding,
+			Headers:         headers,
+			DeliveryMode:    amqp.Transient,
+			CorrelationId:   msg.Delivery.CorrelationId,
+			MessageId:       msg.Delivery.MessageId,
+			Timestamp:       msg.Delivery.Timestamp,
+			Type:            msg.Delivery.Type,
+			AppId:           msg.Delivery.AppId,
+			Body:            msg.Delivery.Body,
+		})
+	con.ConnectionPool.ReturnChannel(chanHost, err != nil)
+
+	if err != nil {
+		con.errors <- fmt.Errorf("consumer %q failed to tap MessageID %s to %q: %w", con.ConsumerName, msg.MessageID, config.QueueName, err)
+	}
+}
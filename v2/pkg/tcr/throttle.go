@@ -0,0 +1,80 @@
+package tcr
+
+import (
+	"context"
+	"fmt"
+)
+
+// SetMaxProcessingRate throttles how many messages per second are handed to the handler, regardless of the
+// prefetch, to protect a fragile downstream. A rate of zero removes the limit.
+func (con *Consumer) SetMaxProcessingRate(rate float64, burst int) {
+	con.conLock.Lock()
+	defer con.conLock.Unlock()
+
+	con.rateLimiter = newRateLimiter(rate, burst)
+}
+
+// throttle waits for the rate limiter, deliveries pile up in the prefetch (then the queue) meanwhile.
+func (con *Consumer) throttle() {
+
+	con.conLock.Lock()
+	limiter := con.rateLimiter
+	con.conLock.Unlock()
+
+	_ = limiter.wait(context.Background())
+}
+
+// PublishRateLimit throttles a Publisher with token buckets, publishes wait for their tokens.
+type PublishRateLimit struct {
+	MessagesPerSecond float64 `json:"MessagesPerSecond,omitempty" yaml:"MessagesPerSecond,omitempty"` // 0 is unlimited
+	BytesPerSecond    float64 `json:"BytesPerSecond,omitempty" yaml:"BytesPerSecond,omitempty"`       // body bytes, 0 is unlimited
+	Burst             int     `json:"Burst,omitempty" yaml:"Burst,omitempty"`                         // messages allowed at once, defaults to 1
+}
+
+type publishRateLimit struct {
+	messages *rateLimiter
+	bytes    *rateLimiter
+}
+
+// newPublishRateLimit returns nil (unlimited) without a config.
+func newPublishRateLimit(config *PublishRateLimit) *publishRateLimit {
+
+	if config == nil || (config.MessagesPerSecond <= 0 && config.BytesPerSecond <= 0) {
+		return nil
+	}
+
+	return &publishRateLimit{
+		messages: newRateLimiter(config.MessagesPerSecond, config.Burst),
+		bytes:    newRateLimiter(config.BytesPerSecond, int(config.BytesPerSecond)), // a second worth of bytes
+	}
+}
+
+// SetRateLimit throttles every publish of the Publisher, nil removes the limit.
+func (pub *Publisher) SetRateLimit(config *PublishRateLimit) {
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	pub.rateLimit = newPublishRateLimit(config)
+}
+
+// throttle waits for the letter's message and body byte tokens, failing when the context is done first.
+func (pub *Publisher) throttle(ctx context.Context, letter *Letter) error {
+
+	pub.pubRWLock.RLock()
+	limit := pub.rateLimit
+	pub.pubRWLock.RUnlock()
+
+	if limit == nil {
+		return nil
+	}
+
+	err := limit.messages.wait(ctx)
+	if err == nil {
+		err = limit.bytes.waitN(ctx, float64(len(letter.Body)))
+	}
+	if err != nil {
+		return fmt.Errorf("publish of LetterID: %s abandoned waiting for the rate limit: %w", letter.LetterID.String(), err)
+	}
+
+	return nil
+}
@@ -4,10 +4,19 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"io/ioutil"
+	"os"
+	"sync"
+	"time"
 )
 
 // CreateTLSConfig creates a x509 TLS Config for use in TLS-based communication.
 func CreateTLSConfig(pemLocation string, localLocation string) (*tls.Config, error) {
+	return CreateTLSConfigWithKey(pemLocation, localLocation, localLocation)
+}
+
+// CreateTLSConfigWithKey creates a x509 TLS Config for use in TLS-based communication when the local
+// certificate and its private key are stored in separate files.
+func CreateTLSConfigWithKey(pemLocation string, localCertLocation string, localKeyLocation string) (*tls.Config, error) {
 	cfg := new(tls.Config)
 	cfg.RootCAs = x509.NewCertPool()
 
@@ -19,8 +28,8 @@ func CreateTLSConfig(pemLocation string, localLocation string) (*tls.Config, err
 	cfg.RootCAs.AppendCertsFromPEM(ca)
 
 	cert, err := tls.LoadX509KeyPair(
-		localLocation,
-		localLocation)
+		localCertLocation,
+		localKeyLocation)
 	if err != nil {
 		return nil, err
 	}
@@ -28,3 +37,136 @@ func CreateTLSConfig(pemLocation string, localLocation string) (*tls.Config, err
 	cfg.Certificates = append(cfg.Certificates, cert)
 	return cfg, nil
 }
+
+// TLSReloader keeps the TLS material of a TLSConfig current by watching the files for modifications.
+// New connections always get the latest successfully loaded material, existing connections are untouched.
+type TLSReloader struct {
+	config       *TLSConfig
+	current      *tls.Config
+	modTimes     map[string]time.Time
+	errorHandler func(error)
+	stop         chan struct{}
+	stopOnce     *sync.Once
+	lock         *sync.RWMutex
+}
+
+// NewTLSReloader loads the files of the TLSConfig and, with a ReloadInterval set, watches them until Stop.
+// Reload errors are passed to the errorHandler.
+func NewTLSReloader(config *TLSConfig, errorHandler func(error)) (*TLSReloader, error) {
+
+	reloader := &TLSReloader{
+		config:       config,
+		modTimes:     make(map[string]time.Time),
+		errorHandler: errorHandler,
+		stop:         make(chan struct{}),
+		stopOnce:     &sync.Once{},
+		lock:         &sync.RWMutex{},
+	}
+
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+
+	if config.ReloadInterval > 0 {
+		go reloader.watch(time.Duration(config.ReloadInterval) * time.Millisecond)
+	}
+
+	return reloader, nil
+}
+
+// TLSConfig returns a copy of the latest TLS material.
+func (tr *TLSReloader) TLSConfig() *tls.Config {
+	tr.lock.RLock()
+	defer tr.lock.RUnlock()
+
+	return tr.current.Clone()
+}
+
+// GetClientCertificate returns the latest local certificate, it fits tls.Config.GetClientCertificate.
+func (tr *TLSReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	tr.lock.RLock()
+	defer tr.lock.RUnlock()
+
+	cert := tr.current.Certificates[0]
+	return &cert, nil
+}
+
+func (tr *TLSReloader) files() []string {
+	keyLocation := tr.config.LocalKeyLocation
+	if keyLocation == "" {
+		keyLocation = tr.config.LocalCertLocation
+	}
+
+	return []string{tr.config.PEMCertLocation, tr.config.LocalCertLocation, keyLocation}
+}
+
+func (tr *TLSReloader) reload() error {
+
+	files := tr.files()
+	modTimes := make(map[string]time.Time, len(files))
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	cfg, err := CreateTLSConfigWithKey(files[0], files[1], files[2])
+	if err != nil {
+		return err
+	}
+
+	tr.lock.Lock()
+	tr.current = cfg
+	tr.modTimes = modTimes
+	tr.lock.Unlock()
+
+	return nil
+}
+
+// changed reports whether any of the watched files has a different modification time.
+func (tr *TLSReloader) changed() bool {
+	tr.lock.RLock()
+	defer tr.lock.RUnlock()
+
+	for file, modTime := range tr.modTimes {
+		info, err := os.Stat(file)
+		if err != nil {
+			return false // file is mid-rotation, try again next interval
+		}
+
+		if !info.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (tr *TLSReloader) watch(interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-tr.stop:
+			return
+		case <-ticker.C:
+			if !tr.changed() {
+				continue
+			}
+
+			// Keep serving the previous material if the new files are incomplete or invalid.
+			if err := tr.reload(); err != nil && tr.errorHandler != nil {
+				tr.errorHandler(err)
+			}
+		}
+	}
+}
+
+// Stop ends the file watching.
+func (tr *TLSReloader) Stop() {
+	tr.stopOnce.Do(func() { close(tr.stop) })
+}
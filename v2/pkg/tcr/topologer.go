@@ -2,6 +2,9 @@ package tcr
 
 import (
 	"errors"
+	"fmt"
+	"regexp"
+	"sync"
 
 	"github.com/streadway/amqp"
 )
@@ -12,11 +15,19 @@ const (
 
 	// QueueTypeClassic indicates a queue of type classic.
 	QueueTypeClassic = "classic"
+
+	// QueueTypeStream indicates a queue of type stream, an append-only log consumers read from any offset.
+	QueueTypeStream = "stream"
 )
 
+// DefaultTopologyConcurrency is the amount of declarations BuildTopology runs at the same time.
+const DefaultTopologyConcurrency = 10
+
 // Topologer allows you to build RabbitMQ topology backed by a ConnectionPool.
 type Topologer struct {
 	ConnectionPool *ConnectionPool
+	Concurrency    int               // parallel declarations (each on its own transient channel) used by BuildTopology
+	Management     *ManagementClient // optional, required for operations the management API provides
 }
 
 // NewTopologer builds you a new Topologer.
@@ -24,35 +35,117 @@ func NewTopologer(cp *ConnectionPool) *Topologer {
 
 	return &Topologer{
 		ConnectionPool: cp,
+		Concurrency:    DefaultTopologyConcurrency,
 	}
 }
 
+// NewTopologerWithManagement builds you a new Topologer that can also use the management API.
+func NewTopologerWithManagement(cp *ConnectionPool, management *ManagementClient) *Topologer {
+
+	top := NewTopologer(cp)
+	top.Management = management
+
+	return top
+}
+
 // BuildTopology builds a topology based on a TopologyConfig - stops on first error.
+//
+// Independent declarations are applied concurrently. Exchanges and Queues are declared first and
+// only then the QueueBindings and ExchangeBindings that depend on them.
 func (top *Topologer) BuildTopology(config *TopologyConfig, ignoreErrors bool) error {
 
-	err := top.BuildExchanges(config.Exchanges, ignoreErrors)
-	if err != nil && !ignoreErrors {
-		return err
+	declarations := make([]func() error, 0, len(config.Exchanges)+len(config.Queues))
+	for _, exchange := range config.Exchanges {
+		exchange := exchange
+		declarations = append(declarations, func() error { return top.CreateExchangeFromConfig(exchange) })
 	}
 
-	err = top.BuildQueues(config.Queues, ignoreErrors)
-	if err != nil && !ignoreErrors {
-		return err
+	for _, queue := range config.Queues {
+		queue := queue
+		declarations = append(declarations, func() error { return top.CreateQueueFromConfig(queue) })
 	}
 
-	err = top.BindQueues(config.QueueBindings, ignoreErrors)
+	err := top.RunConcurrently(declarations, ignoreErrors)
 	if err != nil && !ignoreErrors {
 		return err
 	}
 
-	err = top.BindExchanges(config.ExchangeBindings, ignoreErrors)
+	bindings := make([]func() error, 0, len(config.QueueBindings)+len(config.ExchangeBindings))
+	for _, queueBinding := range config.QueueBindings {
+		queueBinding := queueBinding
+		bindings = append(bindings, func() error { return top.QueueBind(queueBinding) })
+	}
+
+	for _, exchangeBinding := range config.ExchangeBindings {
+		exchangeBinding := exchangeBinding
+		bindings = append(bindings, func() error { return top.ExchangeBind(exchangeBinding) })
+	}
+
+	err = top.RunConcurrently(bindings, ignoreErrors)
 	if err != nil && !ignoreErrors {
 		return err
 	}
 
+	for _, user := range config.Users {
+		err = top.CreateUser(user)
+		if err != nil && !ignoreErrors {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// RunConcurrently executes the declarations with at most Concurrency in flight and returns the first error, it
+// is what BuildTopology declares with so callers can run their own declarations under the same bound.
+// Unless errors are ignored, declarations that haven't started yet are skipped after the first error.
+func (top *Topologer) RunConcurrently(declarations []func() error, ignoreErrors bool) error {
+
+	concurrency := top.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var firstErr error
+	errLock := &sync.Mutex{}
+	semaphore := make(chan struct{}, concurrency)
+	wg := &sync.WaitGroup{}
+
+	for _, declaration := range declarations {
+
+		// checked once a slot is free, a declaration in flight while waiting may have failed
+		semaphore <- struct{}{}
+
+		errLock.Lock()
+		failed := firstErr != nil
+		errLock.Unlock()
+
+		if failed && !ignoreErrors {
+			<-semaphore
+			break
+		}
+
+		wg.Add(1)
+		go func(declaration func() error) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+
+			if err := declaration(); err != nil {
+				errLock.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errLock.Unlock()
+			}
+		}(declaration)
+	}
+
+	wg.Wait()
+	return firstErr
+}
+
 // BuildExchanges loops through and builds Exchanges - stops on first error.
 func (top *Topologer) BuildExchanges(exchanges []*Exchange, ignoreErrors bool) error {
 
@@ -246,6 +339,15 @@ func (top *Topologer) CreateQueueFromConfig(queue *Queue) error {
 		}
 	}
 
+	// streams are durable, shared and never deleted automatically as well
+	if queue.Type == QueueTypeStream {
+		queue.Exclusive = false
+		queue.Durable = true
+		queue.NoWait = false
+		queue.AutoDelete = false
+		queue.Args = mergeHeaders(queue.Args, amqp.Table{"x-queue-type": queue.Type})
+	}
+
 	if queue.PassiveDeclare {
 		_, err := channel.QueueDeclarePassive(queue.Name, queue.Durable, queue.AutoDelete, queue.Exclusive, queue.NoWait, queue.Args)
 		return err
@@ -321,3 +423,154 @@ func (top *Topologer) UnbindQueue(queueName, routingKey, exchangeName string, ar
 		exchangeName,
 		amqp.Table(args))
 }
+
+// QueueGuard protects PurgeQueueWithGuard and QueueDeleteWithGuard from acting on the wrong queue.
+// When an Allowlist and/or AllowPattern is set the queue name has to match one of them.
+type QueueGuard struct {
+	IfEmpty      bool     `json:"IfEmpty" yaml:"IfEmpty"`
+	IfUnused     bool     `json:"IfUnused" yaml:"IfUnused"` // no consumers attached
+	Allowlist    []string `json:"Allowlist,omitempty" yaml:"Allowlist,omitempty"`
+	AllowPattern string   `json:"AllowPattern,omitempty" yaml:"AllowPattern,omitempty"` // regular expression
+}
+
+// InspectQueue passively declares the queue to retrieve its message and consumer counts.
+func (top *Topologer) InspectQueue(queueName string) (amqp.Queue, error) {
+
+	channel := top.ConnectionPool.GetTransientChannel(false)
+	defer channel.Close()
+
+	return channel.QueueDeclarePassive(queueName, false, false, false, false, nil)
+}
+
+// PurgeQueueWithGuard purges the queue only when every condition of the guard is met.
+func (top *Topologer) PurgeQueueWithGuard(queueName string, noWait bool, guard *QueueGuard) (int, error) {
+
+	if err := top.checkQueueGuard(queueName, guard); err != nil {
+		return 0, err
+	}
+
+	return top.PurgeQueue(queueName, noWait)
+}
+
+// QueueDeleteWithGuard deletes the queue only when every condition of the guard is met.
+// IfEmpty and IfUnused are also enforced by the server to avoid races with publishers/consumers.
+func (top *Topologer) QueueDeleteWithGuard(queueName string, noWait bool, guard *QueueGuard) (int, error) {
+
+	if err := top.checkQueueGuard(queueName, guard); err != nil {
+		return 0, err
+	}
+
+	if guard == nil {
+		return top.QueueDelete(queueName, false, false, noWait)
+	}
+
+	return top.QueueDelete(queueName, guard.IfUnused, guard.IfEmpty, noWait)
+}
+
+func (top *Topologer) checkQueueGuard(queueName string, guard *QueueGuard) error {
+
+	if guard == nil {
+		return nil
+	}
+
+	if len(guard.Allowlist) > 0 || guard.AllowPattern != "" {
+		allowed := false
+		for _, name := range guard.Allowlist {
+			if name == queueName {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed && guard.AllowPattern != "" {
+			pattern, err := regexp.Compile(guard.AllowPattern)
+			if err != nil {
+				return err
+			}
+			allowed = pattern.MatchString(queueName)
+		}
+
+		if !allowed {
+			return fmt.Errorf("queue guard refused %q - name is not allowed", queueName)
+		}
+	}
+
+	if !guard.IfEmpty && !guard.IfUnused {
+		return nil
+	}
+
+	queue, err := top.InspectQueue(queueName)
+	if err != nil {
+		return err
+	}
+
+	if guard.IfEmpty && queue.Messages > 0 {
+		return fmt.Errorf("queue guard refused %q - queue still has %d messages", queueName, queue.Messages)
+	}
+
+	if guard.IfUnused && queue.Consumers > 0 {
+		return fmt.Errorf("queue guard refused %q - queue still has %d consumers", queueName, queue.Consumers)
+	}
+
+	return nil
+}
+
+// CreateUser creates (or updates) the user and its permissions through the management API.
+func (top *Topologer) CreateUser(user *User) error {
+
+	if top.Management == nil {
+		return errors.New("can't provision users without a management client")
+	}
+
+	if err := top.Management.PutUser(user.Name, user.Password, user.Tags); err != nil {
+		return err
+	}
+
+	for _, permission := range user.Permissions {
+		if err := top.Management.PutPermission(user.Name, permission); err != nil {
+			return err
+		}
+	}
+
+	for _, permission := range user.TopicPermissions {
+		if err := top.Management.PutTopicPermission(user.Name, permission); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeleteUser removes the user through the management API.
+func (top *Topologer) DeleteUser(name string) error {
+
+	if top.Management == nil {
+		return errors.New("can't delete users without a management client")
+	}
+
+	return top.Management.DeleteUser(name)
+}
+
+// DeleteExchangeCascade removes every binding to and from the exchange (found via the management API)
+// and then deletes the exchange itself so no orphaned bindings are left behind.
+func (top *Topologer) DeleteExchangeCascade(exchangeName string) error {
+
+	if top.Management == nil {
+		return errors.New("can't cascade delete an exchange without a management client")
+	}
+
+	for _, asSource := range []bool{true, false} {
+		bindings, err := top.Management.ListExchangeBindings(exchangeName, asSource)
+		if err != nil {
+			return err
+		}
+
+		for _, binding := range bindings {
+			if err := top.Management.DeleteBinding(binding); err != nil {
+				return err
+			}
+		}
+	}
+
+	return top.ExchangeDelete(exchangeName, false, false)
+}
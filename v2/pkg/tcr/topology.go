@@ -22,7 +22,7 @@ type Queue struct {
 	AutoDelete     bool       `json:"AutoDelete" yaml:"AutoDelete"`
 	Exclusive      bool       `json:"Exclusive" yaml:"Exclusive"`
 	NoWait         bool       `json:"NoWait" yaml:"NoWait"`
-	Type           string     `json:"Type" yaml:"Type"`           // classic or quorum, type of quorum disregards exclusive and enables durable properties when building from config
+	Type           string     `json:"Type" yaml:"Type"`           // classic, quorum or stream, types quorum and stream disregard exclusive and enable durable properties when building from config
 	Args           amqp.Table `json:"Args,omitempty" yaml:"Args,omitempty"` // map[string]interface()
 }
 
@@ -43,3 +43,28 @@ type ExchangeBinding struct {
 	NoWait             bool       `json:"NoWait" yaml:"NoWait"`
 	Args               amqp.Table `json:"Args,omitempty" yaml:"Args,omitempty"` // map[string]interface()
 }
+
+// User allows for you to provision a user (and its permissions) through the management API.
+type User struct {
+	Name             string             `json:"Name" yaml:"Name"`
+	Password         string             `json:"Password" yaml:"Password"`
+	Tags             string             `json:"Tags" yaml:"Tags"` // comma separated, ex.) "administrator" or "monitoring"
+	Permissions      []*Permission      `json:"Permissions,omitempty" yaml:"Permissions,omitempty"`
+	TopicPermissions []*TopicPermission `json:"TopicPermissions,omitempty" yaml:"TopicPermissions,omitempty"`
+}
+
+// Permission grants a user access to a vhost, each field is a regular expression of resource names.
+type Permission struct {
+	VHost     string `json:"VHost" yaml:"VHost"` // defaults to the management client's vhost
+	Configure string `json:"Configure" yaml:"Configure"`
+	Write     string `json:"Write" yaml:"Write"`
+	Read      string `json:"Read" yaml:"Read"`
+}
+
+// TopicPermission restricts the routing keys a user may publish/consume with on a topic exchange.
+type TopicPermission struct {
+	VHost    string `json:"VHost" yaml:"VHost"` // defaults to the management client's vhost
+	Exchange string `json:"Exchange" yaml:"Exchange"`
+	Write    string `json:"Write" yaml:"Write"`
+	Read     string `json:"Read" yaml:"Read"`
+}
@@ -0,0 +1,133 @@
+package tcr
+
+import (
+	"context"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// HeaderTraceID is shared by every letter descending from the same original message.
+	HeaderTraceID = "x-tcr-trace-id"
+
+	// HeaderCausationID is the MessageID of the delivery that caused the letter to be published.
+	HeaderCausationID = "x-tcr-causation-id"
+
+	// HeaderTraceDepth counts the hops from the original message.
+	HeaderTraceDepth = "x-tcr-trace-depth"
+)
+
+// propagatedHeaders are copied unchanged from the inbound delivery (W3C trace context and B3).
+var propagatedHeaders = []string{
+	"traceparent",
+	"tracestate",
+	"baggage",
+	"b3",
+	"X-B3-TraceId",
+	"X-B3-SpanId",
+	"X-B3-ParentSpanId",
+	"X-B3-Sampled",
+}
+
+type receivedMessageKey struct{}
+
+// ContextWithReceivedMessage returns a context carrying the inbound message for trace propagation.
+func ContextWithReceivedMessage(ctx context.Context, msg *ReceivedMessage) context.Context {
+	return context.WithValue(ctx, receivedMessageKey{}, msg)
+}
+
+// ReceivedMessageFromContext returns the inbound message carried by the context, if any.
+func ReceivedMessageFromContext(ctx context.Context) (*ReceivedMessage, bool) {
+	msg, ok := ctx.Value(receivedMessageKey{}).(*ReceivedMessage)
+	return msg, ok && msg != nil
+}
+
+// Context returns a background context carrying the message, hand it to PublishWithContext or the
+// PublishWithConfirmationContext variants when publishing from a handler to propagate its trace.
+func (msg *ReceivedMessage) Context() context.Context {
+	return ContextWithReceivedMessage(context.Background(), msg)
+}
+
+// PropagateTrace copies the trace and correlation details of the inbound message in ctx onto the letter.
+// Headers the letter already has are never overwritten. The letter gets a copy of its Envelope, one shared by
+// several letters is never modified.
+func PropagateTrace(ctx context.Context, letter *Letter) {
+
+	msg, ok := ReceivedMessageFromContext(ctx)
+	if !ok || letter == nil || letter.Envelope == nil {
+		return
+	}
+
+	inbound := msg.Delivery.Headers
+	headers := make(amqp.Table, len(letter.Envelope.Headers)+len(propagatedHeaders)+3)
+	for key, value := range letter.Envelope.Headers {
+		headers[key] = value
+	}
+
+	setIfMissing := func(key string, value interface{}) {
+		if _, ok := headers[key]; !ok {
+			headers[key] = value
+		}
+	}
+
+	for _, key := range propagatedHeaders {
+		if value, ok := inbound[key]; ok {
+			setIfMissing(key, value)
+		}
+	}
+
+	traceID, ok := inbound[HeaderTraceID]
+	if !ok && msg.MessageID != "" {
+		traceID = msg.MessageID // the inbound message is the root of the chain
+	}
+	if traceID != nil {
+		setIfMissing(HeaderTraceID, traceID)
+	}
+
+	if msg.MessageID != "" {
+		setIfMissing(HeaderCausationID, msg.MessageID)
+	}
+
+	setIfMissing(HeaderTraceDepth, traceDepth(inbound)+1)
+
+	envelope := *letter.Envelope
+	envelope.Headers = headers
+	if envelope.CorrelationID == "" {
+		envelope.CorrelationID = msg.Delivery.CorrelationId
+	}
+
+	letter.Envelope = &envelope
+}
+
+// traceDepth reads the depth header, zero when missing.
+func traceDepth(headers amqp.Table) int32 {
+
+	switch depth := headers[HeaderTraceDepth].(type) {
+	case int32:
+		return depth
+	case int64:
+		return int32(depth)
+	case int:
+		return int32(depth)
+	case int16:
+		return int32(depth)
+	case int8:
+		return int32(depth)
+	}
+
+	return 0
+}
+
+// PublishWithTraceContext publishes the letter like PublishWithContext and publishes its receipt unless skipped.
+//
+// Deprecated: PublishWithContext and the PublishWithConfirmationContext variants propagate the trace of the
+// inbound message carried by ctx themselves.
+func (pub *Publisher) PublishWithTraceContext(ctx context.Context, letter *Letter, skipReceipt bool) error {
+
+	err := pub.PublishWithContext(ctx, letter)
+	if !skipReceipt {
+		pub.publishReceipt(letter, err)
+	}
+
+	return err
+}
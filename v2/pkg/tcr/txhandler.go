@@ -0,0 +1,79 @@
+package tcr
+
+import (
+	"fmt"
+)
+
+// TxHandler wraps message processing with begin/commit/rollback hooks so side-effects (ex. database writes) and
+// acknowledgements line up. The message is only Acked after Commit succeeds, any failure is rolled back and the
+// message is Nacked (requeued when RequeueOnFailure is set).
+//
+// Begin and Commit are optional, Handle is required. Rollback receives the error that caused it.
+type TxHandler struct {
+	Begin            func(*ReceivedMessage) error
+	Handle           func(*ReceivedMessage) error
+	Commit           func(*ReceivedMessage) error
+	Rollback         func(*ReceivedMessage, error)
+	RequeueOnFailure bool
+}
+
+// StartConsumingWithTxHandler starts the Consumer invoking the TxHandler on every ReceivedMessage.
+// Requires an ackable (AutoAck false) consumer, errors are sent to the consumer's Errors.
+func (con *Consumer) StartConsumingWithTxHandler(handler *TxHandler) error {
+
+	if con.autoAck {
+		return fmt.Errorf("consumer %q can't use a TxHandler with AutoAck enabled", con.ConsumerName)
+	}
+
+	if handler == nil || handler.Handle == nil {
+		return fmt.Errorf("consumer %q requires a TxHandler with a Handle func", con.ConsumerName)
+	}
+
+	con.StartConsumingWithAction(con.txAction(handler))
+	return nil
+}
+
+// txAction converts a TxHandler into a regular consumer action.
+func (con *Consumer) txAction(handler *TxHandler) func(*ReceivedMessage) {
+
+	return func(msg *ReceivedMessage) {
+
+		if handler.Begin != nil {
+			if err := handler.Begin(msg); err != nil {
+				con.txFailure(handler, msg, fmt.Errorf("tx begin failed for MessageID %s: %w", msg.MessageID, err), false)
+				return
+			}
+		}
+
+		if err := handler.Handle(msg); err != nil {
+			con.txFailure(handler, msg, fmt.Errorf("tx handle failed for MessageID %s: %w", msg.MessageID, err), true)
+			return
+		}
+
+		if handler.Commit != nil {
+			if err := handler.Commit(msg); err != nil {
+				con.txFailure(handler, msg, fmt.Errorf("tx commit failed for MessageID %s: %w", msg.MessageID, err), true)
+				return
+			}
+		}
+
+		if err := msg.Acknowledge(); err != nil {
+			// Commit already happened, the broker will redeliver - handlers should be idempotent.
+			con.errors <- fmt.Errorf("tx committed but ack failed for MessageID %s: %w", msg.MessageID, err)
+		}
+	}
+}
+
+// txFailure rolls back (when a transaction was begun) and nacks the message.
+func (con *Consumer) txFailure(handler *TxHandler, msg *ReceivedMessage, err error, begun bool) {
+
+	if begun && handler.Rollback != nil {
+		handler.Rollback(msg, err)
+	}
+
+	con.errors <- err
+
+	if nackErr := msg.Nack(handler.RequeueOnFailure); nackErr != nil {
+		con.errors <- fmt.Errorf("tx nack failed for MessageID %s: %w", msg.MessageID, nackErr)
+	}
+}
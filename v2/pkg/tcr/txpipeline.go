@@ -0,0 +1,135 @@
+package tcr
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// NewTransactionalPipeline creates a Pipeline publishing a message's letters and acking it in one AMQP transaction,
+// so either all outputs and the ack happen or none do - there is no window between confirming the outputs and
+// acking the input. The consumer consumes on a dedicated tx mode channel the letters are published on, so they
+// must be addressed to the consumer's ConnectionPool. Transactions span the whole channel, messages are processed
+// one at a time regardless of the consumer's workers. Requires an ackable (AutoAck false) consumer that hasn't
+// started yet.
+func NewTransactionalPipeline(con *Consumer, pub *Publisher, handler PipelineHandler) (*Pipeline, error) {
+
+	pipeline, err := NewPipeline(con, pub, 0, handler)
+	if err != nil {
+		return nil, err
+	}
+
+	con.conLock.Lock()
+	defer con.conLock.Unlock()
+
+	if con.started {
+		return nil, fmt.Errorf("consumer %q has to be stopped to change it to a transactional channel", con.ConsumerName)
+	}
+
+	con.transactional = true
+	pipeline.txLock = &sync.Mutex{}
+	return pipeline, nil
+}
+
+// processTx runs the handler and commits its letters with the ack, or rolls them back and nacks the message.
+func (p *Pipeline) processTx(msg *ReceivedMessage) {
+
+	channel, ok := msg.Delivery.Acknowledger.(*amqp.Channel)
+	if !ok {
+		p.fail(msg, fmt.Errorf("pipeline can't transact MessageID %s without its amqp channel", msg.MessageID), true)
+		return
+	}
+
+	p.txLock.Lock()
+	defer p.txLock.Unlock()
+
+	letters, err := p.handler(msg)
+	if err != nil {
+		p.rollback(channel, msg, fmt.Errorf("pipeline handler failed for MessageID %s: %w", msg.MessageID, err), p.RequeueOnFailure)
+		return
+	}
+
+	for _, letter := range letters {
+		err := p.publisher.intercept(context.Background(), letter, func(letter *Letter) error {
+			prepared, err := p.publisher.prepareLetter(letter)
+			if err != nil {
+				return err
+			}
+
+			if prepared.pool != p.consumer.ConnectionPool {
+				return fmt.Errorf("LetterID: %s is addressed to another pool than the consumer's, a transaction can't span connections", letter.LetterID.String())
+			}
+
+			return prepared.publish(channel)
+		})
+		if err != nil {
+			p.rollback(channel, msg, fmt.Errorf("pipeline failed forwarding LetterID %s of MessageID %s: %w", letter.LetterID.String(), msg.MessageID, err), true)
+			return
+		}
+	}
+
+	if err := msg.Acknowledge(); err != nil {
+		p.rollback(channel, msg, fmt.Errorf("pipeline ack failed for MessageID %s: %w", msg.MessageID, err), true)
+		return
+	}
+
+	if err := channel.TxCommit(); err != nil {
+		// A failed commit closes the channel, the outputs are discarded and the broker redelivers the input.
+		p.consumer.errors <- fmt.Errorf("pipeline commit failed for MessageID %s: %w", msg.MessageID, err)
+	}
+}
+
+// rollback discards the uncommitted letters and commits a nack of the message instead.
+func (p *Pipeline) rollback(channel *amqp.Channel, msg *ReceivedMessage, err error, requeue bool) {
+
+	p.consumer.errors <- err
+
+	if rollbackErr := channel.TxRollback(); rollbackErr != nil {
+		// The channel is gone, so is anything uncommitted and the broker redelivers the input.
+		p.consumer.errors <- fmt.Errorf("pipeline rollback failed for MessageID %s: %w", msg.MessageID, rollbackErr)
+		return
+	}
+
+	if nackErr := msg.Nack(requeue); nackErr != nil {
+		p.consumer.errors <- fmt.Errorf("pipeline nack failed for MessageID %s: %w", msg.MessageID, nackErr)
+		return
+	}
+
+	if commitErr := channel.TxCommit(); commitErr != nil {
+		p.consumer.errors <- fmt.Errorf("pipeline nack commit failed for MessageID %s: %w", msg.MessageID, commitErr)
+	}
+}
+
+// consumerChannel is the channel the Consumer consumes on, a tx mode one for transactional pipelines.
+func (con *Consumer) consumerChannel() *ChannelHost {
+
+	con.conLock.Lock()
+	transactional := con.transactional
+	con.conLock.Unlock()
+
+	if transactional {
+		return con.ConnectionPool.GetTxChannel()
+	}
+
+	return con.ConnectionPool.GetConsumerChannel()
+}
+
+// GetTxChannel creates a dedicated channel in transaction (tx) mode, which can't be combined with publisher
+// confirms. Return it with ReturnChannel to close it.
+func (cp *ConnectionPool) GetTxChannel() *ChannelHost {
+
+	// InfiniteLoop: Stay till we have a good channel.
+	for {
+		chanHost := cp.getDedicatedChannel(false)
+
+		if err := chanHost.Channel.Tx(); err != nil {
+			cp.handleError(err)
+			cp.ReturnChannel(chanHost, true)
+			continue
+		}
+
+		return chanHost
+	}
+}
@@ -0,0 +1,62 @@
+package tcr
+
+// SetUnknownOutcomeReceipts sends a PublishReceipt with UnknownOutcome (and ErrUnknownOutcome) for every letter
+// published with confirmation whose channel was replaced before confirming it, ex. on a broker failover - the
+// server may have routed it or not. The letter is still republished and gets its usual receipt afterwards, so
+// the unknown outcome is a heads-up that a duplicate may be delivered, not a failure to retry. Off by default.
+func (pub *Publisher) SetUnknownOutcomeReceipts(enabled bool) {
+	pub.pubRWLock.Lock()
+	defer pub.pubRWLock.Unlock()
+
+	pub.notifyUnknownOutcomes = enabled
+}
+
+// lost is called when the channel of the preparedLetter closed before its confirmation arrived.
+func (pl *preparedLetter) lost() {
+	pl.unconfirmed(FailureReasonPublish)
+	pl.lostOnce = true
+
+	pl.pub.pubRWLock.RLock()
+	notify := pl.pub.notifyUnknownOutcomes
+	pl.pub.pubRWLock.RUnlock()
+
+	if !notify {
+		return
+	}
+
+	pl.pub.sendReceipt(&PublishReceipt{
+		PublisherName:  pl.pub.Name,
+		LetterID:       pl.letterID,
+		UnknownOutcome: true,
+		Error:          newPublishError([]error{ErrUnknownOutcome}, nil, "LetterID: %s channel closed before confirming it, republishing", pl.letterID.String()),
+	})
+}
+
+// outcomeError marks the error of a preparedLetter that was lost on a dead channel before as ErrUnknownOutcome,
+// giving up on it doesn't mean the server never received it.
+func (pl *preparedLetter) outcomeError(err error) error {
+
+	if err == nil || !pl.lostOnce {
+		return err
+	}
+
+	return &unknownOutcomeError{err: err}
+}
+
+// unknownOutcomeError is ErrUnknownOutcome on top of the error giving up on the letter.
+type unknownOutcomeError struct {
+	err error
+}
+
+func (uoe *unknownOutcomeError) Error() string {
+	return uoe.err.Error() + " (an earlier publish of it may have been delivered, its channel closed unconfirmed)"
+}
+
+// Is matches ErrUnknownOutcome, the kinds of the error are matched through Unwrap.
+func (uoe *unknownOutcomeError) Is(target error) bool {
+	return target == ErrUnknownOutcome
+}
+
+func (uoe *unknownOutcomeError) Unwrap() error {
+	return uoe.err
+}
@@ -0,0 +1,414 @@
+package tcr
+
+import (
+	"container/list"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// HeaderWatermarkKey is the key (ex. an aggregate id) messages are processed in order by.
+	HeaderWatermarkKey = "x-tcr-watermark-key"
+
+	// HeaderWatermarkSequence is the position of the message within its key, increasing per key.
+	HeaderWatermarkSequence = "x-tcr-watermark-sequence"
+
+	// DefaultWatermarkCacheSize is how many keys a Consumer keeps the marks of in memory, the least recently
+	// used are reloaded from the WatermarkStore when seen again.
+	DefaultWatermarkCacheSize = 10000
+)
+
+// WatermarkStore persists the highest processed sequence per key so a consumer restarted after a crash can skip
+// the redelivered messages it already processed. A loaded zero can't tell nothing saved from a processed
+// sequence 0, a key's sequence 0 redelivered after a restart is processed again.
+type WatermarkStore interface {
+	SaveWatermark(queueName string, key string, sequence uint64) error
+	LoadWatermark(queueName string, key string) (uint64, error) // zero without error when nothing was saved
+}
+
+// StampWatermark addresses the letter to the ordered processing of the key at the sequence.
+func StampWatermark(letter *Letter, key string, sequence uint64) {
+
+	if letter.Envelope.Headers == nil {
+		letter.Envelope.Headers = amqp.Table{}
+	}
+
+	letter.Envelope.Headers[HeaderWatermarkKey] = key
+	letter.Envelope.Headers[HeaderWatermarkSequence] = int64(sequence)
+}
+
+// watermarks caches the store's marks of the Consumer's queue, least recently used keys are evicted first.
+type watermarks struct {
+	store    WatermarkStore
+	capacity int
+	order    *list.List
+	marks    map[string]*list.Element
+	lock     *sync.Mutex
+}
+
+// keyWatermark is the mark of a key and its messages being processed, which the mark can't pass until acked.
+type keyWatermark struct {
+	key      string
+	mark     uint64
+	marked   bool // the mark is a processed sequence, not the zero of a key nothing was saved of
+	inFlight map[uint64]bool
+	acked    map[uint64]bool // above the mark, held back by a lower sequence in flight
+}
+
+// watermark is the mark a ReceivedMessage moves its key to once acknowledged.
+type watermark struct {
+	watermarks *watermarks
+	queueName  string
+	key        string
+	sequence   uint64
+}
+
+// SetWatermarkStore skips messages (acking them unprocessed) whose HeaderWatermarkSequence isn't above the
+// watermark of their HeaderWatermarkKey, and moves the watermark when a message is acknowledged. Messages
+// without the headers are never skipped, a nil store stops skipping.
+//
+// Acks of a key may arrive out of order (ex. with several Workers), the watermark only moves to the highest
+// acked sequence without a lower one still being processed or requeued. A key must be consumed by a single
+// Consumer (ex. a single active consumer queue), its messages requeued to another are skipped once this one's
+// watermark passes them.
+func (con *Consumer) SetWatermarkStore(store WatermarkStore) {
+	con.conLock.Lock()
+	defer con.conLock.Unlock()
+
+	if store == nil {
+		con.watermarks = nil
+		return
+	}
+
+	con.watermarks = &watermarks{
+		store:    store,
+		capacity: DefaultWatermarkCacheSize,
+		order:    list.New(),
+		marks:    make(map[string]*list.Element),
+		lock:     &sync.Mutex{},
+	}
+}
+
+// skipProcessed acks messages at or below the watermark of their key, true when it was skipped.
+func (con *Consumer) skipProcessed(msg *ReceivedMessage) bool {
+
+	con.conLock.Lock()
+	wm := con.watermarks
+	con.conLock.Unlock()
+
+	if wm == nil {
+		return false
+	}
+
+	key, sequence, ok := watermarkOf(msg)
+	if !ok {
+		return false
+	}
+
+	processed, err := wm.admit(con.QueueName, key, sequence, msg.IsAckable)
+	if err != nil {
+		con.errors <- fmt.Errorf("consumer %q can't load the watermark of key %s: %w", con.ConsumerName, key, err)
+		return false // processing twice beats losing the message
+	}
+
+	if !processed {
+		msg.watermark = &watermark{watermarks: wm, queueName: con.QueueName, key: key, sequence: sequence}
+		return false
+	}
+
+	if msg.IsAckable {
+		if err := msg.Acknowledge(); err != nil {
+			con.errors <- err
+		}
+	}
+
+	return true
+}
+
+// watermarkOf reads the key and sequence headers of the message.
+func watermarkOf(msg *ReceivedMessage) (string, uint64, bool) {
+
+	key, ok := msg.Delivery.Headers[HeaderWatermarkKey].(string)
+	if !ok || key == "" {
+		return "", 0, false
+	}
+
+	var sequence int64
+	switch value := msg.Delivery.Headers[HeaderWatermarkSequence].(type) {
+	case int64:
+		sequence = value
+	case int32:
+		sequence = int64(value)
+	case int16:
+		sequence = int64(value)
+	case int8:
+		sequence = int64(value)
+	case int:
+		sequence = int64(value)
+	case uint8:
+		sequence = int64(value)
+	case string:
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "", 0, false
+		}
+		sequence = parsed
+	default:
+		return "", 0, false
+	}
+
+	if sequence < 0 {
+		return "", 0, false
+	}
+
+	return key, uint64(sequence), true
+}
+
+// admit returns true when the sequence was processed already, otherwise it is tracked in flight (when it will
+// be acked) so the mark can't pass it meanwhile.
+func (wm *watermarks) admit(queueName string, key string, sequence uint64, ackable bool) (bool, error) {
+	wm.lock.Lock()
+	defer wm.lock.Unlock()
+
+	km, err := wm.load(queueName, key)
+	if err != nil {
+		return false, err
+	}
+
+	if (km.marked && sequence <= km.mark) || km.acked[sequence] {
+		return true, nil
+	}
+
+	if ackable {
+		km.inFlight[sequence] = true
+	}
+
+	return false, nil
+}
+
+// load returns the cached mark of the key, reading the store the first time it is seen (or after eviction).
+func (wm *watermarks) load(queueName string, key string) (*keyWatermark, error) {
+
+	if element, ok := wm.marks[key]; ok {
+		wm.order.MoveToFront(element)
+		return element.Value.(*keyWatermark), nil
+	}
+
+	mark, err := wm.store.LoadWatermark(queueName, key)
+	if err != nil {
+		return nil, err
+	}
+
+	km := &keyWatermark{key: key, mark: mark, marked: mark > 0, inFlight: make(map[uint64]bool), acked: make(map[uint64]bool)}
+	wm.marks[key] = wm.order.PushFront(km)
+	wm.evict()
+
+	return km, nil
+}
+
+// evict drops the least recently used marks over capacity, keys with messages in flight are kept.
+func (wm *watermarks) evict() {
+
+	for element := wm.order.Back(); element != nil && wm.order.Len() > wm.capacity; {
+		previous := element.Prev()
+		if km := element.Value.(*keyWatermark); len(km.inFlight) == 0 {
+			wm.order.Remove(element)
+			delete(wm.marks, km.key)
+		}
+		element = previous
+	}
+}
+
+// save settles the acked sequence and moves the mark to the highest acked sequence below every one in flight,
+// never backwards. The sequence stays in flight when the store fails, its message isn't acked.
+func (wm *watermarks) save(queueName string, key string, sequence uint64) error {
+	wm.lock.Lock()
+	defer wm.lock.Unlock()
+
+	km, err := wm.load(queueName, key)
+	if err != nil {
+		return err
+	}
+
+	if km.marked && sequence <= km.mark {
+		delete(km.inFlight, sequence)
+		return nil
+	}
+
+	delete(km.inFlight, sequence)
+	km.acked[sequence] = true
+
+	mark, marked := km.mark, km.marked
+	for acked := range km.acked {
+		if (!marked || acked > mark) && !km.heldBack(acked) {
+			mark, marked = acked, true
+		}
+	}
+
+	if mark == km.mark && marked == km.marked {
+		return nil
+	}
+
+	if err := wm.store.SaveWatermark(queueName, key, mark); err != nil {
+		delete(km.acked, sequence)
+		km.inFlight[sequence] = true
+		return err
+	}
+
+	km.mark, km.marked = mark, true
+	for acked := range km.acked {
+		if acked <= mark {
+			delete(km.acked, acked)
+		}
+	}
+
+	return nil
+}
+
+// release stops tracking a sequence that won't be redelivered (nacked or rejected without requeue).
+func (wm *watermarks) release(key string, sequence uint64) {
+	wm.lock.Lock()
+	defer wm.lock.Unlock()
+
+	if element, ok := wm.marks[key]; ok {
+		delete(element.Value.(*keyWatermark).inFlight, sequence)
+	}
+}
+
+// heldBack is true when a lower sequence is still in flight.
+func (km *keyWatermark) heldBack(sequence uint64) bool {
+
+	for inFlight := range km.inFlight {
+		if inFlight < sequence {
+			return true
+		}
+	}
+
+	return false
+}
+
+// saveWatermark records the message as processed, before it is acked so a crash in between only skips it.
+func (msg *ReceivedMessage) saveWatermark() error {
+
+	if msg.watermark == nil {
+		return nil
+	}
+
+	wm := msg.watermark
+	if err := wm.watermarks.save(wm.queueName, wm.key, wm.sequence); err != nil {
+		return fmt.Errorf("saving the watermark %d of key %s failed, message was not acked: %w", wm.sequence, wm.key, err)
+	}
+
+	return nil
+}
+
+// releaseWatermark stops holding the watermark back for a message that left the queue unacked.
+func (msg *ReceivedMessage) releaseWatermark(requeue bool) {
+
+	if msg.watermark != nil && !requeue {
+		msg.watermark.watermarks.release(msg.watermark.key, msg.watermark.sequence)
+	}
+}
+
+// FileWatermarkStore keeps one JSON file of marks per queue in a directory.
+type FileWatermarkStore struct {
+	directory string
+	queues    map[string]map[string]uint64
+	lock      *sync.Mutex
+}
+
+// NewFileWatermarkStore creates the directory when needed.
+func NewFileWatermarkStore(directory string) (*FileWatermarkStore, error) {
+
+	if err := os.MkdirAll(directory, 0755); err != nil {
+		return nil, err
+	}
+
+	return &FileWatermarkStore{
+		directory: directory,
+		queues:    make(map[string]map[string]uint64),
+		lock:      &sync.Mutex{},
+	}, nil
+}
+
+// SaveWatermark rewrites the marks of the queue atomically (write then rename).
+func (store *FileWatermarkStore) SaveWatermark(queueName string, key string, sequence uint64) error {
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	marks, err := store.marks(queueName)
+	if err != nil {
+		return err
+	}
+
+	updated := make(map[string]uint64, len(marks)+1)
+	for k, v := range marks {
+		updated[k] = v
+	}
+	updated[key] = sequence
+
+	data, err := json.Marshal(updated)
+	if err != nil {
+		return err
+	}
+
+	path := store.path(queueName)
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	store.queues[queueName] = updated
+	return nil
+}
+
+// LoadWatermark reads the mark of the key.
+func (store *FileWatermarkStore) LoadWatermark(queueName string, key string) (uint64, error) {
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	marks, err := store.marks(queueName)
+	if err != nil {
+		return 0, err
+	}
+
+	return marks[key], nil
+}
+
+// marks reads the file of the queue once.
+func (store *FileWatermarkStore) marks(queueName string) (map[string]uint64, error) {
+
+	if marks, ok := store.queues[queueName]; ok {
+		return marks, nil
+	}
+
+	marks := make(map[string]uint64)
+	data, err := ioutil.ReadFile(store.path(queueName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err == nil {
+		if err := json.Unmarshal(data, &marks); err != nil {
+			return nil, err
+		}
+	}
+
+	store.queues[queueName] = marks
+	return marks, nil
+}
+
+func (store *FileWatermarkStore) path(queueName string) string {
+	return filepath.Join(store.directory, filepath.Base(queueName)+".watermarks.json")
+}
@@ -0,0 +1,272 @@
+package tcr
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1" // mandated by RFC 6455 for the handshake, not used for security
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// WebSocketConfig tunnels the AMQP connection through a WebSocket (TCP-over-WS) gateway for environments
+// where only 443 egress is allowed. The pool URI still provides credentials and vhost.
+type WebSocketConfig struct {
+	Enabled     bool              `json:"Enabled" yaml:"Enabled"`
+	URL         string            `json:"URL" yaml:"URL"` // ws:// or wss:// address of the gateway
+	Subprotocol string            `json:"Subprotocol,omitempty" yaml:"Subprotocol,omitempty"`
+	Headers     map[string]string `json:"Headers,omitempty" yaml:"Headers,omitempty"` // ex.) Authorization for the proxy
+}
+
+// DialWebSocket opens a WebSocket to the gateway and returns it as a net.Conn carrying binary frames.
+func DialWebSocket(config *WebSocketConfig, timeout time.Duration) (net.Conn, error) {
+
+	wsURL, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	host := wsURL.Host
+	if wsURL.Port() == "" {
+		switch wsURL.Scheme {
+		case "wss":
+			host = net.JoinHostPort(wsURL.Hostname(), "443")
+		case "ws":
+			host = net.JoinHostPort(wsURL.Hostname(), "80")
+		}
+	}
+
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: timeout}
+	switch wsURL.Scheme {
+	case "wss":
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: wsURL.Hostname(), MinVersion: tls.VersionTLS12})
+	case "ws":
+		conn, err = dialer.Dial("tcp", host)
+	default:
+		return nil, fmt.Errorf("unsupported websocket scheme %q", wsURL.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	wsConn, err := handshakeWebSocket(conn, wsURL, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+	return wsConn, nil
+}
+
+func handshakeWebSocket(conn net.Conn, wsURL *url.URL, config *WebSocketConfig) (*webSocketConn, error) {
+
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	request := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: wsURL.Path, RawQuery: wsURL.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       wsURL.Host,
+	}
+	if request.URL.Path == "" {
+		request.URL.Path = "/"
+	}
+
+	for header, value := range config.Headers {
+		request.Header.Set(header, value)
+	}
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Sec-WebSocket-Key", key)
+	request.Header.Set("Sec-WebSocket-Version", "13")
+	if config.Subprotocol != "" {
+		request.Header.Set("Sec-WebSocket-Protocol", config.Subprotocol)
+	}
+
+	if err := request.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("websocket upgrade was refused with status: %s", response.Status)
+	}
+
+	hash := sha1.Sum([]byte(key + webSocketGUID))
+	if response.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(hash[:]) {
+		return nil, errors.New("websocket upgrade returned an invalid Sec-WebSocket-Accept")
+	}
+
+	return &webSocketConn{
+		Conn:      conn,
+		reader:    reader,
+		writeLock: &sync.Mutex{},
+	}, nil
+}
+
+// webSocketConn presents the payload of binary WebSocket frames as a continuous stream.
+type webSocketConn struct {
+	net.Conn
+	reader    *bufio.Reader
+	remaining uint64 // unread payload of the current data frame
+	writeLock *sync.Mutex
+}
+
+// Read reads the payload of incoming data frames, handling control frames in between.
+func (wc *webSocketConn) Read(p []byte) (int, error) {
+
+	for wc.remaining == 0 {
+		opcode, length, err := wc.readFrameHeader()
+		if err != nil {
+			return 0, err
+		}
+
+		switch opcode {
+		case wsOpBinary, wsOpText, wsOpContinuation:
+			wc.remaining = length
+		case wsOpClose:
+			return 0, io.EOF
+		case wsOpPing:
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(wc.reader, payload); err != nil {
+				return 0, err
+			}
+			if err := wc.writeFrame(wsOpPong, payload); err != nil {
+				return 0, err
+			}
+		default: // pong and unknown frames are discarded
+			if _, err := io.CopyN(io.Discard, wc.reader, int64(length)); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if uint64(len(p)) > wc.remaining {
+		p = p[:wc.remaining]
+	}
+
+	n, err := wc.reader.Read(p)
+	wc.remaining -= uint64(n)
+	return n, err
+}
+
+func (wc *webSocketConn) readFrameHeader() (byte, uint64, error) {
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(wc.reader, header); err != nil {
+		return 0, 0, err
+	}
+
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(wc.reader, extended); err != nil {
+			return 0, 0, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, err := io.ReadFull(wc.reader, extended); err != nil {
+			return 0, 0, err
+		}
+		length = binary.BigEndian.Uint64(extended)
+	}
+
+	if masked {
+		return 0, 0, errors.New("websocket server sent a masked frame")
+	}
+
+	return opcode, length, nil
+}
+
+// Write sends p as a single masked binary frame.
+func (wc *webSocketConn) Write(p []byte) (int, error) {
+	if err := wc.writeFrame(wsOpBinary, p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (wc *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+
+	frame := make([]byte, 0, len(payload)+14)
+	frame = append(frame, 0x80|opcode)
+
+	length := len(payload)
+	switch {
+	case length < 126:
+		frame = append(frame, 0x80|byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, 0x80|126, byte(length>>8), byte(length))
+	default:
+		extended := make([]byte, 8)
+		binary.BigEndian.PutUint64(extended, uint64(length))
+		frame = append(frame, 0x80|127)
+		frame = append(frame, extended...)
+	}
+
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(rand.Reader, mask); err != nil {
+		return err
+	}
+	frame = append(frame, mask...)
+
+	for i := range payload {
+		frame = append(frame, payload[i]^mask[i%4])
+	}
+
+	wc.writeLock.Lock()
+	defer wc.writeLock.Unlock()
+
+	_, err := wc.Conn.Write(frame)
+	return err
+}
+
+// Close sends a close frame before closing the underlying connection.
+func (wc *webSocketConn) Close() error {
+	_ = wc.writeFrame(wsOpClose, nil)
+	return wc.Conn.Close()
+}
@@ -0,0 +1,271 @@
+package tcr
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/streadway/amqp"
+)
+
+// errConfirmWindowClosed is a publish on a window whose channel died, it is republished on a fresh one.
+var errConfirmWindowClosed = errors.New("confirm window channel closed")
+
+// confirmWindow pipelines confirmed publishes on a dedicated channel, up to size of them unconfirmed at once.
+// Confirmations are matched to their publish by delivery tag instead of waiting for the very next one.
+type confirmWindow struct {
+	pool        *ConnectionPool
+	chanHost    *ChannelHost
+	slots       chan struct{}
+	nextTag     uint64
+	publishLock *sync.Mutex // orders publishes with their delivery tags
+	pending     map[uint64]chan bool
+	closed      bool
+	lock        *sync.Mutex
+}
+
+func newConfirmWindow(pool *ConnectionPool, size int) *confirmWindow {
+
+	chanHost := pool.getDedicatedChannel(true)
+	chanHost.Returns = make(chan amqp.Return, 100)
+	chanHost.Channel.NotifyReturn(chanHost.Returns)
+	pool.watchReturns(chanHost)
+
+	window := &confirmWindow{
+		pool:        pool,
+		chanHost:    chanHost,
+		slots:       make(chan struct{}, size),
+		publishLock: &sync.Mutex{},
+		pending:     make(map[uint64]chan bool),
+		lock:        &sync.Mutex{},
+	}
+
+	go window.resolveConfirmations()
+	return window
+}
+
+// publish waits for room in the window and publishes the letter at the returned delivery tag. The outcome yields
+// true once acked, false when nacked and is closed when the channel died before confirming it. A publish abandoned
+// by its caller keeps its slot until the broker settles it, so the window bounds what the broker holds unconfirmed.
+func (cw *confirmWindow) publish(ctx context.Context, prepared *preparedLetter) (uint64, <-chan bool, error) {
+
+	select {
+	case cw.slots <- struct{}{}:
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	}
+
+	cw.publishLock.Lock()
+	defer cw.publishLock.Unlock()
+
+	tag := cw.nextTag + 1
+	outcome := make(chan bool, 1)
+
+	// registered before publishing, the confirmation may beat Publish returning
+	cw.lock.Lock()
+	if cw.closed {
+		cw.lock.Unlock()
+		<-cw.slots
+		return 0, nil, errConfirmWindowClosed
+	}
+	cw.pending[tag] = outcome
+	cw.lock.Unlock()
+
+	if err := prepared.publish(cw.chanHost.Channel); err != nil {
+		cw.lock.Lock()
+		delete(cw.pending, tag)
+		cw.lock.Unlock()
+		<-cw.slots
+
+		cw.close()
+		return 0, nil, err
+	}
+
+	cw.nextTag = tag
+	return tag, outcome, nil
+}
+
+// resolveConfirmations settles publishes by delivery tag until the channel closes, then releases the rest.
+func (cw *confirmWindow) resolveConfirmations() {
+
+	for confirmation := range cw.chanHost.Confirmations {
+		cw.lock.Lock()
+		outcome, ok := cw.pending[confirmation.DeliveryTag]
+		delete(cw.pending, confirmation.DeliveryTag)
+		cw.lock.Unlock()
+
+		if ok {
+			outcome <- confirmation.Ack
+			<-cw.slots
+		}
+	}
+
+	cw.lock.Lock()
+	cw.closed = true
+	pending := cw.pending
+	cw.pending = make(map[uint64]chan bool)
+	cw.lock.Unlock()
+
+	for _, outcome := range pending {
+		close(outcome)
+		<-cw.slots
+	}
+}
+
+func (cw *confirmWindow) isClosed() bool {
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+
+	return cw.closed
+}
+
+// close closes the channel, the publishes still in the window see their outcome closed.
+func (cw *confirmWindow) close() {
+	cw.lock.Lock()
+	cw.closed = true
+	cw.lock.Unlock()
+
+	cw.pool.ReturnChannel(cw.chanHost, true)
+}
+
+// SetConfirmWindow pipelines publishes with confirmation: up to size letters are published on a dedicated channel
+// per ConnectionPool before their confirmations arrive, further publishes block until acks make room (or their
+// timeout/context expires). Confirmations are matched by delivery tag. Zero or one keeps publishing one letter per
+// channel at a time (default). Set it before publishing, windows in use are closed and their letters republished.
+func (pub *Publisher) SetConfirmWindow(size int) {
+
+	pub.pubRWLock.Lock()
+	windows := pub.confirmWindows
+	pub.confirmWindowSize = size
+	pub.confirmWindows = make(map[*ConnectionPool]*confirmWindow)
+	pub.pubRWLock.Unlock()
+
+	for _, window := range windows {
+		window.close()
+	}
+}
+
+// ConfirmWindow is how many letters may be published unconfirmed per channel, one without a window.
+func (pub *Publisher) ConfirmWindow() int {
+	pub.pubRWLock.RLock()
+	defer pub.pubRWLock.RUnlock()
+
+	if pub.confirmWindowSize <= 1 {
+		return 1
+	}
+
+	return pub.confirmWindowSize
+}
+
+// confirmWindow returns the pool's open window, opening one outside of the lock as it may wait for a connection.
+func (pub *Publisher) confirmWindow(pool *ConnectionPool) *confirmWindow {
+
+	pub.pubRWLock.RLock()
+	window, ok := pub.confirmWindows[pool]
+	size := pub.confirmWindowSize
+	pub.pubRWLock.RUnlock()
+
+	if ok && !window.isClosed() {
+		return window
+	}
+
+	opened := newConfirmWindow(pool, size)
+
+	pub.pubRWLock.Lock()
+	if current, ok := pub.confirmWindows[pool]; ok && current != window && !current.isClosed() {
+		pub.pubRWLock.Unlock()
+		opened.close() // another publish opened one meanwhile
+		return current
+	}
+	pub.confirmWindows[pool] = opened
+	pub.pubRWLock.Unlock()
+
+	return opened
+}
+
+// publishWindowed is publishConfirmed pipelining in the pool's confirm window.
+func (pub *Publisher) publishWindowed(ctx context.Context, prepared *preparedLetter, expired func(nacked bool, acquireErr error) error) error {
+
+	nacked := false
+
+	for {
+		_, outcome, err := pub.confirmWindow(prepared.pool).publish(ctx, prepared)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				err = prepared.outcomeError(expired(nacked, ctxErr))
+				pub.emitEvent(PublisherEventConfirmationTimeout, err.Error())
+				return err
+			}
+			continue // republish on a fresh window
+		}
+
+		select {
+		case <-ctx.Done():
+			prepared.unconfirmed(FailureReasonTimeout)
+			err = prepared.outcomeError(expired(nacked, nil))
+			pub.emitEvent(PublisherEventConfirmationTimeout, err.Error())
+			return err
+
+		case ack, ok := <-outcome:
+			if !ok {
+				// The channel closed (ex. a broker failover), this confirmation will never arrive.
+				prepared.lost()
+				continue
+			}
+
+			if !ack {
+				prepared.unconfirmed(FailureReasonNack)
+				if fallback := pub.fallbackConfig(); fallback != nil {
+					return pub.parkNacked(prepared, fallback)
+				}
+				nacked = true
+				continue
+			}
+
+			prepared.confirmed()
+			return nil
+		}
+	}
+}
+
+// closeConfirmWindows closes the windows on shutdown.
+func (pub *Publisher) closeConfirmWindows() {
+
+	pub.pubRWLock.Lock()
+	windows := pub.confirmWindows
+	pub.confirmWindows = make(map[*ConnectionPool]*confirmWindow)
+	pub.pubRWLock.Unlock()
+
+	for _, window := range windows {
+		window.close()
+	}
+}
+
+// getDedicatedChannel creates a channel outside of the cache, return it with ReturnChannel to close it.
+func (cp *ConnectionPool) getDedicatedChannel(ackable bool) *ChannelHost {
+
+	// InfiniteLoop: Stay till we have a good channel.
+	for {
+		connHost, pooled, err := cp.distributedConnection(nil, ackable)
+		if err != nil {
+			cp.handleError(err)
+			continue
+		}
+
+		chanHost, err := NewChannelHost(connHost, atomic.AddUint64(&cp.distributionCounter, 1), connHost.ConnectionID, ackable, false)
+		if err != nil {
+			if cp.backOffOnChannelMax(err) {
+				cp.releaseConnection(connHost, pooled, false)
+				continue
+			}
+			cp.handleError(err)
+			cp.releaseConnection(connHost, pooled, true)
+			continue
+		}
+
+		cp.channelCreated()
+		cp.releaseConnection(connHost, pooled, false)
+		return chanHost
+	}
+}
@@ -2,10 +2,14 @@ package main_test
 
 import (
 	"fmt"
+	"sort"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/fortytw2/leaktest"
 	"github.com/houseofcat/turbocookedrabbit/v2/pkg/tcr"
+	"github.com/streadway/amqp"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -64,3 +68,299 @@ func TestConsumerGet(t *testing.T) {
 
 	TestCleanup(t)
 }
+
+func TestStartWithTxHandlerRequiresAckable(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	consumer := tcr.NewConsumerFromConfig(ConsumerConfig, ConnectionPool)
+	assert.NotNil(t, consumer)
+
+	err := consumer.StartConsumingWithTxHandler(
+		&tcr.TxHandler{
+			Handle: func(msg *tcr.ReceivedMessage) error { return nil },
+		})
+	assert.Error(t, err) // AutoAck consumer
+
+	consumer = tcr.NewConsumerFromConfig(AckableConsumerConfig, ConnectionPool)
+	err = consumer.StartConsumingWithTxHandler(&tcr.TxHandler{})
+	assert.Error(t, err) // missing Handle
+
+	TestCleanup(t)
+}
+
+func TestConsumerAutoTune(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	consumer := tcr.NewConsumerFromConfig(AckableConsumerConfig, ConnectionPool)
+
+	_, err := consumer.EnableAutoTune(&tcr.AutoTuneConfig{MaxWorkers: 4})
+	assert.Error(t, err) // missing TargetLatency
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	for i := 0; i < 200; i++ {
+		publisher.Publish(tcr.CreateMockRandomLetter("TcrTestQueue"), true)
+	}
+
+	tuner, err := consumer.EnableAutoTune(
+		&tcr.AutoTuneConfig{
+			MaxWorkers:    4,
+			MaxPrefetch:   8,
+			TargetLatency: 100,
+			Interval:      50,
+		})
+	assert.NoError(t, err)
+
+	consumer.StartConsumingWithAction(
+		func(msg *tcr.ReceivedMessage) {
+			time.Sleep(time.Millisecond * 10)
+			_ = msg.Acknowledge()
+		})
+
+	time.Sleep(time.Millisecond * 500)
+	workers, prefetch := tuner.Current()
+	assert.Greater(t, workers, 1) // handlers are well below the target with a backlog
+	assert.Equal(t, workers, consumer.Workers())
+	assert.LessOrEqual(t, prefetch, 8)
+
+	tuner.Stop()
+	assert.NoError(t, consumer.StopConsuming(false, true))
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestDeadLetterBrowsing(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	topologer := tcr.NewTopologer(ConnectionPool)
+	assert.NoError(t, topologer.CreateQueue("TcrTestDLQ", false, false, false, false, false, nil))
+	assert.NoError(t, topologer.CreateQueue("TcrTestDeadLettering", false, false, false, false, false,
+		map[string]interface{}{"x-dead-letter-exchange": "", "x-dead-letter-routing-key": "TcrTestDLQ"}))
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	first := tcr.CreateMockRandomLetter("TcrTestDeadLettering")
+	second := tcr.CreateMockRandomLetter("TcrTestDeadLettering")
+	assert.NoError(t, publisher.PublishWithConfirmationError(first, time.Second*5))
+	assert.NoError(t, publisher.PublishWithConfirmationError(second, time.Second*5))
+
+	consumer := tcr.NewConsumerFromConfig(AckableConsumerConfig, ConnectionPool)
+	rejected, err := consumer.InspectQueue("TcrTestDeadLettering", 2, nil,
+		func(*amqp.Delivery) tcr.InspectDecision { return tcr.InspectReject })
+	assert.NoError(t, err)
+	assert.Equal(t, 2, rejected)
+
+	var deadLetters []*tcr.DeadLetter
+	assert.Eventually(t, func() bool {
+		deadLetters, err = consumer.BrowseDeadLetters("TcrTestDLQ", 10)
+		return err == nil && len(deadLetters) == 2
+	}, time.Second*5, time.Millisecond*50)
+	assert.Equal(t, "TcrTestDeadLettering", deadLetters[0].FirstDeathQueue)
+	assert.Equal(t, "rejected", deadLetters[0].FirstDeathReason)
+
+	consumer.SetDeadLetterScanLimit(1)
+	discarded, err := consumer.DiscardDeadLetters("TcrTestDLQ", second.LetterID.String())
+	assert.ErrorIs(t, err, tcr.ErrDeadLettersUnseen) // second is behind first
+	assert.Equal(t, 0, discarded)
+	consumer.SetDeadLetterScanLimit(0)
+
+	requeued, err := consumer.RequeueDeadLetters("TcrTestDLQ", first.LetterID.String())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, requeued)
+
+	discarded, err = consumer.DiscardDeadLetters("TcrTestDLQ", second.LetterID.String())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, discarded)
+
+	delivery, err := consumer.Get("TcrTestDeadLettering")
+	assert.NoError(t, err)
+	if assert.NotNil(t, delivery) {
+		assert.Equal(t, first.LetterID.String(), delivery.MessageId)
+	}
+
+	_, err = topologer.QueueDelete("TcrTestDeadLettering", false, false, false)
+	assert.NoError(t, err)
+	_, err = topologer.QueueDelete("TcrTestDLQ", false, false, false)
+	assert.NoError(t, err)
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestQueueLeaseLocker(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	otherPool, err := tcr.NewConnectionPool(Seasoning.PoolConfig) // another process, as far as the broker knows
+	assert.NoError(t, err)
+	defer otherPool.Shutdown()
+
+	locker := tcr.NewQueueLeaseLocker(ConnectionPool)
+	unlock, err := locker.Lock("TcrTestQueue", "TcrLeaseLock")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = locker.Lock("TcrTestQueue", "TcrLeaseLock")
+	assert.Equal(t, tcr.ErrLeaseLocked, err)
+	_, err = tcr.NewQueueLeaseLocker(otherPool).Lock("TcrTestQueue", "TcrLeaseLock")
+	assert.Equal(t, tcr.ErrLeaseLocked, err)
+
+	unlock()
+	unlock, err = tcr.NewQueueLeaseLocker(otherPool).Lock("TcrTestQueue", "TcrLeaseLock")
+	assert.NoError(t, err)
+	if unlock != nil {
+		unlock()
+	}
+}
+
+func TestInspectQueueScanLimit(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	topologer := tcr.NewTopologer(ConnectionPool)
+	assert.NoError(t, topologer.CreateQueue("TcrTestInspect", false, false, false, false, false, nil))
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, publisher.PublishWithConfirmationError(tcr.CreateMockRandomLetter("TcrTestInspect"), time.Second*5))
+	}
+
+	consumer := tcr.NewConsumerFromConfig(AckableConsumerConfig, ConnectionPool)
+	scanned := 0
+	inspected, err := consumer.InspectQueue("TcrTestInspect", 1,
+		&tcr.MessageFilter{RoutingKey: "TcrTestNoMatch", MaxScanned: 2},
+		func(*amqp.Delivery) tcr.InspectDecision { scanned++; return tcr.InspectAck })
+	assert.NoError(t, err)
+	assert.Equal(t, 0, inspected)
+	assert.Equal(t, 0, scanned)
+
+	inspected, err = consumer.InspectQueue("TcrTestInspect", 3, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, inspected) // nothing was lost by the bounded scan
+
+	_, err = topologer.QueueDelete("TcrTestInspect", false, false, false)
+	assert.NoError(t, err)
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+// partitionLog records the partitions a Rebalancer assigned and revoked.
+type partitionLog struct {
+	assigned []string
+	revoked  []string
+	lock     *sync.Mutex
+}
+
+func (log *partitionLog) onAssigned(queueName string) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	log.assigned = append(log.assigned, queueName)
+}
+
+func (log *partitionLog) onRevoked(queueName string) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	log.revoked = append(log.revoked, queueName)
+}
+
+func (log *partitionLog) counts() (int, int) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	return len(log.assigned), len(log.revoked)
+}
+
+func newTestRebalancer(t *testing.T, instanceID string, partitions []string) (*tcr.Rebalancer, *partitionLog) {
+
+	log := &partitionLog{lock: &sync.Mutex{}}
+	rebalancer, err := tcr.NewRebalancer(ConnectionPool,
+		&tcr.RebalanceConfig{
+			ControlExchange:   "TcrTestRebalance",
+			InstanceID:        instanceID,
+			Partitions:        partitions,
+			HeartbeatInterval: 50,
+			MemberTimeout:     300,
+		}, log.onAssigned, log.onRevoked)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rebalancer, log
+}
+
+func TestNewRebalancer(t *testing.T) {
+
+	_, err := tcr.NewRebalancer(nil, &tcr.RebalanceConfig{Partitions: []string{"TcrTestPartition"}}, nil, nil)
+	assert.Error(t, err)
+
+	rebalancer, err := tcr.NewRebalancer(nil, &tcr.RebalanceConfig{ControlExchange: "TcrTestRebalance"}, nil, nil)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, rebalancer.InstanceID) // generated
+	assert.Empty(t, rebalancer.Owned())
+	assert.Empty(t, rebalancer.Members())
+}
+
+func TestRebalancer(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	partitions := make([]string, 16)
+	for i := range partitions {
+		partitions[i] = fmt.Sprintf("TcrTestPartition%d", i)
+	}
+
+	owners := func(rebalancers ...*tcr.Rebalancer) []string {
+		owned := make([]string, 0, len(partitions))
+		for _, rebalancer := range rebalancers {
+			owned = append(owned, rebalancer.Owned()...)
+		}
+		sort.Strings(owned)
+		return owned
+	}
+	sorted := append([]string(nil), partitions...)
+	sort.Strings(sorted)
+
+	// claim: a lone instance owns every partition
+	first, firstLog := newTestRebalancer(t, "TcrTestNodeA", partitions)
+	first.Start()
+	assert.Eventually(t, func() bool { return len(first.Owned()) == len(partitions) }, time.Second*5, time.Millisecond*20)
+	assigned, revoked := firstLog.counts()
+	assert.Equal(t, len(partitions), assigned)
+	assert.Equal(t, 0, revoked)
+
+	// join: the partitions are split without overlap, first only gives up what second takes
+	second, secondLog := newTestRebalancer(t, "TcrTestNodeB", partitions)
+	second.Start()
+	assert.Eventually(t, func() bool {
+		return len(first.Members()) == 2 && len(second.Members()) == 2 && assert.ObjectsAreEqual(sorted, owners(first, second))
+	}, time.Second*5, time.Millisecond*20)
+	assert.NotEmpty(t, first.Owned())
+	assert.NotEmpty(t, second.Owned())
+	assigned, revoked = firstLog.counts()
+	assert.Equal(t, len(partitions), assigned)
+	assert.Equal(t, len(second.Owned()), revoked)
+
+	// leave: second revokes its partitions on Stop and first reclaims them
+	secondOwned := len(second.Owned())
+	second.Stop()
+	assert.Empty(t, second.Owned())
+	assigned, revoked = secondLog.counts()
+	assert.Equal(t, secondOwned, assigned)
+	assert.Equal(t, secondOwned, revoked)
+	assert.Eventually(t, func() bool {
+		return len(first.Members()) == 1 && len(first.Owned()) == len(partitions)
+	}, time.Second*5, time.Millisecond*20)
+
+	// stale: an instance that died without leaving holds its partitions until its heartbeats time out
+	channel := ConnectionPool.GetTransientChannel(false)
+	assert.NoError(t, channel.Publish("TcrTestRebalance", "", false, false,
+		amqp.Publishing{ContentType: "application/json", Body: []byte(`{"InstanceID":"TcrTestNodeGhost"}`)}))
+	channel.Close()
+	assert.Eventually(t, func() bool {
+		return len(first.Members()) == 2 && len(first.Owned()) < len(partitions)
+	}, time.Second*5, time.Millisecond*20)
+	assert.Eventually(t, func() bool {
+		return len(first.Members()) == 1 && len(first.Owned()) == len(partitions)
+	}, time.Second*5, time.Millisecond*20)
+
+	first.Stop()
+	assert.Empty(t, first.Owned())
+
+	topologer := tcr.NewTopologer(ConnectionPool)
+	assert.NoError(t, topologer.ExchangeDelete("TcrTestRebalance", false, false))
+	TestCleanup(t)
+}
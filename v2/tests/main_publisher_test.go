@@ -1,11 +1,15 @@
 package main_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/fortytw2/leaktest"
+	"github.com/houseofcat/turbocookedrabbit/v2/pkg/resilience"
 	"github.com/houseofcat/turbocookedrabbit/v2/pkg/tcr"
 	"github.com/streadway/amqp"
 	"github.com/stretchr/testify/assert"
@@ -238,3 +242,1098 @@ WaitLoop:
 
 	TestCleanup(t)
 }
+
+func TestPublishWithUnknownExchangeAlias(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+
+	err := publisher.AddExchangeAlias("Orders", &tcr.ExchangeAlias{
+		Exchange:           "",
+		RoutingKeyTemplate: "TcrTestQueue{{.RoutingKey}}",
+	})
+	assert.NoError(t, err)
+
+	letter := tcr.CreateMockRandomLetter("")
+	letter.Envelope.Alias = "DoesNotExist"
+
+	err = publisher.PublishWithError(letter, true)
+	assert.Error(t, err)
+
+	letter.Envelope.Alias = "Orders"
+	err = publisher.PublishWithError(letter, true)
+	assert.NoError(t, err)
+
+	TestCleanup(t)
+}
+
+func TestPublisherRegistry(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+
+	_, ok := tcr.GetPublisher(publisher.Name)
+	assert.False(t, ok) // not until registered
+
+	assert.NoError(t, tcr.RegisterPublisher(publisher))
+	assert.NoError(t, tcr.RegisterPublisher(publisher)) // again, a no-op
+	registered, ok := tcr.GetPublisher(publisher.Name)
+	assert.True(t, ok)
+	assert.Equal(t, publisher, registered)
+
+	publisher.Publish(tcr.CreateMockRandomLetter("TcrTestQueue"), false)
+	receipt := <-publisher.PublishReceipts()
+	registered, ok = tcr.GetPublisher(receipt.PublisherName) // the receipt names it as registered
+	assert.True(t, ok)
+	assert.Equal(t, publisher, registered)
+
+	publisher.Shutdown(false)
+
+	_, ok = tcr.GetPublisher(publisher.Name)
+	assert.False(t, ok)
+
+	// publishers built from the same config don't evict each other
+	seasoning := *Seasoning
+	publisherConfig := *Seasoning.PublisherConfig
+	publisherConfig.Name = "TcrRegistryPublisher"
+	seasoning.PublisherConfig = &publisherConfig
+
+	first := tcr.NewPublisherFromConfig(&seasoning, ConnectionPool)
+	second := tcr.NewPublisherFromConfig(&seasoning, ConnectionPool)
+
+	assert.NoError(t, tcr.RegisterPublisher(first))
+	assert.ErrorIs(t, tcr.RegisterPublisher(second), tcr.ErrNameRegistered)
+
+	second.Shutdown(false)
+	registered, ok = tcr.GetPublisher("TcrRegistryPublisher")
+	assert.True(t, ok)
+	assert.Equal(t, first, registered)
+
+	first.Shutdown(false)
+	_, ok = tcr.GetPublisher("TcrRegistryPublisher")
+	assert.False(t, ok)
+}
+
+func TestPropagateTrace(t *testing.T) {
+
+	inbound := tcr.NewReceivedMessage(false, amqp.Delivery{
+		MessageId:     "Inbound",
+		CorrelationId: "Correlation",
+		Headers:       amqp.Table{"traceparent": "00-abc-def-01"},
+	})
+
+	letter := tcr.CreateMockRandomLetter("TcrTestQueue")
+	shared := letter.Envelope
+	sibling := &tcr.Letter{Body: letter.Body, Envelope: shared}
+	tcr.PropagateTrace(inbound.Context(), letter)
+
+	assert.Equal(t, "00-abc-def-01", letter.Envelope.Headers["traceparent"])
+	assert.Equal(t, "Inbound", letter.Envelope.Headers[tcr.HeaderTraceID])
+	assert.Equal(t, "Inbound", letter.Envelope.Headers[tcr.HeaderCausationID])
+	assert.Equal(t, int32(1), letter.Envelope.Headers[tcr.HeaderTraceDepth])
+	assert.Equal(t, "Correlation", letter.Envelope.CorrelationID)
+
+	assert.NotSame(t, shared, letter.Envelope) // the envelope shared with sibling is left alone
+	assert.Same(t, shared, sibling.Envelope)
+	assert.Empty(t, shared.CorrelationID)
+	assert.NotContains(t, shared.Headers, tcr.HeaderTraceID)
+}
+
+func TestPublishWithContextPropagatesTrace(t *testing.T) {
+
+	publisher := tcr.NewPublisher(nil, 0, 0, 0)
+	published := make([]*tcr.Letter, 0)
+	publisher.Use(func(next tcr.PublishFunc) tcr.PublishFunc {
+		return func(letter *tcr.Letter) error {
+			published = append(published, letter)
+			return nil
+		}
+	})
+
+	inbound := tcr.NewReceivedMessage(false, amqp.Delivery{MessageId: "Inbound", CorrelationId: "Correlation"})
+	assert.NoError(t, publisher.PublishWithContext(inbound.Context(), tcr.CreateMockRandomLetter("TcrTestQueue")))
+	assert.NoError(t, publisher.PublishWithConfirmationContextError(inbound.Context(), tcr.CreateMockRandomLetter("TcrTestQueue")))
+	publisher.PublishWithConfirmationContext(inbound.Context(), tcr.CreateMockRandomLetter("TcrTestQueue"))
+	assert.NoError(t, publisher.PublishWithContext(context.Background(), tcr.CreateMockRandomLetter("TcrTestQueue")))
+
+	if assert.Len(t, published, 4) {
+		for _, letter := range published[:3] {
+			assert.Equal(t, "Inbound", letter.Envelope.Headers[tcr.HeaderCausationID])
+			assert.Equal(t, "Correlation", letter.Envelope.CorrelationID)
+		}
+		assert.NotContains(t, published[3].Envelope.Headers, tcr.HeaderCausationID)
+	}
+}
+
+func TestPublishWithTraceContextCancelled(t *testing.T) {
+
+	publisher := tcr.NewPublisher(nil, 0, 0, 0)
+	publisher.SetRateLimit(&tcr.PublishRateLimit{MessagesPerSecond: 1000, Burst: 1})
+	publisher.Use(func(next tcr.PublishFunc) tcr.PublishFunc {
+		return func(letter *tcr.Letter) error { return nil }
+	})
+
+	inbound := tcr.NewReceivedMessage(false, amqp.Delivery{MessageId: "Inbound"})
+	ctx, cancel := context.WithCancel(inbound.Context())
+	cancel()
+
+	err := publisher.PublishWithTraceContext(ctx, tcr.CreateMockRandomLetter("TcrTestQueue"), true)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.NoError(t, publisher.PublishWithTraceContext(inbound.Context(), tcr.CreateMockRandomLetter("TcrTestQueue"), true))
+}
+
+func TestPublishWithPoolManager(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+
+	letter := tcr.CreateMockRandomLetter("TcrTestQueue")
+	letter.Envelope.Pool = "Tenant"
+
+	err := publisher.PublishWithError(letter, true)
+	assert.Error(t, err)
+
+	poolManager := tcr.NewPoolManager()
+	assert.NoError(t, poolManager.AddPool("Tenant", ConnectionPool))
+	assert.Error(t, poolManager.AddPool("Tenant", ConnectionPool))
+	publisher.SetPoolManager(poolManager)
+
+	err = publisher.PublishWithError(letter, true)
+	assert.NoError(t, err)
+
+	poolManager.RemovePool("Tenant", false)
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestPublishWithMismatchedContentType(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	seasoning := *Seasoning
+	publisherConfig := *Seasoning.PublisherConfig
+	publisherConfig.ContentTypePolicy = tcr.ContentTypePolicyFail
+	seasoning.PublisherConfig = &publisherConfig
+
+	publisher := tcr.NewPublisherFromConfig(&seasoning, ConnectionPool)
+	publisher.SetMarshaller(tcr.JSONMarshaller{})
+
+	letter, err := publisher.CreateLetter("", "TcrTestQueue", map[string]string{"Fighter": "MBison"})
+	assert.NoError(t, err)
+	assert.Equal(t, tcr.ContentTypeJSON, letter.Envelope.ContentType)
+
+	letter.Envelope.ContentType = "application/xml"
+	assert.Error(t, publisher.PublishWithError(letter, true))
+
+	letter.Envelope.ContentType = "application/json; charset=utf-8"
+	assert.NoError(t, publisher.PublishWithError(letter, true))
+
+	letter.Envelope.ContentType = tcr.ContentTypeSubEntryBatch // framed by a StreamBatcher, not the Marshaller
+	assert.NoError(t, publisher.PublishWithError(letter, true))
+
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestPublishWithCancelledContext(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := publisher.PublishWithContext(ctx, tcr.CreateMockRandomLetter("TcrTestQueue"))
+	assert.ErrorIs(t, err, context.Canceled)
+
+	err = publisher.PublishWithContext(context.Background(), tcr.CreateMockRandomLetter("TcrTestQueue"))
+	assert.NoError(t, err)
+
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestPublishBatch(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+
+	letters := make([]*tcr.Letter, 10)
+	for i := range letters {
+		letters[i] = tcr.CreateMockRandomLetter("TcrTestQueue")
+	}
+	letters[5].Envelope = nil
+
+	receipt := publisher.PublishBatch(letters)
+	assert.False(t, receipt.Success)
+	assert.Error(t, receipt.Error)
+	assert.Equal(t, 10, len(receipt.Batch))
+	assert.False(t, receipt.Batch[5].Success)
+	assert.True(t, receipt.Batch[6].Success)
+
+	<-publisher.PublishReceipts()
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestPublishMandatoryReturned(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+
+	letter := tcr.CreateMockRandomLetter("TcrUnroutableQueue")
+	letter.Envelope.Mandatory = true
+
+	err := publisher.PublishWithConfirmationError(letter, time.Second*5)
+	assert.NoError(t, err)
+
+	select {
+	case returned := <-publisher.Returns():
+		assert.Equal(t, letter.LetterID, returned.Letter.LetterID)
+		assert.Equal(t, "TcrUnroutableQueue", returned.Letter.Envelope.RoutingKey)
+		assert.Equal(t, uint16(312), returned.ReplyCode) // NO_ROUTE
+	case <-time.After(time.Second * 5):
+		t.Error("expected the unroutable letter to be returned")
+	}
+
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestPublishReturnedToFallbackExchange(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	topologer := tcr.NewTopologer(ConnectionPool)
+	assert.NoError(t, topologer.CreateQueue("TcrTestFallbackQueue", false, false, false, false, false, nil))
+	assert.NoError(t, topologer.QueueBind(&tcr.QueueBinding{QueueName: "TcrTestFallbackQueue", ExchangeName: "amq.direct", RoutingKey: "TcrTestFallbackQueue"}))
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	publisher.SetFallbackExchange(&tcr.FallbackExchangeConfig{Exchange: "amq.direct", RoutingKey: "TcrTestFallbackQueue"})
+
+	letter := tcr.CreateMockRandomLetter("TcrUnroutableQueue")
+	letter.Envelope.Mandatory = true
+	letter.Envelope.Compression = tcr.GzipCompressionType
+	assert.NoError(t, publisher.PublishWithConfirmationError(letter, time.Second*5))
+
+	consumer := tcr.NewConsumerFromConfig(ConsumerConfig, ConnectionPool)
+	var delivery *amqp.Delivery
+	for i := 0; i < 50 && delivery == nil; i++ {
+		var err error
+		delivery, err = consumer.Get("TcrTestFallbackQueue")
+		assert.NoError(t, err)
+		time.Sleep(time.Millisecond * 100)
+	}
+
+	if assert.NotNil(t, delivery) {
+		assert.Equal(t, letter.LetterID.String(), delivery.MessageId)
+		assert.Equal(t, tcr.GzipCompressionType, delivery.ContentEncoding) // still decodable
+		assert.Equal(t, tcr.FallbackReasonReturned, delivery.Headers[tcr.HeaderFallbackReason])
+		assert.Equal(t, "TcrUnroutableQueue", delivery.Headers[tcr.HeaderOriginalRoutingKey])
+		assert.Equal(t, int32(312), delivery.Headers[tcr.HeaderReturnCode]) // NO_ROUTE
+	}
+
+	publisher.Shutdown(false)
+	_, err := topologer.QueueDelete("TcrTestFallbackQueue", false, false, false)
+	assert.NoError(t, err)
+	TestCleanup(t)
+}
+
+func TestAutoPublishTenantQuota(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	publisher.SetTenantQuota(&tcr.TenantQuotaConfig{
+		Header:            "x-tenant",
+		MessagesPerSecond: 1,
+		Burst:             1,
+	})
+	publisher.StartAutoPublishing()
+
+	for i := 0; i < 3; i++ {
+		letter := tcr.CreateMockRandomLetter("TcrTestQueue")
+		letter.Envelope.Headers = amqp.Table{"x-tenant": "noisy"}
+		publisher.QueueLetter(letter)
+	}
+
+	refused := 0
+	for i := 0; i < 3; i++ {
+		receipt := <-publisher.PublishReceipts()
+		if errors.Is(receipt.Error, tcr.ErrTenantQuotaExceeded) {
+			refused++
+		}
+	}
+	assert.Equal(t, 2, refused)
+
+	event := <-publisher.Events()
+	assert.Equal(t, tcr.PublisherEventTenantQuotaExceeded, event.Type)
+	assert.Equal(t, "noisy", event.Tenant)
+
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestPublishStruct(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+
+	envelope := &tcr.Envelope{RoutingKey: "TcrTestQueue", DeliveryMode: 2}
+	err := publisher.PublishStruct(map[string]string{"Fighter": "Ryu"}, envelope)
+	assert.NoError(t, err)
+	assert.Equal(t, "", envelope.ContentType) // the caller's envelope is left as is
+
+	assert.Error(t, publisher.PublishStruct(map[string]string{"Fighter": "Ken"}, nil))
+
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestPublishRateLimit(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	publisher.SetRateLimit(&tcr.PublishRateLimit{MessagesPerSecond: 20, Burst: 1})
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, publisher.PublishWithError(tcr.CreateMockRandomLetter("TcrTestQueue"), true))
+	}
+	assert.GreaterOrEqual(t, time.Since(start), time.Millisecond*190) // the burst, then a token every 50ms
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Error(t, publisher.PublishWithContext(ctx, tcr.CreateMockRandomLetter("TcrTestQueue")))
+
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestPublishVerifyExchanges(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	publisher.SetVerifyExchanges(true)
+
+	letter := tcr.CreateMockRandomLetter("TcrTestQueue")
+	letter.Envelope.Exchange = "TcrMissingExchange"
+	err := publisher.PublishWithError(letter, true)
+	assert.True(t, errors.Is(err, tcr.ErrExchangeNotFound))
+
+	assert.NoError(t, publisher.PublishWithError(tcr.CreateMockRandomLetter("TcrTestQueue"), true))
+
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestPublishStamping(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	publisher.SetStamping(tcr.MessageIDFormatULID, true)
+
+	envelope := &tcr.Envelope{RoutingKey: "TcrTestQueue", DeliveryMode: 2}
+	first := &tcr.Letter{Body: []byte("first"), Envelope: envelope}
+	second := &tcr.Letter{Body: []byte("second"), Envelope: envelope}
+	assert.NoError(t, publisher.PublishWithConfirmationError(first, time.Second*5))
+	assert.NoError(t, publisher.PublishWithConfirmationError(second, time.Second*5))
+
+	assert.NotEqual(t, first.LetterID, second.LetterID)
+	assert.Equal(t, 26, len(first.Envelope.MessageID))
+	assert.NotEqual(t, first.Envelope.MessageID, second.Envelope.MessageID)
+	assert.False(t, first.Envelope.Timestamp.IsZero())
+	assert.Equal(t, "", envelope.MessageID) // the shared envelope is left as is
+
+	stamped := first.Envelope.MessageID
+	assert.NoError(t, publisher.PublishWithConfirmationError(first, time.Second*5))
+	assert.Equal(t, stamped, first.Envelope.MessageID) // republishing keeps the stamp
+
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestPublisherFlush(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+
+	assert.True(t, publisher.QueueLetter(tcr.CreateMockRandomLetter("TcrTestQueue")))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	assert.Error(t, publisher.Flush(ctx)) // nothing publishes the queued letter yet
+	cancel()
+
+	publisher.StartAutoPublishing()
+	for i := 0; i < 9; i++ {
+		assert.True(t, publisher.QueueLetter(tcr.CreateMockRandomLetter("TcrTestQueue")))
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	assert.NoError(t, publisher.Flush(ctx))
+
+	for i := 0; i < 10; i++ {
+		select {
+		case receipt := <-publisher.PublishReceipts():
+			assert.True(t, receipt.Success)
+		case <-time.After(time.Second):
+			t.Fatal("flushed letters are missing their receipts")
+		}
+	}
+
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestPublisherPauseResume(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	publisher.StartAutoPublishing()
+	publisher.Pause()
+	assert.True(t, publisher.Paused())
+
+	assert.True(t, publisher.QueueLetter(tcr.CreateMockRandomLetter("TcrTestQueue")))
+	select {
+	case <-publisher.PublishReceipts():
+		t.Fatal("a paused publisher published the letter")
+	case <-time.After(time.Millisecond * 300):
+	}
+
+	publisher.Resume()
+	select {
+	case receipt := <-publisher.PublishReceipts():
+		assert.True(t, receipt.Success)
+	case <-time.After(time.Second * 5):
+		t.Fatal("the resumed publisher didn't publish the queued letter")
+	}
+
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestAutoPublishWorkers(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	publisher.SetAutoPublishWorkers(4)
+	publisher.StartAutoPublishing()
+
+	for i := 0; i < 20; i++ {
+		assert.True(t, publisher.QueueLetter(tcr.CreateMockRandomLetter("TcrTestQueue")))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	assert.NoError(t, publisher.Flush(ctx))
+
+	for i := 0; i < 20; i++ {
+		receipt := <-publisher.PublishReceipts()
+		assert.True(t, receipt.Success)
+	}
+
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestPublisherStats(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, publisher.PublishWithConfirmationError(tcr.CreateMockRandomLetter("TcrTestQueue"), time.Second*5))
+	}
+
+	stats := publisher.Stats()
+	assert.Equal(t, uint64(10), stats.Published)
+	assert.Equal(t, uint64(10), stats.ConfirmLatency.Count)
+	assert.Greater(t, stats.ConfirmLatency.Quantile(0.99), time.Duration(0))
+	assert.Equal(t, 0, stats.QueueDepth)
+	assert.Zero(t, stats.FailuresByReason[tcr.FailureReasonTimeout])
+
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestPublishAfterCommit(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	publisher.StartAutoPublishing()
+
+	callbacks := make([]func(), 0)
+	tx := tcr.CommitNotifierFunc(func(callback func()) { callbacks = append(callbacks, callback) })
+
+	letter := tcr.CreateMockRandomLetter("TcrTestQueue")
+	assert.NoError(t, publisher.PublishAfterCommit(tx, letter))
+
+	select {
+	case <-publisher.PublishReceipts():
+		t.Error("letter was published before the commit")
+	case <-time.After(time.Millisecond * 500):
+	}
+
+	for _, callback := range callbacks {
+		callback() // commit
+	}
+
+	receipt := <-publisher.PublishReceipts()
+	assert.True(t, receipt.Success)
+	assert.Equal(t, letter.LetterID, receipt.LetterID)
+
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestPublisherMiddleware(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+
+	order := make([]string, 0)
+	publisher.Use(func(next tcr.PublishFunc) tcr.PublishFunc {
+		return func(letter *tcr.Letter) error {
+			order = append(order, "outer")
+			return next(letter)
+		}
+	})
+	publisher.Use(func(next tcr.PublishFunc) tcr.PublishFunc {
+		return func(letter *tcr.Letter) error {
+			order = append(order, "inner")
+			if letter.Envelope.RoutingKey == "" {
+				return errors.New("letters need a routing key")
+			}
+			return next(letter)
+		}
+	})
+
+	letter := tcr.CreateMockRandomLetter("TcrTestQueue")
+	assert.NoError(t, publisher.PublishWithConfirmationError(letter, time.Second*5))
+	assert.Equal(t, []string{"outer", "inner"}, order)
+
+	letter.Envelope.RoutingKey = ""
+	assert.Error(t, publisher.PublishWithError(letter, true))
+
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestPublishWithDelay(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	seasoning := *Seasoning
+	publisherConfig := *Seasoning.PublisherConfig
+	publisherConfig.DelayConfig = &tcr.DelayConfig{Mode: tcr.DelayModeTTL}
+	seasoning.PublisherConfig = &publisherConfig
+
+	publisher := tcr.NewPublisherFromConfig(&seasoning, ConnectionPool)
+
+	letter := tcr.CreateMockRandomLetter("TcrTestQueue")
+	assert.NoError(t, publisher.PublishWithDelay(letter, time.Millisecond*500))
+
+	topologer := tcr.NewTopologer(ConnectionPool)
+	_, err := topologer.QueueDelete("tcr.delay.default.500", false, false, false)
+	assert.NoError(t, err)
+	err = topologer.ExchangeDelete("tcr.delay.default.500", false, false)
+	assert.NoError(t, err)
+
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestOnPublishReceipts(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+
+	successes := make(chan *tcr.PublishReceipt, 10)
+	failures := make(chan *tcr.PublishReceipt, 10)
+	listener := tcr.OnPublishReceipts(
+		publisher,
+		func(receipt *tcr.PublishReceipt) { successes <- receipt },
+		func(receipt *tcr.PublishReceipt) { failures <- receipt },
+		nil)
+
+	publisher.Publish(tcr.CreateMockRandomLetter("TcrTestQueue"), false)
+	publisher.Publish(&tcr.Letter{}, false) // no envelope
+
+	assert.True(t, (<-successes).Success)
+	assert.False(t, (<-failures).Success)
+
+	listener.Stop()
+	listener.Stop() // idempotent
+
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestPublisherOnPublishReceipt(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+
+	receipts := make(chan *tcr.PublishReceipt, 10)
+	publisher.OnPublishReceipt(func(receipt *tcr.PublishReceipt) { receipts <- receipt })
+
+	publisher.Publish(tcr.CreateMockRandomLetter("TcrTestQueue"), false)
+	assert.True(t, (<-receipts).Success)
+
+	publisher.OnPublishReceipt(nil)
+	publisher.Publish(tcr.CreateMockRandomLetter("TcrTestQueue"), false)
+	assert.True(t, (<-publisher.PublishReceipts()).Success)
+
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+// expiredClock times out everything right away.
+type expiredClock struct {
+	tcr.SystemClock
+}
+
+func (expiredClock) After(d time.Duration) <-chan time.Time {
+	expired := make(chan time.Time, 1)
+	expired <- time.Now()
+	return expired
+}
+
+func TestPublishWithConfirmationTimeout(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	publisher.SetClock(expiredClock{})
+
+	err := publisher.PublishWithConfirmationError(tcr.CreateMockRandomLetter("TcrTestQueue"), time.Second*5)
+	assert.ErrorIs(t, err, tcr.ErrTimeout)
+
+	select {
+	case event := <-publisher.Events():
+		assert.Equal(t, tcr.PublisherEventConfirmationTimeout, event.Type)
+	case <-time.After(time.Second):
+		t.Error("no confirmation timeout event")
+	}
+
+	publisher.SetClock(nil)
+	assert.NoError(t, publisher.PublishWithConfirmationError(tcr.CreateMockRandomLetter("TcrTestQueue"), time.Second*5))
+
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestPublisherProbe(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+
+	_, err := publisher.StartProbe(&tcr.ProbeConfig{})
+	assert.Error(t, err) // missing QueueName
+
+	probe, err := publisher.StartProbe(&tcr.ProbeConfig{QueueName: "TcrTestQueue", Interval: 50})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return probe.Health().Probes > 0 }, time.Second*5, time.Millisecond*10)
+
+	health := probe.Health()
+	assert.NoError(t, health.LastError)
+	assert.False(t, health.Failing)
+	assert.Greater(t, health.LastRoundTrip, time.Duration(0))
+	probe.Stop()
+
+	// nothing routes probes to a missing queue
+	probe, err = publisher.StartProbe(&tcr.ProbeConfig{QueueName: "TcrTestMissingProbeQueue", Interval: 50, FailureThreshold: 2})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool { return probe.Health().Failing }, time.Second*5, time.Millisecond*10)
+	assert.Error(t, probe.Health().LastError)
+
+	probe.Stop()
+	assert.Equal(t, time.Duration(0), ConnectionPool.UnhealthyFor())
+
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestPublishTx(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	topologer := tcr.NewTopologer(ConnectionPool)
+	assert.NoError(t, topologer.CreateQueue("TcrTestTxQueue", false, false, false, false, false, nil))
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	assert.Error(t, publisher.PublishTx(nil))
+
+	assert.NoError(t, publisher.PublishTx([]*tcr.Letter{
+		tcr.CreateMockRandomLetter("TcrTestTxQueue"),
+		tcr.CreateMockRandomLetter("TcrTestTxQueue"),
+	}))
+
+	// the letter missing its envelope rolls back the one before it
+	assert.Error(t, publisher.PublishTx([]*tcr.Letter{
+		tcr.CreateMockRandomLetter("TcrTestTxQueue"),
+		{Body: []byte("no envelope")},
+	}))
+
+	channel := ConnectionPool.GetTransientChannel(false)
+	queue, err := channel.QueueDeclarePassive("TcrTestTxQueue", false, false, false, false, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, queue.Messages)
+	_ = channel.Close()
+
+	_, err = topologer.QueueDelete("TcrTestTxQueue", false, false, false)
+	assert.NoError(t, err)
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestPublishWithConfirmWindow(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	assert.Equal(t, 1, publisher.ConfirmWindow())
+
+	publisher.SetConfirmWindow(8)
+	assert.Equal(t, 8, publisher.ConfirmWindow())
+
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		go func() {
+			errs <- publisher.PublishWithConfirmationError(tcr.CreateMockRandomLetter("TcrTestQueue"), time.Second*5)
+		}()
+	}
+
+	for i := 0; i < 50; i++ {
+		assert.NoError(t, <-errs)
+	}
+
+	stats := publisher.Stats()
+	assert.Equal(t, uint64(50), stats.ConfirmLatency.Count)
+
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestPublishUnknownOutcomeReceipts(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	publisher.SetConfirmWindow(64)
+	publisher.SetUnknownOutcomeReceipts(true)
+
+	unknown := make(chan *tcr.PublishReceipt, 200)
+	publisher.OnPublishReceipt(func(receipt *tcr.PublishReceipt) { unknown <- receipt })
+
+	errs := make(chan error, 200)
+	for i := 0; i < 200; i++ {
+		go func() {
+			errs <- publisher.PublishWithConfirmationError(tcr.CreateMockRandomLetter("TcrTestQueue"), time.Second*5)
+		}()
+	}
+
+	// Replacing the window closes its channel with letters still unconfirmed.
+	time.Sleep(time.Millisecond)
+	publisher.SetConfirmWindow(64)
+
+	for i := 0; i < 200; i++ {
+		assert.NoError(t, <-errs) // republished on the new window
+	}
+
+	for len(unknown) > 0 {
+		receipt := <-unknown
+		assert.True(t, receipt.UnknownOutcome)
+		assert.False(t, receipt.Success)
+		assert.ErrorIs(t, receipt.Error, tcr.ErrUnknownOutcome)
+	}
+
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestOnPublishReceiptsUnknownOutcomes(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	publisher.SetConfirmWindow(64)
+	publisher.SetUnknownOutcomeReceipts(true)
+
+	successes := make(chan *tcr.PublishReceipt, 200)
+	unknown := make(chan *tcr.PublishReceipt, 200)
+	listener := tcr.OnPublishReceipts(
+		publisher,
+		func(receipt *tcr.PublishReceipt) { successes <- receipt },
+		func(receipt *tcr.PublishReceipt) { t.Errorf("letter %s failed: %v", receipt.LetterID, receipt.Error) },
+		func(receipt *tcr.PublishReceipt) { unknown <- receipt })
+
+	done := make(chan struct{}, 200)
+	for i := 0; i < 200; i++ {
+		go func() {
+			publisher.PublishWithConfirmation(tcr.CreateMockRandomLetter("TcrTestQueue"), time.Second*5)
+			done <- struct{}{}
+		}()
+	}
+
+	// Replacing the window closes its channel with letters still unconfirmed.
+	time.Sleep(time.Millisecond)
+	publisher.SetConfirmWindow(64)
+
+	for i := 0; i < 200; i++ {
+		<-done
+		assert.True(t, (<-successes).Success) // republished on the new window
+	}
+
+	listener.Stop()
+	for len(unknown) > 0 {
+		receipt := <-unknown
+		assert.True(t, receipt.UnknownOutcome)
+		assert.ErrorIs(t, receipt.Error, tcr.ErrUnknownOutcome)
+	}
+
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestShardedPublisher(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	second, err := tcr.NewConnectionPool(Seasoning.PoolConfig)
+	assert.NoError(t, err)
+
+	_, err = tcr.NewShardedPublisher([]*tcr.ConnectionPool{ConnectionPool, second}, "busiest", 0, 0, 0)
+	assert.Error(t, err)
+
+	publisher, err := tcr.NewShardedPublisher([]*tcr.ConnectionPool{ConnectionPool, second}, tcr.ShardingLeastLoaded, 0, 0, 0)
+	assert.NoError(t, err)
+	assert.Len(t, publisher.Shards(), 2)
+
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, publisher.PublishWithConfirmationError(tcr.CreateMockRandomLetter("TcrTestQueue"), time.Second*5))
+	}
+
+	// a transaction and a batch stay on the shard they started on
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, publisher.PublishTx([]*tcr.Letter{
+			tcr.CreateMockRandomLetter("TcrTestQueue"),
+			tcr.CreateMockRandomLetter("TcrTestQueue"),
+			tcr.CreateMockRandomLetter("TcrTestQueue"),
+		}))
+
+		letters := []*tcr.Letter{
+			tcr.CreateMockRandomLetter("TcrTestQueue"),
+			tcr.CreateMockRandomLetter("TcrTestQueue"),
+			tcr.CreateMockRandomLetter("TcrTestQueue"),
+		}
+		receipt := publisher.PublishBatch(letters)
+		assert.True(t, receipt.Success)
+		assert.NoError(t, receipt.Error)
+		<-publisher.PublishReceipts()
+	}
+
+	assert.NoError(t, publisher.SetShards(""))
+	assert.Len(t, publisher.Shards(), 1)
+
+	publisher.Shutdown(false)
+	second.Shutdown()
+	TestCleanup(t)
+}
+
+func TestAutoPublishLanes(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	publisher.SetAutoPublishWorkers(1)
+
+	published := make(chan tcr.QueueLane, 9)
+	publisher.Use(func(next tcr.PublishFunc) tcr.PublishFunc {
+		return func(letter *tcr.Letter) error {
+			published <- letter.Lane
+			return next(letter)
+		}
+	})
+
+	// a backlog builds up while paused, the urgent letter is queued last
+	publisher.Pause()
+	publisher.StartAutoPublishing()
+	for _, lane := range []tcr.QueueLane{tcr.QueueLaneLow, tcr.QueueLaneNormal, tcr.QueueLaneLow, tcr.QueueLaneNormal, tcr.QueueLaneHigh} {
+		letter := tcr.CreateMockRandomLetter("TcrTestQueue")
+		letter.Lane = lane
+		assert.True(t, publisher.QueueLetter(letter))
+	}
+	publisher.Resume()
+
+	expected := []tcr.QueueLane{tcr.QueueLaneHigh, tcr.QueueLaneNormal, tcr.QueueLaneNormal, tcr.QueueLaneLow, tcr.QueueLaneLow}
+	for _, lane := range expected {
+		select {
+		case <-time.After(time.Second * 10):
+			t.Fatal("test timeout")
+		case publishedLane := <-published:
+			assert.Equal(t, lane, publishedLane)
+		}
+	}
+
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestPublisherGracefulShutdown(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	for i := 0; i < 20; i++ {
+		assert.True(t, publisher.QueueLetter(tcr.CreateMockRandomLetter("TcrTestQueue")))
+	}
+
+	// auto-publishing was never started, shutting down flushes the queue anyway
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	assert.NoError(t, publisher.GracefulShutdown(ctx, false))
+	assert.ErrorIs(t, publisher.QueueLetterWithError(tcr.CreateMockRandomLetter("TcrTestQueue")), tcr.ErrPublisherClosed)
+
+	successes := 0
+	for receipt := range publisher.PublishReceipts() {
+		if receipt.Success {
+			successes++
+		}
+	}
+	assert.Equal(t, 20, successes)
+
+	TestCleanup(t)
+}
+
+func TestPublisherBodySizeAlert(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	publisher.SetBodySizeAlert(&tcr.BodySizeAlertConfig{MaxMessageSize: 10000, Threshold: 0.5})
+
+	letter := tcr.CreateMockLetter("", "TcrTestQueue", make([]byte, 6000))
+	assert.NoError(t, publisher.PublishWithConfirmationError(letter, time.Second*5))
+
+	select {
+	case event := <-publisher.Events():
+		assert.Equal(t, tcr.PublisherEventBodySizeNearLimit, event.Type)
+	case <-time.After(time.Second):
+		t.Error("no body size event")
+	}
+
+	stats := publisher.Stats()
+	assert.Equal(t, uint64(1), stats.BodySizes.Count)
+	assert.Equal(t, 6000, stats.BodySizes.Max)
+
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestAutoPublishRetriesFailedLetters(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	publisher.SetAutoRetry(true)
+	publisher.SetRetryPolicy(&resilience.Constant{Delay: time.Millisecond * 10})
+
+	attempts := make(map[string]int)
+	attemptsLock := &sync.Mutex{}
+	publisher.Use(func(next tcr.PublishFunc) tcr.PublishFunc {
+		return func(letter *tcr.Letter) error {
+			attemptsLock.Lock()
+			attempts[letter.LetterID.String()]++
+			attempt := attempts[letter.LetterID.String()]
+			attemptsLock.Unlock()
+
+			if string(letter.Body) == "always fails" || attempt < 3 {
+				return errors.New("channel closed")
+			}
+			return next(letter)
+		}
+	})
+	publisher.StartAutoPublishing()
+
+	recovering := tcr.CreateMockLetter("", "TcrTestQueue", []byte("fails twice"))
+	recovering.RetryCount = 3
+	failing := tcr.CreateMockLetter("", "TcrTestQueue", []byte("always fails"))
+	failing.RetryCount = 1
+	assert.True(t, publisher.QueueLetters([]*tcr.Letter{recovering, failing}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	assert.NoError(t, publisher.Flush(ctx))
+
+	// only the outcome after the retries surfaces
+	receipts := map[string]*tcr.PublishReceipt{}
+	for i := 0; i < 2; i++ {
+		receipt := <-publisher.PublishReceipts()
+		receipts[receipt.LetterID.String()] = receipt
+	}
+	assert.True(t, receipts[recovering.LetterID.String()].Success)
+	assert.False(t, receipts[failing.LetterID.String()].Success)
+	assert.Equal(t, 3, attempts[recovering.LetterID.String()])
+	assert.Equal(t, 2, attempts[failing.LetterID.String()])
+
+	select {
+	case receipt := <-publisher.PublishReceipts():
+		t.Errorf("unexpected receipt of LetterID %s", receipt.LetterID)
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestPublishToStream(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	topologer := tcr.NewTopologer(ConnectionPool)
+	assert.NoError(t, topologer.CreateQueueFromConfig(tcr.StreamQueue("TcrTestStream", "1h", 0, 0)))
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	publisher.SetStreamWindow(100)
+
+	letters := make([]*tcr.Letter, 1000)
+	for i := range letters {
+		letters[i] = tcr.CreateMockRandomLetter("")
+		tcr.StampStreamFilter(letters[i], "eu")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	result := publisher.PublishToStream(ctx, "TcrTestStream", letters)
+	assert.True(t, result.Success(), result.Error)
+	assert.Equal(t, len(letters), result.Confirmed)
+	assert.Empty(t, result.Failed)
+	for i := 1; i < len(result.Sequences); i++ {
+		assert.Greater(t, result.Sequences[i], result.Sequences[i-1])
+	}
+
+	_, err := topologer.QueueDelete("TcrTestStream", false, false, false)
+	assert.NoError(t, err)
+	publisher.Shutdown(false)
+}
+
+func TestPublisherAutoDeclare(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	publisher.SetAutoDeclare(&tcr.TopologyConfig{
+		Exchanges: []*tcr.Exchange{{Name: "TcrTestAutoDeclared", Type: "topic", AutoDelete: true}},
+		Queues: []*tcr.Queue{
+			{Name: "TcrTestAutoDeclaredOrders", AutoDelete: true},
+			{Name: "TcrTestAutoDeclaredInvoices", AutoDelete: true},
+		},
+		QueueBindings: []*tcr.QueueBinding{
+			{QueueName: "TcrTestAutoDeclaredOrders", ExchangeName: "TcrTestAutoDeclared", RoutingKey: "orders.#"},
+			{QueueName: "TcrTestAutoDeclaredInvoices", ExchangeName: "TcrTestAutoDeclared", RoutingKey: "invoices.#"},
+		},
+	})
+
+	// neither the exchange nor the queue exist before the first publish
+	letter := tcr.CreateMockLetter("TcrTestAutoDeclared", "orders.created", []byte("cold start"))
+	assert.NoError(t, publisher.PublishWithConfirmationError(letter, time.Second*5))
+
+	topologer := tcr.NewTopologer(ConnectionPool)
+	queue, err := topologer.InspectQueue("TcrTestAutoDeclaredOrders")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, queue.Messages)
+
+	// only the bindings matching the routing key were declared
+	_, err = topologer.InspectQueue("TcrTestAutoDeclaredInvoices")
+	assert.Error(t, err)
+
+	_, err = topologer.QueueDelete("TcrTestAutoDeclaredOrders", false, false, false)
+	assert.NoError(t, err)
+	publisher.Shutdown(false)
+}
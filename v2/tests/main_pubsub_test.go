@@ -1,10 +1,12 @@
 package main_test
 
 import (
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/fortytw2/leaktest"
+	"github.com/google/uuid"
 	"github.com/houseofcat/turbocookedrabbit/v2/pkg/tcr"
 	"github.com/stretchr/testify/assert"
 )
@@ -219,3 +221,480 @@ func TestLargePublishConfirmation(t *testing.T) {
 
 	TestCleanup(t)
 }
+
+// TestConsumingCompressedLetter publishes a zstd compressed letter and consumes it decompressed.
+func TestConsumingCompressedLetter(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	consumerConfig := *ConsumerConfig
+	consumerConfig.AutoDecompress = true
+	consumer := tcr.NewConsumerFromConfig(&consumerConfig, ConnectionPool)
+	consumer.StartConsuming()
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	letter := tcr.CreateMockRandomLetter("TcrTestQueue")
+	letter.Envelope.Compression = tcr.ZstdCompressionType
+	assert.NoError(t, publisher.PublishWithConfirmationError(letter, time.Second*5))
+
+	timeoutAfter := time.After(time.Second * 10)
+WaitForConsumer:
+	for {
+		select {
+		case <-timeoutAfter:
+			t.Fatal("test timeout")
+		case message := <-consumer.ReceivedMessages():
+			_ = message.Acknowledge()
+			if message.MessageID == letter.LetterID.String() {
+				assert.Empty(t, message.Delivery.ContentEncoding) // decoded
+				assert.Equal(t, letter.Body, message.Body)
+				break WaitForConsumer
+			}
+		}
+	}
+
+	assert.NoError(t, consumer.StopConsuming(false, false))
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+// TestConsumingEncryptedLetter publishes a transparently encrypted letter and consumes it decrypted.
+func TestConsumingEncryptedLetter(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	encryption := &tcr.EncryptionConfig{
+		Enabled:    true,
+		Hashkey:    []byte("0123456789abcdef0123456789abcdef"),
+		KeyVersion: "v1",
+	}
+
+	consumer := tcr.NewConsumerFromConfig(ConsumerConfig, ConnectionPool)
+	consumer.SetEncryption(encryption)
+	consumer.StartConsuming()
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	publisher.SetEncryption(encryption)
+	letter := tcr.CreateMockRandomLetter("TcrTestQueue")
+	assert.NoError(t, publisher.PublishWithConfirmationError(letter, time.Second*5))
+
+	timeoutAfter := time.After(time.Second * 10)
+WaitForConsumer:
+	for {
+		select {
+		case <-timeoutAfter:
+			t.Fatal("test timeout")
+		case message := <-consumer.ReceivedMessages():
+			_ = message.Acknowledge()
+			if message.MessageID == letter.LetterID.String() {
+				assert.Equal(t, tcr.EncryptionAesGcm, message.Delivery.Headers[tcr.HeaderEncryption])
+				assert.Equal(t, "v1", message.Delivery.Headers[tcr.HeaderEncryptionKeyVersion])
+				assert.Equal(t, letter.Body, message.Body)
+				break WaitForConsumer
+			}
+		}
+	}
+
+	assert.NoError(t, consumer.StopConsuming(false, false))
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+// TestPipelineForwarding forwards consumed messages to another queue before acking them.
+func TestPipelineForwarding(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	topologer := tcr.NewTopologer(ConnectionPool)
+	assert.NoError(t, topologer.CreateQueue("TcrTestPipelineQueue", false, false, false, false, false, nil))
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	pipeline, err := tcr.NewPipeline(tcr.NewConsumerFromConfig(AckableConsumerConfig, ConnectionPool), publisher, time.Second*5,
+		func(msg *tcr.ReceivedMessage) ([]*tcr.Letter, error) {
+			forwarded := tcr.CreateMockLetter("", "TcrTestPipelineQueue", msg.Body)
+			return []*tcr.Letter{forwarded}, nil
+		})
+	assert.NoError(t, err)
+	pipeline.StartConsuming()
+
+	outputConfig := *ConsumerConfig
+	outputConfig.QueueName = "TcrTestPipelineQueue"
+	output := tcr.NewConsumerFromConfig(&outputConfig, ConnectionPool)
+	output.StartConsuming()
+
+	letter := tcr.CreateMockRandomLetter("TcrTestQueue")
+	assert.NoError(t, publisher.PublishWithConfirmationError(letter, time.Second*5))
+
+	timeoutAfter := time.After(time.Second * 10)
+WaitForOutput:
+	for {
+		select {
+		case <-timeoutAfter:
+			t.Fatal("test timeout")
+		case message := <-output.ReceivedMessages():
+			_ = message.Acknowledge()
+			if string(message.Body) == string(letter.Body) {
+				break WaitForOutput
+			}
+		}
+	}
+
+	assert.NoError(t, output.StopConsuming(false, false))
+	assert.NoError(t, pipeline.StopConsuming(false, false))
+	_, err = topologer.QueueDelete("TcrTestPipelineQueue", false, false, false)
+	assert.NoError(t, err)
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestTransactionalPipeline(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	topologer := tcr.NewTopologer(ConnectionPool)
+	assert.NoError(t, topologer.CreateQueue("TcrTestTxPipelineQueue", false, false, false, false, false, nil))
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	pipeline, err := tcr.NewTransactionalPipeline(tcr.NewConsumerFromConfig(AckableConsumerConfig, ConnectionPool), publisher,
+		func(msg *tcr.ReceivedMessage) ([]*tcr.Letter, error) {
+			return []*tcr.Letter{
+				tcr.CreateMockLetter("", "TcrTestTxPipelineQueue", msg.Body),
+				tcr.CreateMockLetter("", "TcrTestTxPipelineQueue", msg.Body),
+			}, nil
+		})
+	assert.NoError(t, err)
+	pipeline.StartConsuming()
+
+	letter := tcr.CreateMockRandomLetter("TcrTestQueue")
+	assert.NoError(t, publisher.PublishWithConfirmationError(letter, time.Second*5))
+
+	outputConfig := *ConsumerConfig
+	outputConfig.QueueName = "TcrTestTxPipelineQueue"
+	output := tcr.NewConsumerFromConfig(&outputConfig, ConnectionPool)
+	output.StartConsuming()
+
+	received := 0
+	timeoutAfter := time.After(time.Second * 10)
+	for received < 2 {
+		select {
+		case <-timeoutAfter:
+			t.Fatal("test timeout")
+		case message := <-output.ReceivedMessages():
+			assert.Equal(t, letter.Body, message.Body)
+			received++
+		}
+	}
+
+	assert.NoError(t, output.StopConsuming(false, false))
+	assert.NoError(t, pipeline.StopConsuming(false, false))
+	_, err = topologer.QueueDelete("TcrTestTxPipelineQueue", false, false, false)
+	assert.NoError(t, err)
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+// TestConsumingEnvelopeProperties publishes every AMQP property the Envelope carries.
+func TestConsumingEnvelopeProperties(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	consumer := tcr.NewConsumerFromConfig(ConsumerConfig, ConnectionPool)
+	consumer.StartConsuming()
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	letter := tcr.CreateMockRandomLetter("TcrTestQueue")
+	letter.Envelope.MessageID = "TcrTestProperties-" + letter.LetterID.String()
+	letter.Envelope.CorrelationID = "TcrCorrelation"
+	letter.Envelope.ReplyTo = "TcrReplyQueue"
+	letter.Envelope.Expiration = "60000"
+	letter.Envelope.AppID = "TcrTestApp"
+	letter.Envelope.Timestamp = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.NoError(t, publisher.PublishWithConfirmationError(letter, time.Second*5))
+
+	timeoutAfter := time.After(time.Second * 10)
+WaitForConsumer:
+	for {
+		select {
+		case <-timeoutAfter:
+			t.Fatal("test timeout")
+		case message := <-consumer.ReceivedMessages():
+			_ = message.Acknowledge()
+			if message.MessageID == letter.Envelope.MessageID {
+				assert.Equal(t, "TcrCorrelation", message.Delivery.CorrelationId)
+				assert.Equal(t, "TcrReplyQueue", message.Delivery.ReplyTo)
+				assert.Equal(t, "60000", message.Delivery.Expiration)
+				assert.Equal(t, "TcrTestApp", message.Delivery.AppId)
+				assert.True(t, letter.Envelope.Timestamp.Equal(message.Delivery.Timestamp))
+				break WaitForConsumer
+			}
+		}
+	}
+
+	assert.NoError(t, consumer.StopConsuming(false, false))
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+// TestConsumingCompressionHeuristics only compresses bodies worth compressing.
+func TestConsumingCompressionHeuristics(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	consumer := tcr.NewConsumerFromConfig(ConsumerConfig, ConnectionPool)
+	consumer.StartConsuming()
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	publisher.SetCompression(&tcr.CompressionConfig{Enabled: true, Type: tcr.GzipCompressionType, MinSize: 1024})
+
+	small := tcr.CreateMockLetter("", "TcrTestQueue", []byte("too small to bother"))
+	text := tcr.CreateMockLetter("", "TcrTestQueue", []byte(strings.Repeat("compress me please ", 100)))
+	image := tcr.CreateMockLetter("", "TcrTestQueue", []byte(strings.Repeat("pretend png ", 100)))
+	image.Envelope.ContentType = "image/png"
+
+	expected := map[string]string{
+		small.LetterID.String(): "",
+		text.LetterID.String():  tcr.GzipCompressionType,
+		image.LetterID.String(): "",
+	}
+	for _, letter := range []*tcr.Letter{small, text, image} {
+		assert.NoError(t, publisher.PublishWithConfirmationError(letter, time.Second*5))
+	}
+
+	timeoutAfter := time.After(time.Second * 10)
+	for len(expected) > 0 {
+		select {
+		case <-timeoutAfter:
+			t.Fatal("test timeout")
+		case message := <-consumer.ReceivedMessages():
+			_ = message.Acknowledge()
+			if encoding, ok := expected[message.MessageID]; ok {
+				assert.Equal(t, encoding, message.Delivery.ContentEncoding)
+				delete(expected, message.MessageID)
+			}
+		}
+	}
+
+	assert.NoError(t, consumer.StopConsuming(false, false))
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestConsumingStreamedBody(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	store, err := tcr.NewFileBlobStore(t.TempDir())
+	assert.NoError(t, err)
+
+	consumer := tcr.NewConsumerFromConfig(ConsumerConfig, ConnectionPool)
+	consumer.SetBlobStore(store)
+	consumer.StartConsuming()
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	publisher.SetBlobStore(store, 1024)
+
+	small := []byte("framed from a single buffer")
+	large := []byte(strings.Repeat("streamed into the blob store ", 100))
+	for _, body := range [][]byte{small, large} {
+		envelope := &tcr.Envelope{RoutingKey: "TcrTestQueue", ContentType: "text/plain", DeliveryMode: 2}
+		assert.NoError(t, publisher.PublishStream(envelope, strings.NewReader(string(body)), int64(len(body))))
+	}
+
+	for _, body := range [][]byte{small, large} {
+		select {
+		case <-time.After(time.Second * 10):
+			t.Fatal("test timeout")
+		case message := <-consumer.ReceivedMessages():
+			assert.Equal(t, body, message.Body)
+		}
+	}
+
+	assert.NoError(t, consumer.StopConsuming(false, false))
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+// TestConsumingClaimCheckedLetters offloads the bodies of letters sharing a LetterID without them colliding.
+func TestConsumingClaimCheckedLetters(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	store, err := tcr.NewFileBlobStore(t.TempDir())
+	assert.NoError(t, err)
+
+	consumer := tcr.NewConsumerFromConfig(ConsumerConfig, ConnectionPool)
+	consumer.SetBlobStore(store)
+	consumer.StartConsuming()
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	publisher.SetBlobStore(store, 16)
+
+	expected := map[string]bool{}
+	for _, body := range []string{"the first body over the threshold", "the second body over the threshold"} {
+		letter := tcr.CreateMockLetter("", "TcrTestQueue", []byte(body))
+		letter.LetterID = uuid.Nil
+		assert.NoError(t, publisher.PublishWithConfirmationError(letter, time.Second*5))
+		expected[body] = true
+	}
+
+	for len(expected) > 0 {
+		select {
+		case <-time.After(time.Second * 10):
+			t.Fatal("test timeout")
+		case message := <-consumer.ReceivedMessages():
+			_ = message.Acknowledge()
+			assert.True(t, expected[string(message.Body)], "unexpected body %q", message.Body)
+			delete(expected, string(message.Body))
+		}
+	}
+
+	assert.NoError(t, consumer.StopConsuming(false, false))
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+// TestConsumingOwnedQueue subscribes to a fanout exchange with a queue the consumer declares itself.
+func TestConsumingOwnedQueue(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	topologer := tcr.NewTopologer(ConnectionPool)
+	assert.NoError(t, topologer.CreateExchange("TcrTestOwnedFanout", "fanout", false, false, false, false, false, nil))
+
+	consumerConfig := *ConsumerConfig
+	consumerConfig.QueueName = "TcrTestOwnedQueue"
+	consumer := tcr.NewConsumerFromConfig(&consumerConfig, ConnectionPool)
+	consumer.OwnQueue(
+		&tcr.Queue{AutoDelete: true, Exclusive: true},
+		&tcr.QueueBinding{ExchangeName: "TcrTestOwnedFanout"})
+	consumer.StartConsuming()
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	letter := tcr.CreateMockLetter("TcrTestOwnedFanout", "", []byte("fanned out"))
+
+	timeoutAfter := time.After(time.Second * 10)
+WaitForMessage:
+	for {
+		// the queue only exists once the consumer declared it
+		assert.NoError(t, publisher.PublishWithConfirmationError(letter, time.Second*5))
+
+		select {
+		case <-timeoutAfter:
+			t.Fatal("test timeout")
+		case message := <-consumer.ReceivedMessages():
+			_ = message.Acknowledge()
+			break WaitForMessage
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+
+	assert.NoError(t, consumer.StopConsuming(false, false))
+	assert.NoError(t, topologer.ExchangeDelete("TcrTestOwnedFanout", false, false))
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+func TestConsumingWithWatermarks(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	store, err := tcr.NewFileWatermarkStore(t.TempDir())
+	assert.NoError(t, err)
+	assert.NoError(t, store.SaveWatermark(ConsumerConfig.QueueName, "order-1", 2)) // processed before the "crash"
+
+	consumer := tcr.NewConsumerFromConfig(ConsumerConfig, ConnectionPool)
+	consumer.SetWatermarkStore(store)
+	consumer.StartConsuming()
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	for sequence := uint64(1); sequence <= 3; sequence++ {
+		letter := tcr.CreateMockLetter("", ConsumerConfig.QueueName, nil)
+		tcr.StampWatermark(letter, "order-1", sequence)
+		assert.NoError(t, publisher.PublishWithConfirmationError(letter, time.Second*5))
+	}
+
+	// only the unprocessed sequence reaches the handler
+	select {
+	case <-time.After(time.Second * 10):
+		t.Fatal("test timeout")
+	case message := <-consumer.ReceivedMessages():
+		assert.Equal(t, int64(3), message.Delivery.Headers[tcr.HeaderWatermarkSequence])
+		assert.NoError(t, message.Acknowledge())
+	}
+
+	mark, err := store.LoadWatermark(ConsumerConfig.QueueName, "order-1")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), mark)
+
+	assert.NoError(t, consumer.StopConsuming(false, false))
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+// TestConsumingRecreatesDeletedQueue deletes the queue under a consumer, which declares it again and resubscribes.
+func TestConsumingRecreatesDeletedQueue(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	topologer := tcr.NewTopologer(ConnectionPool)
+	assert.NoError(t, topologer.CreateQueue("TcrTestDeletedQueue", false, false, true, false, false, nil))
+
+	consumerConfig := *ConsumerConfig
+	consumerConfig.QueueName = "TcrTestDeletedQueue"
+	consumerConfig.QueueDeleted = &tcr.QueueDeletedConfig{
+		Policy: tcr.QueueDeletedRecreate,
+		Queue:  &tcr.OwnedQueue{Queue: &tcr.Queue{AutoDelete: true}},
+	}
+	consumer := tcr.NewConsumerFromConfig(&consumerConfig, ConnectionPool)
+	consumer.StartConsuming()
+
+	time.Sleep(time.Millisecond * 500)
+	_, err := topologer.QueueDelete("TcrTestDeletedQueue", false, false, false)
+	assert.NoError(t, err)
+
+	select {
+	case <-time.After(time.Second * 10):
+		t.Fatal("test timeout")
+	case err := <-consumer.Errors():
+		assert.ErrorIs(t, err, tcr.ErrQueueDeleted)
+	}
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	letter := tcr.CreateMockLetter("", "TcrTestDeletedQueue", []byte("after the deletion"))
+
+	timeoutAfter := time.After(time.Second * 10)
+WaitForMessage:
+	for {
+		// published to the default exchange, dropped until the queue was recreated
+		assert.NoError(t, publisher.PublishWithConfirmationError(letter, time.Second*5))
+
+		select {
+		case <-timeoutAfter:
+			t.Fatal("test timeout")
+		case message := <-consumer.ReceivedMessages():
+			assert.Equal(t, []byte("after the deletion"), message.Body)
+			_ = message.Acknowledge()
+			break WaitForMessage
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+
+	assert.NoError(t, consumer.StopConsuming(false, false))
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
+
+// TestConsumingByPolling receives through the basic.get loop with the same handler API.
+func TestConsumingByPolling(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	consumerConfig := *ConsumerConfig
+	consumerConfig.Polling = &tcr.PollingConfig{Mode: tcr.PollingModeAlways, MaxInterval: 100}
+	consumer := tcr.NewConsumerFromConfig(&consumerConfig, ConnectionPool)
+	consumer.StartConsuming()
+
+	publisher := tcr.NewPublisherFromConfig(Seasoning, ConnectionPool)
+	letter := tcr.CreateMockLetter("", ConsumerConfig.QueueName, []byte("polled"))
+	assert.NoError(t, publisher.PublishWithConfirmationError(letter, time.Second*5))
+
+	select {
+	case <-time.After(time.Second * 10):
+		t.Fatal("test timeout")
+	case message := <-consumer.ReceivedMessages():
+		assert.Equal(t, []byte("polled"), message.Body)
+		assert.NoError(t, message.Acknowledge())
+	}
+
+	assert.NoError(t, consumer.StopConsuming(false, false))
+	publisher.Shutdown(false)
+	TestCleanup(t)
+}
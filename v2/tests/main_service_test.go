@@ -1,6 +1,7 @@
 package main_test
 
 import (
+	"context"
 	"testing"
 	"time"
 
@@ -88,3 +89,44 @@ func TestRabbitServicePublishLetterToNonExistentQueueForRetryTesting(t *testing.
 
 	service.Shutdown(true)
 }
+
+func TestRabbitServiceStartFromSeasoning(t *testing.T) {
+	defer leaktest.Check(t)() // Fail on leaked goroutines.
+
+	seasoning := *Seasoning
+	seasoning.EncryptionConfig = &tcr.EncryptionConfig{}
+	seasoning.TopologyConfig = &tcr.TopologyConfig{
+		Queues: []*tcr.Queue{{Name: "TcrTestWiredQueue", AutoDelete: true}},
+	}
+	seasoning.PublisherConfigs = map[string]*tcr.PublisherConfig{
+		"orders": {PublishTimeOutInterval: 500},
+	}
+	seasoning.ConsumerConfigs = map[string]*tcr.ConsumerConfig{
+		"wired":  {Enabled: true, QueueName: "TcrTestWiredQueue", ConsumerName: "TcrWiredConsumer", Handler: "orders"},
+		"ignore": {Enabled: true, QueueName: "TcrTestQueue", ConsumerName: "TcrUnwiredConsumer"},
+	}
+
+	service, err := tcr.NewRabbitService(&seasoning, "", "", nil, nil)
+	assert.NoError(t, err)
+
+	// every handler is looked up before anything starts
+	assert.Error(t, service.Start(context.Background(), tcr.HandlerRegistry{"invoices": func(*tcr.ReceivedMessage) {}}))
+
+	received := make(chan []byte, 1)
+	assert.NoError(t, service.Start(context.Background(), tcr.HandlerRegistry{
+		"orders": func(msg *tcr.ReceivedMessage) { received <- msg.Body },
+	}))
+
+	publisher, err := service.GetPublisher("orders")
+	assert.NoError(t, err)
+	assert.NoError(t, publisher.PublishWithConfirmationError(tcr.CreateMockLetter("", "TcrTestWiredQueue", []byte("wired")), time.Second*5))
+
+	select {
+	case <-time.After(time.Second * 10):
+		t.Fatal("test timeout")
+	case body := <-received:
+		assert.Equal(t, []byte("wired"), body)
+	}
+
+	service.Shutdown(true)
+}
@@ -1,10 +1,18 @@
 package main_test
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/houseofcat/turbocookedrabbit/v2/pkg/tcr"
 	"github.com/streadway/amqp"
@@ -96,3 +104,487 @@ func TestCreateQuorumQueue(t *testing.T) {
 	_, err = topologer.QueueDelete("TcrTestQuorumQueue", false, false, false)
 	assert.NoError(t, err)
 }
+
+func TestPurgeQueueWithGuard(t *testing.T) {
+
+	topologer := tcr.NewTopologer(ConnectionPool)
+
+	_, err := topologer.PurgeQueueWithGuard("TcrTestQueue", false, &tcr.QueueGuard{Allowlist: []string{"TcrOtherQueue"}})
+	assert.Error(t, err)
+
+	_, err = topologer.PurgeQueueWithGuard("TcrTestQueue", false, &tcr.QueueGuard{AllowPattern: "^Tcr.*Queue$"})
+	assert.NoError(t, err)
+}
+
+func TestVerifyExchangeRouting(t *testing.T) {
+
+	topologer := tcr.NewTopologer(ConnectionPool)
+
+	err := topologer.CreateExchange("TcrTestUnboundExchange", "direct", false, false, true, false, false, nil)
+	assert.NoError(t, err)
+
+	verifications, err := topologer.VerifyExchangeRouting([]*tcr.Exchange{
+		{Name: ""}, // default exchange routes the routing key to the queue of the same name
+		{Name: "TcrTestUnboundExchange"},
+	}, "TcrTestQueue", time.Second*5)
+	assert.Error(t, err)
+	assert.Equal(t, 2, len(verifications))
+	assert.True(t, verifications[0].Routed)
+	assert.False(t, verifications[1].Routed)
+	assert.NoError(t, verifications[1].Err)
+
+	err = topologer.ExchangeDelete("TcrTestUnboundExchange", false, false)
+	assert.NoError(t, err)
+}
+
+func TestVerifyBindings(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[
+			{"source": "", "destination": "TcrTestQueue", "destination_type": "queue", "routing_key": "TcrTestQueue"},
+			{"source": "MyTopicExchange", "destination": "QueueAttachedToExch", "destination_type": "queue", "routing_key": "Orders.#"},
+			{"source": "MyTopicExchange", "destination": "QueueAttachedToExch", "destination_type": "queue", "routing_key": "Stale.#"}
+		]`))
+	}))
+	defer server.Close()
+
+	management, err := tcr.NewManagementClient(&tcr.ManagementConfig{URI: server.URL})
+	assert.NoError(t, err)
+
+	config := &tcr.TopologyConfig{
+		QueueBindings: []*tcr.QueueBinding{
+			{QueueName: "QueueAttachedToExch", ExchangeName: "MyTopicExchange", RoutingKey: "Orders.#"},
+			{QueueName: "QueueAttachedToExch", ExchangeName: "MyTopicExchange", RoutingKey: "Invoices.#"},
+		},
+	}
+
+	report, err := tcr.NewTopologerWithManagement(nil, management).VerifyBindings(config)
+	assert.NoError(t, err)
+	assert.True(t, report.Drifted())
+	assert.Equal(t, 1, report.Verified)
+	assert.Len(t, report.Missing, 1)
+	assert.Equal(t, "Invoices.#", report.Missing[0].RoutingKey)
+	assert.Len(t, report.Unexpected, 1)
+	assert.Equal(t, "Stale.#", report.Unexpected[0].RoutingKey)
+}
+
+// managementRequest is a request received by the fake management API.
+type managementRequest struct {
+	Route string // method and escaped path, ex.) GET /api/queues/%2F/TcrTestQueue
+	Body  map[string]string
+}
+
+// fakeManagement answers routes with canned JSON (or status codes) and records every request it receives.
+type fakeManagement struct {
+	responses map[string]string
+	statuses  map[string]int
+	requests  []*managementRequest
+	lock      *sync.Mutex
+}
+
+func newFakeManagement(t *testing.T) (*fakeManagement, *tcr.ManagementClient, func()) {
+
+	fake := &fakeManagement{
+		responses: make(map[string]string),
+		statuses:  make(map[string]int),
+		lock:      &sync.Mutex{},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "TcrUser" || password != "TcrPassword" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		request := &managementRequest{Route: r.Method + " " + r.URL.EscapedPath()}
+		_ = json.NewDecoder(r.Body).Decode(&request.Body)
+
+		fake.lock.Lock()
+		fake.requests = append(fake.requests, request)
+		status, response := fake.statuses[request.Route], fake.responses[request.Route]
+		fake.lock.Unlock()
+
+		if status != 0 {
+			w.WriteHeader(status)
+		}
+		_, _ = w.Write([]byte(response))
+	}))
+
+	management, err := tcr.NewManagementClient(&tcr.ManagementConfig{URI: server.URL + "/", Username: "TcrUser", Password: "TcrPassword"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fake, management, server.Close
+}
+
+// respond sets the response of the route.
+func (fake *fakeManagement) respond(route string, response string) {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	fake.responses[route] = response
+}
+
+func (fake *fakeManagement) routes() []string {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	routes := make([]string, 0, len(fake.requests))
+	for _, request := range fake.requests {
+		routes = append(routes, request.Route)
+	}
+
+	return routes
+}
+
+func (fake *fakeManagement) body(route string) map[string]string {
+	fake.lock.Lock()
+	defer fake.lock.Unlock()
+
+	for _, request := range fake.requests {
+		if request.Route == route {
+			return request.Body
+		}
+	}
+
+	return nil
+}
+
+func TestManagementClientRequests(t *testing.T) {
+
+	fake, management, closeServer := newFakeManagement(t)
+	defer closeServer()
+
+	fake.responses["GET /api/exchanges/%2F/Tcr%20Orders%2FEU/bindings/source"] = `[
+		{"source": "Tcr Orders/EU", "vhost": "/", "destination": "TcrTestQueue", "destination_type": "queue", "routing_key": "Orders.#", "properties_key": "Orders.%23"}
+	]`
+	fake.responses["GET /api/queues/%2F/TcrTestQueue"] = `{"name": "TcrTestQueue", "vhost": "/", "messages": 3, "messages_ready": 2, "messages_unacknowledged": 1, "consumers": 1}`
+	fake.responses["GET /api/overview"] = `{"exchange_types": [{"name": "direct"}, {"name": "x-delayed-message"}]}`
+	fake.responses["GET /api/connections"] = `[{"name": "127.0.0.1:5000 -> 127.0.0.1:5672", "channels": 4, "peer_port": 5000, "client_properties": {"connection_name": "TurboCookedRabbit-0"}}]`
+
+	bindings, err := management.ListExchangeBindings("Tcr Orders/EU", true)
+	assert.NoError(t, err)
+	if assert.Len(t, bindings, 1) {
+		assert.Equal(t, "Orders.#", bindings[0].RoutingKey)
+		assert.NoError(t, management.DeleteBinding(bindings[0]))
+	}
+
+	bindings, err = management.ListExchangeBindings("Tcr Orders/EU", false)
+	assert.NoError(t, err)
+	assert.Empty(t, bindings)
+	assert.NoError(t, management.DeleteBinding(&tcr.ManagementBinding{Source: "TcrParent", Destination: "TcrChild", DestinationType: "exchange"}))
+
+	queue, err := management.GetQueue("TcrTestQueue")
+	assert.NoError(t, err)
+	assert.Equal(t, &tcr.ManagementQueue{Name: "TcrTestQueue", VHost: "/", Messages: 3, MessagesReady: 2, MessagesUnacknowledged: 1, Consumers: 1}, queue)
+
+	types, err := management.ExchangeTypes()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"direct", "x-delayed-message"}, types)
+
+	connections, err := management.ListConnections()
+	assert.NoError(t, err)
+	if assert.Len(t, connections, 1) {
+		assert.Equal(t, "TurboCookedRabbit-0", connections[0].ClientProperties.ConnectionName)
+		assert.Equal(t, 4, connections[0].Channels)
+	}
+
+	_, err = management.ListBindings()
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"GET /api/exchanges/%2F/Tcr%20Orders%2FEU/bindings/source", // the default vhost / is escaped like names
+		"DELETE /api/bindings/%2F/e/Tcr%20Orders%2FEU/q/TcrTestQueue/Orders.%2523",
+		"GET /api/exchanges/%2F/Tcr%20Orders%2FEU/bindings/destination",
+		"DELETE /api/bindings/%2F/e/TcrParent/e/TcrChild/~", // empty routing key without arguments
+		"GET /api/queues/%2F/TcrTestQueue",
+		"GET /api/overview",
+		"GET /api/connections",
+		"GET /api/bindings/%2F",
+	}, fake.routes())
+}
+
+func TestManagementClientVHost(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/queues/tenant%2Fa/TcrTestQueue", r.URL.EscapedPath())
+		_, _ = w.Write([]byte(`{"name": "TcrTestQueue", "vhost": "tenant/a"}`))
+	}))
+	defer server.Close()
+
+	management, err := tcr.NewManagementClient(&tcr.ManagementConfig{URI: server.URL, VHost: "tenant/a"})
+	assert.NoError(t, err)
+
+	queue, err := management.GetQueue("TcrTestQueue")
+	assert.NoError(t, err)
+	assert.Equal(t, "tenant/a", queue.VHost)
+}
+
+func TestManagementClientErrors(t *testing.T) {
+
+	_, err := tcr.NewManagementClient(nil)
+	assert.Error(t, err)
+	_, err = tcr.NewManagementClient(&tcr.ManagementConfig{})
+	assert.Error(t, err)
+
+	fake, management, closeServer := newFakeManagement(t)
+
+	fake.statuses["GET /api/queues/%2F/TcrMissingQueue"] = http.StatusNotFound
+	fake.responses["GET /api/queues/%2F/TcrMissingQueue"] = `{"error": "Object Not Found", "reason": "Not Found"}` + "\n"
+	queue, err := management.GetQueue("TcrMissingQueue")
+	assert.Nil(t, queue)
+	assert.EqualError(t, err, `management api GET /queues/%2F/TcrMissingQueue failed with status 404 Not Found: {"error": "Object Not Found", "reason": "Not Found"}`)
+
+	fake.responses["GET /api/connections"] = `{"not": "a list"}`
+	_, err = management.ListConnections()
+	assert.Error(t, err)
+
+	unauthorized, err := tcr.NewManagementClient(&tcr.ManagementConfig{URI: management.Config.URI}) // without credentials
+	assert.NoError(t, err)
+	_, err = unauthorized.ExchangeTypes()
+	assert.ErrorContains(t, err, "401")
+
+	closeServer()
+	_, err = management.ExchangeTypes()
+	assert.Error(t, err) // unreachable
+}
+
+func TestProvisionUsers(t *testing.T) {
+
+	fake, management, closeServer := newFakeManagement(t)
+	defer closeServer()
+
+	topologer := tcr.NewTopologerWithManagement(nil, management)
+	err := topologer.CreateUser(&tcr.User{
+		Name:     "Tcr Service",
+		Password: "Secret",
+		Tags:     "monitoring",
+		Permissions: []*tcr.Permission{
+			{Configure: "^tcr\\.", Write: ".*", Read: ".*"},
+			{VHost: "tenant/a", Configure: "", Write: "", Read: ".*"},
+		},
+		TopicPermissions: []*tcr.TopicPermission{
+			{Exchange: "amq.topic", Write: "^orders\\.", Read: ".*"},
+		},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, topologer.DeleteUser("Tcr Service"))
+
+	assert.Equal(t, []string{
+		"PUT /api/users/Tcr%20Service",
+		"PUT /api/permissions/%2F/Tcr%20Service",
+		"PUT /api/permissions/tenant%2Fa/Tcr%20Service",
+		"PUT /api/topic-permissions/%2F/Tcr%20Service",
+		"DELETE /api/users/Tcr%20Service",
+	}, fake.routes())
+	assert.Equal(t, map[string]string{"password": "Secret", "tags": "monitoring"}, fake.body("PUT /api/users/Tcr%20Service"))
+	assert.Equal(t, map[string]string{"configure": "^tcr\\.", "write": ".*", "read": ".*"}, fake.body("PUT /api/permissions/%2F/Tcr%20Service"))
+	assert.Equal(t, map[string]string{"exchange": "amq.topic", "write": "^orders\\.", "read": ".*"}, fake.body("PUT /api/topic-permissions/%2F/Tcr%20Service"))
+
+	fake.statuses["PUT /api/users/TcrRejected"] = http.StatusBadRequest
+	err = topologer.CreateUser(&tcr.User{Name: "TcrRejected", Permissions: []*tcr.Permission{{Read: ".*"}}})
+	assert.ErrorContains(t, err, "400")
+	assert.NotContains(t, fake.routes(), "PUT /api/permissions/%2F/TcrRejected") // stops at the failed user
+
+	assert.Error(t, tcr.NewTopologer(nil).CreateUser(&tcr.User{Name: "TcrService"})) // no management client
+}
+
+func TestDeleteExchangeCascadeErrors(t *testing.T) {
+
+	assert.Error(t, tcr.NewTopologer(nil).DeleteExchangeCascade("TcrTestCascade"))
+
+	fake, management, closeServer := newFakeManagement(t)
+	defer closeServer()
+
+	fake.responses["GET /api/exchanges/%2F/TcrTestCascade/bindings/source"] = `[{"source": "TcrTestCascade", "destination": "TcrTestQueue", "destination_type": "queue"}]`
+	fake.statuses["DELETE /api/bindings/%2F/e/TcrTestCascade/q/TcrTestQueue/~"] = http.StatusInternalServerError
+
+	err := tcr.NewTopologerWithManagement(nil, management).DeleteExchangeCascade("TcrTestCascade")
+	assert.ErrorContains(t, err, "500")
+	assert.Equal(t, []string{ // the exchange is kept while its bindings can't be removed
+		"GET /api/exchanges/%2F/TcrTestCascade/bindings/source",
+		"DELETE /api/bindings/%2F/e/TcrTestCascade/q/TcrTestQueue/~",
+	}, fake.routes())
+}
+
+func TestQueueDepthWatcher(t *testing.T) {
+
+	fake, management, closeServer := newFakeManagement(t)
+	defer closeServer()
+
+	watcher := tcr.NewQueueDepthWatcher(tcr.NewTopologerWithManagement(nil, management), time.Millisecond)
+	assert.Error(t, watcher.OnThreshold("TcrTestQueue", 0, func(*tcr.QueueDepth, bool) {}))
+
+	crossings := make(chan bool, 10)
+	assert.NoError(t, watcher.OnThreshold("TcrTestQueue", 5, func(depth *tcr.QueueDepth, above bool) {
+		assert.Equal(t, "TcrTestQueue", depth.QueueName)
+		crossings <- above
+	}))
+
+	errs := make(chan error, 10)
+	watcher.SetErrorHandler(func(err error) {
+		select {
+		case errs <- err:
+		default: // polled again before Stop
+		}
+	})
+
+	depth := func(messages int) {
+		fake.respond("GET /api/queues/%2F/TcrTestQueue", fmt.Sprintf(`{"name": "TcrTestQueue", "messages": %d, "consumers": 1}`, messages))
+	}
+
+	depth(0)
+	watcher.Poll() // an empty queue is below any threshold
+	depth(5)
+	watcher.Poll()
+	depth(9)
+	watcher.Poll() // still above, no crossing
+	depth(4)
+	watcher.Poll()
+	assert.Equal(t, []bool{true, false}, []bool{<-crossings, <-crossings})
+	assert.Empty(t, crossings)
+
+	// polled every interval once started, failed polls reach the error handler
+	fake.lock.Lock()
+	fake.statuses["GET /api/queues/%2F/TcrTestQueue"] = http.StatusNotFound
+	fake.lock.Unlock()
+
+	watcher.Start()
+	assert.ErrorContains(t, <-errs, "404")
+	watcher.Stop()
+	watcher.Stop() // idempotent
+}
+
+func TestDeleteExchangeCascade(t *testing.T) {
+
+	fake, management, closeServer := newFakeManagement(t)
+	defer closeServer()
+
+	fake.responses["GET /api/exchanges/%2F/TcrTestCascade/bindings/source"] = `[{"source": "TcrTestCascade", "destination": "TcrTestQueue", "destination_type": "queue", "routing_key": "TcrTestQueue", "properties_key": "TcrTestQueue"}]`
+	fake.responses["GET /api/exchanges/%2F/TcrTestCascade/bindings/destination"] = `[{"source": "TcrTestParent", "destination": "TcrTestCascade", "destination_type": "exchange", "properties_key": "~"}]`
+
+	topologer := tcr.NewTopologerWithManagement(ConnectionPool, management)
+	assert.NoError(t, topologer.CreateExchange("TcrTestCascade", "direct", false, false, false, false, false, nil))
+	assert.NoError(t, topologer.DeleteExchangeCascade("TcrTestCascade"))
+
+	assert.Equal(t, []string{
+		"GET /api/exchanges/%2F/TcrTestCascade/bindings/source",
+		"DELETE /api/bindings/%2F/e/TcrTestCascade/q/TcrTestQueue/TcrTestQueue",
+		"GET /api/exchanges/%2F/TcrTestCascade/bindings/destination",
+		"DELETE /api/bindings/%2F/e/TcrTestParent/e/TcrTestCascade/~",
+	}, fake.routes())
+
+	err := topologer.CreateExchange("TcrTestCascade", "direct", true, false, false, false, false, nil)
+	assert.Error(t, err) // passive declare, the exchange is gone
+}
+
+func TestConnectionPoolLeakReport(t *testing.T) {
+
+	_, err := (&tcr.ConnectionPool{}).LeakReport(nil)
+	assert.Error(t, err)
+
+	fake, management, closeServer := newFakeManagement(t)
+	defer closeServer()
+
+	name := Seasoning.PoolConfig.ApplicationName + "-0"
+	fake.responses["GET /api/connections"] = `[
+		{"name": "first", "channels": 500, "client_properties": {"connection_name": "` + name + `"}},
+		{"name": "crashed", "channels": 1, "client_properties": {"connection_name": "` + name + `"}},
+		{"name": "other", "channels": 1, "client_properties": {"connection_name": "SomeOtherApplication-0"}}
+	]`
+
+	report, err := ConnectionPool.LeakReport(management)
+	assert.NoError(t, err)
+	assert.True(t, report.Leaking(10))
+	if assert.Len(t, report.Orphaned, 1) {
+		assert.Equal(t, "crashed", report.Orphaned[0].Name)
+	}
+
+	for _, status := range report.Connections {
+		if status.ConnectionName != name {
+			assert.Nil(t, status.Broker) // not reported by the broker, the pool holds a dead connection
+			continue
+		}
+
+		if assert.NotNil(t, status.Broker) {
+			assert.Equal(t, "first", status.Broker.Name)
+			assert.Equal(t, 500-status.CachedChannels, status.UnmanagedChannels)
+		}
+	}
+}
+
+func TestTopologerRunConcurrentlyBound(t *testing.T) {
+
+	topologer := tcr.NewTopologer(nil)
+	topologer.Concurrency = 3
+
+	var started, active, maxActive int32
+	gate := make(chan struct{})
+	declarations := make([]func() error, 10)
+	for i := range declarations {
+		declarations[i] = func() error {
+			atomic.AddInt32(&started, 1)
+			current := atomic.AddInt32(&active, 1)
+			defer atomic.AddInt32(&active, -1)
+
+			for {
+				seen := atomic.LoadInt32(&maxActive)
+				if current <= seen || atomic.CompareAndSwapInt32(&maxActive, seen, current) {
+					break
+				}
+			}
+
+			<-gate
+			return nil
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- topologer.RunConcurrently(declarations, false) }()
+
+	// Only Concurrency declarations start while the first ones are held back.
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&started) == 3 }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&started))
+
+	close(gate)
+	assert.NoError(t, <-done)
+	assert.Equal(t, int32(10), atomic.LoadInt32(&started))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&maxActive))
+
+	// Without a Concurrency the declarations run one at a time.
+	topologer.Concurrency = 0
+	atomic.StoreInt32(&maxActive, 0)
+	assert.NoError(t, topologer.RunConcurrently(declarations, false))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&maxActive))
+}
+
+func TestTopologerRunConcurrentlyErrors(t *testing.T) {
+
+	topologer := tcr.NewTopologer(nil)
+	topologer.Concurrency = 1
+
+	first := errors.New("first declaration failed")
+	second := errors.New("second declaration failed")
+
+	ran := make([]int, 0)
+	declare := func(i int, err error) func() error {
+		return func() error {
+			ran = append(ran, i)
+			return err
+		}
+	}
+	declarations := []func() error{declare(0, nil), declare(1, first), declare(2, second), declare(3, nil)}
+
+	// The first error stops the declarations that haven't started yet.
+	assert.Equal(t, first, topologer.RunConcurrently(declarations, false))
+	assert.Equal(t, []int{0, 1}, ran)
+
+	// Ignoring errors runs everything and still reports the first error.
+	ran = ran[:0]
+	assert.Equal(t, first, topologer.RunConcurrently(declarations, true))
+	assert.Equal(t, []int{0, 1, 2, 3}, ran)
+
+	assert.NoError(t, topologer.RunConcurrently(nil, false))
+}
@@ -2,14 +2,34 @@ package main_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"math/big"
 	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/houseofcat/turbocookedrabbit/v2/pkg/resilience"
 	"github.com/houseofcat/turbocookedrabbit/v2/pkg/tcr"
 	jsoniter "github.com/json-iterator/go"
+	"github.com/streadway/amqp"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -47,6 +67,48 @@ func TestCompressAndDecompressWithZstd(t *testing.T) {
 	assert.Equal(t, data, buffer.String())
 }
 
+func TestCompressWithPooledWriters(t *testing.T) {
+
+	// compressors go back to a pool, each reuse must produce a complete stream of its own
+	for i := 0; i < 3; i++ {
+		data := fmt.Sprintf("SuperStreetFighter2TurboMBisonDidNothingWrong%d", i)
+
+		buffer := &bytes.Buffer{}
+		assert.NoError(t, tcr.CompressWithGzip([]byte(data), buffer))
+		assert.NoError(t, tcr.DecompressWithGzip(buffer))
+		assert.Equal(t, data, buffer.String())
+
+		buffer = &bytes.Buffer{}
+		assert.NoError(t, tcr.CompressWithZstd([]byte(data), buffer))
+		assert.NoError(t, tcr.DecompressWithZstd(buffer))
+		assert.Equal(t, data, buffer.String())
+	}
+}
+
+func TestAcquireAndReleaseLetter(t *testing.T) {
+
+	letter := tcr.AcquireLetter()
+	assert.NotNil(t, letter.Envelope)
+	firstID := letter.LetterID
+
+	letter.Body = append(letter.Body[:0], "hello world"...)
+	letter.RetryCount = 3
+	letter.Envelope.Exchange = "orders"
+	letter.Envelope.Headers = amqp.Table{"x-tenant": "acme"}
+	tcr.ReleaseLetter(letter)
+
+	// whichever letter the pool hands out, nothing of its last use is left
+	letter = tcr.AcquireLetter()
+	assert.NotEqual(t, firstID, letter.LetterID)
+	assert.Empty(t, letter.Body)
+	assert.Zero(t, letter.RetryCount)
+	assert.Equal(t, "", letter.Envelope.Exchange)
+	assert.Empty(t, letter.Envelope.Headers)
+	tcr.ReleaseLetter(letter)
+
+	tcr.ReleaseLetter(nil)
+}
+
 func TestGetHashWithArgon2(t *testing.T) {
 
 	password := "SuperStreetFighter2Turbo"
@@ -370,3 +432,1884 @@ func TestRandomStringFromSource(t *testing.T) {
 
 	assert.NotEqual(t, randoString, anotherRandoString)
 }
+
+func TestUnpackTruncatedSubEntries(t *testing.T) {
+
+	entries, err := tcr.UnpackSubEntries([]byte("SuperStreetFighter2"))
+	assert.Error(t, err)
+	assert.Nil(t, entries)
+
+	entries, err = tcr.UnpackSubEntries(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(entries))
+}
+
+func TestJSONLinesLetterIteratorResume(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "letters.jsonl")
+	data, err := jsoniter.Marshal(tcr.CreateMockRandomLetter("TcrTestQueue"))
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(path, append(append(data, '\n'), append(data, '\n')...), 0644))
+
+	iter, err := tcr.NewJSONLinesLetterIterator(path)
+	assert.NoError(t, err)
+
+	letter, err := iter.Next()
+	assert.NoError(t, err)
+	assert.NotNil(t, letter)
+	assert.NoError(t, iter.Checkpoint())
+	assert.NoError(t, iter.Close())
+
+	checkpoint, err := os.ReadFile(path + ".checkpoint")
+	assert.NoError(t, err)
+	assert.Equal(t, "1", string(checkpoint))
+	assert.NoFileExists(t, path+".checkpoint.tmp")
+
+	// a crash while checkpointing leaves the previous checkpoint intact
+	assert.NoError(t, os.WriteFile(path+".checkpoint.tmp", nil, 0644)) // truncated
+
+	iter, err = tcr.NewJSONLinesLetterIterator(path)
+	assert.NoError(t, err)
+	defer iter.Close()
+
+	_, err = iter.Next()
+	assert.NoError(t, err)
+
+	_, err = iter.Next()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestFileSequenceStore(t *testing.T) {
+
+	store, err := tcr.NewFileSequenceStore(t.TempDir())
+	assert.NoError(t, err)
+
+	record, err := store.LoadSequence("Changefeed")
+	assert.NoError(t, err)
+	assert.Nil(t, record)
+
+	saved := &tcr.SequenceRecord{Sequence: 42, Time: time.Now().UTC()}
+	assert.NoError(t, store.SaveSequence("Changefeed", saved))
+
+	record, err = store.LoadSequence("Changefeed")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(42), record.Sequence)
+}
+
+func TestSequenceWatermarkOutOfOrderConfirms(t *testing.T) {
+
+	watermark := tcr.NewSequenceWatermark(3)
+	for sequence := uint64(4); sequence <= 7; sequence++ {
+		watermark.Track(sequence)
+	}
+
+	confirm := func(sequence uint64) *tcr.SequenceRecord {
+		return watermark.Confirm(&tcr.SequenceRecord{Sequence: sequence, Time: time.Now().UTC()})
+	}
+
+	// 5 and 6 are confirmed while 4 is pending, a restart has to resume at 3
+	assert.Nil(t, confirm(5))
+	assert.Nil(t, confirm(6))
+	assert.Equal(t, uint64(3), watermark.Position())
+
+	// once 4 is confirmed (ex. republished after failing) the watermark catches up to 6, 7 is still in flight
+	record := confirm(4)
+	if assert.NotNil(t, record) {
+		assert.Equal(t, uint64(6), record.Sequence)
+	}
+	assert.Equal(t, uint64(6), watermark.Position())
+
+	assert.Nil(t, confirm(2)) // behind the watermark
+	assert.Equal(t, uint64(7), confirm(7).Sequence)
+
+	// untracked confirmations move it as long as nothing lower is in flight
+	watermark.Track(9)
+	assert.Equal(t, uint64(8), confirm(8).Sequence)
+	assert.Nil(t, confirm(10))
+	assert.Equal(t, uint64(10), confirm(9).Sequence)
+}
+
+func TestGobMarshallerRoundTrip(t *testing.T) {
+
+	marshaller, ok := tcr.GetMarshaller("gob")
+	assert.True(t, ok)
+	assert.Equal(t, tcr.ContentTypeGob, marshaller.ContentType())
+
+	data, err := marshaller.Marshal(map[string]string{"Fighter": "MBison"})
+	assert.NoError(t, err)
+
+	msg := tcr.NewReceivedMessage(false, amqp.Delivery{Body: data, ContentType: tcr.ContentTypeGob})
+
+	decoded := make(map[string]string)
+	assert.NoError(t, msg.Unmarshal(&decoded))
+	assert.Equal(t, "MBison", decoded["Fighter"])
+}
+
+func TestUnknownConfiguredMarshaller(t *testing.T) {
+
+	publisher := tcr.NewPublisherFromConfig(&tcr.RabbitSeasoning{PublisherConfig: &tcr.PublisherConfig{Marshaller: "TcrNoSuchMarshaller"}}, nil)
+	defer tcr.UnregisterPublisher(publisher.Name)
+
+	_, err := publisher.CreateLetter("", "TcrTestQueue", "value")
+	assert.ErrorContains(t, err, `no marshaller is registered as "TcrNoSuchMarshaller"`)
+
+	publisher.SetMarshaller(tcr.JSONMarshaller{}) // fixes the publisher
+	_, err = publisher.CreateLetter("", "TcrTestQueue", "value")
+	assert.NoError(t, err)
+
+	config := &tcr.ConsumerConfig{ConsumerName: "TcrUnknownMarshaller", Marshaller: "TcrNoSuchMarshaller"}
+	consumer := tcr.NewConsumerFromConfig(config, nil)
+	defer tcr.UnregisterConsumer(consumer.ConsumerName)
+	select {
+	case err := <-consumer.Errors():
+		assert.ErrorContains(t, err, `consumer "TcrUnknownMarshaller": no marshaller is registered as "TcrNoSuchMarshaller"`)
+	default:
+		t.Error("the unknown marshaller wasn't reported")
+	}
+
+	seasoning := &tcr.RabbitSeasoning{
+		PublisherConfig: &tcr.PublisherConfig{Marshaller: "TcrNoSuchMarshaller"},
+		ConsumerConfigs: map[string]*tcr.ConsumerConfig{"TcrUnknownMarshaller": config},
+	}
+
+	_, err = tcr.NewConsumer(seasoning, nil, "TcrTestQueue", "TcrUnknownMarshaller", false, false, false, nil, 0, 0, 0)
+	assert.ErrorContains(t, err, "TcrNoSuchMarshaller")
+
+	_, err = tcr.NewRabbitServiceWithConnectionPool(nil, seasoning, "", "", nil, nil)
+	assert.ErrorContains(t, err, "TcrNoSuchMarshaller")
+}
+
+func TestReceiptJournalRotation(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "failed.jsonl")
+	journal, err := tcr.NewReceiptJournal(&tcr.ReceiptJournalConfig{Path: path, MaxSize: 200, MaxBackups: 2})
+	assert.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, journal.Write(&tcr.ReceiptJournalEntry{PublisherName: "TcrTestPublisher", Error: "timeout"}))
+	}
+	assert.NoError(t, journal.Close())
+
+	_, err = os.Stat(path + ".1")
+	assert.NoError(t, err)
+
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+
+	policy := &tcr.RetryPolicy{
+		InitialDelay: 100,
+		Multiplier:   2,
+		MaxDelay:     500,
+	}
+
+	assert.Equal(t, time.Duration(0), policy.Delay(0))
+	assert.Equal(t, 100*time.Millisecond, policy.Delay(1))
+	assert.Equal(t, 200*time.Millisecond, policy.Delay(2))
+	assert.Equal(t, 400*time.Millisecond, policy.Delay(3))
+	assert.Equal(t, 500*time.Millisecond, policy.Delay(4))
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		delay := policy.Delay(1)
+		assert.True(t, delay >= 50*time.Millisecond && delay <= 150*time.Millisecond)
+	}
+
+	var none *tcr.RetryPolicy
+	assert.Equal(t, time.Duration(0), none.Delay(3))
+}
+
+func TestRecordAndReplayDeliveries(t *testing.T) {
+
+	recording := &bytes.Buffer{}
+	recorder := tcr.NewDeliveryRecorder(recording)
+	for i := 0; i < 3; i++ {
+		err := recorder.Record(amqp.Delivery{
+			RoutingKey: "TcrTestQueue",
+			MessageId:  fmt.Sprintf("letter-%d", i),
+			Headers:    amqp.Table{"x-index": i},
+			Body:       []byte(fmt.Sprintf("body-%d", i)),
+		})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, recorder.Close())
+
+	consumer := tcr.NewConsumerFromConfig(&tcr.ConsumerConfig{ConsumerName: "TcrReplayConsumer"}, nil)
+
+	bodies := make([]string, 0)
+	result, err := consumer.Replay(recording, func(msg *tcr.ReceivedMessage) {
+		bodies = append(bodies, string(msg.Body))
+		if msg.MessageID == "letter-1" {
+			_ = msg.Nack(false)
+			return
+		}
+		_ = msg.Acknowledge()
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, result.Delivered)
+	assert.Equal(t, []string{"body-0", "body-1", "body-2"}, bodies)
+	assert.Equal(t, []uint64{1, 3}, result.Acked)
+	assert.Equal(t, []uint64{2}, result.Nacked)
+}
+
+func TestConsumerMaxProcessingRate(t *testing.T) {
+
+	consumer := tcr.NewConsumerFromConfig(&tcr.ConsumerConfig{
+		ConsumerName:      "TcrThrottledConsumer",
+		MaxProcessingRate: 20,
+	}, nil)
+
+	recording := &bytes.Buffer{}
+	recorder := tcr.NewDeliveryRecorder(recording)
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, recorder.Record(amqp.Delivery{Body: []byte("throttled")}))
+	}
+
+	start := time.Now()
+	result, err := consumer.Replay(recording, func(msg *tcr.ReceivedMessage) {})
+	assert.NoError(t, err)
+	assert.Equal(t, 5, result.Delivered)
+	assert.True(t, time.Since(start) >= 150*time.Millisecond) // the first message is free, the rest wait 50ms each
+}
+
+func TestQueueLetterOverflow(t *testing.T) {
+
+	publisher := tcr.NewPublisherFromConfig(&tcr.RabbitSeasoning{
+		PublisherConfig: &tcr.PublisherConfig{QueueCapacity: 1, QueueOverflow: tcr.QueueOverflowError},
+	}, nil)
+	defer tcr.UnregisterPublisher(publisher.Name)
+
+	assert.NoError(t, publisher.QueueLetterWithError(tcr.CreateMockRandomLetter("TcrTestQueue")))
+	assert.Equal(t, tcr.ErrQueueFull, publisher.QueueLetterWithError(tcr.CreateMockRandomLetter("TcrTestQueue")))
+
+	dropping := tcr.NewPublisherFromConfig(&tcr.RabbitSeasoning{
+		PublisherConfig: &tcr.PublisherConfig{QueueCapacity: 1, QueueOverflow: tcr.QueueOverflowDropOldest},
+	}, nil)
+	defer tcr.UnregisterPublisher(dropping.Name)
+
+	oldest := tcr.CreateMockRandomLetter("TcrTestQueue")
+	assert.True(t, dropping.QueueLetter(oldest))
+	assert.True(t, dropping.QueueLetter(tcr.CreateMockRandomLetter("TcrTestQueue")))
+
+	receipt := <-dropping.PublishReceipts()
+	assert.Equal(t, oldest.LetterID, receipt.LetterID)
+	assert.Equal(t, tcr.ErrLetterDropped, receipt.Error)
+}
+
+// fakeClock only moves when advanced.
+type fakeClock struct {
+	now  time.Time
+	lock *sync.Mutex
+}
+
+func (fc *fakeClock) Now() time.Time {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	return fc.now
+}
+
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	fc.now = fc.now.Add(d)
+}
+
+func (fc *fakeClock) After(d time.Duration) <-chan time.Time {
+	return make(chan time.Time) // never fires
+}
+
+func (fc *fakeClock) AfterFunc(d time.Duration, f func()) func() bool {
+	return func() bool { return true }
+}
+
+// timerClock is a fakeClock whose After channels fire when advanced past them. Every After is announced on
+// timers, so tests can wait for a watchdog to be waiting before advancing.
+type timerClock struct {
+	*fakeClock
+	pending []timerClockWaiter
+	timers  chan time.Duration
+}
+
+type timerClockWaiter struct {
+	at      time.Time
+	channel chan time.Time
+}
+
+func newTimerClock() *timerClock {
+	return &timerClock{
+		fakeClock: &fakeClock{now: time.Now(), lock: &sync.Mutex{}},
+		timers:    make(chan time.Duration, 100),
+	}
+}
+
+func (tc *timerClock) After(d time.Duration) <-chan time.Time {
+	tc.lock.Lock()
+	channel := make(chan time.Time, 1)
+	tc.pending = append(tc.pending, timerClockWaiter{at: tc.now.Add(d), channel: channel})
+	tc.lock.Unlock()
+
+	tc.timers <- d
+	return channel
+}
+
+func (tc *timerClock) Advance(d time.Duration) {
+	tc.lock.Lock()
+	defer tc.lock.Unlock()
+
+	tc.now = tc.now.Add(d)
+	pending := tc.pending[:0]
+	for _, waiter := range tc.pending {
+		if waiter.at.After(tc.now) {
+			pending = append(pending, waiter)
+			continue
+		}
+		waiter.channel <- tc.now
+	}
+	tc.pending = pending
+}
+
+// sequentialIDs generates LetterIDs 1, 2, 3...
+type sequentialIDs struct {
+	next byte
+}
+
+func (ids *sequentialIDs) NewLetterID() uuid.UUID {
+	ids.next++
+	return uuid.UUID{15: ids.next}
+}
+
+func TestStreamBatcher(t *testing.T) {
+
+	publisher := tcr.NewPublisher(nil, 0, 0, 0)
+	publisher.SetIDGenerator(&sequentialIDs{})
+
+	published := make([]*tcr.Letter, 0)
+	publisher.Use(func(next tcr.PublishFunc) tcr.PublishFunc {
+		return func(letter *tcr.Letter) error {
+			published = append(published, letter)
+			if len(published) > 1 {
+				return tcr.ErrNack
+			}
+			return nil
+		}
+	})
+
+	batcher := tcr.NewStreamBatcher(publisher, "", "TcrTestStream", 2, 0, 0)
+	first := tcr.CreateMockRandomLetter("TcrTestStream")
+	second := tcr.CreateMockRandomLetter("TcrTestStream")
+	assert.NoError(t, batcher.Add(first))
+	assert.NoError(t, batcher.Add(second)) // full, published
+
+	receipt := <-publisher.PublishReceipts()
+	assert.True(t, receipt.Success)
+	if assert.Len(t, published, 1) {
+		assert.Equal(t, uuid.UUID{15: 1}, published[0].LetterID) // from the publisher's IDGenerator
+		assert.Equal(t, receipt.LetterID, published[0].LetterID)
+		assert.Equal(t, int32(2), published[0].Envelope.Headers[tcr.HeaderSubEntryCount])
+
+		entries, err := tcr.UnpackSubEntries(published[0].Body)
+		assert.NoError(t, err)
+		if assert.Len(t, entries, 2) {
+			assert.Equal(t, first.LetterID, entries[0].LetterID)
+			assert.Equal(t, second.Body, entries[1].Body)
+		}
+	}
+
+	assert.NoError(t, batcher.Add(tcr.CreateMockRandomLetter("TcrTestStream")))
+	assert.ErrorIs(t, batcher.Stop(), tcr.ErrNack) // the remaining entry is flushed, its failure is reported
+
+	receipt = <-publisher.PublishReceipts()
+	assert.False(t, receipt.Success)
+	if assert.NotNil(t, receipt.FailedLetter) {
+		assert.Equal(t, int32(1), receipt.FailedLetter.Envelope.Headers[tcr.HeaderSubEntryCount])
+	}
+}
+
+func TestPublisherClockAndIDGenerator(t *testing.T) {
+
+	publisher := tcr.NewPublisherFromConfig(&tcr.RabbitSeasoning{PublisherConfig: &tcr.PublisherConfig{}}, nil)
+	defer tcr.UnregisterPublisher(publisher.Name)
+
+	clock := &fakeClock{now: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), lock: &sync.Mutex{}}
+	publisher.SetClock(clock)
+	publisher.SetIDGenerator(&sequentialIDs{})
+
+	first, err := publisher.CreateLetter("", "TcrTestQueue", "first")
+	assert.NoError(t, err)
+	second, err := publisher.CreateLetter("", "TcrTestQueue", "second")
+	assert.NoError(t, err)
+
+	assert.Equal(t, uuid.UUID{15: 1}, first.LetterID)
+	assert.Equal(t, uuid.UUID{15: 2}, second.LetterID)
+}
+
+func TestConsumerClockProcessingDeadline(t *testing.T) {
+
+	consumer := tcr.NewConsumerFromConfig(&tcr.ConsumerConfig{
+		ConsumerName:       "TcrClockedConsumer",
+		ProcessingDeadline: 60000,
+		ProgressInterval:   10,
+	}, nil)
+
+	clock := &fakeClock{now: time.Now(), lock: &sync.Mutex{}}
+	consumer.SetClock(clock)
+
+	recording := &bytes.Buffer{}
+	recorder := tcr.NewDeliveryRecorder(recording)
+	assert.NoError(t, recorder.Record(amqp.Delivery{DeliveryTag: 1, Body: []byte("slow")}))
+
+	result, err := consumer.Replay(recording, func(msg *tcr.ReceivedMessage) {
+		clock.Advance(time.Minute * 2) // way past the deadline without waiting a minute
+		time.Sleep(time.Millisecond * 100)
+		assert.Equal(t, tcr.ErrProcessingDeadline, msg.Acknowledge())
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1}, result.Nacked)
+	assert.Empty(t, result.Acked)
+}
+
+func TestConsumerLeaseExtension(t *testing.T) {
+
+	consumer := tcr.NewConsumerFromConfig(&tcr.ConsumerConfig{
+		ConsumerName:       "TcrLeasedConsumer",
+		ProcessingDeadline: 60000,
+		ProgressInterval:   10000,
+	}, nil)
+
+	clock := newTimerClock()
+	consumer.SetClock(clock)
+
+	elapsed := make(chan time.Duration, 100)
+	consumer.SetProgressHandler(func(msg *tcr.ReceivedMessage, processing time.Duration) {
+		assert.True(t, msg.ExtendDeadline(time.Minute))
+		elapsed <- processing
+	})
+
+	recording := &bytes.Buffer{}
+	recorder := tcr.NewDeliveryRecorder(recording)
+	assert.NoError(t, recorder.Record(amqp.Delivery{DeliveryTag: 1, Body: []byte("long")}))
+
+	result, err := consumer.Replay(recording, func(msg *tcr.ReceivedMessage) {
+		assert.Equal(t, clock.Now().Add(time.Minute), msg.Deadline())
+
+		for i := 1; i <= 3; i++ {
+			assert.Equal(t, time.Second*10, <-clock.timers) // the watchdog waits for the next interval
+			clock.Advance(time.Second * 50)                 // 150s in total, well past the original deadline
+			assert.Equal(t, time.Second*50*time.Duration(i), <-elapsed)
+		}
+
+		assert.Equal(t, clock.Now().Add(time.Minute), msg.Deadline()) // extended on every tick
+		assert.NoError(t, msg.Acknowledge())
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{1}, result.Acked)
+	assert.Empty(t, result.Nacked)
+}
+
+func TestConsumerLeaseExpiry(t *testing.T) {
+
+	consumer := tcr.NewConsumerFromConfig(&tcr.ConsumerConfig{
+		ConsumerName:       "TcrExpiringConsumer",
+		ProcessingDeadline: 60000,
+		ProgressInterval:   10000,
+	}, nil)
+
+	ticks := make(chan time.Duration, 100)
+	consumer.SetProgressHandler(func(msg *tcr.ReceivedMessage, processing time.Duration) { ticks <- processing })
+
+	replay := func(clock *timerClock, action func(*tcr.ReceivedMessage)) *tcr.ReplayResult {
+		consumer.SetClock(clock)
+
+		recording := &bytes.Buffer{}
+		assert.NoError(t, tcr.NewDeliveryRecorder(recording).Record(amqp.Delivery{DeliveryTag: 1}))
+		result, err := consumer.Replay(recording, action)
+		assert.NoError(t, err)
+		return result
+	}
+
+	clock := newTimerClock()
+	result := replay(clock, func(msg *tcr.ReceivedMessage) {
+		<-clock.timers
+		clock.Advance(time.Second * 50)
+		<-ticks
+		assert.True(t, msg.ExtendDeadline(time.Second*20)) // good until 70s
+
+		<-clock.timers
+		clock.Advance(time.Second * 15)
+		<-ticks
+		assert.NoError(t, msg.Acknowledge()) // 65s, past the original deadline only
+	})
+	assert.Equal(t, []uint64{1}, result.Acked)
+	assert.Empty(t, result.Nacked)
+
+	clock = newTimerClock()
+	result = replay(clock, func(msg *tcr.ReceivedMessage) {
+		<-clock.timers
+		clock.Advance(time.Second * 61)
+		assert.ErrorContains(t, <-consumer.Errors(), "exceeded processing deadline")
+		assert.False(t, msg.ExtendDeadline(time.Minute)) // too late, the lease is gone
+		assert.Equal(t, tcr.ErrProcessingDeadline, msg.Acknowledge())
+	})
+	assert.Empty(t, result.Acked)
+	assert.Equal(t, []uint64{1}, result.Nacked)
+
+	msg := tcr.NewReceivedMessage(true, amqp.Delivery{})
+	assert.False(t, msg.ExtendDeadline(time.Minute)) // no ProcessingDeadline, no lease
+	assert.True(t, msg.Deadline().IsZero())
+}
+
+// leaseLocks is a LeaseLocker of a single process.
+type leaseLocks struct {
+	held     map[string]bool
+	unlocked []string
+	err      error
+	lock     *sync.Mutex
+}
+
+func (locks *leaseLocks) Lock(queueName string, messageID string) (func(), error) {
+	locks.lock.Lock()
+	defer locks.lock.Unlock()
+
+	if locks.err != nil {
+		return nil, locks.err
+	}
+
+	if locks.held[messageID] {
+		return nil, tcr.ErrLeaseLocked
+	}
+
+	locks.held[messageID] = true
+	return func() {
+		locks.lock.Lock()
+		defer locks.lock.Unlock()
+
+		delete(locks.held, messageID)
+		locks.unlocked = append(locks.unlocked, queueName+"/"+messageID)
+	}, nil
+}
+
+func TestConsumerLeaseLocks(t *testing.T) {
+
+	consumer := tcr.NewConsumerFromConfig(&tcr.ConsumerConfig{
+		ConsumerName:       "TcrLockedConsumer",
+		QueueName:          "TcrTestQueue",
+		ProcessingDeadline: 60000,
+		ProgressInterval:   10000,
+	}, nil)
+
+	clock := newTimerClock()
+	consumer.SetClock(clock)
+	locks := &leaseLocks{held: make(map[string]bool), lock: &sync.Mutex{}}
+	consumer.SetLeaseLocker(locks)
+
+	replay := func(messageID string, action func(*tcr.ReceivedMessage)) *tcr.ReplayResult {
+		recording := &bytes.Buffer{}
+		assert.NoError(t, tcr.NewDeliveryRecorder(recording).Record(amqp.Delivery{MessageId: messageID}))
+		result, err := consumer.Replay(recording, action)
+		assert.NoError(t, err)
+		return result
+	}
+
+	// the redelivery of a message whose deadline passed is requeued while its lock is held
+	var redelivered *tcr.ReplayResult
+	result := replay("locked", func(msg *tcr.ReceivedMessage) {
+		<-clock.timers
+		clock.Advance(time.Second * 61)
+		<-consumer.Errors() // expired and nacked
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			redelivered = replay("locked", func(*tcr.ReceivedMessage) { t.Error("processed the locked message") })
+		}()
+
+		assert.Equal(t, time.Second*10, <-clock.timers) // waiting before it requeues
+		clock.Advance(time.Second * 10)
+		<-done
+	})
+	assert.Equal(t, []uint64{1}, result.Nacked)
+	assert.Equal(t, []uint64{1}, redelivered.Nacked)
+	assert.Equal(t, []string{"TcrTestQueue/locked"}, locks.unlocked)
+
+	// released, the next redelivery is processed, messages without a MessageID aren't locked
+	processed := 0
+	result = replay("locked", func(msg *tcr.ReceivedMessage) { processed++; assert.NoError(t, msg.Acknowledge()) })
+	assert.Equal(t, []uint64{1}, result.Acked)
+	replay("", func(msg *tcr.ReceivedMessage) { processed++; assert.NoError(t, msg.Acknowledge()) })
+	assert.Equal(t, 2, processed)
+	assert.Len(t, locks.unlocked, 2)
+
+	// a failing locker doesn't keep messages from being processed
+	locks.err = errors.New("broker unreachable")
+	result = replay("unlocked", func(msg *tcr.ReceivedMessage) { processed++; assert.NoError(t, msg.Acknowledge()) })
+	assert.Equal(t, []uint64{1}, result.Acked)
+	assert.ErrorContains(t, <-consumer.Errors(), "broker unreachable")
+	assert.Equal(t, 3, processed)
+}
+
+func TestLatencyHistogramQuantile(t *testing.T) {
+
+	histogram := &tcr.LatencyHistogram{
+		Count: 10,
+		Sum:   time.Millisecond * 100,
+		Max:   time.Second * 3,
+		Buckets: []tcr.LatencyBucket{
+			{UpperBound: time.Millisecond * 5, Count: 8},
+			{UpperBound: time.Millisecond * 50, Count: 1},
+			{Count: 1},
+		},
+	}
+
+	assert.Equal(t, time.Millisecond*10, histogram.Mean())
+	assert.Equal(t, time.Millisecond*5, histogram.Quantile(0.5))
+	assert.Equal(t, time.Millisecond*50, histogram.Quantile(0.85))
+	assert.Equal(t, time.Second*3, histogram.Quantile(0.99))
+	assert.Zero(t, (&tcr.LatencyHistogram{}).Quantile(0.5))
+}
+
+func TestResiliencePolicies(t *testing.T) {
+
+	exponential := &resilience.Exponential{InitialDelay: time.Millisecond * 10, MaxDelay: time.Millisecond * 50, MaxAttempts: 4}
+	for attempt, expected := range []time.Duration{10, 20, 40, 50} {
+		delay, retry := exponential.Backoff(uint32(attempt + 1))
+		assert.True(t, retry)
+		assert.Equal(t, expected*time.Millisecond, delay)
+	}
+	_, retry := exponential.Backoff(5)
+	assert.False(t, retry)
+
+	// RetryPolicy is the config form of the same policy.
+	policy := &tcr.RetryPolicy{InitialDelay: 10, MaxDelay: 50}
+	assert.Equal(t, time.Millisecond*40, policy.Delay(3))
+
+	breaker := resilience.NewCircuitBreaker(&resilience.Constant{Delay: time.Millisecond}, 2, time.Hour)
+	delay, _ := breaker.Backoff(1)
+	assert.Equal(t, time.Millisecond, delay)
+	assert.False(t, breaker.Open())
+
+	delay, _ = breaker.Backoff(2)
+	assert.Greater(t, delay, time.Minute)
+	assert.True(t, breaker.Open())
+
+	breaker.Success()
+	assert.False(t, breaker.Open())
+
+	calls := 0
+	err := resilience.Retry(context.Background(), &resilience.Constant{MaxAttempts: 2}, func() error {
+		calls++
+		return errors.New("unavailable")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 3, calls) // the first attempt and two retries
+}
+
+func TestTypedPublishErrors(t *testing.T) {
+
+	returned := &tcr.ReturnedLetter{Letter: tcr.CreateMockRandomLetter("TcrTestQueue"), ReplyCode: 312, ReplyText: "NO_ROUTE"}
+	assert.ErrorIs(t, returned.Err(), tcr.ErrReturned)
+	assert.Contains(t, returned.Err().Error(), "NO_ROUTE")
+
+	assert.ErrorIs(t, tcr.ErrPublisherClosed, tcr.ErrShutdown)
+	assert.NotErrorIs(t, tcr.ErrQueueFull, tcr.ErrShutdown)
+}
+
+func TestConsumerRestoresClaimCheckedBody(t *testing.T) {
+
+	store, err := tcr.NewFileBlobStore(t.TempDir())
+	assert.NoError(t, err)
+	assert.NoError(t, store.PutBlob("first-key", []byte("first offloaded body")))
+	assert.NoError(t, store.PutBlob("second-key", []byte("second offloaded body")))
+
+	recording := &bytes.Buffer{}
+	recorder := tcr.NewDeliveryRecorder(recording)
+	for _, key := range []string{"first-key", "second-key", "missing-key"} {
+		assert.NoError(t, recorder.Record(amqp.Delivery{
+			MessageId: uuid.Nil.String(), // letters without a LetterID share it, their keys don't
+			Headers:   amqp.Table{tcr.HeaderClaimCheck: key, tcr.HeaderClaimCheckSize: int64(20)},
+			Body:      []byte{},
+		}))
+	}
+	assert.NoError(t, recorder.Close())
+
+	consumer := tcr.NewConsumerFromConfig(&tcr.ConsumerConfig{ConsumerName: "TcrClaimCheckConsumer"}, nil)
+	consumer.SetBlobStore(store)
+
+	bodies := make([]string, 0)
+	result, err := consumer.Replay(recording, func(msg *tcr.ReceivedMessage) {
+		bodies = append(bodies, string(msg.Body))
+		_ = msg.Acknowledge()
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"first offloaded body", "second offloaded body"}, bodies)
+	assert.Equal(t, []uint64{3}, result.Nacked) // its blob is gone
+	assert.Error(t, <-consumer.Errors())
+}
+
+func TestFileBlobStoreStream(t *testing.T) {
+
+	store, err := tcr.NewFileBlobStore(t.TempDir())
+	assert.NoError(t, err)
+
+	body := []byte("a body streamed into the blob store")
+	assert.NoError(t, store.PutBlobStream("streamed", bytes.NewReader(body), int64(len(body))))
+
+	stored, err := store.GetBlob("streamed")
+	assert.NoError(t, err)
+	assert.Equal(t, body, stored)
+
+	assert.Error(t, store.PutBlobStream("short", bytes.NewReader(body), int64(len(body)+1)))
+	assert.Error(t, store.PutBlobStream("long", bytes.NewReader(body), int64(len(body)-1)))
+}
+
+// manualClock only moves when the test advances it.
+type manualClock struct {
+	tcr.SystemClock
+	now time.Time
+}
+
+func (mc *manualClock) Now() time.Time {
+	return mc.now
+}
+
+func TestPublisherDeduplication(t *testing.T) {
+
+	publisher := tcr.NewPublisher(nil, 0, 0, 0)
+	clock := &manualClock{now: time.Now()}
+	publisher.SetClock(clock)
+	publisher.SetDeduplication(&tcr.DeduplicationConfig{Window: 2, TTL: 1000})
+
+	var sent int
+	var failing bool
+	publisher.Use(func(next tcr.PublishFunc) tcr.PublishFunc {
+		return func(letter *tcr.Letter) error {
+			sent++
+			if failing {
+				return errors.New("channel closed")
+			}
+			return nil
+		}
+	})
+
+	letter := tcr.CreateMockRandomLetter("TcrTestQueue")
+	assert.NoError(t, publisher.PublishWithError(letter, true))
+	assert.NoError(t, publisher.PublishWithError(letter, true))
+	assert.Equal(t, 1, sent)
+	assert.Equal(t, uint64(1), publisher.Stats().Deduplicated)
+
+	// the id is remembered for the TTL only
+	clock.now = clock.now.Add(time.Second)
+	assert.NoError(t, publisher.PublishWithError(letter, true))
+	assert.Equal(t, 2, sent)
+
+	// failed publishes may be retried
+	failing = true
+	retried := tcr.CreateMockRandomLetter("TcrTestQueue")
+	assert.Error(t, publisher.PublishWithError(retried, true))
+	failing = false
+	assert.NoError(t, publisher.PublishWithError(retried, true))
+	assert.Equal(t, 4, sent)
+
+	// the window evicts the least recently seen ids
+	assert.NoError(t, publisher.PublishWithError(tcr.CreateMockRandomLetter("TcrTestQueue"), true))
+	assert.NoError(t, publisher.PublishWithError(tcr.CreateMockRandomLetter("TcrTestQueue"), true))
+	assert.NoError(t, publisher.PublishWithError(retried, true))
+	assert.Equal(t, 7, sent)
+
+	publisher.SetDeduplication(nil)
+	assert.NoError(t, publisher.PublishWithError(retried, true))
+	assert.Equal(t, 8, sent)
+}
+
+func TestPublisherDeduplicationInFlight(t *testing.T) {
+
+	publisher := tcr.NewPublisher(nil, 0, 0, 0)
+	publisher.SetDeduplication(&tcr.DeduplicationConfig{})
+
+	entered := make(chan struct{}, 10)
+	outcomes := make(chan error)
+	publisher.Use(func(next tcr.PublishFunc) tcr.PublishFunc {
+		return func(letter *tcr.Letter) error {
+			entered <- struct{}{}
+			return <-outcomes
+		}
+	})
+
+	letter := tcr.CreateMockRandomLetter("TcrTestQueue")
+	publish := func(ctx context.Context) <-chan error {
+		done := make(chan error, 1)
+		go func() { done <- publisher.PublishWithContext(ctx, letter) }()
+		return done
+	}
+
+	// the duplicate waits for the first publish, which fails, and publishes in its place
+	first := publish(context.Background())
+	<-entered
+	duplicate := publish(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	impatient := publish(ctx)
+	cancel()
+	assert.ErrorIs(t, <-impatient, context.Canceled)
+
+	outcomes <- errors.New("channel closed")
+	assert.Error(t, <-first)
+	<-entered
+	assert.Empty(t, entered) // only one of them republished
+
+	// succeeded, the duplicates waiting meanwhile are skipped
+	third := publish(context.Background())
+	outcomes <- nil
+	assert.NoError(t, <-duplicate)
+	assert.NoError(t, <-third)
+	assert.NoError(t, <-publish(context.Background()))
+	assert.Empty(t, entered)
+	assert.Equal(t, uint64(2), publisher.Stats().Deduplicated)
+}
+
+func TestFormatBody(t *testing.T) {
+
+	assert.Equal(t, "{\n  \"z\": 1.50,\n  \"a\": [\n    12345678901234567890\n  ]\n}", tcr.FormatBody([]byte(`{"z":1.50,"a":[12345678901234567890]}`)))
+	assert.Equal(t, "not json, but text", tcr.FormatBody([]byte("not json, but text")))
+	assert.Contains(t, tcr.FormatBody([]byte{0x00, 0x01, 0xFF}), "00 01 ff")
+}
+
+func TestFileOutbox(t *testing.T) {
+
+	outbox, err := tcr.NewFileOutbox(t.TempDir())
+	assert.NoError(t, err)
+
+	publisher := tcr.NewPublisher(nil, 0, 0, 0)
+
+	letters, err := outbox.LoadLetters(publisher.Name)
+	assert.NoError(t, err)
+	assert.Empty(t, letters)
+
+	first := tcr.CreateMockRandomLetter("TcrTestQueue")
+	first.Envelope.Headers = amqp.Table{"x-test": "header"}
+	second := tcr.CreateMockRandomLetter("TcrTestQueue")
+	assert.NoError(t, outbox.SaveLetter(publisher.Name, first))
+	assert.NoError(t, outbox.SaveLetter(publisher.Name, second))
+
+	letters, err = outbox.LoadLetters(publisher.Name)
+	assert.NoError(t, err)
+	assert.Len(t, letters, 2)
+	assert.Equal(t, first.LetterID, letters[0].LetterID)
+	assert.Equal(t, first.Body, letters[0].Body)
+	assert.Equal(t, "header", letters[0].Envelope.Headers["x-test"])
+
+	assert.NoError(t, outbox.DeleteLetter(publisher.Name, first.LetterID))
+	assert.NoError(t, outbox.DeleteLetter(publisher.Name, first.LetterID)) // already gone
+
+	// a restarted publisher replays what is left and persists what it queues
+	replayed, err := publisher.SetOutbox(outbox)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, replayed)
+	assert.Equal(t, 1, publisher.Stats().QueueDepth)
+
+	assert.True(t, publisher.QueueLetter(&tcr.Letter{Body: []byte("queued"), Envelope: second.Envelope}))
+	letters, err = outbox.LoadLetters(publisher.Name)
+	assert.NoError(t, err)
+	assert.Len(t, letters, 2)
+	assert.Equal(t, "queued", string(letters[1].Body))
+}
+
+func TestFileOutboxSaveOrder(t *testing.T) {
+
+	directory := t.TempDir()
+	outbox, err := tcr.NewFileOutbox(directory)
+	assert.NoError(t, err)
+
+	// saved within the same tick and in the reverse order of their LetterIDs
+	saved := make([]uuid.UUID, 0)
+	for i := 0; i < 50; i++ {
+		letter := tcr.CreateMockRandomLetter("TcrTestQueue")
+		letter.LetterID = uuid.UUID{15: byte(200 - i)}
+		assert.NoError(t, outbox.SaveLetter("Outboxed", letter))
+		saved = append(saved, letter.LetterID)
+	}
+
+	// saving a letter again keeps its place, a reopened outbox saves after what it holds
+	resaved := tcr.CreateMockRandomLetter("TcrTestQueue")
+	resaved.LetterID = saved[0]
+	resaved.Body = []byte("resaved")
+	assert.NoError(t, outbox.SaveLetter("Outboxed", resaved))
+	assert.NoError(t, outbox.DeleteLetter("Outboxed", saved[1]))
+	saved = append(saved[:1], saved[2:]...)
+
+	outbox, err = tcr.NewFileOutbox(directory)
+	assert.NoError(t, err)
+	last := tcr.CreateMockRandomLetter("TcrTestQueue")
+	last.LetterID = uuid.UUID{15: 1}
+	assert.NoError(t, outbox.SaveLetter("Outboxed", last))
+	saved = append(saved, last.LetterID)
+
+	letters, err := outbox.LoadLetters("Outboxed")
+	assert.NoError(t, err)
+
+	loaded := make([]uuid.UUID, 0, len(letters))
+	for _, letter := range letters {
+		loaded = append(loaded, letter.LetterID)
+	}
+	assert.Equal(t, saved, loaded)
+	assert.Equal(t, "resaved", string(letters[0].Body))
+}
+
+func TestParseDeaths(t *testing.T) {
+
+	died := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	delivery := &amqp.Delivery{
+		Headers: amqp.Table{
+			"x-death": []interface{}{
+				amqp.Table{"queue": "retry", "reason": "expired", "count": int64(1), "exchange": "", "routing-keys": []interface{}{"retry"}, "time": died},
+				amqp.Table{"queue": "orders", "reason": "rejected", "count": int64(3), "exchange": "shop", "routing-keys": []interface{}{"orders.created"}, "time": died},
+			},
+		},
+	}
+
+	deaths := tcr.ParseDeaths(delivery)
+	assert.Len(t, deaths, 2)
+	assert.Equal(t, "orders", deaths[1].Queue)
+	assert.Equal(t, "rejected", deaths[1].Reason)
+	assert.Equal(t, int64(3), deaths[1].Count)
+	assert.Equal(t, []string{"orders.created"}, deaths[1].RoutingKeys)
+	assert.Equal(t, died, deaths[1].Time)
+
+	assert.Nil(t, tcr.ParseDeaths(&amqp.Delivery{}))
+}
+
+func TestPublisherStrictTopology(t *testing.T) {
+
+	publisher := tcr.NewPublisher(nil, 0, 0, 0)
+	publisher.SetStrictTopology("", &tcr.TopologyConfig{
+		Exchanges: []*tcr.Exchange{{Name: "orders"}, {Name: "payments"}},
+	})
+
+	err := publisher.PublishWithError(tcr.CreateMockLetter("ordres", "created", nil), true)
+	assert.ErrorIs(t, err, tcr.ErrExchangeNotDeclared)
+	assert.Contains(t, err.Error(), `did you mean "orders"`)
+
+	err = publisher.PublishWithError(tcr.CreateMockLetter("inventory", "created", nil), true)
+	assert.ErrorIs(t, err, tcr.ErrExchangeNotDeclared)
+	assert.NotContains(t, err.Error(), "did you mean")
+
+	// letters to other pools aren't restricted by this topology (the publisher has no such pool)
+	letter := tcr.CreateMockLetter("inventory", "created", nil)
+	letter.Envelope.Pool = "secondary"
+	err = publisher.PublishWithError(letter, true)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, tcr.ErrExchangeNotDeclared)
+
+	publisher.SetStrictTopology("secondary", &tcr.TopologyConfig{})
+	assert.ErrorIs(t, publisher.PublishWithError(letter, true), tcr.ErrExchangeNotDeclared)
+
+	publisher.SetStrictTopology("secondary", nil)
+	assert.NotErrorIs(t, publisher.PublishWithError(letter, true), tcr.ErrExchangeNotDeclared)
+}
+
+func TestFileWatermarkStore(t *testing.T) {
+
+	directory := t.TempDir()
+	store, err := tcr.NewFileWatermarkStore(directory)
+	assert.NoError(t, err)
+
+	mark, err := store.LoadWatermark("TcrTestQueue", "order-1")
+	assert.NoError(t, err)
+	assert.Zero(t, mark)
+
+	assert.NoError(t, store.SaveWatermark("TcrTestQueue", "order-1", 7))
+	assert.NoError(t, store.SaveWatermark("TcrTestQueue", "order-2", 3))
+	assert.NoError(t, store.SaveWatermark("OtherQueue", "order-1", 1))
+
+	// a restarted consumer reads the marks back from disk
+	store, err = tcr.NewFileWatermarkStore(directory)
+	assert.NoError(t, err)
+
+	mark, err = store.LoadWatermark("TcrTestQueue", "order-1")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(7), mark)
+
+	mark, err = store.LoadWatermark("TcrTestQueue", "order-2")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), mark)
+
+	mark, err = store.LoadWatermark("OtherQueue", "order-1")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), mark)
+
+	letter := tcr.CreateMockLetter("", "TcrTestQueue", nil)
+	tcr.StampWatermark(letter, "order-1", 8)
+	assert.Equal(t, "order-1", letter.Envelope.Headers[tcr.HeaderWatermarkKey])
+	assert.Equal(t, int64(8), letter.Envelope.Headers[tcr.HeaderWatermarkSequence])
+}
+
+// memoryWatermarkStore keeps marks in memory and counts the loads.
+type memoryWatermarkStore struct {
+	marks map[string]uint64
+	loads int
+}
+
+func (store *memoryWatermarkStore) SaveWatermark(queueName string, key string, sequence uint64) error {
+	store.marks[queueName+"/"+key] = sequence
+	return nil
+}
+
+func (store *memoryWatermarkStore) LoadWatermark(queueName string, key string) (uint64, error) {
+	store.loads++
+	return store.marks[queueName+"/"+key], nil
+}
+
+// recordWatermarked records a delivery of the key at the sequence, as a string since the recording is JSON.
+func recordWatermarked(t *testing.T, recorder *tcr.DeliveryRecorder, key string, sequence uint64) {
+	assert.NoError(t, recorder.Record(amqp.Delivery{
+		Headers: amqp.Table{tcr.HeaderWatermarkKey: key, tcr.HeaderWatermarkSequence: fmt.Sprint(sequence)},
+	}))
+}
+
+func TestWatermarksOutOfOrderAcks(t *testing.T) {
+
+	consumer := tcr.NewConsumerFromConfig(&tcr.ConsumerConfig{ConsumerName: "TcrWatermarkConsumer", QueueName: "TcrTestQueue"}, nil)
+	store := &memoryWatermarkStore{marks: make(map[string]uint64)}
+	consumer.SetWatermarkStore(store)
+
+	recording := &bytes.Buffer{}
+	recorder := tcr.NewDeliveryRecorder(recording)
+	for sequence := uint64(1); sequence <= 7; sequence++ {
+		recordWatermarked(t, recorder, "order-1", sequence)
+	}
+
+	var slow *tcr.ReceivedMessage
+	_, err := consumer.Replay(recording, func(msg *tcr.ReceivedMessage) {
+		switch msg.Delivery.Headers[tcr.HeaderWatermarkSequence] {
+		case "1":
+			slow = msg // another worker is still busy with it
+		case "4":
+			assert.NoError(t, msg.Reject(false)) // dead lettered, never comes back
+		case "6":
+			assert.NoError(t, msg.Nack(true)) // requeued, comes back
+		default:
+			assert.NoError(t, msg.Acknowledge())
+		}
+	})
+	assert.NoError(t, err)
+	assert.Zero(t, store.marks["TcrTestQueue/order-1"]) // 2, 3 and 5 are acked but 1 is still processed
+
+	assert.NoError(t, slow.Acknowledge())
+	assert.Equal(t, uint64(5), store.marks["TcrTestQueue/order-1"]) // up to the requeued 6, passing the rejected 4
+
+	// the redelivery of 6 is processed, 7 was acked already and 5 is below the mark
+	recording.Reset()
+	recorder = tcr.NewDeliveryRecorder(recording)
+	recordWatermarked(t, recorder, "order-1", 5)
+	recordWatermarked(t, recorder, "order-1", 6)
+	recordWatermarked(t, recorder, "order-1", 7)
+	processed := make([]interface{}, 0)
+	result, err := consumer.Replay(recording, func(msg *tcr.ReceivedMessage) {
+		processed = append(processed, msg.Delivery.Headers[tcr.HeaderWatermarkSequence])
+		assert.NoError(t, msg.Acknowledge())
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"6"}, processed)
+	assert.Len(t, result.Acked, 3)
+	assert.Equal(t, uint64(7), store.marks["TcrTestQueue/order-1"])
+}
+
+func TestWatermarksSequenceZero(t *testing.T) {
+
+	consumer := tcr.NewConsumerFromConfig(&tcr.ConsumerConfig{ConsumerName: "TcrWatermarkZeroConsumer", QueueName: "TcrTestQueue"}, nil)
+	store := &memoryWatermarkStore{marks: make(map[string]uint64)}
+	consumer.SetWatermarkStore(store)
+
+	processed := make([]interface{}, 0)
+	replay := func(sequences ...uint64) *tcr.ReplayResult {
+		recording := &bytes.Buffer{}
+		recorder := tcr.NewDeliveryRecorder(recording)
+		for _, sequence := range sequences {
+			recordWatermarked(t, recorder, "order-0", sequence)
+		}
+
+		result, err := consumer.Replay(recording, func(msg *tcr.ReceivedMessage) {
+			processed = append(processed, msg.Delivery.Headers[tcr.HeaderWatermarkSequence])
+			assert.NoError(t, msg.Acknowledge())
+		})
+		assert.NoError(t, err)
+		return result
+	}
+
+	// the first message of a key nothing was saved of is processed, its redelivery skipped
+	assert.Len(t, replay(0, 0, 1).Acked, 3)
+	assert.Equal(t, []interface{}{"0", "1"}, processed)
+	assert.Equal(t, uint64(1), store.marks["TcrTestQueue/order-0"])
+}
+
+func TestWatermarksCacheEviction(t *testing.T) {
+
+	consumer := tcr.NewConsumerFromConfig(&tcr.ConsumerConfig{ConsumerName: "TcrWatermarkCacheConsumer", QueueName: "TcrTestQueue"}, nil)
+	store := &memoryWatermarkStore{marks: make(map[string]uint64)}
+	consumer.SetWatermarkStore(store)
+
+	recording := &bytes.Buffer{}
+	recorder := tcr.NewDeliveryRecorder(recording)
+	for i := 0; i <= tcr.DefaultWatermarkCacheSize; i++ {
+		recordWatermarked(t, recorder, fmt.Sprintf("order-%d", i), 1)
+	}
+
+	_, err := consumer.Replay(recording, func(msg *tcr.ReceivedMessage) { assert.NoError(t, msg.Acknowledge()) })
+	assert.NoError(t, err)
+	assert.Equal(t, tcr.DefaultWatermarkCacheSize+1, store.loads)
+
+	// order-0 was evicted, its mark is read back from the store and the redelivery still skipped
+	recording.Reset()
+	recorder = tcr.NewDeliveryRecorder(recording)
+	recordWatermarked(t, recorder, "order-0", 1)
+	recordWatermarked(t, recorder, fmt.Sprintf("order-%d", tcr.DefaultWatermarkCacheSize), 1)
+	processed := 0
+	result, err := consumer.Replay(recording, func(msg *tcr.ReceivedMessage) { processed++ })
+	assert.NoError(t, err)
+	assert.Zero(t, processed)
+	assert.Len(t, result.Acked, 2)
+	assert.Equal(t, tcr.DefaultWatermarkCacheSize+2, store.loads) // the most recent key stayed cached
+}
+
+func TestDeliveryCount(t *testing.T) {
+
+	for count, expected := range map[interface{}]int64{
+		int64(3):               3,
+		int32(4):               4,
+		int16(5):               5,
+		int8(6):                6,
+		int(7):                 7,
+		uint64(8):              8,
+		uint32(9):              9,
+		uint16(10):             10,
+		uint8(11):              11,
+		float64(12):            12,
+		float32(13):            13,
+		"14":                   14,
+		uint64(math.MaxUint64): math.MaxInt64,
+		"fifteen":              1, // unreadable, a redelivery all the same
+		true:                   1,
+	} {
+		msg := tcr.NewReceivedMessage(true, amqp.Delivery{Redelivered: true, Headers: amqp.Table{tcr.HeaderDeliveryCount: count}})
+		assert.Equal(t, expected, msg.DeliveryCount, "%T %v", count, count)
+	}
+
+	assert.Equal(t, int64(1), tcr.NewReceivedMessage(true, amqp.Delivery{Redelivered: true}).DeliveryCount)
+	assert.Zero(t, tcr.NewReceivedMessage(true, amqp.Delivery{}).DeliveryCount)
+}
+
+func TestConsumerPoisonMessages(t *testing.T) {
+
+	consumer := tcr.NewConsumerFromConfig(&tcr.ConsumerConfig{
+		ConsumerName:        "TcrPoisonConsumer",
+		PoisonMessageConfig: &tcr.PoisonMessageConfig{Enabled: true, MaxDeliveryCount: 2},
+	}, nil)
+
+	poisoned := make([]*tcr.ReceivedMessage, 0)
+	consumer.SetPoisonMessageHandler(func(msg *tcr.ReceivedMessage) { poisoned = append(poisoned, msg) })
+
+	// the counts are float64 once recorded as JSON
+	recording := &bytes.Buffer{}
+	recorder := tcr.NewDeliveryRecorder(recording)
+	for count := int64(1); count <= 3; count++ {
+		assert.NoError(t, recorder.Record(amqp.Delivery{Redelivered: true, Headers: amqp.Table{tcr.HeaderDeliveryCount: count}}))
+	}
+
+	processed := make([]int64, 0)
+	result, err := consumer.Replay(recording, func(msg *tcr.ReceivedMessage) {
+		processed = append(processed, msg.DeliveryCount)
+		assert.NoError(t, msg.Acknowledge())
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{1, 2}, processed)
+	assert.Equal(t, []uint64{3}, result.Rejected)
+	if assert.Len(t, poisoned, 1) {
+		assert.Equal(t, int64(3), poisoned[0].DeliveryCount)
+	}
+	assert.ErrorContains(t, <-consumer.Errors(), "poison message (delivery count: 3)")
+}
+
+func TestMirrorConsumerRequeuedCopies(t *testing.T) {
+
+	primary := tcr.NewConsumerFromConfig(&tcr.ConsumerConfig{ConsumerName: "TcrMirrorPrimary", QueueName: "TcrTestQueue"}, nil)
+	secondary := tcr.NewConsumerFromConfig(&tcr.ConsumerConfig{ConsumerName: "TcrMirrorSecondary", QueueName: "TcrTestQueue"}, nil)
+	mirror, err := tcr.NewMirrorConsumer(100, primary, secondary)
+	assert.NoError(t, err)
+
+	deliveries := 0
+	settle := func(msg *tcr.ReceivedMessage) error { return msg.Acknowledge() }
+	handler := mirror.Handler(func(msg *tcr.ReceivedMessage) {
+		deliveries++
+		assert.NoError(t, settle(msg))
+	})
+
+	replay := func(con *tcr.Consumer) *tcr.ReplayResult {
+		recording := &bytes.Buffer{}
+		assert.NoError(t, tcr.NewDeliveryRecorder(recording).Record(amqp.Delivery{MessageId: "mirrored"}))
+		result, err := con.Replay(recording, handler)
+		assert.NoError(t, err)
+		return result
+	}
+
+	// the first delivery is requeued, its redelivery and the mirrored copy reach the action again
+	settle = func(msg *tcr.ReceivedMessage) error { return msg.Nack(true) }
+	assert.Len(t, replay(primary).Nacked, 1)
+	settle = func(msg *tcr.ReceivedMessage) error { return msg.Reject(false) }
+	assert.Len(t, replay(primary).Rejected, 1)
+	settle = func(msg *tcr.ReceivedMessage) error { return msg.Acknowledge() }
+	assert.Len(t, replay(secondary).Acked, 1)
+	assert.Equal(t, 3, deliveries)
+
+	// acknowledged, later copies are dropped until forgotten
+	assert.Len(t, replay(primary).Acked, 1)
+	assert.Equal(t, 3, deliveries)
+	mirror.Forget("mirrored")
+	replay(primary)
+	assert.Equal(t, 4, deliveries)
+
+	// a copy arriving while another is processed is requeued
+	var held *tcr.ReceivedMessage
+	var copied *tcr.ReplayResult
+	settle = func(msg *tcr.ReceivedMessage) error {
+		held = msg
+		copied = replay(secondary)
+		return nil
+	}
+	mirror.Forget("mirrored")
+	replay(primary)
+	assert.Equal(t, 5, deliveries)
+	assert.Len(t, copied.Nacked, 1)
+	assert.NoError(t, held.Acknowledge())
+}
+
+func TestSizeHistogramQuantile(t *testing.T) {
+
+	histogram := &tcr.SizeHistogram{
+		Count: 100,
+		Max:   3000,
+		Buckets: []tcr.SizeBucket{
+			{UpperBound: 1000, Count: 90},
+			{UpperBound: 4000, Count: 10},
+			{UpperBound: 0},
+		},
+	}
+
+	assert.Equal(t, 500, histogram.Quantile(0.45))
+	assert.Equal(t, 1000, histogram.Quantile(0.9))
+	assert.Equal(t, 2800, histogram.Quantile(0.99)) // interpolated up to Max, not the bucket's bound
+	assert.Equal(t, 3000, histogram.Quantile(1))
+	assert.Zero(t, (&tcr.SizeHistogram{}).Quantile(0.99))
+}
+
+func TestConsumerEndToEndLatency(t *testing.T) {
+
+	consumer := tcr.NewConsumerFromConfig(&tcr.ConsumerConfig{
+		ConsumerName: "TcrLatencyConsumer",
+		MaxClockSkew: 500,
+	}, nil)
+
+	now := time.UnixMilli(time.Now().UnixMilli()) // the stamps are ms
+	consumer.SetClock(&fakeClock{now: now, lock: &sync.Mutex{}})
+
+	recording := &bytes.Buffer{}
+	recorder := tcr.NewDeliveryRecorder(recording)
+	for _, headers := range []amqp.Table{
+		{tcr.HeaderPublishedAt: now.Add(-time.Millisecond * 40).UnixMilli()},
+		{tcr.HeaderPublishedAt: now.Add(-time.Hour).UnixMilli(), tcr.HeaderBrokerTimestamp: now.Add(-time.Millisecond * 20).UnixMilli()},
+		{tcr.HeaderPublishedAt: now.Add(time.Millisecond * 200).UnixMilli()}, // within the skew, measured as zero
+		{tcr.HeaderPublishedAt: now.Add(time.Second * 5).UnixMilli()},        // beyond the skew, dropped
+		nil,
+	} {
+		assert.NoError(t, recorder.Record(amqp.Delivery{Headers: headers}))
+	}
+
+	_, err := consumer.Replay(recording, func(msg *tcr.ReceivedMessage) {})
+	assert.NoError(t, err)
+
+	latency := consumer.EndToEndLatency()
+	assert.Equal(t, uint64(3), latency.Latency.Count)
+	assert.Equal(t, uint64(1), latency.BrokerStamped)
+	assert.Equal(t, uint64(2), latency.PublisherStamped)
+	assert.Equal(t, uint64(1), latency.Skewed)
+	assert.Equal(t, time.Millisecond*40, latency.Latency.Max)
+	assert.Equal(t, time.Millisecond*60, latency.Latency.Sum)
+}
+
+// listenStatsD starts a UDP listener standing in for the StatsD agent.
+func listenStatsD(t *testing.T) net.PacketConn {
+
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return listener
+}
+
+// readStatsD returns the lines of the next packet the agent receives, nil if none arrives in time.
+func readStatsD(listener net.PacketConn) []string {
+
+	_ = listener.SetReadDeadline(time.Now().Add(time.Second * 2))
+
+	packet := make([]byte, 65536)
+	n, _, err := listener.ReadFrom(packet)
+	if err != nil {
+		return nil
+	}
+
+	return strings.Split(string(packet[:n]), "\n")
+}
+
+func TestStatsDEmitter(t *testing.T) {
+
+	_, err := tcr.NewStatsDEmitter(nil)
+	assert.Error(t, err)
+
+	consumer := tcr.NewConsumerFromConfig(&tcr.ConsumerConfig{ConsumerName: "TcrStatsDConsumer"}, nil)
+	now := time.UnixMilli(time.Now().UnixMilli())
+	consumer.SetClock(&fakeClock{now: now, lock: &sync.Mutex{}})
+
+	recording := &bytes.Buffer{}
+	recorder := tcr.NewDeliveryRecorder(recording)
+	assert.NoError(t, recorder.Record(amqp.Delivery{Headers: amqp.Table{tcr.HeaderPublishedAt: now.Add(-time.Millisecond * 40).UnixMilli()}}))
+	_, err = consumer.Replay(recording, func(msg *tcr.ReceivedMessage) {})
+	assert.NoError(t, err)
+
+	listener := listenStatsD(t)
+	defer listener.Close()
+
+	emitter, err := tcr.NewStatsDEmitter(&tcr.StatsDConfig{
+		Address:   listener.LocalAddr().String(),
+		Prefix:    "myservice.rabbit.", // the trailing dot is trimmed
+		Tags:      map[string]string{"env": "test", "canary": ""},
+		DogStatsD: true,
+	})
+	assert.NoError(t, err)
+	emitter.AddConsumer("TcrStatsDConsumer", consumer)
+	emitter.Emit()
+
+	lines := readStatsD(listener)
+	if assert.Len(t, lines, 6) {
+		assert.Equal(t, "myservice.rabbit.consumer.TcrStatsDConsumer.latency.count:1|g|#canary,env:test", lines[0])
+		assert.Equal(t, "myservice.rabbit.consumer.TcrStatsDConsumer.latency.mean_ms:40|g|#canary,env:test", lines[1])
+		assert.True(t, strings.HasPrefix(lines[2], "myservice.rabbit.consumer.TcrStatsDConsumer.latency.p50_ms:"))
+		assert.True(t, strings.HasPrefix(lines[3], "myservice.rabbit.consumer.TcrStatsDConsumer.latency.p99_ms:"))
+		assert.Equal(t, "myservice.rabbit.consumer.TcrStatsDConsumer.latency.max_ms:40|g|#canary,env:test", lines[4])
+		assert.Equal(t, "myservice.rabbit.consumer.TcrStatsDConsumer.latency.skewed:0|g|#canary,env:test", lines[5])
+		for _, line := range lines {
+			assert.True(t, strings.HasSuffix(line, "|g|#canary,env:test"), line)
+		}
+	}
+	emitter.Stop()
+
+	// plain StatsD has no tags and the interval pushes on its own
+	emitter, err = tcr.NewStatsDEmitter(&tcr.StatsDConfig{
+		Address:  listener.LocalAddr().String(),
+		Tags:     map[string]string{"env": "test"},
+		Interval: 20,
+	})
+	assert.NoError(t, err)
+	emitter.AddConsumer("TcrStatsDConsumer", consumer)
+	emitter.Start()
+
+	lines = readStatsD(listener)
+	if assert.Len(t, lines, 6) {
+		assert.Equal(t, "consumer.TcrStatsDConsumer.latency.count:1|g", lines[0])
+	}
+	emitter.Stop()
+}
+
+func TestStreamQueue(t *testing.T) {
+
+	queue := tcr.StreamQueue("TcrTestStream", "7D", 20_000_000_000, 0)
+	assert.Equal(t, tcr.QueueTypeStream, queue.Type)
+	assert.True(t, queue.Durable)
+	assert.Equal(t, amqp.Table{
+		"x-queue-type":       tcr.QueueTypeStream,
+		"x-max-age":          "7D",
+		"x-max-length-bytes": int64(20_000_000_000),
+	}, queue.Args)
+
+	letter := tcr.CreateMockRandomLetter("TcrTestStream")
+	tcr.StampStreamFilter(letter, "eu")
+	assert.Equal(t, "eu", letter.Envelope.Headers[tcr.HeaderStreamFilterValue])
+}
+
+func TestPublisherIntrospection(t *testing.T) {
+
+	publisher := tcr.NewPublisher(nil, 0, 0, 0)
+	defer tcr.UnregisterPublisher(publisher.Name)
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	publisher.Use(func(next tcr.PublishFunc) tcr.PublishFunc {
+		return func(letter *tcr.Letter) error {
+			close(entered)
+			<-release
+			return errors.New("broker unavailable")
+		}
+	})
+
+	assert.Nil(t, publisher.LastError())
+	assert.False(t, publisher.IsAutoPublishing())
+	assert.Equal(t, 0, publisher.QueueDepth())
+
+	letter := tcr.CreateMockLetter("", "TcrTestQueue", nil)
+	done := make(chan error)
+	go func() { done <- publisher.PublishWithError(letter, true) }()
+
+	<-entered
+	assert.Equal(t, 1, publisher.InFlightCount())
+	close(release)
+	assert.Error(t, <-done)
+
+	assert.Equal(t, 0, publisher.InFlightCount())
+	lastError := publisher.LastError()
+	assert.NotNil(t, lastError)
+	assert.Equal(t, letter.LetterID, lastError.LetterID)
+	assert.EqualError(t, lastError.Err, "broker unavailable")
+
+	assert.True(t, publisher.QueueLetter(tcr.CreateMockLetter("", "TcrTestQueue", nil)))
+	assert.Equal(t, 1, publisher.QueueDepth())
+}
+
+func TestPublishAsync(t *testing.T) {
+
+	publisher := tcr.NewPublisher(nil, 0, 0, 0)
+	defer tcr.UnregisterPublisher(publisher.Name)
+
+	release := make(chan struct{})
+	publisher.Use(func(next tcr.PublishFunc) tcr.PublishFunc {
+		return func(letter *tcr.Letter) error {
+			<-release
+			return fmt.Errorf("LetterID: %s refused", letter.LetterID.String())
+		}
+	})
+
+	letter := tcr.CreateMockLetter("", "TcrTestQueue", nil)
+	result := publisher.PublishAsync(letter)
+	assert.Equal(t, letter.LetterID, result.LetterID)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, result.Wait(ctx), context.Canceled)
+	assert.Nil(t, result.Err())
+
+	close(release)
+	err := result.Wait(context.Background())
+	assert.EqualError(t, err, fmt.Sprintf("LetterID: %s refused", letter.LetterID.String()))
+	<-result.Done()
+	assert.Equal(t, err, result.Err())
+}
+
+// laneAcknowledger records the nacks of lane messages.
+type laneAcknowledger struct {
+	lock   sync.Mutex
+	nacked []uint64
+}
+
+func (la *laneAcknowledger) Ack(tag uint64, multiple bool) error { return nil }
+
+func (la *laneAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	la.lock.Lock()
+	defer la.lock.Unlock()
+
+	la.nacked = append(la.nacked, tag)
+	return nil
+}
+
+func (la *laneAcknowledger) Reject(tag uint64, requeue bool) error { return nil }
+
+func TestPriorityLanesWeightedOrder(t *testing.T) {
+
+	high := &tcr.ConsumerLane{Weight: 3}
+	low := &tcr.ConsumerLane{Weight: 1}
+	lanes, err := tcr.NewPriorityLanes(1, high, low)
+	assert.NoError(t, err)
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	order := make(chan string, 9)
+	lanes.StartConsumingWithAction(func(msg *tcr.ReceivedMessage) {
+		if msg.MessageID == "gate" {
+			close(entered)
+			<-release
+			return
+		}
+		order <- msg.MessageID
+	})
+
+	// hold the only worker so both lanes fill up
+	lanes.LaneAction(high)(tcr.NewReceivedMessage(false, amqp.Delivery{MessageId: "gate"}))
+	<-entered
+	for i := 0; i < 4; i++ {
+		lanes.LaneAction(high)(tcr.NewReceivedMessage(false, amqp.Delivery{MessageId: "high"}))
+		lanes.LaneAction(low)(tcr.NewReceivedMessage(false, amqp.Delivery{MessageId: "low"}))
+	}
+	close(release)
+
+	assert.NoError(t, lanes.StopConsuming(false)) // dispatches the buffered messages first
+	close(order)
+
+	dispatched := make([]string, 0, 8)
+	for messageID := range order {
+		dispatched = append(dispatched, messageID)
+	}
+	assert.Equal(t, []string{"high", "high", "low", "high", "high", "low", "low", "low"}, dispatched)
+	assert.Nil(t, lanes.LaneAction(&tcr.ConsumerLane{}))
+}
+
+func TestPriorityLanesStop(t *testing.T) {
+
+	lane := &tcr.ConsumerLane{Weight: 1}
+	lanes, err := tcr.NewPriorityLanes(1, lane)
+	assert.NoError(t, err)
+
+	acknowledger := &laneAcknowledger{}
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	acted := make(chan string, 4)
+	lanes.StartConsumingWithAction(func(msg *tcr.ReceivedMessage) {
+		if msg.MessageID == "gate" {
+			close(entered)
+			<-release
+		}
+		acted <- msg.MessageID
+	})
+
+	feed := lanes.LaneAction(lane)
+	feed(tcr.NewReceivedMessage(true, amqp.Delivery{MessageId: "gate", DeliveryTag: 1, Acknowledger: acknowledger}))
+	<-entered
+	feed(tcr.NewReceivedMessage(true, amqp.Delivery{MessageId: "buffered", DeliveryTag: 2, Acknowledger: acknowledger}))
+
+	stopped := make(chan error)
+	go func() { stopped <- lanes.StopConsuming(true) }()
+
+	// the immediate stop nacks the buffered message while the gate is still being processed
+	assert.Eventually(t, func() bool {
+		acknowledger.lock.Lock()
+		defer acknowledger.lock.Unlock()
+		return len(acknowledger.nacked) == 1
+	}, time.Second, time.Millisecond)
+
+	close(release)
+	assert.NoError(t, <-stopped)
+	assert.Error(t, lanes.StopConsuming(false))
+
+	// a late delivery is nacked, or run right away when it can't be nacked, never left in the buffer
+	feed(tcr.NewReceivedMessage(true, amqp.Delivery{MessageId: "late", DeliveryTag: 3, Acknowledger: acknowledger}))
+	feed(tcr.NewReceivedMessage(false, amqp.Delivery{MessageId: "late-noack"}))
+
+	assert.Equal(t, []uint64{2, 3}, acknowledger.nacked)
+	assert.Equal(t, "gate", <-acted)
+	assert.Equal(t, "late-noack", <-acted)
+	assert.Empty(t, acted)
+}
+
+func TestConsumerRegistryNames(t *testing.T) {
+
+	first := tcr.NewConsumerFromConfig(&tcr.ConsumerConfig{ConsumerName: "TcrRegistryConsumer"}, nil)
+	second := tcr.NewConsumerFromConfig(&tcr.ConsumerConfig{ConsumerName: "TcrRegistryConsumer"}, nil)
+	defer tcr.UnregisterConsumer("TcrRegistryConsumer")
+	defer tcr.UnregisterConsumer("TcrRegistryConsumer-2")
+
+	_, ok := tcr.GetRegisteredConsumer("TcrRegistryConsumer")
+	assert.False(t, ok) // not until started or registered
+
+	assert.NoError(t, tcr.RegisterConsumer(first))
+	assert.NoError(t, tcr.RegisterConsumer(first)) // again, a no-op
+	assert.ErrorIs(t, tcr.RegisterConsumer(second), tcr.ErrNameRegistered)
+
+	registered, ok := tcr.GetRegisteredConsumer("TcrRegistryConsumer")
+	assert.True(t, ok)
+	assert.Equal(t, first, registered)
+
+	second.ConsumerName = "TcrRegistryConsumer-2"
+	assert.NoError(t, tcr.RegisterConsumer(second))
+	first.ConsumerName = "TcrRegistryConsumer-2"
+	assert.ErrorIs(t, tcr.RegisterConsumer(first), tcr.ErrNameRegistered)
+	first.ConsumerName = "TcrRegistryConsumer-1"
+	assert.NoError(t, tcr.RegisterConsumer(first)) // renamed, it moves
+	defer tcr.UnregisterConsumer("TcrRegistryConsumer-1")
+
+	assert.NotContains(t, tcr.ConsumerNames(), "TcrRegistryConsumer")
+	registered, ok = tcr.GetRegisteredConsumer("TcrRegistryConsumer-2")
+	assert.True(t, ok)
+	assert.Equal(t, second, registered)
+}
+
+// writeCertificate writes a fresh self-signed certificate and its key to the files and returns the DER bytes.
+func writeCertificate(t *testing.T, certFile, keyFile string, serial int64) []byte {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "tcr-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(crand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return der
+}
+
+func TestTLSReloader(t *testing.T) {
+
+	dir := t.TempDir()
+	config := &tcr.TLSConfig{
+		EnableTLS:         true,
+		PEMCertLocation:   filepath.Join(dir, "ca.pem"),
+		LocalCertLocation: filepath.Join(dir, "cert.pem"),
+		LocalKeyLocation:  filepath.Join(dir, "key.pem"),
+		ReloadInterval:    5,
+	}
+
+	first := writeCertificate(t, config.LocalCertLocation, config.LocalKeyLocation, 1)
+	ca, err := os.ReadFile(config.LocalCertLocation)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(config.PEMCertLocation, ca, 0600))
+
+	errs := make(chan error, 10)
+	reloader, err := tcr.NewTLSReloader(config, func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+	assert.NoError(t, err)
+	defer reloader.Stop()
+
+	cert, err := reloader.GetClientCertificate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, first, cert.Certificate[0])
+
+	// Modification times may not tick between the writes, so move them forward explicitly.
+	later := time.Now().Add(time.Minute)
+	second := writeCertificate(t, config.LocalCertLocation, config.LocalKeyLocation, 2)
+	assert.NoError(t, os.Chtimes(config.LocalCertLocation, later, later))
+	assert.NoError(t, os.Chtimes(config.LocalKeyLocation, later, later))
+
+	assert.Eventually(t, func() bool {
+		cert, err := reloader.GetClientCertificate(nil)
+		return err == nil && bytes.Equal(second, cert.Certificate[0])
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, second, reloader.TLSConfig().Certificates[0].Certificate[0])
+
+	// An invalid rewrite is reported and the previous certificate stays in use.
+	later = later.Add(time.Minute)
+	assert.NoError(t, os.WriteFile(config.LocalCertLocation, []byte("not a certificate"), 0600))
+	assert.NoError(t, os.Chtimes(config.LocalCertLocation, later, later))
+
+	select {
+	case err := <-errs:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("the invalid certificate was not reported")
+	}
+
+	cert, err = reloader.GetClientCertificate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, second, cert.Certificate[0])
+}
+
+// writeRecorder keeps every Write call separately to show what reached the writer in one piece.
+type writeRecorder struct {
+	writes [][]byte
+	lock   sync.Mutex
+}
+
+func (wr *writeRecorder) Write(data []byte) (int, error) {
+	wr.lock.Lock()
+	defer wr.lock.Unlock()
+
+	wr.writes = append(wr.writes, append([]byte(nil), data...))
+	return len(data), nil
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestJSONLinesArchiveSink(t *testing.T) {
+
+	recorder := &writeRecorder{}
+	sink := tcr.NewJSONLinesArchiveSink(recorder)
+
+	count := 50
+	ids := make(map[uuid.UUID]bool, count)
+	letters := make([]*tcr.ArchivedLetter, count)
+	for i := range letters {
+		letters[i] = &tcr.ArchivedLetter{
+			LetterID:    uuid.New(),
+			Exchange:    "TcrArchiveExchange",
+			RoutingKey:  fmt.Sprintf("TcrArchiveKey.%d", i),
+			ContentType: "application/json",
+			Headers:     amqp.Table{"x-tcr-test": "archive"},
+			Timestamp:   time.Now().UTC().Truncate(time.Second),
+			BodySize:    2,
+			Body:        []byte("{}"),
+		}
+		ids[letters[i].LetterID] = true
+	}
+
+	wg := &sync.WaitGroup{}
+	for _, letter := range letters {
+		wg.Add(1)
+		go func(letter *tcr.ArchivedLetter) {
+			defer wg.Done()
+			sink.Archive(letter)
+		}(letter)
+	}
+	wg.Wait()
+
+	// Each letter is one line written in one piece, so concurrent archiving never interleaves lines.
+	var json = jsoniter.ConfigFastest
+	assert.Len(t, recorder.writes, count)
+	for _, write := range recorder.writes {
+		assert.Equal(t, 1, bytes.Count(write, []byte("\n")))
+		assert.True(t, bytes.HasSuffix(write, []byte("\n")))
+
+		archived := &tcr.ArchivedLetter{}
+		assert.NoError(t, json.Unmarshal(write, archived))
+		assert.True(t, ids[archived.LetterID])
+		delete(ids, archived.LetterID)
+
+		assert.Equal(t, "TcrArchiveExchange", archived.Exchange)
+		assert.Equal(t, "archive", archived.Headers["x-tcr-test"])
+		assert.Equal(t, []byte("{}"), archived.Body)
+		assert.Equal(t, 2, archived.BodySize)
+	}
+	assert.Empty(t, ids)
+
+	// Without bodies the field is left out of the line entirely.
+	buffer := &bytes.Buffer{}
+	tcr.NewJSONLinesArchiveSink(buffer).Archive(&tcr.ArchivedLetter{LetterID: uuid.New(), BodySize: 10})
+	assert.NotContains(t, buffer.String(), `"Body"`)
+	assert.Contains(t, buffer.String(), `"BodySize":10`)
+
+	// Archival is best effort, a failing writer is dropped silently.
+	assert.NotPanics(t, func() {
+		tcr.NewJSONLinesArchiveSink(failingWriter{}).Archive(letters[0])
+	})
+}
+
+func TestConsumerTap(t *testing.T) {
+
+	compressed := &bytes.Buffer{}
+	assert.NoError(t, tcr.CompressWithGzip([]byte("SuperStreetFighter2Turbo"), compressed))
+
+	recordTapped := func(config *tcr.TapConfig, count int) (tapped [][]byte, handled []string, result *tcr.ReplayResult) {
+		consumer := tcr.NewConsumerFromConfig(&tcr.ConsumerConfig{
+			ConsumerName:   "TcrTapConsumer",
+			QueueName:      "TcrTestQueue",
+			AutoDecompress: true,
+			TapConfig:      config,
+		}, nil)
+
+		order := make([]string, 0)
+		consumer.SetTap(func(msg *tcr.ReceivedMessage) {
+			order = append(order, "tap:"+msg.MessageID)
+			tapped = append(tapped, append([]byte(nil), msg.Body...))
+		})
+
+		recording := &bytes.Buffer{}
+		recorder := tcr.NewDeliveryRecorder(recording)
+		for i := 0; i < count; i++ {
+			assert.NoError(t, recorder.Record(amqp.Delivery{
+				MessageId:       fmt.Sprintf("TcrTap-%d", i),
+				ContentEncoding: tcr.GzipCompressionType,
+				Body:            compressed.Bytes(),
+			}))
+		}
+
+		result, err := consumer.Replay(recording, func(msg *tcr.ReceivedMessage) {
+			order = append(order, "handle:"+msg.MessageID)
+			assert.Equal(t, "SuperStreetFighter2Turbo", string(msg.Body))
+			assert.NoError(t, msg.Acknowledge())
+		})
+		assert.NoError(t, err)
+		return tapped, order, result
+	}
+
+	// Every message is tapped before the handler sees it, as it arrived and without being settled by the tap.
+	tapped, order, result := recordTapped(&tcr.TapConfig{Enabled: true, SampleRate: 100}, 2)
+	assert.Equal(t, []string{"tap:TcrTap-0", "handle:TcrTap-0", "tap:TcrTap-1", "handle:TcrTap-1"}, order)
+	assert.Equal(t, [][]byte{compressed.Bytes(), compressed.Bytes()}, tapped)
+	assert.Equal(t, []uint64{1, 2}, result.Acked)
+	assert.Empty(t, result.Nacked)
+	assert.Empty(t, result.Rejected)
+
+	// Disabled or unsampled taps see nothing, the handler still sees everything.
+	for _, config := range []*tcr.TapConfig{nil, {Enabled: false, SampleRate: 100}, {Enabled: true, SampleRate: 0}} {
+		tapped, order, _ = recordTapped(config, 2)
+		assert.Empty(t, tapped)
+		assert.Equal(t, []string{"handle:TcrTap-0", "handle:TcrTap-1"}, order)
+	}
+
+	// A partial sample rate taps some of the messages but not all.
+	tapped, _, result = recordTapped(&tcr.TapConfig{Enabled: true, SampleRate: 50}, 200)
+	assert.Len(t, result.Acked, 200)
+	assert.NotEmpty(t, tapped)
+	assert.Less(t, len(tapped), 200)
+}
+
+func TestPublisherStandbyFailover(t *testing.T) {
+
+	publisher := tcr.NewPublisher(nil, 0, 0, 0)
+	clock := newTimerClock()
+	publisher.SetClock(clock)
+
+	var unhealthy int64
+	publisher.SetStandbyHealthCheck(func() time.Duration { return time.Duration(atomic.LoadInt64(&unhealthy)) })
+
+	// Each check ends with the monitor waiting for the next interval.
+	check := func(unhealthyFor time.Duration) {
+		atomic.StoreInt64(&unhealthy, int64(unhealthyFor))
+		clock.Advance(time.Second)
+		assert.Equal(t, time.Second, <-clock.timers)
+	}
+
+	publisher.SetStandbyPool(&tcr.ConnectionPool{}, 10*time.Second, time.Second)
+	assert.Equal(t, time.Second, <-clock.timers)
+
+	check(5 * time.Second)
+	assert.False(t, publisher.UsingStandby())
+
+	check(10 * time.Second)
+	assert.True(t, publisher.UsingStandby())
+	event := <-publisher.Events()
+	assert.Equal(t, tcr.PublisherEventFailover, event.Type)
+	assert.Equal(t, "primary pool unhealthy for 10s", event.Reason)
+
+	// Still unhealthy stays on the standby without repeating the event.
+	check(20 * time.Second)
+	assert.True(t, publisher.UsingStandby())
+
+	check(0)
+	assert.False(t, publisher.UsingStandby())
+	assert.Equal(t, tcr.PublisherEventFailback, (<-publisher.Events()).Type)
+	assert.Empty(t, publisher.Events())
+
+	// Removing the standby while promoted returns publishing to the primary and ends the monitoring.
+	check(time.Minute)
+	assert.True(t, publisher.UsingStandby())
+	assert.Equal(t, tcr.PublisherEventFailover, (<-publisher.Events()).Type)
+
+	publisher.SetStandbyPool(nil, 0, 0)
+	assert.False(t, publisher.UsingStandby())
+
+	clock.Advance(time.Second)
+	assert.Empty(t, clock.timers)
+	assert.Empty(t, publisher.Events())
+}
@@ -0,0 +1,293 @@
+package main_test
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/houseofcat/turbocookedrabbit/v2/pkg/tcr"
+	"github.com/stretchr/testify/assert"
+)
+
+// webSocketFrame is a frame as the gateway side of the tests sees it, unmasked.
+type webSocketFrame struct {
+	fin     bool
+	opcode  byte
+	masked  bool
+	payload []byte
+}
+
+// serveWebSocket accepts one connection, answers the upgrade with the status and accept value returned by
+// respond for the request and hands the connection to serve.
+func serveWebSocket(
+	t *testing.T,
+	respond func(request *http.Request) (int, string),
+	serve func(conn net.Conn, reader *bufio.Reader)) (string, <-chan *http.Request) {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requests := make(chan *http.Request, 1)
+	go func() {
+		defer listener.Close()
+
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		request, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		requests <- request
+
+		status, accept := respond(request)
+		fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", status, http.StatusText(status), accept)
+		if status == http.StatusSwitchingProtocols && serve != nil {
+			serve(conn, reader)
+		}
+	}()
+
+	return "ws://" + listener.Addr().String() + "/amqp", requests
+}
+
+func webSocketAccept(request *http.Request) (int, string) {
+	hash := sha1.Sum([]byte(request.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return http.StatusSwitchingProtocols, base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func readWebSocketFrame(reader *bufio.Reader) (*webSocketFrame, error) {
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	frame := &webSocketFrame{
+		fin:    header[0]&0x80 != 0,
+		opcode: header[0] & 0x0F,
+		masked: header[1]&0x80 != 0,
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(reader, extended); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, err := io.ReadFull(reader, extended); err != nil {
+			return nil, err
+		}
+		length = binary.BigEndian.Uint64(extended)
+	}
+
+	mask := make([]byte, 4)
+	if frame.masked {
+		if _, err := io.ReadFull(reader, mask); err != nil {
+			return nil, err
+		}
+	}
+
+	frame.payload = make([]byte, length)
+	if _, err := io.ReadFull(reader, frame.payload); err != nil {
+		return nil, err
+	}
+	for i := range frame.payload {
+		frame.payload[i] ^= mask[i%4]
+	}
+
+	return frame, nil
+}
+
+// writeWebSocketFrame writes a short server frame, masked only to provoke the client's protocol error.
+func writeWebSocketFrame(conn net.Conn, fin bool, opcode byte, masked bool, payload []byte) error {
+
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+
+	frame := []byte{first, byte(len(payload))}
+	if masked {
+		frame[1] |= 0x80
+		frame = append(frame, 0, 0, 0, 0) // a zero mask keeps the payload as is
+	}
+	frame = append(frame, payload...)
+
+	_, err := conn.Write(frame)
+	return err
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+
+	wsURL, requests := serveWebSocket(t, webSocketAccept, nil)
+	conn, err := tcr.DialWebSocket(
+		&tcr.WebSocketConfig{
+			URL:         wsURL,
+			Subprotocol: "amqp",
+			Headers:     map[string]string{"Authorization": "Bearer token"},
+		}, time.Second*5)
+	assert.NoError(t, err)
+	if conn != nil {
+		conn.Close()
+	}
+
+	request := <-requests
+	assert.Equal(t, "/amqp", request.URL.Path)
+	assert.Equal(t, "websocket", request.Header.Get("Upgrade"))
+	assert.Equal(t, "Upgrade", request.Header.Get("Connection"))
+	assert.Equal(t, "13", request.Header.Get("Sec-WebSocket-Version"))
+	assert.Equal(t, "amqp", request.Header.Get("Sec-WebSocket-Protocol"))
+	assert.Equal(t, "Bearer token", request.Header.Get("Authorization"))
+
+	nonce, err := base64.StdEncoding.DecodeString(request.Header.Get("Sec-WebSocket-Key"))
+	assert.NoError(t, err)
+	assert.Len(t, nonce, 16)
+}
+
+func TestWebSocketHandshakeRejected(t *testing.T) {
+
+	wsURL, _ := serveWebSocket(t,
+		func(*http.Request) (int, string) {
+			return http.StatusSwitchingProtocols, base64.StdEncoding.EncodeToString([]byte("not the accept value"))
+		}, nil)
+	_, err := tcr.DialWebSocket(&tcr.WebSocketConfig{URL: wsURL}, time.Second*5)
+	assert.ErrorContains(t, err, "Sec-WebSocket-Accept")
+
+	wsURL, _ = serveWebSocket(t,
+		func(*http.Request) (int, string) { return http.StatusForbidden, "" }, nil)
+	_, err = tcr.DialWebSocket(&tcr.WebSocketConfig{URL: wsURL}, time.Second*5)
+	assert.ErrorContains(t, err, "403")
+
+	_, err = tcr.DialWebSocket(&tcr.WebSocketConfig{URL: "http://127.0.0.1:1"}, time.Second*5)
+	assert.ErrorContains(t, err, "unsupported websocket scheme")
+}
+
+func TestWebSocketClientMasksFrames(t *testing.T) {
+
+	frames := make(chan *webSocketFrame, 3)
+	wsURL, _ := serveWebSocket(t, webSocketAccept,
+		func(conn net.Conn, reader *bufio.Reader) {
+			for i := 0; i < 3; i++ {
+				frame, err := readWebSocketFrame(reader)
+				if err != nil {
+					close(frames)
+					return
+				}
+				frames <- frame
+			}
+		})
+
+	conn, err := tcr.DialWebSocket(&tcr.WebSocketConfig{URL: wsURL}, time.Second*5)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	large := make([]byte, 300) // past the 125 byte short length
+	for i := range large {
+		large[i] = byte(i)
+	}
+
+	written, err := conn.Write([]byte("AMQP"))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, written)
+	_, err = conn.Write(large)
+	assert.NoError(t, err)
+	assert.NoError(t, conn.Close())
+
+	frame := <-frames
+	if assert.NotNil(t, frame) {
+		assert.True(t, frame.fin)
+		assert.True(t, frame.masked)
+		assert.Equal(t, byte(0x2), frame.opcode) // binary
+		assert.Equal(t, []byte("AMQP"), frame.payload)
+	}
+
+	frame = <-frames
+	if assert.NotNil(t, frame) {
+		assert.True(t, frame.masked)
+		assert.Equal(t, large, frame.payload)
+	}
+
+	frame = <-frames
+	if assert.NotNil(t, frame) {
+		assert.True(t, frame.masked)
+		assert.Equal(t, byte(0x8), frame.opcode) // close
+		assert.Empty(t, frame.payload)
+	}
+}
+
+func TestWebSocketFragmentsAndControlFrames(t *testing.T) {
+
+	pongs := make(chan *webSocketFrame, 1)
+	wsURL, _ := serveWebSocket(t, webSocketAccept,
+		func(conn net.Conn, reader *bufio.Reader) {
+			_ = writeWebSocketFrame(conn, false, 0x2, false, []byte("hel"))
+			_ = writeWebSocketFrame(conn, true, 0x9, false, []byte("heartbeat")) // ping between the fragments
+			_ = writeWebSocketFrame(conn, true, 0xA, false, []byte("unsolicited"))
+			_ = writeWebSocketFrame(conn, true, 0x0, false, []byte("lo"))
+
+			frame, err := readWebSocketFrame(reader)
+			if err == nil {
+				pongs <- frame
+			}
+			close(pongs)
+
+			_ = writeWebSocketFrame(conn, true, 0x8, false, nil)
+		})
+
+	conn, err := tcr.DialWebSocket(&tcr.WebSocketConfig{URL: wsURL}, time.Second*5)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	payload := make([]byte, 5)
+	_, err = io.ReadFull(conn, payload)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(payload))
+
+	pong := <-pongs
+	if assert.NotNil(t, pong) {
+		assert.True(t, pong.masked)
+		assert.Equal(t, byte(0xA), pong.opcode)
+		assert.Equal(t, "heartbeat", string(pong.payload))
+	}
+
+	_, err = conn.Read(payload)
+	assert.Equal(t, io.EOF, err) // the gateway closed the websocket
+}
+
+func TestWebSocketRejectsMaskedServerFrames(t *testing.T) {
+
+	wsURL, _ := serveWebSocket(t, webSocketAccept,
+		func(conn net.Conn, reader *bufio.Reader) {
+			_ = writeWebSocketFrame(conn, true, 0x2, true, []byte("masked"))
+			_, _ = readWebSocketFrame(reader)
+		})
+
+	conn, err := tcr.DialWebSocket(&tcr.WebSocketConfig{URL: wsURL}, time.Second*5)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	_, err = conn.Read(make([]byte, 6))
+	assert.ErrorContains(t, err, "masked frame")
+}